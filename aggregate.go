@@ -0,0 +1,255 @@
+package godatapipe
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// AggregateFunc is how an aggregate combines the values of a group.
+type AggregateFunc int
+
+const (
+	AggCount AggregateFunc = iota //Number of rows, or of the column's values which aren't NULL
+	AggSum                        //Sum of the values, NULL if they're all NULL
+	AggMin                        //Least value, compared numerically, as times or as text
+	AggMax                        //Greatest value, compared numerically, as times or as text
+)
+
+// Aggregate is a destination column computed from the rows of each group
+// when rolling rows up.
+type Aggregate struct {
+	Name   string //Destination column
+	Func   AggregateFunc
+	Column string //Column aggregated, empty to count the rows
+}
+
+// Parses aggregates in the form "name=func[:column],..." where func is
+// "count", "sum", "min" or "max". Only count can leave out the column.
+func ParseAggregates(spec string) (aggs []Aggregate, err error) {
+	funcs := map[string]AggregateFunc{"count": AggCount, "sum": AggSum, "min": AggMin, "max": AggMax}
+
+	for _, entry := range splitList(spec) {
+		name, fn, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, errors.NotValidf("aggregate %q", entry)
+		}
+
+		a := Aggregate{Name: name}
+		fn, a.Column, _ = strings.Cut(fn, ":")
+		if a.Func, ok = funcs[strings.ToLower(fn)]; !ok {
+			return nil, errors.NotValidf("aggregate function %q for column %s", fn, name)
+		}
+		if a.Column == "" && a.Func != AggCount {
+			return nil, errors.NotValidf("aggregate %q without a column", entry)
+		}
+
+		aggs = append(aggs, a)
+	}
+
+	return aggs, nil
+}
+
+// aggregator rolls rows up into a row per group of the group by columns'
+// values, in the order the groups are first seen.
+type aggregator struct {
+	groupPos []int
+	aggs     []Aggregate
+	aggPos   []int //Position of each aggregate's column, -1 for counting rows
+
+	groups map[rowKey]*aggGroup
+	order  []*aggGroup
+}
+
+// aggGroup is a group's values and the state of its aggregates.
+type aggGroup struct {
+	values []interface{}
+	states []aggState
+}
+
+// aggState is an aggregate's state for a group.
+type aggState struct {
+	count int64
+	value interface{} //Least or greatest value so far
+	sum   *big.Rat    //Exact sum, unless a value was a float
+	float float64     //Sum once a value was a float
+	kind  sumKind
+	scale int //Most digits after the point of decimal text summed
+}
+
+// sumKind is what the values summed have been, deciding the sum's type.
+type sumKind int
+
+const (
+	sumNone    sumKind = iota //No values
+	sumInt                    //Integers, summed to an int64
+	sumDecimal                //Integers and decimal text, summed to decimal text
+	sumFloat                  //Any float, summed to a float64
+)
+
+// newAggregator returns an aggregator of rows with the columns, and its
+// output columns, the group by columns then the aggregates.
+func newAggregator(groupBy []string, aggs []Aggregate, columns []string) (a *aggregator, outColumns []string, err error) {
+	a = &aggregator{aggs: aggs, groups: map[rowKey]*aggGroup{}}
+
+	for _, name := range groupBy {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, nil, errors.Trace(sourceColumnError(name, "group by"))
+		}
+		a.groupPos = append(a.groupPos, pos)
+		outColumns = append(outColumns, name)
+	}
+	for _, agg := range aggs {
+		pos := -1
+		if agg.Column != "" {
+			if pos = indexOf(columns, agg.Column); pos < 0 {
+				return nil, nil, errors.Trace(sourceColumnError(agg.Column, "aggregate"))
+			}
+		}
+		if indexOf(outColumns, agg.Name) >= 0 {
+			return nil, nil, errors.Errorf("aggregate %s is already a column", agg.Name)
+		}
+		a.aggPos = append(a.aggPos, pos)
+		outColumns = append(outColumns, agg.Name)
+	}
+
+	return a, outColumns, nil
+}
+
+// add adds a row to its group's aggregates.
+func (a *aggregator) add(values []interface{}) (err error) {
+	k := hashKey(values, a.groupPos)
+	g, ok := a.groups[k]
+	if !ok {
+		g = &aggGroup{values: make([]interface{}, len(a.groupPos)), states: make([]aggState, len(a.aggs))}
+		for i, pos := range a.groupPos {
+			g.values[i] = values[pos]
+		}
+		a.groups[k] = g
+		a.order = append(a.order, g)
+	}
+
+	for i, agg := range a.aggs {
+		s := &g.states[i]
+		if a.aggPos[i] < 0 {
+			s.count++
+			continue
+		}
+		v := values[a.aggPos[i]]
+		if v == nil {
+			continue
+		}
+		s.count++
+
+		switch agg.Func {
+		case AggSum:
+			if err = s.addSum(v); err != nil {
+				return errors.Annotatef(err, "summing column %s", agg.Column)
+			}
+		case AggMin, AggMax:
+			cmp, _ := compareValues(v, s.value)
+			if s.value == nil || agg.Func == AggMin && cmp < 0 || agg.Func == AggMax && cmp > 0 {
+				s.value = v
+			}
+		}
+	}
+
+	return nil
+}
+
+// addSum adds a value to the sum, exactly unless it's a float.
+func (s *aggState) addSum(v interface{}) (err error) {
+	var r *big.Rat
+	kind := sumInt
+
+	switch t := v.(type) {
+	case int64:
+		r = new(big.Rat).SetInt64(t)
+	case int:
+		r = new(big.Rat).SetInt64(int64(t))
+	case int32:
+		r = new(big.Rat).SetInt64(int64(t))
+	case float64, float32:
+		kind = sumFloat
+	case []byte, string:
+		text := strings.TrimSpace(valueText(t))
+		var ok bool
+		if r, ok = new(big.Rat).SetString(text); !ok || strings.ContainsRune(text, '/') {
+			return errors.NotValidf("number %q", text)
+		}
+		if scale := decimalScale(text); scale > 0 || !r.IsInt() {
+			kind = sumDecimal
+			s.scale = max(s.scale, scale)
+		}
+	default:
+		return errors.NotValidf("number %v", v)
+	}
+
+	if s.sum == nil {
+		s.sum = new(big.Rat)
+	}
+	s.kind = max(s.kind, kind)
+	if kind == sumFloat {
+		f, _ := numericValue(v)
+		s.float += f
+		return nil
+	}
+	s.sum.Add(s.sum, r)
+
+	return nil
+}
+
+// decimalScale returns the digits after the point of decimal text, such
+// as 2 for "1.25" and 3 for "1e-3".
+func decimalScale(text string) int {
+	mantissa, exp, _ := strings.Cut(strings.ToLower(text), "e")
+
+	scale := 0
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		scale = len(mantissa) - i - 1
+	}
+	n, _ := strconv.Atoi(exp)
+
+	return max(scale-n, 0)
+}
+
+// result returns the aggregate's value.
+func (s *aggState) result(f AggregateFunc) interface{} {
+	switch f {
+	case AggCount:
+		return s.count
+	case AggMin, AggMax:
+		return s.value
+	}
+
+	switch s.kind {
+	case sumInt:
+		if s.sum.Num().IsInt64() {
+			return s.sum.Num().Int64()
+		}
+		return s.sum.Num().String()
+	case sumDecimal:
+		return s.sum.FloatString(s.scale)
+	case sumFloat:
+		f, _ := s.sum.Float64()
+		return s.float + f
+	}
+
+	return nil
+}
+
+// rows returns a row of each group's values and aggregates.
+func (a *aggregator) rows() (rows [][]interface{}) {
+	for _, g := range a.order {
+		row := append([]interface{}{}, g.values...)
+		for i, agg := range a.aggs {
+			row = append(row, g.states[i].result(agg.Func))
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
@@ -0,0 +1,71 @@
+package godatapipe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAggregates(t *testing.T) {
+	got, err := ParseAggregates("rows=count, qty=sum:quantity,low=MIN:price,high=max:price,priced=count:price")
+	want := []Aggregate{
+		{Name: "rows", Func: AggCount},
+		{Name: "qty", Func: AggSum, Column: "quantity"},
+		{Name: "low", Func: AggMin, Column: "price"},
+		{Name: "high", Func: AggMax, Column: "price"},
+		{Name: "priced", Func: AggCount, Column: "price"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAggregates = %v, %v, want %v", got, err, want)
+	}
+
+	for _, spec := range []string{"rows", "=count", "x=avg:price", "x=sum"} {
+		if _, err = ParseAggregates(spec); err == nil {
+			t.Errorf("ParseAggregates(%q) didn't fail", spec)
+		}
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	columns := []string{"region", "quantity", "price", "amount"}
+	rows := [][]interface{}{
+		{"north", int64(2), "1.5", "10.25"},
+		{"south", int64(1), "3", "5"},
+		{"north", nil, "0.75", "2.1"},
+		{"north", int64(5), nil, "1"}}
+
+	aggs, err := ParseAggregates("rows=count,qty=sum:quantity,priced=count:price,low=min:price,high=max:price,total=sum:amount")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, written, err := copyColumns(t, &Config{MaxRowBufSz: 2, GroupBy: []string{"region"}, Aggregates: aggs}, columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"region", "rows", "qty", "priced", "low", "high", "total"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	// Groups are written in the order they're first seen, decimal text is
+	// summed exactly to the most digits after the point, and prices are
+	// compared as numbers rather than text. Integer text sums to an integer
+	want := [][]interface{}{
+		{"north", int64(3), int64(7), int64(2), "0.75", "1.5", "13.35"},
+		{"south", int64(1), int64(1), int64(1), "3", "3", int64(5)}}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written %v, want %v", written, want)
+	}
+
+	bad := &Config{MaxRowBufSz: 2, GroupBy: []string{"region"}, Aggregates: []Aggregate{{Name: "x", Func: AggSum, Column: "region"}}}
+	if _, _, err = copyColumns(t, bad, columns, rows); err == nil || !strings.Contains(err.Error(), "summing column region") {
+		t.Errorf("summing text error = %v", err)
+	}
+}
+
+func TestDecimalScale(t *testing.T) {
+	for text, want := range map[string]int{"1": 0, "1.25": 2, "1e-3": 3, "1.5E2": 0, "12.345e1": 2} {
+		if got := decimalScale(text); got != want {
+			t.Errorf("decimalScale(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
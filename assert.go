@@ -0,0 +1,188 @@
+package godatapipe
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// AssertionCheck is what an assertion checks a column's values for.
+type AssertionCheck int
+
+const (
+	AssertNotNull    AssertionCheck = iota //Value isn't NULL
+	AssertIn                               //Value's text is one of Assertion.Values, NULL passes
+	AssertMatch                            //Value's text matches Assertion.Pattern, NULL passes
+	AssertIncreasing                       //Value is greater than the last row's, NULL passes
+)
+
+// AssertionAction determines what happens to a row failing an assertion.
+type AssertionAction int
+
+const (
+	AssertFail  AssertionAction = iota //Fail the copy with an AssertionError
+	AssertSkip                         //Drop the row
+	AssertCount                        //Copy the row anyway
+)
+
+// Assertion is a check of a destination column's values, made on each row
+// before it's written. Failures are counted in Result.AssertionFailures
+// whatever the action.
+type Assertion struct {
+	Column  string
+	Check   AssertionCheck
+	Values  []string       //Allowed values for AssertIn
+	Pattern *regexp.Regexp //Pattern for AssertMatch
+	Action  AssertionAction
+}
+
+// Returns the assertion in the form it's parsed from, without the action.
+func (a *Assertion) String() string {
+	switch a.Check {
+	case AssertIn:
+		return fmt.Sprintf("%s:in:%s", a.Column, strings.Join(a.Values, "|"))
+	case AssertMatch:
+		return fmt.Sprintf("%s:match:%s", a.Column, a.Pattern)
+	case AssertIncreasing:
+		return a.Column + ":increasing"
+	}
+
+	return a.Column + ":not_null"
+}
+
+// AssertionError reports a row failing an assertion whose action is
+// AssertFail.
+type AssertionError struct {
+	Row       int //Source row number, from 1
+	Assertion *Assertion
+	Value     interface{}
+}
+
+func (e *AssertionError) Error() string {
+	if e.Value == nil {
+		return fmt.Sprintf("row %d: NULL fails %s", e.Row, e.Assertion)
+	}
+
+	return fmt.Sprintf("row %d: %q fails %s", e.Row, valueText(e.Value), e.Assertion)
+}
+
+// Parses assertions in the form "column:check[:arg][:action];..." where
+// check is "not_null", "in" with the allowed values separated by "|",
+// "match" with a regular expression, or "increasing", and action is
+// "fail", the default, "skip" or "count". Assertions are separated by
+// semicolons as patterns may hold commas.
+func ParseAssertions(spec string) (assertions []*Assertion, err error) {
+	actions := map[string]AssertionAction{"fail": AssertFail, "skip": AssertSkip, "count": AssertCount}
+
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 {
+			return nil, errors.NotValidf("assertion %q", entry)
+		}
+
+		a := &Assertion{Column: parts[0]}
+		if action, ok := actions[parts[len(parts)-1]]; ok && len(parts) > 2 {
+			a.Action = action
+			parts = parts[:len(parts)-1]
+		}
+		arg := strings.Join(parts[2:], ":")
+
+		switch parts[1] {
+		case "not_null":
+			a.Check = AssertNotNull
+		case "in":
+			a.Check = AssertIn
+			a.Values = strings.Split(arg, "|")
+		case "match":
+			a.Check = AssertMatch
+			if a.Pattern, err = regexp.Compile(arg); err != nil {
+				return nil, errors.Annotatef(err, "assertion on column %s", a.Column)
+			}
+		case "increasing":
+			a.Check = AssertIncreasing
+		default:
+			return nil, errors.NotValidf("assertion check %q for column %s", parts[1], a.Column)
+		}
+		if arg != "" && (a.Check == AssertNotNull || a.Check == AssertIncreasing) {
+			return nil, errors.NotValidf("assertion %q", entry)
+		}
+
+		assertions = append(assertions, a)
+	}
+
+	return assertions, nil
+}
+
+// newAssertStage returns a stage checking the assertions, or nil if there
+// are none.
+func newAssertStage(assertions []*Assertion, columns []string, res *Result) (s stage, err error) {
+	if len(assertions) == 0 {
+		return nil, nil
+	}
+
+	positions := make([]int, len(assertions))
+	for i, a := range assertions {
+		if positions[i] = indexOf(columns, a.Column); positions[i] < 0 {
+			return nil, errors.Trace(sourceColumnError(a.Column, "assertion"))
+		}
+	}
+
+	// Last value of each increasing column
+	last := make([]interface{}, len(assertions))
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		skip := false
+
+		for i, a := range assertions {
+			v := values[positions[i]]
+
+			ok := true
+			switch a.Check {
+			case AssertNotNull:
+				ok = v != nil
+			case AssertIn:
+				if v != nil {
+					ok = indexOf(a.Values, valueText(v)) >= 0
+				}
+			case AssertMatch:
+				if v != nil {
+					ok = a.Pattern.MatchString(valueText(v))
+				}
+			case AssertIncreasing:
+				if v != nil && last[i] != nil {
+					cmp, comparable := compareValues(v, last[i])
+					ok = comparable && cmp > 0
+				}
+				if v != nil && ok {
+					last[i] = v
+				}
+			}
+			if ok {
+				continue
+			}
+
+			if res.AssertionFailures == nil {
+				res.AssertionFailures = map[string]int{}
+			}
+			res.AssertionFailures[a.String()]++
+
+			switch a.Action {
+			case AssertFail:
+				return nil, errors.Trace(&AssertionError{Row: rowNum, Assertion: a, Value: v})
+			case AssertSkip:
+				skip = true
+			}
+		}
+
+		if skip {
+			return nil, nil
+		}
+		return values, nil
+	}, nil
+}
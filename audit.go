@@ -0,0 +1,102 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Run statuses recorded in the audit table.
+const (
+	RunRunning     = "running"
+	RunSucceeded   = "succeeded"
+	RunInterrupted = "interrupted"
+	RunFailed      = "failed"
+)
+
+// auditLog records a run in the destination's audit table.
+type auditLog struct {
+	conn  *sql.Conn
+	d     *bulk.Dialect
+	table string //Quoted table name
+	runID string
+}
+
+// startAudit creates the audit table if it doesn't exist and records the
+// run as running.
+func startAudit(ctx context.Context, conn *sql.Conn, cfg *Config, res *Result) (a *auditLog, err error) {
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	table := cfg.AuditTable
+	if table == "" {
+		table = "_datapipe_runs"
+	}
+	a = &auditLog{conn: conn, d: d, table: d.QualifiedName(cfg.DstSchema, table), runID: res.RunID}
+
+	if _, err = conn.ExecContext(ctx, a.createSQL()); err != nil {
+		return nil, errors.Annotatef(err, "creating audit table %s", a.table)
+	}
+
+	q := fmt.Sprintf("INSERT INTO %s (run_id, pipeline, started_at, row_count, status) VALUES (%s, %s, %s, 0, %s)",
+		a.table, d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4))
+	if _, err = conn.ExecContext(ctx, q, res.RunID, cfg.pipelineName(), res.StartedAt.UTC(), RunRunning); err != nil {
+		return nil, errors.Annotate(err, "recording run")
+	}
+
+	return a, nil
+}
+
+func (a *auditLog) createSQL() string {
+	columns := `run_id VARCHAR(36) NOT NULL PRIMARY KEY,
+	pipeline VARCHAR(255) NOT NULL,
+	started_at %[1]s NOT NULL,
+	finished_at %[1]s NULL,
+	row_count BIGINT NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	error %[2]s NULL`
+
+	switch a.d {
+	case bulk.SQLServer:
+		return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			strings.Replace(a.table, "'", "''", -1), a.table, fmt.Sprintf(columns, "DATETIME2", "NVARCHAR(MAX)"))
+	case bulk.MySQL:
+		return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", a.table, fmt.Sprintf(columns, "DATETIME(6)", "TEXT"))
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", a.table, fmt.Sprintf(columns, "TIMESTAMP", "TEXT"))
+}
+
+// finish records the outcome of the run. conn is used if it's set, as the
+// run's connection may be left in a failed transaction.
+func (a *auditLog) finish(ctx context.Context, conn *sql.Conn, res *Result, runErr error) (err error) {
+	var errText interface{}
+
+	if conn == nil {
+		conn = a.conn
+	}
+
+	status := RunSucceeded
+	rowCount := 0
+	if runErr != nil {
+		status = RunFailed
+		errText = runErr.Error()
+	} else {
+		rowCount = res.RowCount
+		if res.Interrupted {
+			status = RunInterrupted
+		}
+	}
+
+	q := fmt.Sprintf("UPDATE %s SET finished_at = %s, row_count = %s, status = %s, error = %s WHERE run_id = %s",
+		a.table, a.d.Placeholder(1), a.d.Placeholder(2), a.d.Placeholder(3), a.d.Placeholder(4), a.d.Placeholder(5))
+	if _, err = conn.ExecContext(ctx, q, time.Now().UTC(), rowCount, status, errText, a.runID); err != nil {
+		return errors.Annotate(err, "recording run outcome")
+	}
+
+	return nil
+}
@@ -0,0 +1,725 @@
+package godatapipe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Avro object container files start with the magic, then metadata holding
+// the schema and codec and a random sync marker, followed by blocks of
+// rows each ending with the marker.
+var avroMagic = []byte("Obj\x01")
+
+// Rows per block avroWriter writes.
+const avroBlockRows = 4096
+
+// AvroTypes maps the column types without an exact Avro type to the Avro
+// types they're written as when the schema is derived from them.
+type AvroTypes struct {
+	Time    string //timestamp-micros, the default, or timestamp-millis
+	Date    string //date, the default, timestamp-micros, timestamp-millis or string
+	Decimal string //string, the default, or double
+}
+
+// Parses Avro type mappings, comma separated family=type pairs such as
+// time=timestamp-millis,decimal=double.
+func ParseAvroTypes(s string) (t AvroTypes, err error) {
+	allowed := map[string][]string{
+		"time":    {"timestamp-micros", "timestamp-millis"},
+		"date":    {"date", "timestamp-micros", "timestamp-millis", "string"},
+		"decimal": {"string", "double"}}
+
+	for _, kv := range splitList(s) {
+		family, typ, _ := strings.Cut(kv, "=")
+		found := false
+		for _, a := range allowed[family] {
+			found = found || a == typ
+		}
+		if !found {
+			return t, errors.NotValidf("Avro type mapping %q", kv)
+		}
+
+		switch family {
+		case "time":
+			t.Time = typ
+		case "date":
+			t.Date = typ
+		case "decimal":
+			t.Decimal = typ
+		}
+	}
+
+	return t, nil
+}
+
+// avroType is a parsed Avro schema.
+type avroType struct {
+	Type    string //Primitive or complex type name
+	Logical string
+	Scale   int
+	Size    int
+	Fields  []avroField
+	Items   *avroType //Array items
+	Values  *avroType //Map values
+	Union   []*avroType
+	Symbols []string
+}
+
+type avroField struct {
+	Name string
+	Type *avroType
+}
+
+// parseAvroSchema parses a schema, resolving references to named types.
+func parseAvroSchema(v interface{}, named map[string]*avroType) (t *avroType, err error) {
+	switch s := v.(type) {
+	case string:
+		if t = named[s]; t != nil {
+			return t, nil
+		}
+		switch s {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{Type: s}, nil
+		}
+		return nil, errors.NotValidf("Avro type %q", s)
+	case []interface{}:
+		t = &avroType{Type: "union"}
+		for _, b := range s {
+			var bt *avroType
+			if bt, err = parseAvroSchema(b, named); err != nil {
+				return nil, errors.Trace(err)
+			}
+			t.Union = append(t.Union, bt)
+		}
+		return t, nil
+	case map[string]interface{}:
+		if inner, ok := s["type"].(map[string]interface{}); ok {
+			return parseAvroSchema(inner, named)
+		}
+		name, _ := s["type"].(string)
+		t = &avroType{Type: name}
+		t.Logical, _ = s["logicalType"].(string)
+		if f, ok := s["scale"].(float64); ok {
+			t.Scale = int(f)
+		}
+		if f, ok := s["size"].(float64); ok {
+			t.Size = int(f)
+		}
+		if n, ok := s["name"].(string); ok {
+			named[n] = t
+		}
+
+		switch name {
+		case "record", "error":
+			fields, _ := s["fields"].([]interface{})
+			for _, f := range fields {
+				fm, _ := f.(map[string]interface{})
+				af := avroField{}
+				af.Name, _ = fm["name"].(string)
+				if af.Type, err = parseAvroSchema(fm["type"], named); err != nil {
+					return nil, errors.Annotatef(err, "field %s", af.Name)
+				}
+				t.Fields = append(t.Fields, af)
+			}
+		case "enum":
+			for _, sym := range s["symbols"].([]interface{}) {
+				t.Symbols = append(t.Symbols, sym.(string))
+			}
+		case "array":
+			if t.Items, err = parseAvroSchema(s["items"], named); err != nil {
+				return nil, errors.Trace(err)
+			}
+		case "map":
+			if t.Values, err = parseAvroSchema(s["values"], named); err != nil {
+				return nil, errors.Trace(err)
+			}
+		case "fixed":
+		default:
+			// A primitive with a logical type
+			var p *avroType
+			if p, err = parseAvroSchema(s["type"], named); err != nil {
+				return nil, errors.Trace(err)
+			}
+			p.Logical, p.Scale = t.Logical, t.Scale
+			t = p
+		}
+		return t, nil
+	}
+
+	return nil, errors.NotValidf("Avro schema %v", v)
+}
+
+// avroSchemaFor returns the record schema, as JSON, and its parsed form
+// for the columns. Every field is nullable.
+func avroSchemaFor(name string, types []ColumnType, m AvroTypes) (schema []byte, t *avroType, err error) {
+	var fields []interface{}
+
+	if m.Time == "" {
+		m.Time = "timestamp-micros"
+	}
+	if m.Date == "" {
+		m.Date = "date"
+	}
+	if m.Decimal == "" {
+		m.Decimal = "string"
+	}
+
+	for _, ct := range types {
+		var ft interface{} = "string"
+		switch bulk.Family(ct.DatabaseType) {
+		case bulk.FamilyInt:
+			ft = "long"
+		case bulk.FamilyFloat:
+			ft = "double"
+		case bulk.FamilyBool:
+			ft = "boolean"
+		case bulk.FamilyBinary, bulk.FamilyGeometry:
+			ft = "bytes"
+		case bulk.FamilyUUID:
+			ft = map[string]string{"type": "string", "logicalType": "uuid"}
+		case bulk.FamilyDecimal:
+			ft = m.Decimal
+		case bulk.FamilyTime:
+			ft = map[string]string{"type": "long", "logicalType": m.Time}
+		case bulk.FamilyDate:
+			switch m.Date {
+			case "date":
+				ft = map[string]string{"type": "int", "logicalType": "date"}
+			case "string":
+			default:
+				ft = map[string]string{"type": "long", "logicalType": m.Date}
+			}
+		}
+		fields = append(fields, map[string]interface{}{"name": avroName(ct.Name), "type": []interface{}{"null", ft}, "default": nil})
+	}
+
+	if schema, err = json.Marshal(map[string]interface{}{"type": "record", "name": avroName(name), "fields": fields}); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var v interface{}
+	if err = json.Unmarshal(schema, &v); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if t, err = parseAvroSchema(v, map[string]*avroType{}); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return schema, t, nil
+}
+
+// avroName returns the name with the characters Avro doesn't allow in
+// names replaced by underscores.
+func avroName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+
+	return string(b)
+}
+
+// appendAvro appends the binary encoding of the value.
+func appendAvro(buf []byte, t *avroType, v interface{}) (out []byte, err error) {
+	switch t.Type {
+	case "union":
+		for i, b := range t.Union {
+			if (v == nil) == (b.Type == "null") {
+				buf = binary.AppendVarint(buf, int64(i))
+				return appendAvro(buf, b, v)
+			}
+		}
+		return nil, errors.NotValidf("value %v for the union", v)
+	case "null":
+		return buf, nil
+	case "boolean":
+		var b bool
+		if b, err = recordBool(v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case "int", "long":
+		var i int64
+		switch t.Logical {
+		case "date", "timestamp-millis", "timestamp-micros":
+			var tm time.Time
+			if tm, err = recordTime(v); err != nil {
+				return nil, errors.Trace(err)
+			}
+			switch t.Logical {
+			case "date":
+				y, m, d := tm.Date()
+				i = time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+			case "timestamp-millis":
+				i = tm.UnixMilli()
+			default:
+				i = tm.UnixMicro()
+			}
+		default:
+			if i, err = recordInt(v); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return binary.AppendVarint(buf, i), nil
+	case "float", "double":
+		var f float64
+		if f, err = recordFloat(v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if t.Type == "float" {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case "bytes", "string":
+		var b []byte
+		if bv, ok := v.([]byte); ok {
+			b = bv
+		} else {
+			b = []byte(fileText(v))
+		}
+		buf = binary.AppendVarint(buf, int64(len(b)))
+		return append(buf, b...), nil
+	}
+
+	return nil, errors.NotSupportedf("writing Avro %s", t.Type)
+}
+
+// avroDecoder decodes values from a block.
+type avroDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *avroDecoder) long() (i int64, err error) {
+	if i, err = binary.ReadVarint(d.r); err != nil {
+		return 0, errors.Annotate(err, "reading Avro long")
+	}
+
+	return i, nil
+}
+
+func (d *avroDecoder) bytes() (b []byte, err error) {
+	var n int64
+
+	if n, err = d.long(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if n < 0 || n > int64(d.r.Len()) {
+		return nil, errors.NotValidf("Avro length %d", n)
+	}
+
+	b = make([]byte, n)
+	_, err = io.ReadFull(d.r, b)
+	return b, errors.Trace(err)
+}
+
+// value decodes a value as an int64, float64, bool, string, []byte,
+// time.Time or nil, or for arrays, maps and records slices and maps of
+// them.
+func (d *avroDecoder) value(t *avroType) (v interface{}, err error) {
+	switch t.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		var b byte
+		if b, err = d.r.ReadByte(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return b != 0, nil
+	case "int", "long":
+		var i int64
+		if i, err = d.long(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch t.Logical {
+		case "date":
+			return time.Unix(i*86400, 0).UTC(), nil
+		case "timestamp-millis":
+			return time.UnixMilli(i).UTC(), nil
+		case "timestamp-micros":
+			return time.UnixMicro(i).UTC(), nil
+		}
+		return i, nil
+	case "float":
+		var b [4]byte
+		if _, err = io.ReadFull(d.r, b[:]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))), nil
+	case "double":
+		var b [8]byte
+		if _, err = io.ReadFull(d.r, b[:]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case "bytes", "string", "fixed":
+		var b []byte
+		if t.Type == "fixed" {
+			b = make([]byte, t.Size)
+			_, err = io.ReadFull(d.r, b)
+		} else {
+			b, err = d.bytes()
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch {
+		case t.Logical == "decimal":
+			return avroDecimal(b, t.Scale), nil
+		case t.Type == "string":
+			return string(b), nil
+		}
+		return b, nil
+	case "enum":
+		var i int64
+		if i, err = d.long(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if i < 0 || i >= int64(len(t.Symbols)) {
+			return nil, errors.NotValidf("Avro enum index %d", i)
+		}
+		return t.Symbols[i], nil
+	case "union":
+		var i int64
+		if i, err = d.long(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if i < 0 || i >= int64(len(t.Union)) {
+			return nil, errors.NotValidf("Avro union index %d", i)
+		}
+		return d.value(t.Union[i])
+	case "record", "error":
+		m := map[string]interface{}{}
+		for _, f := range t.Fields {
+			if m[f.Name], err = d.value(f.Type); err != nil {
+				return nil, errors.Annotatef(err, "field %s", f.Name)
+			}
+		}
+		return m, nil
+	case "array", "map":
+		var items []interface{}
+		m := map[string]interface{}{}
+		for {
+			var n int64
+			if n, err = d.long(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if n == 0 {
+				break
+			}
+			// A negative count is followed by the block's size
+			if n < 0 {
+				n = -n
+				if _, err = d.long(); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+			for ; n > 0; n-- {
+				if t.Type == "array" {
+					var item interface{}
+					if item, err = d.value(t.Items); err != nil {
+						return nil, errors.Trace(err)
+					}
+					items = append(items, item)
+					continue
+				}
+				var k []byte
+				if k, err = d.bytes(); err != nil {
+					return nil, errors.Trace(err)
+				}
+				if m[string(k)], err = d.value(t.Values); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+		if t.Type == "array" {
+			return items, nil
+		}
+		return m, nil
+	}
+
+	return nil, errors.NotSupportedf("reading Avro %s", t.Type)
+}
+
+// avroDecimal returns the text of a two's complement big endian unscaled
+// decimal.
+func avroDecimal(b []byte, scale int) string {
+	n := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+
+	s := n.String()
+	if scale <= 0 {
+		return s
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	if neg {
+		s = "-" + s
+	}
+
+	return s
+}
+
+// avroReader reads the rows of an object container file whose schema is
+// a record.
+type avroReader struct {
+	r      *bufio.Reader
+	schema *avroType
+	codec  string
+	sync   [16]byte
+	block  avroDecoder
+	left   int64 //Rows left in the block
+}
+
+func newAvroReader(r io.Reader) (a *avroReader, columns []string, err error) {
+	var magic [4]byte
+	var meta map[string][]byte
+
+	a = &avroReader{r: bufio.NewReader(r)}
+	if _, err = io.ReadFull(a.r, magic[:]); err != nil {
+		return nil, nil, errors.Trace(err)
+	} else if !bytes.Equal(magic[:], avroMagic) {
+		return nil, nil, errors.NotValidf("Avro file without the magic")
+	}
+
+	if meta, err = a.readMeta(); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if _, err = io.ReadFull(a.r, a.sync[:]); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var v interface{}
+	if err = json.Unmarshal(meta["avro.schema"], &v); err != nil {
+		return nil, nil, errors.Annotate(err, "reading Avro schema")
+	}
+	if a.schema, err = parseAvroSchema(v, map[string]*avroType{}); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if a.schema.Type != "record" {
+		return nil, nil, errors.NotSupportedf("Avro files of %s", a.schema.Type)
+	}
+
+	switch a.codec = string(meta["avro.codec"]); a.codec {
+	case "", "null", "deflate":
+	default:
+		return nil, nil, errors.NotSupportedf("Avro %s codec", a.codec)
+	}
+
+	for _, f := range a.schema.Fields {
+		columns = append(columns, f.Name)
+	}
+
+	return a, columns, nil
+}
+
+func (a *avroReader) readMeta() (meta map[string][]byte, err error) {
+	meta = map[string][]byte{}
+	for {
+		var n int64
+		if n, err = binary.ReadVarint(a.r); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n == 0 {
+			return meta, nil
+		}
+		if n < 0 {
+			n = -n
+			if _, err = binary.ReadVarint(a.r); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		for ; n > 0; n-- {
+			var k, v []byte
+			if k, err = a.readBytes(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if v, err = a.readBytes(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			meta[string(k)] = v
+		}
+	}
+}
+
+func (a *avroReader) readBytes() (b []byte, err error) {
+	var n int64
+
+	if n, err = binary.ReadVarint(a.r); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if n < 0 || n > 1<<30 {
+		return nil, errors.NotValidf("Avro length %d", n)
+	}
+
+	b = make([]byte, n)
+	_, err = io.ReadFull(a.r, b)
+	return b, errors.Trace(err)
+}
+
+// next decodes the next row into values.
+func (a *avroReader) next(values []interface{}) (err error) {
+	for a.left == 0 {
+		if a.left, err = binary.ReadVarint(a.r); err == io.EOF {
+			return io.EOF
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+
+		var data []byte
+		var sync [16]byte
+		if data, err = a.readBytes(); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err = io.ReadFull(a.r, sync[:]); err != nil {
+			return errors.Trace(err)
+		}
+		if sync != a.sync {
+			return errors.NotValidf("Avro block sync marker")
+		}
+
+		if a.codec == "deflate" {
+			if data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+				return errors.Annotate(err, "inflating Avro block")
+			}
+		}
+		a.block.r = bytes.NewReader(data)
+	}
+
+	for i, f := range a.schema.Fields {
+		var v interface{}
+		if v, err = a.block.value(f.Type); err != nil {
+			return errors.Annotatef(err, "column %s", f.Name)
+		}
+		// Nested values are kept as JSON text
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			var b []byte
+			if b, err = json.Marshal(fileJSONValue(v)); err != nil {
+				return errors.Trace(err)
+			}
+			v = string(b)
+		}
+		values[i] = v
+	}
+
+	a.left--
+	return nil
+}
+
+// avroWriter writes rows to an object container file in blocks.
+type avroWriter struct {
+	w      io.Writer
+	schema *avroType
+	codec  string
+	sync   [16]byte
+	block  []byte
+	rows   int //Rows in the block
+	out    []byte
+}
+
+// newAvroWriter writes the header of a file with the schema. codec is
+// null or deflate.
+func newAvroWriter(w io.Writer, schemaJSON []byte, schema *avroType, codec string) (a *avroWriter, err error) {
+	switch codec {
+	case "", "none", "null":
+		codec = "null"
+	case "deflate":
+	default:
+		return nil, errors.NotSupportedf("Avro %s codec", codec)
+	}
+
+	a = &avroWriter{w: w, schema: schema, codec: codec}
+	if _, err = rand.Read(a.sync[:]); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	h := append([]byte{}, avroMagic...)
+	h = binary.AppendVarint(h, 2)
+	for _, kv := range [][2][]byte{{[]byte("avro.schema"), schemaJSON}, {[]byte("avro.codec"), []byte(codec)}} {
+		for _, b := range kv {
+			h = binary.AppendVarint(h, int64(len(b)))
+			h = append(h, b...)
+		}
+	}
+	h = binary.AppendVarint(h, 0)
+	h = append(h, a.sync[:]...)
+
+	_, err = w.Write(h)
+	return a, errors.Trace(err)
+}
+
+func (a *avroWriter) append(values []interface{}) (err error) {
+	if len(values) != len(a.schema.Fields) {
+		return errors.Errorf("row has %d values for %d fields", len(values), len(a.schema.Fields))
+	}
+
+	for i, f := range a.schema.Fields {
+		if a.block, err = appendAvro(a.block, f.Type, values[i]); err != nil {
+			return errors.Annotatef(err, "column %s", f.Name)
+		}
+	}
+	a.rows++
+
+	if a.rows >= avroBlockRows {
+		return errors.Trace(a.flush())
+	}
+
+	return nil
+}
+
+// flush writes the buffered rows as a block.
+func (a *avroWriter) flush() (err error) {
+	if a.rows == 0 {
+		return nil
+	}
+
+	data := a.block
+	if a.codec == "deflate" {
+		var b bytes.Buffer
+		var fw *flate.Writer
+		if fw, err = flate.NewWriter(&b, flate.DefaultCompression); err != nil {
+			return errors.Trace(err)
+		}
+		fw.Write(data)
+		if err = fw.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		data = b.Bytes()
+	}
+
+	a.out = binary.AppendVarint(a.out[:0], int64(a.rows))
+	a.out = binary.AppendVarint(a.out, int64(len(data)))
+	a.out = append(a.out, data...)
+	a.out = append(a.out, a.sync[:]...)
+	a.block, a.rows = a.block[:0], 0
+
+	_, err = a.w.Write(a.out)
+	return errors.Trace(err)
+}
@@ -0,0 +1,229 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// BenchSettings are the writer settings tried by a benchmark.
+type BenchSettings struct {
+	MaxRowBufSz    int
+	MaxRowTxCommit int
+	Concurrency    int  //Writers loading the rows at once, each on its own connection
+	Compress       bool //Compress the MySQL protocol, on connections of their own
+	PacketSize     int  //SQL Server TDS packet size, on connections of their own, the DstConnOptions one if 0
+}
+
+func (s BenchSettings) String() string {
+	str := fmt.Sprintf("MAX_ROW_BUF_SZ=%d MAX_ROW_TX_COMMIT=%d concurrency=%d", s.MaxRowBufSz, s.MaxRowTxCommit, s.Concurrency)
+	if s.Compress {
+		str += " DST_COMPRESS=true"
+	}
+	if s.PacketSize > 0 {
+		str += fmt.Sprintf(" DST_PACKET_SIZE=%d", s.PacketSize)
+	}
+
+	return str
+}
+
+// BenchResult is how fast the rows were written with some settings.
+type BenchResult struct {
+	Settings   BenchSettings
+	Rows       int
+	Elapsed    time.Duration
+	RowsPerSec float64
+	Err        error
+}
+
+// Returns the settings swept by default: a range of batch sizes and
+// commit intervals, written by 1, 2 and 4 writers.
+func DefaultBenchSettings() (settings []BenchSettings) {
+	for _, conc := range []int{1, 2, 4} {
+		for _, buf := range []int{50, 100, 500, 1000} {
+			for _, commit := range []int{buf * 5, buf * 20} {
+				settings = append(settings, BenchSettings{MaxRowBufSz: buf, MaxRowTxCommit: commit, Concurrency: conc})
+			}
+		}
+	}
+
+	return settings
+}
+
+// Returns the settings followed by each of them again with the driver's
+// network option, compression for MySQL or the largest packets for SQL
+// Server, or just the settings for other drivers.
+func NetworkBenchSettings(driver string, settings []BenchSettings) []BenchSettings {
+	network := append([]BenchSettings{}, settings...)
+	for _, s := range settings {
+		switch bulk.DialectFor(driver) {
+		case bulk.MySQL:
+			s.Compress = true
+		case bulk.SQLServer:
+			s.PacketSize = 32767
+		default:
+			return settings
+		}
+		network = append(network, s)
+	}
+
+	return network
+}
+
+// Bench reads sampleRows rows through the pipeline's stages, then writes
+// them to the destination table with each of the settings in turn and
+// returns how fast each was, and the fastest. The destination table is
+// cleared before each attempt and holds the sample afterwards.
+func Bench(ctx context.Context, cfg *Config, sampleRows int, settings []BenchSettings) (results []BenchResult, best *BenchResult, err error) {
+	var db *sql.DB
+	var conn *sql.Conn
+	var release func()
+
+	if cfg.DstDbUri == "" && cfg.DstDB == nil {
+		return nil, nil, errors.NotValidf("benchmark without DstDbUri or DstDB")
+	}
+
+	// Read the sample once, so only the writes are timed
+	sink := bulk.NewMemorySink()
+	sc := *cfg
+	sc.SampleRows = sampleRows
+	sc.DstWriter, sc.DstConn, sc.DstDB = sink, nil, nil
+	sc.LoadMode, sc.CDCSlot = LoadReplace, ""
+	sc.AuditRuns, sc.IdentityInsert, sc.CopyIndexes, sc.ResyncSequences = false, false, false, false
+	sc.OnEvent, sc.WatermarkColumn = nil, ""
+
+	if _, err = run(ctx, &sc, nil); err != nil {
+		return nil, nil, errors.Annotate(err, "reading the sample")
+	}
+	rows, columns := sink.Rows(), sink.Columns()
+
+	// The concurrent writers need a database, not just a connection
+	if db, conn, release, err = connect(ctx, nil, cfg.DstDB, cfg.DstDbUri, cfg.DstDbPassword, cfg.DstConnOptions); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer release()
+
+	// Settings with driver options write on pools opened with them
+	type network struct {
+		compress   bool
+		packetSize int
+	}
+	pools := map[network]*sql.DB{{}: db}
+
+	for _, s := range settings {
+		r := BenchResult{Settings: s, Rows: len(rows)}
+
+		if err = clearTable(ctx, conn, cfg); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		n := network{compress: s.Compress, packetSize: s.PacketSize}
+		if pools[n] == nil && cfg.DstDbUri == "" {
+			r.Err = errors.NotSupportedf("driver options with DstDB")
+		} else if pools[n] == nil {
+			opts := cfg.DstConnOptions
+			opts.Compress = opts.Compress || s.Compress
+			if s.PacketSize > 0 {
+				opts.PacketSize = s.PacketSize
+			}
+			var prelease func()
+			if pools[n], _, prelease, r.Err = connect(ctx, nil, nil, cfg.DstDbUri, cfg.DstDbPassword, opts); r.Err == nil {
+				defer prelease()
+			}
+		}
+
+		start := time.Now()
+		if r.Err == nil {
+			r.Err = benchWrite(ctx, cfg, pools[n], columns, rows, s)
+		}
+		r.Elapsed = time.Since(start)
+
+		if r.Err == nil && r.Elapsed > 0 {
+			r.RowsPerSec = float64(len(rows)) / r.Elapsed.Seconds()
+		}
+		results = append(results, r)
+
+		if ctx.Err() != nil {
+			return results, nil, errors.Trace(ctx.Err())
+		}
+	}
+
+	for i := range results {
+		if results[i].Err == nil && (best == nil || results[i].RowsPerSec > best.RowsPerSec) {
+			best = &results[i]
+		}
+	}
+
+	return results, best, nil
+}
+
+// benchWrite writes the rows split between the settings' writers.
+func benchWrite(ctx context.Context, cfg *Config, db *sql.DB, columns []string, rows [][]interface{}, s BenchSettings) (err error) {
+	conc := max(1, s.Concurrency)
+	errs := make([]error, conc)
+
+	var wg sync.WaitGroup
+	for w := 0; w < conc; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs[w] = benchWriter(ctx, cfg, db, columns, rows[w*len(rows)/conc:(w+1)*len(rows)/conc], s)
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err = range errs {
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// benchWriter writes rows on a connection of its own.
+func benchWriter(ctx context.Context, cfg *Config, db *sql.DB, columns []string, rows [][]interface{}, s BenchSettings) (err error) {
+	var conn *sql.Conn
+	var w bulk.Writer
+
+	if conn, err = db.Conn(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if err = execSessionSQL(ctx, conn, cfg.DstSessionSQL); err != nil {
+		return errors.Trace(err)
+	}
+
+	if w, err = bulk.NewWriter(ctx, conn, bulk.Options{
+		Driver:         cfg.DstDbDriver,
+		Schema:         cfg.DstSchema,
+		Table:          cfg.DstTable,
+		Columns:        columns,
+		MaxRowBufSz:    s.MaxRowBufSz,
+		MaxRowTxCommit: s.MaxRowTxCommit,
+		LargeValueSz:   cfg.LargeValueSz,
+		MaxBufBytes:    cfg.MaxBufBytes,
+		MaxBatchBytes:  cfg.MaxBatchBytes}); err != nil {
+		return errors.Trace(err)
+	}
+	defer w.Close()
+
+	for _, row := range rows {
+		if err = w.AppendValues(ctx, row); err != nil {
+			w.Rollback()
+			return errors.Trace(err)
+		}
+	}
+
+	if _, err = w.Flush(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -5,7 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -13,136 +13,406 @@ import (
 type Bulk struct {
 	conn *sql.Conn //Database handle
 	tx   *sql.Tx
+	d    *Dialect
 
 	schema         string
 	tableName      string
 	columns        []string
 	maxRowTxCommit int
 
-	stmt   *sql.Stmt     //Prepared statement for bulk insert
-	buf    []interface{} //Buffer to hold values to insert
-	bufSz  int           //Size of the buffer
+	stmts  map[int]*sql.Stmt //Prepared statements for bulk insert keyed by row count
+	buf    []interface{}     //Buffer to hold values to insert
+	bufSz  int               //Size of the buffer
 	bufPos int
 
-	valuePtrs []interface{} //Pointer to current row buffer
-	values    []interface{} //Buffer for the current row
-	colCount  int           //Number of columns
+	largeValueSz int //Size at which a value is written in its own statement
+	maxBufBytes  int //Maximum number of large value bytes to buffer
+	bufBytes     int //Number of large value bytes in the buffer
 
-	rowPos        int //Position of current row
-	totalRowCount int //Total number of rows
+	maxBatchBytes int //Maximum estimated size of a batch
+	batchBytes    int //Estimated size of the buffered rows
+
+	colCount int //Number of columns
+
+	batchRetries      int  //Times a failed batch is retried from a savepoint
+	skipFailedBatches bool //Skip batches which still fail
+	skippedRowCount   int  //Number of rows in skipped batches
+	batchCount        int  //Number of batches written
+
+	diagnose  bool //Find the rejected row of a failed batch
+	redactRow bool //Leave values out of row errors
+
+	batchTimer
+
+	rowPos            int //Position of current row
+	totalRowCount     int //Total number of rows appended, including skipped ones
+	committedRowCount int //Number of rows committed to the database
 }
 
 // Appends row values to internal buffer
-func (r *Bulk) Append(ctx context.Context, rows *sql.Rows) (err error) {
-	rows.Scan(r.valuePtrs...)
+func (r *Bulk) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	rowBytes, large := r.rowSize(values)
+
+	rowEst := 0
+	if r.maxBatchBytes > 0 {
+		rowEst = RowSize(values)
+	}
+
+	// Write rows holding large values on their own so the buffer
+	// doesn't hold MaxRowBufSz of them at once.
+	if large {
+		if err = r.execBuffer(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	} else if r.maxBufBytes > 0 && r.rowPos > 0 && r.bufBytes+rowBytes > r.maxBufBytes {
+		if err = r.execBuffer(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	} else if r.maxBatchBytes > 0 && r.rowPos > 0 && r.batchBytes+rowEst > r.maxBatchBytes {
+		if err = r.execBuffer(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	//Copy row values into buffer
 	for i := 0; i < r.colCount; i++ {
-		r.buf[r.bufPos] = r.values[i]
+		r.buf[r.bufPos] = values[i]
 		r.bufPos++
 	}
 
+	r.bufBytes += rowBytes
+	r.batchBytes += rowEst
 	r.rowPos++
 	r.totalRowCount++
 
+	if err = r.commitEvery(); err != nil {
+		return errors.Trace(err)
+	}
+
+	//Insert rows if buffer is full
+	if large || r.bufPos >= r.bufSz {
+		if err = r.execBuffer(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Commits the transaction every maxRowTxCommit rows
+func (r *Bulk) commitEvery() (err error) {
 	// Need to check if tx is nil (caused if totalRowCount > 0 maxRowTxCommit = 1 )
-	if r.tx != nil && r.totalRowCount > 0 && r.totalRowCount%r.maxRowTxCommit == 0 {
+	if r.tx != nil && r.maxRowTxCommit > 0 && r.totalRowCount%r.maxRowTxCommit == 0 {
+		start := time.Now()
 		if err = r.tx.Commit(); err != nil {
 			return errors.Trace(err)
 		}
 		r.tx = nil
+		// Skipped batches were all executed before the buffered rows
+		written := r.totalRowCount - r.rowPos - r.skippedRowCount
+		r.record(start, written-r.committedRowCount, true)
+		r.committedRowCount = written
 	}
 
-	//Insert rows if buffer is full
-	if r.bufPos >= r.bufSz {
-		if r.tx == nil {
-			if r.tx, err = r.conn.BeginTx(ctx, nil); err != nil {
-				return errors.Trace(err)
-			}
-		}
+	return nil
+}
+
+// Inserts the buffered rows, preparing a smaller statement if the buffer
+// isn't full.
+func (r *Bulk) execBuffer(ctx context.Context) (err error) {
+	var stmt *sql.Stmt
+
+	if r.rowPos == 0 {
+		return nil
+	}
 
-		if _, err = r.stmt.Exec(r.buf...); err != nil {
+	start := time.Now()
+
+	if r.tx == nil {
+		if r.tx, err = r.conn.BeginTx(ctx, nil); err != nil {
 			return errors.Trace(err)
 		}
+	}
 
-		r.bufPos = 0
-		r.rowPos = 0
+	if stmt, err = r.stmtFor(ctx, r.rowPos); err != nil {
+		return errors.Trace(err)
 	}
 
+	if r.batchRetries > 0 || r.skipFailedBatches {
+		if err = r.execSavepoint(ctx, stmt); err != nil {
+			return errors.Trace(err)
+		}
+	} else if _, err = stmt.ExecContext(ctx, r.buf[:r.bufPos]...); err != nil {
+		return errors.Trace(r.batchError(ctx, err, false))
+	}
+
+	r.batchCount++
+	r.record(start, r.rowPos, false)
+	r.bufPos = 0
+	r.rowPos = 0
+	r.bufBytes = 0
+	r.batchBytes = 0
+
 	return nil
 }
 
-// Closes any prepared statements
-func (r *Bulk) Close() (err error) {
-	if r.stmt != nil {
-		r.stmt.Close()
+// Inserts the buffered rows inside a savepoint so a failed batch can be
+// retried, or skipped, without aborting the rest of the transaction.
+func (r *Bulk) execSavepoint(ctx context.Context, stmt *sql.Stmt) (err error) {
+	set, rollback, release := r.d.SavepointSQL("datapipe_batch")
+
+	for attempt := 0; ; attempt++ {
+		if _, err = r.tx.ExecContext(ctx, set); err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err = stmt.ExecContext(ctx, r.buf[:r.bufPos]...); err == nil {
+			break
+		}
+
+		if _, rbErr := r.tx.ExecContext(ctx, rollback); rbErr != nil {
+			return errors.Annotatef(err, "rolling back to savepoint failed: %s", rbErr)
+		}
+
+		if attempt < r.batchRetries {
+			continue
+		}
+
+		if !r.skipFailedBatches {
+			return errors.Trace(r.batchError(ctx, err, true))
+		}
+
+		r.skippedRowCount += r.rowPos
+		return nil
+	}
+
+	if release != "" {
+		if _, err = r.tx.ExecContext(ctx, release); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
 	return nil
 }
 
-// Writes any unsaved values from buffer to database
-func (r *Bulk) Flush(ctx context.Context) (totalRowCount int, err error) {
-	if r.bufPos > 0 {
-		buf := make([]interface{}, r.bufPos)
-		for i := 0; i < r.bufPos; i++ {
-			buf[i] = r.buf[i]
+// batchError describes the buffered batch the database rejected, finding
+// the rejected row if diagnosing. txUsable is false if the batch may have
+// aborted the transaction.
+func (r *Bulk) batchError(ctx context.Context, err error, txUsable bool) *BatchError {
+	be := &BatchError{
+		Table:      r.d.QualifiedName(r.schema, r.tableName),
+		BatchIndex: r.batchCount,
+		RowRange:   RowRange{First: r.totalRowCount - r.rowPos + 1, Last: r.totalRowCount},
+		Err:        err}
+
+	if r.diagnose {
+		if rowErr := r.diagnoseBatch(ctx, be, txUsable); rowErr != nil {
+			be.Err = rowErr
 		}
+	}
 
-		stmt, err := r.prepare(ctx, r.rowPos)
-		if err != nil {
-			return 0, errors.Trace(err)
+	return be
+}
+
+// diagnoseBatch inserts the buffered rows one at a time to find the first
+// one the database rejects, then rolls them all back. Inside a usable
+// transaction it works from a savepoint, otherwise the transaction is
+// rolled back and the rows are tried in a new one, as the copy is
+// failing anyway. Returns nil if no row fails on its own.
+func (r *Bulk) diagnoseBatch(ctx context.Context, be *BatchError, txUsable bool) (rowErr *RowError) {
+	var stmt *sql.Stmt
+	var err error
+
+	var undo func()
+	if txUsable {
+		set, rollback, _ := r.d.SavepointSQL("datapipe_diagnose")
+		if _, err = r.tx.ExecContext(ctx, set); err != nil {
+			return nil
 		}
+		undo = func() { r.tx.ExecContext(ctx, rollback) }
+	} else {
+		r.tx.Rollback()
+		if r.tx, err = r.conn.BeginTx(ctx, nil); err != nil {
+			r.tx = nil
+			return nil
+		}
+		undo = func() {
+			r.tx.Rollback()
+			r.tx = nil
+		}
+	}
 
-		defer stmt.Close()
+	if stmt, err = r.stmtFor(ctx, 1); err != nil {
+		undo()
+		return nil
+	}
 
-		if _, err = stmt.Exec(buf...); err != nil {
-			return 0, errors.Trace(err)
+	for i := 0; i < r.rowPos; i++ {
+		row := r.buf[i*r.colCount : (i+1)*r.colCount]
+		if _, err = stmt.ExecContext(ctx, row...); err == nil {
+			continue
+		}
+
+		rowErr = &RowError{
+			Table:    be.Table,
+			Row:      be.RowRange.First + i,
+			Columns:  r.columns,
+			Redacted: r.redactRow,
+			Err:      err}
+		if !r.redactRow {
+			rowErr.Values = append([]interface{}{}, row...)
 		}
+		break
+	}
+	undo()
+
+	// Types are looked up once the transaction is usable again
+	if rowErr != nil && r.d != Generic {
+		rowErr.Types, _ = DestColumnTypes(ctx, r.conn, r.d, r.schema, r.tableName, r.columns)
+	}
+
+	return rowErr
+}
+
+// Returns the number of rows skipped in failed batches.
+func (r *Bulk) SkippedRowCount() int {
+	return r.skippedRowCount
+}
+
+// Returns the prepared insert statement for a number of rows
+func (r *Bulk) stmtFor(ctx context.Context, rowCount int) (stmt *sql.Stmt, err error) {
+	if stmt = r.stmts[rowCount]; stmt != nil {
+		return stmt, nil
+	}
+
+	if stmt, err = r.prepare(ctx, rowCount); err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.stmts[rowCount] = stmt
+
+	return stmt, nil
+}
+
+// Returns the number of bytes held by string and []byte values and
+// whether any of them is over the large value size.
+func (r *Bulk) rowSize(values []interface{}) (n int, large bool) {
+	for _, v := range values {
+		var sz int
+
+		switch t := v.(type) {
+		case []byte:
+			sz = len(t)
+		case string:
+			sz = len(t)
+		}
+
+		n += sz
+		large = large || (r.largeValueSz > 0 && sz >= r.largeValueSz)
+	}
+
+	return n, large
+}
+
+// Returns the estimated size in bytes of a row's values as sent to the
+// database.
+func RowSize(values []interface{}) (n int) {
+	for _, v := range values {
+		switch t := v.(type) {
+		case nil:
+			n++
+		case bool, int8, uint8:
+			n++
+		case int16, uint16:
+			n += 2
+		case int32, uint32, float32:
+			n += 4
+		case int, int64, uint, uint64, float64:
+			n += 8
+		case time.Time:
+			n += 12
+		case []byte:
+			n += len(t)
+		case string:
+			n += len(t)
+		default:
+			n += len(fmt.Sprint(v))
+		}
+	}
+
+	return n
+}
 
-		r.totalRowCount += r.rowPos
+// Closes any prepared statements
+func (r *Bulk) Close() (err error) {
+	for n, stmt := range r.stmts {
+		stmt.Close()
+		delete(r.stmts, n)
+	}
 
-		r.bufPos = 0
-		r.rowPos = 0
+	return nil
+}
+
+// Writes any unsaved values from buffer to database
+func (r *Bulk) Flush(ctx context.Context) (totalRowCount int, err error) {
+	if err = r.execBuffer(ctx); err != nil {
+		return 0, errors.Trace(err)
 	}
 
+	written := r.totalRowCount - r.skippedRowCount
+
 	// Source db was empty so we ended up with no rows, and nil tx
 	// so we need to test for nil tx otherwise we'll panic.
 	if r.tx != nil {
+		start := time.Now()
 		if err = r.tx.Commit(); err != nil {
 			return 0, errors.Trace(err)
 		}
+		r.tx = nil
+		r.record(start, written-r.committedRowCount, true)
 	}
+	r.committedRowCount = written
 
-	return r.totalRowCount, nil
+	return written, nil
 }
 
-// fqSchemaTable concatenates schema and table
-// taking into account a null schema and whether the schema and table
-// are already quoted.
-func (r *Bulk) FqSchemaTable(schema string, table string) string {
-	schemaQuoted := strings.HasPrefix(schema, "`") && strings.HasSuffix(schema, "`")
-	tableQuoted := strings.HasPrefix(table, "`") && strings.HasSuffix(table, "`")
+// Discards buffered rows, rolls back the open transaction and closes
+// any prepared statements. Returns the number of rows committed before
+// the rollback.
+func (r *Bulk) Rollback() (committedRowCount int, err error) {
+	r.bufPos = 0
+	r.rowPos = 0
+	r.bufBytes = 0
+	r.batchBytes = 0
 
-	if schema == "" {
-		if !tableQuoted {
-			table = fmt.Sprintf("`%s`", table)
-		}
-		return table
-	} else {
-		if !schemaQuoted {
-			schema = fmt.Sprintf("`%s`", schema)
-		}
-		if !tableQuoted {
-			table = fmt.Sprintf("`%s`", table)
+	if r.tx != nil {
+		// The tx is already rolled back if its context was cancelled
+		if err = r.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return r.committedRowCount, errors.Trace(err)
 		}
-		return fmt.Sprintf("%s.%s", schema, table)
+		r.tx = nil
+	}
+
+	if err = r.Close(); err != nil {
+		return r.committedRowCount, errors.Trace(err)
 	}
+
+	return r.committedRowCount, nil
+}
+
+// Returns the schema qualified table name quoted for the destination
+// dialect. Names already quoted in any dialect's style are re-quoted.
+func (r *Bulk) FqSchemaTable(schema string, table string) string {
+	return r.d.QualifiedName(schema, table)
 }
 
 // Creates a bulk insert SQL prepared statement based on a number of rows
-// Uses $x for row position
 func (r *Bulk) prepare(ctx context.Context, rowCount int) (stmt *sql.Stmt, err error) {
+	return r.conn.PrepareContext(ctx, r.insertSQL(rowCount))
+}
+
+// insertSQL returns the insert statement for a number of rows, with the
+// table and column names quoted for the dialect.
+func (r *Bulk) insertSQL(rowCount int) string {
 	var buf bytes.Buffer
 
 	buf.WriteString("INSERT INTO ")
@@ -152,7 +422,7 @@ func (r *Bulk) prepare(ctx context.Context, rowCount int) (stmt *sql.Stmt, err e
 		if i > 0 {
 			buf.WriteString(",")
 		}
-		buf.WriteString(r.columns[i])
+		buf.WriteString(r.d.QuoteIdent(r.columns[i]))
 	}
 	buf.WriteString(") VALUES ")
 
@@ -174,24 +444,56 @@ func (r *Bulk) prepare(ctx context.Context, rowCount int) (stmt *sql.Stmt, err e
 		buf.WriteString(")")
 	}
 
-	return r.conn.PrepareContext(ctx, buf.String())
+	return buf.String()
 }
 
 func NewBulk(ctx context.Context, db *sql.Conn, columns []string, schema string, tableName string, rowCount int, maxRowTxCommit int) (r *Bulk, err error) {
+	return newBulk(ctx, db, Options{
+		Schema:         schema,
+		Table:          tableName,
+		Columns:        columns,
+		MaxRowBufSz:    rowCount,
+		MaxRowTxCommit: maxRowTxCommit})
+}
+
+func newBulk(ctx context.Context, db *sql.Conn, opts Options) (r *Bulk, err error) {
 	r = &Bulk{
 		conn:           db,
-		schema:         schema,
-		tableName:      tableName,
-		columns:        columns,
-		maxRowTxCommit: maxRowTxCommit}
+		schema:         UnquoteIdent(opts.Schema),
+		tableName:      UnquoteIdent(opts.Table),
+		columns:        opts.Columns,
+		maxRowTxCommit: opts.MaxRowTxCommit,
+		largeValueSz:   opts.LargeValueSz,
+		maxBufBytes:    opts.MaxBufBytes,
+		maxBatchBytes:  opts.MaxBatchBytes,
+		stmts:          map[int]*sql.Stmt{},
+
+		batchRetries:      opts.BatchRetries,
+		skipFailedBatches: opts.SkipFailedBatches,
+
+		diagnose:  opts.DiagnoseErrors,
+		redactRow: opts.RedactErrorValues,
+
+		batchTimer: batchTimer{onBatch: opts.OnBatch}}
+
+	// Writers created without a driver have always written MySQL
+	if r.d = DialectFor(opts.Driver); opts.Driver == "" {
+		r.d = MySQL
+	}
 
-	r.colCount = len(columns)
+	if r.columns, err = ResolveColumns(ctx, db, r.d, r.schema, r.tableName, r.columns); err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	r.values = make([]interface{}, r.colCount)
-	r.valuePtrs = make([]interface{}, r.colCount)
+	rowCount := opts.MaxRowBufSz
 
-	for i := 0; i < r.colCount; i++ {
-		r.valuePtrs[i] = &r.values[i]
+	r.colCount = len(r.columns)
+
+	// Keep each statement's bind parameters within the dialect's limit
+	if max := r.d.MaxRowsPerStatement(r.colCount); r.d.maxParams > 0 && max == 0 {
+		return nil, errors.NotSupportedf("%d columns, more than the %d bind parameters %s allows", r.colCount, r.d.maxParams, r.d.Name)
+	} else if max > 0 && rowCount > max {
+		rowCount = max
 	}
 
 	r.bufSz = r.colCount * rowCount
@@ -200,7 +502,7 @@ func NewBulk(ctx context.Context, db *sql.Conn, columns []string, schema string,
 
 	r.buf = make([]interface{}, r.bufSz)
 
-	if r.stmt, err = r.prepare(ctx, rowCount); err != nil {
+	if _, err = r.stmtFor(ctx, rowCount); err != nil {
 		return nil, errors.Trace(err)
 	}
 
@@ -0,0 +1,121 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestInsertSQL(t *testing.T) {
+	columns := []string{"id", "order date", "OrderTotal", "order", "user", `a"b`, "a`b", "a]b"}
+
+	tests := []struct {
+		d    *Dialect
+		want string
+	}{
+		{Postgres, `INSERT INTO "sales"."Orders" ("id","order date","OrderTotal","order","user","a""b","a` + "`" + `b","a]b") VALUES (?,?,?,?,?,?,?,?),(?,?,?,?,?,?,?,?)`},
+		{MySQL, "INSERT INTO `sales`.`Orders` (`id`,`order date`,`OrderTotal`,`order`,`user`,`a\"b`,`a``b`,`a]b`) VALUES (?,?,?,?,?,?,?,?),(?,?,?,?,?,?,?,?)"},
+		{SQLServer, `INSERT INTO [sales].[Orders] ([id],[order date],[OrderTotal],[order],[user],[a"b],[a` + "`" + `b],[a]]b]) VALUES (?,?,?,?,?,?,?,?),(?,?,?,?,?,?,?,?)`},
+	}
+
+	for _, tt := range tests {
+		r := &Bulk{d: tt.d, schema: "sales", tableName: "Orders", columns: columns, colCount: len(columns)}
+		if got := r.insertSQL(2); got != tt.want {
+			t.Errorf("%s insertSQL(2) =\n%s\nwant\n%s", tt.d.Name, got, tt.want)
+		}
+	}
+}
+
+// rejectDriver is a database/sql driver accepting every statement except
+// inserts binding the value "bad".
+type rejectDriver struct{}
+
+func (rejectDriver) Open(name string) (driver.Conn, error) { return rejectConn{}, nil }
+
+type rejectConn struct{}
+
+func (rejectConn) Prepare(query string) (driver.Stmt, error) { return rejectStmt{}, nil }
+func (rejectConn) Close() error                              { return nil }
+func (rejectConn) Begin() (driver.Tx, error)                 { return rejectTx{}, nil }
+
+type rejectTx struct{}
+
+func (rejectTx) Commit() error   { return nil }
+func (rejectTx) Rollback() error { return nil }
+
+type rejectStmt struct{}
+
+func (rejectStmt) Close() error  { return nil }
+func (rejectStmt) NumInput() int { return -1 }
+func (rejectStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+func (rejectStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, v := range args {
+		if v == "bad" {
+			return nil, errors.New("rejected")
+		}
+	}
+	return driver.RowsAffected(len(args)), nil
+}
+
+func TestSkippedBatchCommits(t *testing.T) {
+	sql.Register("bulk_reject", rejectDriver{})
+	db, err := sql.Open("bulk_reject", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var commits []int
+	r, err := newBulk(ctx, conn, Options{
+		Driver:            "generic",
+		Table:             "t",
+		Columns:           []string{"v"},
+		MaxRowBufSz:       2,
+		MaxRowTxCommit:    4,
+		SkipFailedBatches: true,
+		OnBatch: func(bt BatchTiming) {
+			if bt.Commit {
+				commits = append(commits, bt.Rows)
+			}
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		v := interface{}(int64(i))
+		if i == 3 {
+			v = "bad"
+		}
+		if err = r.AppendValues(ctx, []interface{}{v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := r.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Commits stay at every 4 source rows, rows 3 and 4 being skipped
+	if want := []int{2, 2, 4}; !reflect.DeepEqual(commits, want) {
+		t.Errorf("rows committed = %v, want %v", commits, want)
+	}
+	if n != 8 || r.SkippedRowCount() != 2 {
+		t.Errorf("Flush = %d with %d skipped, want 8 with 2 skipped", n, r.SkippedRowCount())
+	}
+	if be := r.batchError(ctx, errors.New("rejected"), true); be.RowRange != (RowRange{First: 11, Last: 10}) {
+		t.Errorf("batch error rows = %+v after the last batch", be.RowRange)
+	}
+}
@@ -0,0 +1,104 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Returns the comments on a table and its columns keyed by column name,
+// the table's own under the empty name. Dialects without comments give
+// none.
+func Comments(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (comments map[string]string, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case Postgres:
+		q = fmt.Sprintf(`SELECT '', obj_description(to_regclass(%[1]s), 'pg_class')
+UNION ALL
+SELECT a.attname, col_description(a.attrelid, a.attnum)
+FROM pg_attribute a
+WHERE a.attrelid = to_regclass(%[1]s) AND a.attnum > 0 AND NOT a.attisdropped`, d.Placeholder(1))
+		args = []interface{}{d.QualifiedName(schema, tableName)}
+	case MySQL:
+		// MySQL's placeholders are positional so the arguments repeat
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+		args = append(args, args...)
+		q = fmt.Sprintf(`SELECT '', table_comment FROM information_schema.tables WHERE table_schema = %[1]s AND table_name = %[2]s
+UNION ALL
+SELECT column_name, column_comment FROM information_schema.columns WHERE table_schema = %[1]s AND table_name = %[2]s`,
+			schemaExpr, d.Placeholder(1))
+	case SQLServer:
+		q = fmt.Sprintf(`SELECT COALESCE(c.name, ''), CAST(ep.value AS NVARCHAR(MAX))
+FROM sys.extended_properties ep
+LEFT JOIN sys.columns c ON c.object_id = ep.major_id AND c.column_id = ep.minor_id
+WHERE ep.class = 1 AND ep.name = 'MS_Description' AND ep.major_id = OBJECT_ID(%s)`, d.Placeholder(1))
+		args = []interface{}{d.QualifiedName(schema, tableName)}
+	default:
+		return nil, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	comments = map[string]string{}
+	for rows.Next() {
+		var name string
+		var comment sql.NullString
+		if err = rows.Scan(&name, &comment); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if comment.String != "" {
+			comments[name] = comment.String
+		}
+	}
+
+	return comments, errors.Trace(rows.Err())
+}
+
+// Returns a statement setting the comment on a table, or on a column if
+// ct isn't nil. MySQL redefines the column so needs its type. Dialects
+// without comments give an empty statement.
+func (d *Dialect) CommentSQL(schema string, table string, ct *ColumnType, comment string) string {
+	name := d.QualifiedName(schema, table)
+	lit := "'" + strings.Replace(comment, "'", "''", -1) + "'"
+
+	switch d {
+	case Postgres:
+		if ct == nil {
+			return fmt.Sprintf("COMMENT ON TABLE %s IS %s", name, lit)
+		}
+		return fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", name, d.QuoteIdent(ct.Name), lit)
+	case MySQL:
+		lit = strings.Replace(lit, `\`, `\\`, -1)
+		if ct == nil {
+			return fmt.Sprintf("ALTER TABLE %s COMMENT = %s", name, lit)
+		}
+		null := "NOT NULL"
+		if ct.Nullable {
+			null = "NULL"
+		}
+		return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s %s COMMENT %s", name, d.QuoteIdent(ct.Name), d.ColumnDDLType(*ct), null, lit)
+	case SQLServer:
+		if schema == "" {
+			schema = "dbo"
+		}
+		q := fmt.Sprintf("EXEC sp_addextendedproperty @name = N'MS_Description', @value = N%s, @level0type = N'SCHEMA', @level0name = N'%s', @level1type = N'TABLE', @level1name = N'%s'",
+			lit, strings.Replace(UnquoteIdent(schema), "'", "''", -1), strings.Replace(UnquoteIdent(table), "'", "''", -1))
+		if ct != nil {
+			q += fmt.Sprintf(", @level2type = N'COLUMN', @level2name = N'%s'", strings.Replace(ct.Name, "'", "''", -1))
+		}
+		return q
+	}
+
+	return ""
+}
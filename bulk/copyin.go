@@ -3,7 +3,7 @@ package bulk
 import (
 	"context"
 	"database/sql"
-	"strconv"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/lib/pq"
@@ -13,37 +13,30 @@ type CopyIn struct {
 	conn *sql.Conn //Database handle
 	tx   *sql.Tx
 
-	stmt *sql.Stmt
+	stmt  *sql.Stmt
+	table string //Quoted destination table name
 
-	valueTypes []string
+	valueTypes []ColumnType
 
-	valuePtrs []interface{} //Pointer to current row buffer
-	values    []interface{} //Buffer for the current row
+	values []interface{} //Buffer for the current row
+
+	batchTimer
 
 	totalRowCount int //Total number of rows
 }
 
 // Appends row values to internal buffer
-func (r *CopyIn) Append(ctx context.Context, rows *sql.Rows) (err error) {
-	rows.Scan(r.valuePtrs...)
+func (r *CopyIn) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	copy(r.values, values)
 
 	for i := 0; i < len(r.valueTypes); i++ {
-		if r.values[i] == nil {
-			continue
-		}
-
-		if s, ok := r.values[i].([]byte); ok {
-			switch r.valueTypes[i] {
-			case "numeric":
-				r.values[i], _ = strconv.ParseFloat(string(s), 64)
-			default:
-				r.values[i] = string(s)
-			}
+		if r.values[i], err = pgCopyValue(r.values[i], r.valueTypes[i]); err != nil {
+			return errors.Trace(err)
 		}
 	}
 
 	if _, err = r.stmt.Exec(r.values...); err != nil {
-		return errors.Trace(err)
+		return errors.Trace(r.batchError(err, r.totalRowCount+1))
 	}
 
 	r.totalRowCount++
@@ -57,69 +50,103 @@ func (r *CopyIn) Close() (err error) {
 		return errors.Trace(err)
 	}
 
+	// Nothing to commit if the copy was rolled back
+	if r.tx == nil {
+		return nil
+	}
+
+	start := time.Now()
 	if err = r.tx.Commit(); err != nil {
 		return errors.Trace(err)
 	}
+	r.record(start, r.totalRowCount, true)
 
 	return nil
 }
 
-func (r *CopyIn) Flush(ctx context.Context) (totalRowCount int, err error) {
-	if _, err = r.stmt.Exec(); err != nil {
+// Aborts the COPY and rolls back the transaction. Nothing is committed
+// until Close so the committed row count is always zero.
+func (r *CopyIn) Rollback() (committedRowCount int, err error) {
+	if err = r.stmt.Close(); err != nil {
 		return 0, errors.Trace(err)
 	}
 
-	return r.totalRowCount, nil
-}
-
-func (r *CopyIn) findColumnTypes(ctx context.Context, schema string, tableName string, columns []string) (err error) {
-	sql := "SELECT column_name AS name, data_type AS type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2"
+	if r.tx == nil {
+		return 0, nil
+	}
 
-	rows, err := r.conn.QueryContext(ctx, sql, schema, tableName)
-	if err != nil {
-		return errors.Trace(err)
+	// The tx is already rolled back if its context was cancelled
+	if err = r.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return 0, errors.Trace(err)
 	}
+	r.tx = nil
 
-	defer rows.Close()
+	return 0, nil
+}
 
-	for rows.Next() {
-		var colName, colType string
+func (r *CopyIn) Flush(ctx context.Context) (totalRowCount int, err error) {
+	// Most rejected rows are only reported once the COPY ends
+	start := time.Now()
+	if _, err = r.stmt.Exec(); err != nil {
+		return 0, errors.Trace(r.batchError(err, 1))
+	}
+	r.record(start, r.totalRowCount, false)
 
-		if err := rows.Scan(&colName, &colType); err != nil {
-			return errors.Trace(err)
-		}
+	return r.totalRowCount, nil
+}
 
-		for i := 0; i < len(columns); i++ {
-			if colName == columns[i] {
-				r.valueTypes[i] = colType
-			}
-		}
+// batchError describes the rows from first on which the COPY rejected. The
+// whole copy is a single batch.
+func (r *CopyIn) batchError(err error, first int) *BatchError {
+	last := r.totalRowCount
+	if last < first {
+		last = first
 	}
 
-	return errors.Trace(rows.Err())
+	return &BatchError{
+		Table:    r.table,
+		RowRange: RowRange{First: first, Last: last},
+		Err:      err}
 }
 
 func NewCopyIn(ctx context.Context, conn *sql.Conn, columns []string, schema string, tableName string) (r *CopyIn, err error) {
+	return newCopyIn(ctx, conn, Options{
+		Schema:  schema,
+		Table:   tableName,
+		Columns: columns})
+}
+
+func newCopyIn(ctx context.Context, conn *sql.Conn, opts Options) (r *CopyIn, err error) {
 	r = &CopyIn{
-		conn: conn}
+		conn:       conn,
+		table:      Postgres.QualifiedName(opts.Schema, opts.Table),
+		batchTimer: batchTimer{onBatch: opts.OnBatch}}
+
+	schema, tableName, columns := UnquoteIdent(opts.Schema), UnquoteIdent(opts.Table), opts.Columns
 
 	colCount := len(columns)
 
 	r.values = make([]interface{}, colCount)
-	r.valuePtrs = make([]interface{}, colCount)
-	r.valueTypes = make([]string, colCount)
 
-	for i := 0; i < colCount; i++ {
-		r.valuePtrs[i] = &r.values[i]
+	if r.tx, err = r.conn.BeginTx(ctx, nil); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	if r.tx, err = r.conn.BeginTx(ctx, nil); err != nil {
+	if columns, err = ResolveColumns(ctx, r.conn, Postgres, schema, tableName, columns); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	if err = r.findColumnTypes(ctx, schema, tableName, columns); err != nil {
+	if r.valueTypes, err = DestColumnTypes(ctx, r.conn, Postgres, schema, tableName, columns); err != nil {
 		return nil, errors.Trace(err)
 	}
+	// Without the types json, array and uuid values aren't converted
+	found := false
+	for _, ct := range r.valueTypes {
+		found = found || ct.DatabaseType != ""
+	}
+	if !found && colCount > 0 {
+		return nil, errors.NotFoundf("columns of %s", r.table)
+	}
 
 	if r.stmt, err = r.tx.Prepare(pq.CopyInSchema(schema, tableName, columns...)); err != nil {
 		return nil, errors.Trace(err)
@@ -0,0 +1,232 @@
+package bulk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Returns the column type in the dialect holding the values of a column
+// of another database, mapped by type family. Unknown types map to the
+// dialect's unbounded text type.
+func (d *Dialect) ColumnDDLType(ct ColumnType) string {
+	name := strings.ToLower(strings.TrimSpace(ct.DatabaseType))
+
+	switch Family(ct.DatabaseType) {
+	case FamilyString:
+		return d.stringType(ct.Length)
+	case FamilyInt:
+		switch name {
+		case "bigint", "int8", "bigserial", "unsigned bigint", "bigint unsigned":
+			return "BIGINT"
+		case "smallint", "int2", "smallserial", "tinyint", "year":
+			return "SMALLINT"
+		}
+		// Unsigned ints may not fit a signed int
+		if strings.Contains(name, "unsigned") {
+			return "BIGINT"
+		}
+		return "INTEGER"
+	case FamilyDecimal:
+		if ct.Precision > 0 && ct.Precision <= 38 {
+			return fmt.Sprintf("DECIMAL(%d,%d)", ct.Precision, ct.Scale)
+		}
+		if d == Postgres || d == SQLite {
+			return "NUMERIC"
+		}
+		return "DECIMAL(38,10)"
+	case FamilyFloat:
+		single := name == "real" || name == "float4"
+		switch d {
+		case Postgres:
+			if single {
+				return "REAL"
+			}
+			return "DOUBLE PRECISION"
+		case MySQL:
+			if single {
+				return "FLOAT"
+			}
+			return "DOUBLE"
+		case SQLServer:
+			if single {
+				return "REAL"
+			}
+			return "FLOAT"
+		}
+		return "REAL"
+	case FamilyBool:
+		if d == SQLServer {
+			return "BIT"
+		}
+		return "BOOLEAN"
+	case FamilyDate:
+		return "DATE"
+	case FamilyTime:
+		return d.timeType(name)
+	case FamilyBinary:
+		switch d {
+		case Postgres:
+			return "BYTEA"
+		case MySQL:
+			return "LONGBLOB"
+		case SQLServer:
+			return "VARBINARY(MAX)"
+		}
+		return "BLOB"
+	case FamilyJSON:
+		switch d {
+		case Postgres:
+			return "JSONB"
+		case MySQL:
+			return "JSON"
+		}
+		return d.stringType(0)
+	case FamilyUUID:
+		switch d {
+		case Postgres:
+			return "UUID"
+		case SQLServer:
+			return "UNIQUEIDENTIFIER"
+		}
+		return d.stringType(36)
+	case FamilyGeometry:
+		switch d {
+		case Postgres, MySQL:
+			return "GEOMETRY"
+		case SQLServer:
+			if name == "geography" {
+				return "GEOGRAPHY"
+			}
+			return "GEOMETRY"
+		}
+	}
+
+	return d.stringType(0)
+}
+
+// stringType returns a variable length string type, unbounded if the
+// length is 0 or too long for the dialect's bounded type.
+func (d *Dialect) stringType(length int64) string {
+	switch d {
+	case SQLServer:
+		if length > 0 && length <= 4000 {
+			return fmt.Sprintf("NVARCHAR(%d)", length)
+		}
+		return "NVARCHAR(MAX)"
+	case MySQL:
+		if length > 0 && length <= 16383 {
+			return fmt.Sprintf("VARCHAR(%d)", length)
+		}
+		return "LONGTEXT"
+	case Postgres:
+		if length > 0 && length <= 10485760 {
+			return fmt.Sprintf("VARCHAR(%d)", length)
+		}
+	}
+
+	return "TEXT"
+}
+
+func (d *Dialect) timeType(name string) string {
+	zoned := strings.Contains(name, "tz") || strings.Contains(name, "with time zone") || name == "datetimeoffset"
+
+	if name == "time" || strings.HasPrefix(name, "time with") || name == "timetz" {
+		if d == Postgres && zoned {
+			return "TIMETZ"
+		}
+		return "TIME"
+	}
+
+	switch d {
+	case Postgres:
+		if zoned {
+			return "TIMESTAMPTZ"
+		}
+		return "TIMESTAMP"
+	case MySQL:
+		return "DATETIME(6)"
+	case SQLServer:
+		if zoned {
+			return "DATETIMEOFFSET"
+		}
+		return "DATETIME2"
+	}
+
+	return "TIMESTAMP"
+}
+
+// Returns a statement adding a nullable column to a table.
+func (d *Dialect) AddColumnSQL(schema string, table string, ct ColumnType) string {
+	add := "ADD COLUMN"
+	if d == SQLServer {
+		add = "ADD"
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s %s %s %s NULL",
+		d.QualifiedName(schema, table), add, d.QuoteIdent(ct.Name), d.ColumnDDLType(ct))
+}
+
+// Returns the statements deleting every row of a table, using TRUNCATE
+// where the dialect has it and DELETE where it doesn't. cascade also
+// truncates the tables referencing it and restartIdentity resets its
+// identity columns, which MySQL and SQL Server always do. cascade is
+// Postgres only.
+func (d *Dialect) ClearTableSQL(schema string, table string, cascade bool, restartIdentity bool) (qs []string, err error) {
+	name := d.QualifiedName(schema, table)
+
+	if cascade && d != Postgres {
+		return nil, errors.NotSupportedf("truncating with cascade for the %s dialect", d.Name)
+	}
+
+	switch d {
+	case Postgres:
+		q := "TRUNCATE TABLE " + name
+		if restartIdentity {
+			q += " RESTART IDENTITY"
+		}
+		if cascade {
+			q += " CASCADE"
+		}
+		return []string{q}, nil
+	case MySQL, SQLServer:
+		return []string{"TRUNCATE TABLE " + name}, nil
+	case SQLite:
+		qs = []string{"DELETE FROM " + name}
+		if restartIdentity {
+			// sqlite_sequence only exists once an AUTOINCREMENT table does
+			qs = append(qs, fmt.Sprintf("DELETE FROM sqlite_sequence WHERE name = '%s'", strings.Replace(UnquoteIdent(table), "'", "''", -1)))
+		}
+		return qs, nil
+	}
+
+	if restartIdentity {
+		return nil, errors.NotSupportedf("restarting identity columns for the %s dialect", d.Name)
+	}
+
+	return []string{"DELETE FROM " + name}, nil
+}
+
+// Returns a CREATE TABLE statement with columns holding the values of the
+// column types, which are usually another database's.
+func (d *Dialect) CreateTableSQL(schema string, table string, types []ColumnType) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "CREATE TABLE %s (\n", d.QualifiedName(schema, table))
+	for i, ct := range types {
+		null := "NOT NULL"
+		if ct.Nullable {
+			null = "NULL"
+		}
+
+		fmt.Fprintf(&b, "    %s %s %s", d.QuoteIdent(ct.Name), d.ColumnDDLType(ct), null)
+		if i < len(types)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(")")
+
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package bulk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the SQL differences between destination databases.
+type Dialect struct {
+	Name string //Canonical dialect name
+
+	placeholder   func(pos int) string
+	quote         [2]string //Opening and closing identifier quotes
+	currentSchema string    //Expression returning the session's default schema
+	maxParams     int       //Most bind parameters a statement can have, 0 for no known limit
+}
+
+var (
+	Postgres = &Dialect{
+		Name:          "postgres",
+		placeholder:   func(pos int) string { return "$" + strconv.Itoa(pos) },
+		quote:         [2]string{`"`, `"`},
+		currentSchema: "current_schema()",
+		maxParams:     65535}
+
+	MySQL = &Dialect{
+		Name:          "mysql",
+		placeholder:   func(pos int) string { return "?" },
+		quote:         [2]string{"`", "`"},
+		currentSchema: "DATABASE()",
+		maxParams:     65535}
+
+	SQLServer = &Dialect{
+		Name:          "sqlserver",
+		placeholder:   func(pos int) string { return "@p" + strconv.Itoa(pos) },
+		quote:         [2]string{"[", "]"},
+		currentSchema: "SCHEMA_NAME()",
+		maxParams:     2100}
+
+	SQLite = &Dialect{
+		Name:        "sqlite",
+		placeholder: func(pos int) string { return "?" },
+		quote:       [2]string{`"`, `"`},
+		maxParams:   32766}
+
+	Generic = &Dialect{
+		Name:        "generic",
+		placeholder: func(pos int) string { return "?" },
+		quote:       [2]string{`"`, `"`}}
+)
+
+// Returns the dialect for a database/sql driver name, or Generic if the
+// driver isn't known.
+func DialectFor(driver string) *Dialect {
+	switch strings.ToLower(driver) {
+	case "postgres", "postgresql", "pgx", "pq":
+		return Postgres
+	case "mysql", "mariadb":
+		return MySQL
+	case "mssql", "sqlserver", "azuresql":
+		return SQLServer
+	case "sqlite", "sqlite3":
+		return SQLite
+	}
+
+	return Generic
+}
+
+// Returns the bind parameter placeholder for the 1-based position.
+func (d *Dialect) Placeholder(pos int) string {
+	return d.placeholder(pos)
+}
+
+// Returns the most rows of colCount columns a multi-row statement can
+// bind, or 0 if the dialect has no known parameter limit.
+func (d *Dialect) MaxRowsPerStatement(colCount int) int {
+	if d.maxParams == 0 || colCount == 0 {
+		return 0
+	}
+
+	return d.maxParams / colCount
+}
+
+// Limits a query starting with SELECT to its first n rows.
+func (d *Dialect) LimitQuery(query string, n int) string {
+	if d == SQLServer {
+		return fmt.Sprintf("SELECT TOP (%d)%s", n, strings.TrimSpace(query)[len("SELECT"):])
+	}
+
+	return fmt.Sprintf("%s LIMIT %d", query, n)
+}
+
+// Returns a query reading a random sample of about percent of the
+// query's rows.
+func (d *Dialect) SampleQuery(query string, percent float64) string {
+	var cond string
+
+	switch d {
+	case Postgres:
+		cond = fmt.Sprintf("random() < %g", percent/100)
+	case MySQL:
+		cond = fmt.Sprintf("RAND() < %g", percent/100)
+	case SQLServer:
+		// RAND() is only evaluated once per query
+		cond = fmt.Sprintf("ABS(CHECKSUM(NEWID())) %% 1000000 < %d", int(percent*10000))
+	default:
+		cond = fmt.Sprintf("ABS(RANDOM()) %% 1000000 < %d", int(percent*10000))
+	}
+
+	return fmt.Sprintf("SELECT * FROM (%s) datapipe_sample WHERE %s", query, cond)
+}
+
+// Quotes an identifier, escaping any closing quote characters.
+func (d *Dialect) QuoteIdent(name string) string {
+	closing := d.quote[1]
+	return d.quote[0] + strings.Replace(name, closing, closing+closing, -1) + closing
+}
+
+// Removes the quotes from an identifier quoted in any dialect's style,
+// "name", `name` or [name], unescaping doubled closing quotes. Unquoted
+// identifiers are returned unchanged.
+func UnquoteIdent(name string) string {
+	for _, q := range [][2]string{{`"`, `"`}, {"`", "`"}, {"[", "]"}} {
+		if len(name) >= 2 && strings.HasPrefix(name, q[0]) && strings.HasSuffix(name, q[1]) {
+			return strings.Replace(name[1:len(name)-1], q[1]+q[1], q[1], -1)
+		}
+	}
+
+	return name
+}
+
+// Returns the quoted schema qualified table name. The schema is left out
+// if it's empty. Names already quoted in any dialect's style are
+// re-quoted for this dialect.
+func (d *Dialect) QualifiedName(schema string, table string) string {
+	if schema == "" {
+		return d.QuoteIdent(UnquoteIdent(table))
+	}
+
+	return d.QuoteIdent(UnquoteIdent(schema)) + "." + d.QuoteIdent(UnquoteIdent(table))
+}
+
+// Postgres' alias of the session's temporary schema.
+const pgTempSchema = "pg_temp"
+
+// Returns the schema of the staging tables CreateStageSQL creates, to
+// write to and look them up in: pg_temp for Postgres, whose temporary
+// tables are in a schema of their own, and none otherwise.
+func (d *Dialect) StageSchema() string {
+	if d == Postgres {
+		return pgTempSchema
+	}
+
+	return ""
+}
+
+// schemaFilter returns the SQL expression matching a schema name, using
+// the session's default schema if the name is empty, and its arguments.
+func (d *Dialect) schemaFilter(schema string, pos int) (expr string, args []interface{}) {
+	if schema == "" && d.currentSchema != "" {
+		return d.currentSchema, nil
+	}
+	// The catalog names the temporary schema pg_temp_N
+	if d == Postgres && schema == pgTempSchema {
+		return "(SELECT nspname FROM pg_namespace WHERE oid = pg_my_temp_schema())", nil
+	}
+
+	return d.Placeholder(pos), []interface{}{schema}
+}
+
+// Returns the statements setting, rolling back to and releasing a
+// savepoint. SQL Server has no release statement so it's empty.
+func (d *Dialect) SavepointSQL(name string) (set string, rollback string, release string) {
+	name = d.QuoteIdent(name)
+
+	if d == SQLServer {
+		return "SAVE TRANSACTION " + name, "ROLLBACK TRANSACTION " + name, ""
+	}
+
+	return "SAVEPOINT " + name, "ROLLBACK TO SAVEPOINT " + name, "RELEASE SAVEPOINT " + name
+}
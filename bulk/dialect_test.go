@@ -0,0 +1,109 @@
+package bulk
+
+import (
+	"testing"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		name      string
+		postgres  string
+		mysql     string
+		sqlserver string
+	}{
+		{"id", `"id"`, "`id`", "[id]"},
+		{"order date", `"order date"`, "`order date`", "[order date]"},
+		{"OrderDate", `"OrderDate"`, "`OrderDate`", "[OrderDate]"},
+		{"order", `"order"`, "`order`", "[order]"},
+		{"user", `"user"`, "`user`", "[user]"},
+		{"Group", `"Group"`, "`Group`", "[Group]"},
+		{`a"b`, `"a""b"`, "`a\"b`", `[a"b]`},
+		{"a`b", "\"a`b\"", "`a``b`", "[a`b]"},
+		{"a]b", `"a]b"`, "`a]b`", "[a]]b]"},
+		{"[a]", `"[a]"`, "`[a]`", "[[a]]]"},
+	}
+
+	for _, tt := range tests {
+		for _, c := range []struct {
+			d    *Dialect
+			want string
+		}{{Postgres, tt.postgres}, {SQLite, tt.postgres}, {Generic, tt.postgres}, {MySQL, tt.mysql}, {SQLServer, tt.sqlserver}} {
+			if got := c.d.QuoteIdent(tt.name); got != c.want {
+				t.Errorf("%s QuoteIdent(%q) = %s, want %s", c.d.Name, tt.name, got, c.want)
+			}
+		}
+	}
+}
+
+func TestUnquoteIdent(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Orders", "Orders"},
+		{`"Orders"`, "Orders"},
+		{"`Orders`", "Orders"},
+		{"[Orders]", "Orders"},
+		{`"a""b"`, `a"b`},
+		{"`a``b`", "a`b"},
+		{"[a]]b]", "a]b"},
+		{`"order date"`, "order date"},
+		{`"`, `"`},
+		{"[Orders", "[Orders"},
+	}
+
+	for _, tt := range tests {
+		if got := UnquoteIdent(tt.name); got != tt.want {
+			t.Errorf("UnquoteIdent(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQualifiedName(t *testing.T) {
+	tests := []struct {
+		schema    string
+		table     string
+		postgres  string
+		mysql     string
+		sqlserver string
+	}{
+		{"s", "t", `"s"."t"`, "`s`.`t`", "[s].[t]"},
+		{`"s"`, `"t"`, `"s"."t"`, "`s`.`t`", "[s].[t]"},
+		{"[dbo]", "[Orders]", `"dbo"."Orders"`, "`dbo`.`Orders`", "[dbo].[Orders]"},
+		{"`db`", "`t`", `"db"."t"`, "`db`.`t`", "[db].[t]"},
+		{"", `"a""b"`, `"a""b"`, "`a\"b`", `[a"b]`},
+		{"", "[a]]b]", `"a]b"`, "`a]b`", "[a]]b]"},
+		{"", "Orders", `"Orders"`, "`Orders`", "[Orders]"},
+		{"dbo", "[order]", `"dbo"."order"`, "`dbo`.`order`", "[dbo].[order]"},
+	}
+
+	for _, tt := range tests {
+		for _, c := range []struct {
+			d    *Dialect
+			want string
+		}{{Postgres, tt.postgres}, {MySQL, tt.mysql}, {SQLServer, tt.sqlserver}} {
+			if got := c.d.QualifiedName(tt.schema, tt.table); got != c.want {
+				t.Errorf("%s QualifiedName(%q, %q) = %s, want %s", c.d.Name, tt.schema, tt.table, got, c.want)
+			}
+		}
+	}
+}
+
+func TestStageSchemaFilter(t *testing.T) {
+	tests := []struct {
+		d    *Dialect
+		expr string
+		args int
+	}{
+		{Postgres, "(SELECT nspname FROM pg_namespace WHERE oid = pg_my_temp_schema())", 0},
+		{MySQL, "DATABASE()", 0},
+		{SQLServer, "SCHEMA_NAME()", 0},
+	}
+
+	for _, tt := range tests {
+		expr, args := tt.d.schemaFilter(tt.d.StageSchema(), 1)
+		if expr != tt.expr || len(args) != tt.args {
+			t.Errorf("%s stage schema filter = %s %v, want %s", tt.d.Name, expr, args, tt.expr)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package bulk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RowRange is the 1-based positions of the first and last rows of a batch
+// in the order they were written.
+type RowRange struct {
+	First int
+	Last  int
+}
+
+// BatchError reports a batch of rows the destination rejected.
+type BatchError struct {
+	Table      string   //Destination table
+	BatchIndex int      //0-based position of the batch among those written
+	RowRange   RowRange //Rows in the batch
+	Err        error    //Database error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("writing rows %d-%d (batch %d) to %s: %s",
+		e.RowRange.First, e.RowRange.Last, e.BatchIndex, e.Table, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// RowError reports the row of a rejected batch which the destination
+// rejected on its own.
+type RowError struct {
+	Table    string
+	Row      int           //1-based position of the row in the order written
+	Columns  []string      //Destination columns
+	Values   []interface{} //Row values, nil if redacted
+	Types    []ColumnType  //Destination column types, if they could be found
+	Redacted bool          //Values were left out of the error
+	Err      error         //Database error for the row
+}
+
+func (e *RowError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "row %d of %s rejected: %s; values:", e.Row, e.Table, e.Err)
+	for i, c := range e.Columns {
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		v := "<redacted>"
+		if !e.Redacted && i < len(e.Values) {
+			v = formatValue(e.Values[i])
+		}
+		fmt.Fprintf(&b, " %s=%s", c, v)
+
+		if i < len(e.Types) && e.Types[i].DatabaseType != "" {
+			fmt.Fprintf(&b, " (%s)", e.Types[i].DatabaseType)
+		}
+	}
+
+	return b.String()
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// formatValue returns a short printable form of a row value.
+func formatValue(v interface{}) string {
+	var s string
+
+	switch t := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return fmt.Sprintf("<%d bytes>", len(t))
+	case string:
+		s = strconv.Quote(t)
+	default:
+		s = fmt.Sprintf("%v", t)
+	}
+
+	if len(s) > 64 {
+		s = s[:61] + "..."
+	}
+
+	return s
+}
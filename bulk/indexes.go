@@ -0,0 +1,236 @@
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Index is a table's primary key or an index on plain columns.
+type Index struct {
+	Name    string
+	Columns []string //Key columns in index order
+	Unique  bool
+	Primary bool
+}
+
+// ForeignKey is a constraint referencing another table's key.
+type ForeignKey struct {
+	Name       string
+	Columns    []string
+	RefSchema  string
+	RefTable   string
+	RefColumns []string
+	OnUpdate   string //Referential action such as CASCADE, empty for the default
+	OnDelete   string
+}
+
+// Returns the primary key and the indexes on plain columns of a table.
+// Expression and partial indexes are left out as they can't be
+// translated between dialects.
+func Indexes(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (indexes []Index, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case Postgres:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+		q = fmt.Sprintf(`SELECT i.relname, ix.indisunique, ix.indisprimary, a.attname
+FROM pg_index ix
+JOIN pg_class t ON t.oid = ix.indrelid
+JOIN pg_class i ON i.oid = ix.indexrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+CROSS JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord)
+JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+WHERE n.nspname = %s AND t.relname = %s AND ix.indpred IS NULL AND ix.indexprs IS NULL
+ORDER BY i.relname, k.ord`, schemaExpr, d.Placeholder(len(args)))
+	case MySQL:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+		q = fmt.Sprintf(`SELECT index_name, non_unique = 0, index_name = 'PRIMARY', column_name
+FROM information_schema.statistics
+WHERE table_schema = %s AND table_name = %s AND column_name IS NOT NULL
+ORDER BY index_name, seq_in_index`, schemaExpr, d.Placeholder(len(args)))
+	case SQLServer:
+		q = fmt.Sprintf(`SELECT i.name, i.is_unique, i.is_primary_key, c.name
+FROM sys.indexes i
+JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+WHERE i.object_id = OBJECT_ID(%s) AND i.type > 0 AND i.has_filter = 0 AND ic.is_included_column = 0
+ORDER BY i.name, ic.key_ordinal`, d.Placeholder(1))
+		args = []interface{}{d.QualifiedName(schema, tableName)}
+	case SQLite:
+		q = fmt.Sprintf(`SELECT il.name, il."unique", il.origin = 'pk', ii.name
+FROM pragma_index_list(%s) il
+JOIN pragma_index_info(il.name) ii
+WHERE il.partial = 0 AND ii.name IS NOT NULL
+ORDER BY il.name, ii.seqno`, d.Placeholder(1))
+		args = []interface{}{tableName}
+	default:
+		return nil, errors.NotSupportedf("reading indexes for the %s dialect", d.Name)
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var ix Index
+		var column string
+
+		if err = rows.Scan(&ix.Name, &ix.Unique, &ix.Primary, &column); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if n := len(indexes); n > 0 && indexes[n-1].Name == ix.Name {
+			indexes[n-1].Columns = append(indexes[n-1].Columns, column)
+			continue
+		}
+		ix.Columns = []string{column}
+		indexes = append(indexes, ix)
+	}
+
+	return indexes, errors.Trace(rows.Err())
+}
+
+// Returns the foreign keys of a table.
+func ForeignKeys(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (fks []ForeignKey, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case Postgres, SQLServer:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+		q = fmt.Sprintf(`SELECT rc.constraint_name, kcu.column_name, ref.table_schema, ref.table_name, ref.column_name,
+	rc.update_rule, rc.delete_rule
+FROM information_schema.referential_constraints rc
+JOIN information_schema.key_column_usage kcu
+  ON kcu.constraint_schema = rc.constraint_schema AND kcu.constraint_name = rc.constraint_name
+JOIN information_schema.key_column_usage ref
+  ON ref.constraint_schema = rc.unique_constraint_schema AND ref.constraint_name = rc.unique_constraint_name
+ AND ref.ordinal_position = kcu.position_in_unique_constraint
+WHERE kcu.table_schema = %s AND kcu.table_name = %s
+ORDER BY rc.constraint_name, kcu.ordinal_position`, schemaExpr, d.Placeholder(len(args)))
+	case MySQL:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+		q = fmt.Sprintf(`SELECT rc.constraint_name, kcu.column_name, kcu.referenced_table_schema, kcu.referenced_table_name,
+	kcu.referenced_column_name, rc.update_rule, rc.delete_rule
+FROM information_schema.referential_constraints rc
+JOIN information_schema.key_column_usage kcu
+  ON kcu.constraint_schema = rc.constraint_schema AND kcu.constraint_name = rc.constraint_name
+ AND kcu.table_name = rc.table_name
+WHERE kcu.table_schema = %s AND kcu.table_name = %s
+ORDER BY rc.constraint_name, kcu.ordinal_position`, schemaExpr, d.Placeholder(len(args)))
+	case SQLite:
+		q = fmt.Sprintf(`SELECT 'fk_' || id, "from", '', "table", "to", on_update, on_delete
+FROM pragma_foreign_key_list(%s) ORDER BY id, seq`, d.Placeholder(1))
+		args = []interface{}{tableName}
+	default:
+		return nil, errors.NotSupportedf("reading foreign keys for the %s dialect", d.Name)
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var fk ForeignKey
+		var column, refColumn string
+
+		if err = rows.Scan(&fk.Name, &column, &fk.RefSchema, &fk.RefTable, &refColumn, &fk.OnUpdate, &fk.OnDelete); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if n := len(fks); n > 0 && fks[n-1].Name == fk.Name {
+			fks[n-1].Columns = append(fks[n-1].Columns, column)
+			fks[n-1].RefColumns = append(fks[n-1].RefColumns, refColumn)
+			continue
+		}
+		fk.Columns = []string{column}
+		fk.RefColumns = []string{refColumn}
+		fks = append(fks, fk)
+	}
+
+	return fks, errors.Trace(rows.Err())
+}
+
+// Returns the statement creating an index, or adding the primary key, on
+// a table.
+func (d *Dialect) CreateIndexSQL(schema string, table string, ix Index) (q string, err error) {
+	name := d.QualifiedName(schema, table)
+
+	if ix.Primary {
+		if d == SQLite {
+			return "", errors.NotSupportedf("adding a primary key to an existing SQLite table")
+		}
+		return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s PRIMARY KEY (%s)",
+			name, d.QuoteIdent(ix.Name), d.columnList(ix.Columns)), nil
+	}
+
+	unique := ""
+	if ix.Unique {
+		unique = "UNIQUE "
+	}
+
+	// Postgres and SQLite index names belong to the schema
+	ixName := d.QuoteIdent(ix.Name)
+	if d == SQLite && schema != "" {
+		ixName = d.QuoteIdent(schema) + "." + ixName
+	}
+
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique, ixName, name, d.columnList(ix.Columns)), nil
+}
+
+// Returns the statement adding a foreign key to a table.
+func (d *Dialect) AddForeignKeySQL(schema string, table string, fk ForeignKey) (q string, err error) {
+	var buf bytes.Buffer
+
+	if d == SQLite {
+		return "", errors.NotSupportedf("adding a foreign key to an existing SQLite table")
+	}
+
+	fmt.Fprintf(&buf, "ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+		d.QualifiedName(schema, table), d.QuoteIdent(fk.Name), d.columnList(fk.Columns),
+		d.QualifiedName(fk.RefSchema, fk.RefTable), d.columnList(fk.RefColumns))
+
+	for _, a := range []struct{ on, action string }{{"UPDATE", fk.OnUpdate}, {"DELETE", fk.OnDelete}} {
+		action := strings.ToUpper(a.action)
+		switch action {
+		case "CASCADE", "SET NULL", "SET DEFAULT":
+			fmt.Fprintf(&buf, " ON %s %s", a.on, action)
+		case "RESTRICT":
+			// SQL Server only has NO ACTION, which differs from
+			// RESTRICT in when it's checked
+			if d != SQLServer {
+				fmt.Fprintf(&buf, " ON %s %s", a.on, action)
+			}
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// Returns the statement dropping a foreign key constraint.
+func (d *Dialect) DropForeignKeySQL(schema string, table string, name string) (q string, err error) {
+	switch d {
+	case MySQL:
+		return fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", d.QualifiedName(schema, table), d.QuoteIdent(name)), nil
+	case SQLite:
+		return "", errors.NotSupportedf("dropping a foreign key from an existing SQLite table")
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", d.QualifiedName(schema, table), d.QuoteIdent(name)), nil
+}
@@ -0,0 +1,37 @@
+package bulk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// Returns the queries taking and releasing a session lock on name, both
+// taking key, the name shortened to fit if need be, as their argument.
+// The lock query doesn't wait, returning 1 if the lock was taken and 0 if
+// another session holds it.
+func (d *Dialect) LockSQL(name string) (lock string, release string, key string, err error) {
+	switch d {
+	case Postgres:
+		return "SELECT CASE WHEN pg_try_advisory_lock(hashtext($1)) THEN 1 ELSE 0 END",
+			"SELECT pg_advisory_unlock(hashtext($1))", name, nil
+	case MySQL:
+		// Lock names are limited to 64 characters
+		if len(name) > 64 {
+			sum := sha1.Sum([]byte(name))
+			name = hex.EncodeToString(sum[:])
+		}
+		return "SELECT COALESCE(GET_LOCK(?, 0), 0)", "SELECT RELEASE_LOCK(?)", name, nil
+	case SQLServer:
+		if len(name) > 255 {
+			sum := sha1.Sum([]byte(name))
+			name = hex.EncodeToString(sum[:])
+		}
+		return fmt.Sprintf("DECLARE @r int; EXEC @r = sp_getapplock @Resource = %s, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0; SELECT CASE WHEN @r >= 0 THEN 1 ELSE 0 END", d.Placeholder(1)),
+			fmt.Sprintf("EXEC sp_releaseapplock @Resource = %s, @LockOwner = 'Session'", d.Placeholder(1)), name, nil
+	}
+
+	return "", "", "", errors.NotSupportedf("locking on %s", d.Name)
+}
@@ -0,0 +1,38 @@
+package bulk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLockSQL(t *testing.T) {
+	long := "datapipe:" + strings.Repeat("x", 300)
+
+	tests := []struct {
+		d    *Dialect
+		name string
+		key  string
+	}{
+		{Postgres, long, long},
+		{MySQL, "datapipe:`db`.`orders`", "datapipe:`db`.`orders`"},
+		{MySQL, long, "1bef0076ccb1a5f9d88541fd4b31c2f04840ff26"},
+		{SQLServer, "datapipe:[dbo].[orders]", "datapipe:[dbo].[orders]"},
+		{SQLServer, long, "1bef0076ccb1a5f9d88541fd4b31c2f04840ff26"},
+	}
+
+	for _, tt := range tests {
+		lock, release, key, err := tt.d.LockSQL(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lock == "" || release == "" || key != tt.key {
+			t.Errorf("%s LockSQL key = %s, want %s", tt.d.Name, key, tt.key)
+		}
+	}
+
+	for _, d := range []*Dialect{SQLite, Generic} {
+		if _, _, _, err := d.LockSQL("x"); err == nil {
+			t.Errorf("%s LockSQL didn't fail", d.Name)
+		}
+	}
+}
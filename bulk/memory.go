@@ -0,0 +1,87 @@
+package bulk
+
+import (
+	"context"
+	"sync"
+)
+
+// MemorySink is a Writer keeping the rows in memory, for testing
+// pipelines without a destination database. Rows are committed when the
+// sink is flushed and the uncommitted ones are dropped on rollback.
+type MemorySink struct {
+	mu      sync.Mutex
+	columns []string
+	rows    [][]interface{} //Committed rows
+	pending [][]interface{} //Rows appended since the last flush
+}
+
+// Returns an empty memory sink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (m *MemorySink) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The caller reuses values so keep a copy
+	m.pending = append(m.pending, append([]interface{}(nil), values...))
+
+	return nil
+}
+
+func (m *MemorySink) Flush(ctx context.Context) (totalRowCount int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rows = append(m.rows, m.pending...)
+	m.pending = nil
+
+	return len(m.rows), nil
+}
+
+func (m *MemorySink) Rollback() (committedRowCount int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pending = nil
+
+	return len(m.rows), nil
+}
+
+func (m *MemorySink) Close() (err error) {
+	return nil
+}
+
+// Sets the column names returned by Columns. Pipelines set them to the
+// destination columns when the sink is their writer.
+func (m *MemorySink) SetColumns(columns []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.columns = append([]string(nil), columns...)
+}
+
+// Returns the column names of the rows.
+func (m *MemorySink) Columns() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.columns
+}
+
+// Returns the committed rows.
+func (m *MemorySink) Rows() [][]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([][]interface{}(nil), m.rows...)
+}
+
+// Drops all the rows.
+func (m *MemorySink) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rows, m.pending = nil, nil
+}
@@ -0,0 +1,111 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// RangePartition is a partition of a range partitioned table.
+type RangePartition struct {
+	Name    string
+	From    string //Inclusive lower bound, MINVALUE if unbounded, empty for MySQL where it's the previous partition's upper bound
+	To      string //Exclusive upper bound, MAXVALUE if unbounded
+	Default bool   //Postgres default partition, which takes the rows no other partition does
+}
+
+// Postgres partition bounds as given by pg_get_expr.
+var pgRangeBound = regexp.MustCompile(`^FOR VALUES FROM \((.*)\) TO \((.*)\)$`)
+
+// Returns a partitioned table's partition key, such as RANGE (created_at)
+// or MySQL's RANGE COLUMNS (`created_at`), and its partitions in order.
+// A table that isn't partitioned has an empty key.
+func RangePartitions(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (key string, parts []RangePartition, err error) {
+	var q string
+	var args []interface{}
+
+	schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+	args = append(schemaArgs, tableName)
+
+	switch d {
+	case Postgres:
+		q = fmt.Sprintf(`SELECT pg_get_partkeydef(p.oid), c.relname, COALESCE(pg_get_expr(c.relpartbound, c.oid), '')
+FROM pg_class p
+JOIN pg_namespace n ON n.oid = p.relnamespace
+LEFT JOIN pg_inherits i ON i.inhparent = p.oid
+LEFT JOIN pg_class c ON c.oid = i.inhrelid
+WHERE n.nspname = %s AND p.relname = %s AND p.relkind = 'p'
+ORDER BY c.relname`, schemaExpr, d.Placeholder(len(args)))
+	case MySQL:
+		q = fmt.Sprintf(`SELECT CONCAT(partition_method, ' (', partition_expression, ')'), partition_name, COALESCE(partition_description, '')
+FROM information_schema.partitions
+WHERE table_schema = %s AND table_name = %s AND partition_name IS NOT NULL
+ORDER BY partition_ordinal_position`, schemaExpr, d.Placeholder(len(args)))
+	default:
+		return "", nil, errors.NotSupportedf("partitions on %s", d.Name)
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name sql.NullString
+		var bound string
+		if err = rows.Scan(&key, &name, &bound); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		if !name.Valid {
+			continue
+		}
+
+		p := RangePartition{Name: name.String}
+		switch {
+		case d == MySQL:
+			p.To = bound
+		case bound == "DEFAULT":
+			p.Default = true
+		default:
+			m := pgRangeBound.FindStringSubmatch(bound)
+			if m == nil {
+				return "", nil, errors.NotSupportedf("partition %s bounds %s", p.Name, bound)
+			}
+			p.From, p.To = unquoteBound(m[1]), unquoteBound(m[2])
+		}
+		parts = append(parts, p)
+	}
+
+	return key, parts, errors.Trace(rows.Err())
+}
+
+// unquoteBound removes the quotes around a literal partition bound.
+func unquoteBound(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1)
+	}
+
+	return s
+}
+
+// Returns the statement adding a range partition named name to a table.
+// from and to are the bounds as SQL expressions, MySQL only taking the
+// upper bound as its partitions start where the previous one ends.
+func (d *Dialect) AddPartitionSQL(schema string, table string, name string, from string, to string) (q string, err error) {
+	switch d {
+	case Postgres:
+		return fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)",
+			d.QualifiedName(schema, name), d.QualifiedName(schema, table), from, to), nil
+	case MySQL:
+		return fmt.Sprintf("ALTER TABLE %s ADD PARTITION (PARTITION %s VALUES LESS THAN (%s))",
+			d.QualifiedName(schema, table), d.QuoteIdent(name), to), nil
+	}
+
+	return "", errors.NotSupportedf("adding partitions on %s", d.Name)
+}
@@ -0,0 +1,123 @@
+package bulk
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+)
+
+// Formats a 16 byte UUID in its canonical text form.
+func FormatUUID(b []byte) string {
+	var buf [36]byte
+
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:16])
+
+	return string(buf[:])
+}
+
+// pgCopyValue encodes a value for a COPY column so it survives the text
+// format, which would otherwise send []byte as bytea and stringify
+// slices and maps in Go syntax.
+func pgCopyValue(v interface{}, t ColumnType) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch strings.ToLower(t.DatabaseType) {
+	case "bytea":
+		if s, ok := v.(string); ok {
+			return []byte(s), nil
+		}
+		return v, nil
+
+	case "json", "jsonb":
+		switch s := v.(type) {
+		case []byte:
+			if !json.Valid(s) {
+				return nil, errors.Errorf("invalid %s value for column %s", t.DatabaseType, t.Name)
+			}
+			return string(s), nil
+		case string:
+			if !json.Valid([]byte(s)) {
+				return nil, errors.Errorf("invalid %s value for column %s", t.DatabaseType, t.Name)
+			}
+			return s, nil
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Annotatef(err, "column %s", t.Name)
+		}
+		return string(b), nil
+
+	case "uuid":
+		if b, ok := v.([]byte); ok {
+			if len(b) == 16 {
+				return FormatUUID(b), nil
+			}
+			return string(b), nil
+		}
+		return v, nil
+
+	case "array":
+		return pgArrayValue(v, t)
+
+	case "user-defined":
+		// Enums and other user types are sent in their text form
+		if b, ok := v.([]byte); ok {
+			return string(b), nil
+		}
+		if _, ok := v.(string); !ok {
+			return fmt.Sprint(v), nil
+		}
+		return v, nil
+	}
+
+	if b, ok := v.([]byte); ok {
+		return string(b), nil
+	}
+
+	return v, nil
+}
+
+// pgArrayValue encodes Go slices and JSON arrays as Postgres array
+// literals. Text which is already an array literal is passed through.
+func pgArrayValue(v interface{}, t ColumnType) (interface{}, error) {
+	var s string
+
+	switch a := v.(type) {
+	case []byte:
+		s = string(a)
+	case string:
+		s = a
+	default:
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, errors.Errorf("can't write %T to array column %s", v, t.Name)
+		}
+		return pq.Array(v).Value()
+	}
+
+	// JSON arrays, as produced by MySQL and SQL Server, become array literals
+	if trimmed := strings.TrimSpace(s); strings.HasPrefix(trimmed, "[") {
+		var elems []interface{}
+		if err := json.Unmarshal([]byte(trimmed), &elems); err != nil {
+			return nil, errors.Annotatef(err, "column %s", t.Name)
+		}
+		return pq.Array(elems).Value()
+	}
+
+	return s, nil
+}
@@ -0,0 +1,68 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Factory creates a Writer for a destination table.
+type Factory func(ctx context.Context, conn *sql.Conn, opts Options) (w Writer, err error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+func init() {
+	Register("postgres", newCopyInWriter)
+}
+
+// Registers a writer factory for a destination driver name, replacing
+// any factory previously registered for that driver.
+func Register(driver string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		delete(factories, driver)
+		return
+	}
+
+	factories[driver] = factory
+}
+
+// Returns the writer factory registered for a driver name, falling back
+// to the generic Bulk insert writer.
+func Lookup(driver string) Factory {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	if factory, ok := factories[driver]; ok {
+		return factory
+	}
+
+	return newBulkWriter
+}
+
+func newBulkWriter(ctx context.Context, conn *sql.Conn, opts Options) (w Writer, err error) {
+	var r *Bulk
+
+	if r, err = newBulk(ctx, conn, opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return r, nil
+}
+
+func newCopyInWriter(ctx context.Context, conn *sql.Conn, opts Options) (w Writer, err error) {
+	var r *CopyIn
+
+	if r, err = newCopyIn(ctx, conn, opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,294 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ColumnType describes a source or destination column.
+type ColumnType struct {
+	Name         string
+	DatabaseType string //Database type name, e.g. "varchar" or "NUMERIC"
+	Length       int64  //Maximum length of variable length types, 0 if unknown
+	Precision    int64  //Precision of decimal types, 0 if unknown
+	Scale        int64  //Scale of decimal types
+	Nullable     bool
+}
+
+// TypeFamily groups database types which hold the same kind of value.
+type TypeFamily int
+
+const (
+	FamilyUnknown TypeFamily = iota
+	FamilyString
+	FamilyInt
+	FamilyDecimal
+	FamilyFloat
+	FamilyBool
+	FamilyDate
+	FamilyTime
+	FamilyBinary
+	FamilyJSON
+	FamilyUUID
+	FamilyGeometry
+)
+
+// Returns the family of a database type name.
+func Family(typeName string) TypeFamily {
+	t := strings.ToLower(strings.TrimSpace(typeName))
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = t[:i]
+	}
+	t = strings.TrimSuffix(strings.TrimPrefix(t, "unsigned "), " unsigned")
+
+	switch t {
+	case "char", "character", "varchar", "character varying", "nchar", "nvarchar",
+		"text", "ntext", "tinytext", "mediumtext", "longtext", "citext", "name",
+		"string", "bpchar", "enum", "set", "xml", "sysname":
+		return FamilyString
+	case "int", "integer", "int2", "int4", "int8", "smallint", "bigint", "tinyint",
+		"mediumint", "serial", "bigserial", "smallserial", "year":
+		return FamilyInt
+	case "numeric", "decimal", "money", "smallmoney", "number":
+		return FamilyDecimal
+	case "float", "float4", "float8", "real", "double", "double precision":
+		return FamilyFloat
+	case "bool", "boolean", "bit":
+		return FamilyBool
+	case "date":
+		return FamilyDate
+	case "time", "timetz", "timestamp", "timestamptz", "datetime", "datetime2",
+		"smalldatetime", "datetimeoffset", "timestamp without time zone",
+		"timestamp with time zone", "time without time zone", "time with time zone":
+		return FamilyTime
+	case "bytea", "binary", "varbinary", "blob", "tinyblob", "mediumblob",
+		"longblob", "image", "bit varying", "varbit":
+		return FamilyBinary
+	case "json", "jsonb":
+		return FamilyJSON
+	case "uuid", "uniqueidentifier":
+		return FamilyUUID
+	case "geometry", "geography", "point", "linestring", "polygon", "multipoint",
+		"multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+		return FamilyGeometry
+	}
+
+	return FamilyUnknown
+}
+
+// Returns the destination column types for the columns in the same
+// order. Columns which can't be found have an empty DatabaseType.
+func DestColumnTypes(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string, columns []string) (types []ColumnType, err error) {
+	var all []ColumnType
+
+	if all, err = TableColumns(ctx, conn, d, schema, tableName); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	types = make([]ColumnType, len(columns))
+	for i, c := range columns {
+		types[i].Name = c
+	}
+
+	for _, ct := range all {
+		for i := range columns {
+			if strings.EqualFold(ct.Name, columns[i]) {
+				ct.Name = columns[i]
+				types[i] = ct
+			}
+		}
+	}
+
+	return types, nil
+}
+
+// Returns the columns with each name spelt as the destination table's
+// column it matches case-insensitively, so quoting them doesn't change
+// which column they refer to. Names without a match are unchanged.
+func ResolveColumns(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string, columns []string) (resolved []string, err error) {
+	var all []ColumnType
+
+	if d == Generic {
+		return columns, nil
+	}
+
+	if all, err = TableColumns(ctx, conn, d, schema, tableName); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resolved = make([]string, len(columns))
+	for i, c := range columns {
+		resolved[i] = c
+
+		match := ""
+		matches := 0
+		for _, ct := range all {
+			if ct.Name == c {
+				matches = 0
+				break
+			}
+			if strings.EqualFold(ct.Name, c) {
+				match = ct.Name
+				matches++
+			}
+		}
+
+		// Leave ambiguous names for the database to reject
+		if matches == 1 {
+			resolved[i] = match
+		}
+	}
+
+	return resolved, nil
+}
+
+// Returns the columns of a destination table in table order, or none if
+// the table doesn't exist.
+func TableColumns(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (types []ColumnType, err error) {
+	var rows *sql.Rows
+
+	switch d {
+	case SQLite:
+		q := fmt.Sprintf(`SELECT name, type, CASE WHEN "notnull" = 0 THEN 1 ELSE 0 END FROM pragma_table_info(%s) ORDER BY cid`, d.Placeholder(1))
+		rows, err = conn.QueryContext(ctx, q, tableName)
+	default:
+		schemaExpr, args := d.schemaFilter(schema, 1)
+		args = append(args, tableName)
+
+		q := fmt.Sprintf(`SELECT column_name, data_type, CASE WHEN is_nullable = 'YES' THEN 1 ELSE 0 END,
+			COALESCE(character_maximum_length, 0), COALESCE(numeric_precision, 0), COALESCE(numeric_scale, 0)
+			FROM information_schema.columns WHERE table_schema = %s AND table_name = %s
+			ORDER BY ordinal_position`,
+			schemaExpr, d.Placeholder(len(args)))
+		rows, err = conn.QueryContext(ctx, q, args...)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var ct ColumnType
+
+		if d == SQLite {
+			err = rows.Scan(&ct.Name, &ct.DatabaseType, &ct.Nullable)
+		} else {
+			err = rows.Scan(&ct.Name, &ct.DatabaseType, &ct.Nullable, &ct.Length, &ct.Precision, &ct.Scale)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		types = append(types, ct)
+	}
+
+	return types, errors.Trace(rows.Err())
+}
+
+// Table is a table or view found in a database's catalog.
+type Table struct {
+	Schema string
+	Name   string
+	View   bool //Table is a view or materialized view
+}
+
+// Returns the tables in a schema, the session's default if empty, and
+// their views and materialized views if views is set.
+func Tables(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, views bool) (tables []Table, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case Postgres:
+		kinds := "'r', 'p'"
+		if views {
+			kinds += ", 'v', 'm'"
+		}
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = schemaArgs
+		q = fmt.Sprintf(`SELECT n.nspname, c.relname, c.relkind IN ('v', 'm')
+FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = %s AND c.relkind IN (%s) ORDER BY c.relname`, schemaExpr, kinds)
+	case SQLite:
+		types := "'table'"
+		if views {
+			types += ", 'view'"
+		}
+		q = fmt.Sprintf(`SELECT '', name, type = 'view' FROM sqlite_master
+WHERE type IN (%s) AND name NOT LIKE 'sqlite_%%' ORDER BY name`, types)
+	default:
+		types := "'BASE TABLE'"
+		if views {
+			types += ", 'VIEW'"
+		}
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = schemaArgs
+		q = fmt.Sprintf(`SELECT table_schema, table_name, CASE WHEN table_type = 'VIEW' THEN 1 ELSE 0 END
+FROM information_schema.tables WHERE table_schema = %s AND table_type IN (%s) ORDER BY table_name`, schemaExpr, types)
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Table
+		if err = rows.Scan(&t.Schema, &t.Name, &t.View); err != nil {
+			return nil, errors.Trace(err)
+		}
+		tables = append(tables, t)
+	}
+
+	return tables, errors.Trace(rows.Err())
+}
+
+// Returns the names of the identity or auto-increment columns of a
+// destination table.
+func IdentityColumns(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (columns []string, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case SQLServer:
+		q = fmt.Sprintf("SELECT name FROM sys.columns WHERE object_id = OBJECT_ID(%s) AND is_identity = 1", d.Placeholder(1))
+		args = []interface{}{d.QualifiedName(schema, tableName)}
+	case Postgres, MySQL:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+
+		cond := "(is_identity = 'YES' OR column_default LIKE 'nextval(%')"
+		if d == MySQL {
+			cond = "extra LIKE '%auto_increment%'"
+		}
+
+		q = fmt.Sprintf("SELECT column_name FROM information_schema.columns WHERE table_schema = %s AND table_name = %s AND %s",
+			schemaExpr, d.Placeholder(len(args)), cond)
+	default:
+		return nil, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, errors.Trace(rows.Err())
+}
@@ -0,0 +1,119 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// catalogDriver is a database/sql driver answering every query with the
+// columns of one table, as an information_schema.columns query would.
+type catalogDriver struct {
+	columns []string
+}
+
+func (d *catalogDriver) Open(name string) (driver.Conn, error) { return &catalogConn{d}, nil }
+
+type catalogConn struct{ d *catalogDriver }
+
+func (c *catalogConn) Prepare(query string) (driver.Stmt, error) { return &catalogStmt{c.d}, nil }
+func (c *catalogConn) Close() error                              { return nil }
+func (c *catalogConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type catalogStmt struct{ d *catalogDriver }
+
+func (s *catalogStmt) Close() error                                    { return nil }
+func (s *catalogStmt) NumInput() int                                   { return -1 }
+func (s *catalogStmt) Exec(args []driver.Value) (driver.Result, error) { return nil, driver.ErrSkip }
+func (s *catalogStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &catalogRows{columns: s.d.columns}, nil
+}
+
+type catalogRows struct {
+	columns []string
+	pos     int
+}
+
+func (r *catalogRows) Columns() []string {
+	return []string{"column_name", "data_type", "nullable", "length", "precision", "scale"}
+}
+func (r *catalogRows) Close() error { return nil }
+func (r *catalogRows) Next(dest []driver.Value) error {
+	if r.pos == len(r.columns) {
+		return io.EOF
+	}
+	dest[0], dest[1], dest[2], dest[3], dest[4], dest[5] = r.columns[r.pos], "text", int64(1), int64(0), int64(0), int64(0)
+	r.pos++
+	return nil
+}
+
+func TestResolveColumns(t *testing.T) {
+	sql.Register("bulk_catalog", &catalogDriver{columns: []string{"id", "OrderDate", "order date", "User", "Total", "total"}})
+	db, err := sql.Open("bulk_catalog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	columns := []string{"ID", "orderdate", "ORDER DATE", "user", "TOTAL", "total", "missing"}
+	tests := []struct {
+		d    *Dialect
+		want []string
+	}{
+		// Ambiguous and missing names are left for the database to reject
+		{Postgres, []string{"id", "OrderDate", "order date", "User", "TOTAL", "total", "missing"}},
+		{SQLServer, []string{"id", "OrderDate", "order date", "User", "TOTAL", "total", "missing"}},
+		{Generic, columns},
+	}
+
+	for _, tt := range tests {
+		got, err := ResolveColumns(ctx, conn, tt.d, "sales", "orders", columns)
+		if err != nil {
+			t.Fatalf("%s ResolveColumns: %v", tt.d.Name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s ResolveColumns = %q, want %q", tt.d.Name, got, tt.want)
+		}
+	}
+}
+
+func TestFamily(t *testing.T) {
+	tests := []struct {
+		typeName string
+		want     TypeFamily
+	}{
+		{"VARCHAR(255)", FamilyString},
+		{"character varying", FamilyString},
+		{" nvarchar(max) ", FamilyString},
+		{"int unsigned", FamilyInt},
+		{"UNSIGNED BIGINT", FamilyInt},
+		{"numeric(12,2)", FamilyDecimal},
+		{"double precision", FamilyFloat},
+		{"bit", FamilyBool},
+		{"date", FamilyDate},
+		{"timestamp(6) with time zone", FamilyTime},
+		{"datetime2(7)", FamilyTime},
+		{"varbinary(16)", FamilyBinary},
+		{"jsonb", FamilyJSON},
+		{"uniqueidentifier", FamilyUUID},
+		{"geography", FamilyGeometry},
+		{"interval", FamilyUnknown},
+		{"", FamilyUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := Family(tt.typeName); got != tt.want {
+			t.Errorf("Family(%q) = %v, want %v", tt.typeName, got, tt.want)
+		}
+	}
+}
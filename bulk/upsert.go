@@ -0,0 +1,391 @@
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// Returns a statement inserting a row of values for the columns, or
+// updating the existing row with the same key column values.
+func (d *Dialect) UpsertSQL(schema string, table string, columns []string, keys []string) (q string, err error) {
+	var buf bytes.Buffer
+
+	if len(keys) == 0 {
+		return "", errors.NotValidf("upsert into %s without key columns", table)
+	}
+
+	name := d.QualifiedName(schema, table)
+	update := nonKeyColumns(columns, keys)
+
+	if d == SQLServer {
+		fmt.Fprintf(&buf, "MERGE INTO %s AS tgt USING (SELECT ", name)
+		for i, c := range columns {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s AS %s", d.Placeholder(i+1), d.QuoteIdent(c))
+		}
+		buf.WriteString(") AS src ON ")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(" AND ")
+			}
+			fmt.Fprintf(&buf, "tgt.%s = src.%s", d.QuoteIdent(k), d.QuoteIdent(k))
+		}
+		if len(update) > 0 {
+			buf.WriteString(" WHEN MATCHED THEN UPDATE SET ")
+			for i, c := range update {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(&buf, "%s = src.%s", d.QuoteIdent(c), d.QuoteIdent(c))
+			}
+		}
+		fmt.Fprintf(&buf, " WHEN NOT MATCHED THEN INSERT (%s) VALUES (", d.columnList(columns))
+		for i, c := range columns {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "src.%s", d.QuoteIdent(c))
+		}
+		buf.WriteString(");")
+
+		return buf.String(), nil
+	}
+
+	fmt.Fprintf(&buf, "INSERT INTO %s (%s) VALUES (", name, d.columnList(columns))
+	for i := range columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.Placeholder(i + 1))
+	}
+	buf.WriteString(")")
+
+	switch d {
+	case Postgres, SQLite:
+		fmt.Fprintf(&buf, " ON CONFLICT (%s) DO ", d.columnList(keys))
+		if len(update) == 0 {
+			buf.WriteString("NOTHING")
+		} else {
+			buf.WriteString("UPDATE SET ")
+			for i, c := range update {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(&buf, "%s = EXCLUDED.%s", d.QuoteIdent(c), d.QuoteIdent(c))
+			}
+		}
+	case MySQL:
+		// Updating a key to itself keeps the statement valid without
+		// any other columns.
+		if len(update) == 0 {
+			update = keys[:1]
+		}
+		buf.WriteString(" ON DUPLICATE KEY UPDATE ")
+		for i, c := range update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s = VALUES(%s)", d.QuoteIdent(c), d.QuoteIdent(c))
+		}
+	default:
+		return "", errors.NotSupportedf("upserts for the %s dialect", d.Name)
+	}
+
+	return buf.String(), nil
+}
+
+// Returns a statement deleting the row matching the key column values.
+func (d *Dialect) DeleteSQL(schema string, table string, keys []string) (q string, err error) {
+	var buf bytes.Buffer
+
+	if len(keys) == 0 {
+		return "", errors.NotValidf("delete from %s without key columns", table)
+	}
+
+	fmt.Fprintf(&buf, "DELETE FROM %s WHERE ", d.QualifiedName(schema, table))
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(" AND ")
+		}
+		fmt.Fprintf(&buf, "%s = %s", d.QuoteIdent(k), d.Placeholder(i+1))
+	}
+
+	return buf.String(), nil
+}
+
+// columnList returns the quoted, comma separated column names.
+func (d *Dialect) columnList(columns []string) string {
+	var buf bytes.Buffer
+
+	for i, c := range columns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.QuoteIdent(c))
+	}
+
+	return buf.String()
+}
+
+// nonKeyColumns returns the columns which aren't key columns.
+func nonKeyColumns(columns []string, keys []string) (cols []string) {
+	isKey := map[string]bool{}
+	for _, k := range keys {
+		isKey[k] = true
+	}
+
+	for _, c := range columns {
+		if !isKey[c] {
+			cols = append(cols, c)
+		}
+	}
+
+	return cols
+}
+
+// Returns the primary key columns of a destination table in key order.
+func KeyColumns(ctx context.Context, conn *sql.Conn, d *Dialect, schema string, tableName string) (columns []string, err error) {
+	var q string
+	var args []interface{}
+
+	switch d {
+	case SQLite:
+		q = fmt.Sprintf("SELECT name FROM pragma_table_info(%s) WHERE pk > 0 ORDER BY pk", d.Placeholder(1))
+		args = []interface{}{tableName}
+	case Postgres, MySQL, SQLServer:
+		schemaExpr, schemaArgs := d.schemaFilter(schema, 1)
+		args = append(schemaArgs, tableName)
+
+		q = fmt.Sprintf(`SELECT kcu.column_name
+FROM information_schema.table_constraints tc
+JOIN information_schema.key_column_usage kcu
+  ON kcu.constraint_name = tc.constraint_name
+ AND kcu.table_schema = tc.table_schema
+ AND kcu.table_name = tc.table_name
+WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = %s AND tc.table_name = %s
+ORDER BY kcu.ordinal_position`, schemaExpr, d.Placeholder(len(args)))
+	default:
+		return nil, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, errors.Trace(rows.Err())
+}
+
+// Returns the statements creating an empty temporary staging table with
+// the columns of a table, dropping any earlier one first. The staging
+// table's name is qualified by QualifiedName with an empty schema.
+func (d *Dialect) CreateStageSQL(schema string, table string, stage string) (qs []string, err error) {
+	name := d.QualifiedName(schema, table)
+	stageName := d.QualifiedName("", stage)
+
+	switch d {
+	case Postgres:
+		return []string{
+			"DROP TABLE IF EXISTS " + stageName,
+			fmt.Sprintf("CREATE TEMPORARY TABLE %s AS SELECT * FROM %s WHERE false", stageName, name)}, nil
+	case SQLite:
+		return []string{
+			"DROP TABLE IF EXISTS temp." + stageName,
+			fmt.Sprintf("CREATE TEMPORARY TABLE %s AS SELECT * FROM %s WHERE 0", stageName, name)}, nil
+	case MySQL:
+		return []string{
+			"DROP TEMPORARY TABLE IF EXISTS " + stageName,
+			fmt.Sprintf("CREATE TEMPORARY TABLE %s AS SELECT * FROM %s WHERE 1 = 0", stageName, name)}, nil
+	case SQLServer:
+		// The UNION stops SELECT INTO copying identity columns
+		return []string{
+			fmt.Sprintf("IF OBJECT_ID('tempdb..%s') IS NOT NULL DROP TABLE %s", stage, stageName),
+			fmt.Sprintf("SELECT * INTO %s FROM (SELECT * FROM %s WHERE 1 = 0 UNION ALL SELECT * FROM %s WHERE 1 = 0) AS x",
+				stageName, name, name)}, nil
+	}
+
+	return nil, errors.NotSupportedf("staging tables for the %s dialect", d.Name)
+}
+
+// Returns a statement upserting every row of the staging table into the
+// table on the key columns.
+func (d *Dialect) MergeSQL(schema string, table string, stage string, columns []string, keys []string) (q string, err error) {
+	var buf bytes.Buffer
+
+	if len(keys) == 0 {
+		return "", errors.NotValidf("merge into %s without key columns", table)
+	}
+
+	name := d.QualifiedName(schema, table)
+	stageName := d.QualifiedName("", stage)
+	cols := d.columnList(columns)
+	update := nonKeyColumns(columns, keys)
+
+	switch d {
+	case Postgres, SQLite:
+		// The WHERE stops SQLite reading ON CONFLICT as a join constraint
+		fmt.Fprintf(&buf, "INSERT INTO %s (%s) SELECT %s FROM %s WHERE true ON CONFLICT (%s) DO ",
+			name, cols, cols, stageName, d.columnList(keys))
+		if len(update) == 0 {
+			buf.WriteString("NOTHING")
+			break
+		}
+		buf.WriteString("UPDATE SET ")
+		for i, c := range update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s = EXCLUDED.%s", d.QuoteIdent(c), d.QuoteIdent(c))
+		}
+	case MySQL:
+		if len(update) == 0 {
+			update = keys[:1]
+		}
+		fmt.Fprintf(&buf, "INSERT INTO %s (%s) SELECT %s FROM %s ON DUPLICATE KEY UPDATE ", name, cols, cols, stageName)
+		for i, c := range update {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%s = VALUES(%s)", d.QuoteIdent(c), d.QuoteIdent(c))
+		}
+	case SQLServer:
+		fmt.Fprintf(&buf, "MERGE INTO %s AS tgt USING %s AS src ON %s", name, stageName, d.keyJoin("tgt", "src", keys))
+		if len(update) > 0 {
+			buf.WriteString(" WHEN MATCHED THEN UPDATE SET ")
+			for i, c := range update {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(&buf, "%s = src.%s", d.QuoteIdent(c), d.QuoteIdent(c))
+			}
+		}
+		fmt.Fprintf(&buf, " WHEN NOT MATCHED THEN INSERT (%s) VALUES (", cols)
+		for i, c := range columns {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "src.%s", d.QuoteIdent(c))
+		}
+		buf.WriteString(");")
+	default:
+		return "", errors.NotSupportedf("merges for the %s dialect", d.Name)
+	}
+
+	return buf.String(), nil
+}
+
+// Returns a statement deleting the rows of the table whose keys aren't in
+// the staging table.
+func (d *Dialect) AntiJoinDeleteSQL(schema string, table string, stage string, keys []string) (q string, err error) {
+	if len(keys) == 0 {
+		return "", errors.NotValidf("delete from %s without key columns", table)
+	}
+
+	name := d.QualifiedName(schema, table)
+
+	return fmt.Sprintf("DELETE FROM %s WHERE NOT EXISTS (SELECT 1 FROM %s src WHERE %s)",
+		name, d.QualifiedName("", stage), d.keyJoin(name, "src", keys)), nil
+}
+
+// keyJoin returns the condition matching the key columns of two tables.
+func (d *Dialect) keyJoin(left string, right string, keys []string) string {
+	var buf bytes.Buffer
+
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(" AND ")
+		}
+		fmt.Fprintf(&buf, "%s.%s = %s.%s", left, d.QuoteIdent(k), right, d.QuoteIdent(k))
+	}
+
+	return buf.String()
+}
+
+// SCD2Columns names the columns of a type 2 slowly changing dimension
+// which record each version's lifetime.
+type SCD2Columns struct {
+	From    string //When the version became current
+	To      string //When the version was replaced, NULL while it's current
+	Current string //Whether the version is current
+}
+
+// Returns the statements applying a staging table to a type 2 slowly
+// changing dimension on the key columns. The first end-dates the current
+// versions whose compare columns differ from the staged row's, the second
+// inserts a current version of the staged rows without one, which are
+// the new and changed rows. Both take the time of the change as their
+// only parameter.
+func (d *Dialect) SCD2SQL(schema string, table string, stage string, columns []string, keys []string, compare []string, scd SCD2Columns) (end string, insert string, err error) {
+	var changed bytes.Buffer
+	var values bytes.Buffer
+
+	if len(keys) == 0 {
+		return "", "", errors.NotValidf("versioning %s without key columns", table)
+	}
+
+	name := d.QualifiedName(schema, table)
+	stageName := d.QualifiedName("", stage)
+	current := fmt.Sprintf("%s.%s = %s", name, d.QuoteIdent(scd.Current), d.boolLiteral(true))
+
+	at := d.Placeholder(1)
+	if d == Postgres {
+		at = fmt.Sprintf("CAST(%s AS timestamptz)", at)
+	}
+
+	// Values differ if either is NULL and the other isn't
+	for i, c := range compare {
+		if i > 0 {
+			changed.WriteString(" OR ")
+		}
+		fmt.Fprintf(&changed, "%[1]s.%[2]s <> src.%[2]s OR (%[1]s.%[2]s IS NULL AND src.%[2]s IS NOT NULL) OR (%[1]s.%[2]s IS NOT NULL AND src.%[2]s IS NULL)",
+			name, d.QuoteIdent(c))
+	}
+	if changed.Len() == 0 {
+		changed.WriteString("1 = 0")
+	}
+
+	end = fmt.Sprintf("UPDATE %s SET %s = %s, %s = %s WHERE %s AND EXISTS (SELECT 1 FROM %s src WHERE %s AND (%s))",
+		name, d.QuoteIdent(scd.To), at, d.QuoteIdent(scd.Current), d.boolLiteral(false),
+		current, stageName, d.keyJoin(name, "src", keys), changed.String())
+
+	for _, c := range columns {
+		fmt.Fprintf(&values, "src.%s, ", d.QuoteIdent(c))
+	}
+	insert = fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) SELECT %s%s, NULL, %s FROM %s src WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s AND %s)",
+		name, d.columnList(columns), d.QuoteIdent(scd.From), d.QuoteIdent(scd.To), d.QuoteIdent(scd.Current),
+		values.String(), at, d.boolLiteral(true), stageName, name, d.keyJoin(name, "src", keys), current)
+
+	return end, insert, nil
+}
+
+// boolLiteral returns the literal of a boolean, 1 or 0 where there's no
+// boolean type.
+func (d *Dialect) boolLiteral(b bool) string {
+	switch {
+	case d == SQLServer || d == SQLite:
+		if b {
+			return "1"
+		}
+		return "0"
+	case b:
+		return "TRUE"
+	}
+
+	return "FALSE"
+}
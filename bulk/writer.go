@@ -0,0 +1,129 @@
+package bulk
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Writer writes rows to a destination table. Values passed to
+// AppendValues are in Options.Columns order and may be reused by the
+// caller once AppendValues returns.
+type Writer interface {
+	AppendValues(ctx context.Context, values []interface{}) (err error)
+	Flush(ctx context.Context) (totalRowCount int, err error)
+	Rollback() (committedRowCount int, err error)
+	Close() (err error)
+}
+
+// Options configures a destination writer. Writers ignore the options
+// which don't apply to them.
+type Options struct {
+	Driver string //Destination database driver name, used to pick the writer
+
+	Schema  string   //Destination schema name
+	Table   string   //Destination table name
+	Columns []string //Destination column names in source order
+
+	MaxRowBufSz    int //Maximum number of rows to buffer at a time
+	MaxRowTxCommit int //Maximum number of rows to process before committing the database transaction
+
+	LargeValueSz int //Size in bytes at which a row is written on its own, 0 to disable
+	MaxBufBytes  int //Maximum number of string and []byte value bytes to buffer, 0 for no limit
+
+	MaxBatchBytes int //Maximum estimated size of a batch's values, written when either it or MaxRowBufSz is reached, 0 for no limit
+
+	BatchRetries      int  //Times a failed batch is retried from a savepoint before giving up
+	SkipFailedBatches bool //Roll back to a savepoint and carry on when a batch fails
+
+	DiagnoseErrors    bool //Retry a failed batch row by row to report the rejected row
+	RedactErrorValues bool //Leave row values out of errors
+
+	OnBatch func(t BatchTiming) //Called after each batch is written and each commit, if set
+}
+
+// SkipCounter is implemented by writers which can skip failed batches.
+type SkipCounter interface {
+	// Returns the number of rows skipped in failed batches.
+	SkippedRowCount() int
+}
+
+// BatchTiming is the time taken to write or commit one batch.
+type BatchTiming struct {
+	Rows    int           //Rows written, or committed
+	Elapsed time.Duration //Time taken
+	Commit  bool          //Timing is of a commit rather than a batch write
+}
+
+// Timings totals the time a writer spent writing batches and committing.
+type Timings struct {
+	Batches      int           //Number of batches written
+	BatchTime    time.Duration //Time spent writing batches
+	MaxBatchTime time.Duration //Longest batch write
+	Commits      int           //Number of commits
+	CommitTime   time.Duration //Time spent committing
+}
+
+// Adds a batch or commit timing to the totals.
+func (t *Timings) Add(bt BatchTiming) {
+	if bt.Commit {
+		t.Commits++
+		t.CommitTime += bt.Elapsed
+		return
+	}
+
+	t.Batches++
+	t.BatchTime += bt.Elapsed
+	if bt.Elapsed > t.MaxBatchTime {
+		t.MaxBatchTime = bt.Elapsed
+	}
+}
+
+// Merges the totals of another writer.
+func (t *Timings) Merge(o Timings) {
+	t.Batches += o.Batches
+	t.BatchTime += o.BatchTime
+	if o.MaxBatchTime > t.MaxBatchTime {
+		t.MaxBatchTime = o.MaxBatchTime
+	}
+	t.Commits += o.Commits
+	t.CommitTime += o.CommitTime
+}
+
+// Timer is implemented by writers which time their batches and commits.
+type Timer interface {
+	// Returns the batch and commit times so far.
+	Timings() Timings
+}
+
+// batchTimer records a writer's batch and commit times.
+type batchTimer struct {
+	timings Timings
+	onBatch func(t BatchTiming)
+}
+
+func (b *batchTimer) Timings() Timings {
+	return b.timings
+}
+
+// record adds the time since start to the totals and reports it.
+func (b *batchTimer) record(start time.Time, rows int, commit bool) {
+	t := BatchTiming{Rows: rows, Elapsed: time.Since(start), Commit: commit}
+
+	b.timings.Add(t)
+	if b.onBatch != nil {
+		b.onBatch(t)
+	}
+}
+
+// Creates the writer registered for opts.Driver, falling back to the
+// generic Bulk insert writer.
+func NewWriter(ctx context.Context, conn *sql.Conn, opts Options) (w Writer, err error) {
+	if w, err = Lookup(opts.Driver)(ctx, conn, opts); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return w, nil
+}
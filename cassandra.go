@@ -0,0 +1,377 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/tls"
+	"math/big"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/juju/errors"
+	"gopkg.in/inf.v0"
+)
+
+// Batches sent at once.
+const cqlMaxInFlight = 128
+
+// Times a batch which timed out or found replicas unavailable is retried.
+const cqlRetries = 5
+
+// cassandraDriver writes to Apache Cassandra and ScyllaDB with gocql. URIs
+// are cassandra://[user:password@]host[,host...][:port]/keyspace, with
+// optional query parameters: consistency, local_quorum by default, batch,
+// the most rows of a partition in each unlogged batch, 100 by default, and
+// sslmode, sslrootcert, sslcert and sslkey as for Postgres. The password
+// can be a secret reference.
+type cassandraDriver struct{}
+
+func (cassandraDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from Cassandra")
+}
+
+func (cassandraDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c := &cassandraWriter{batchRows: 100}
+	c.keyspace, c.table, _ = strings.Cut(table, ".")
+	if c.table == "" {
+		c.keyspace, c.table = strings.Trim(u.Path, "/"), table
+	}
+	if c.keyspace == "" {
+		return nil, errors.NotValidf("Cassandra table %q without a keyspace", table)
+	}
+
+	var hosts []string
+	port := 9042
+	for _, host := range strings.Split(u.Host, ",") {
+		if h, p, serr := net.SplitHostPort(host); serr == nil {
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, errors.NotValidf("Cassandra port %q", p)
+			}
+			host = h
+		}
+		hosts = append(hosts, host)
+	}
+
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Port = port
+	cluster.Keyspace = c.keyspace
+	cluster.ProtoVersion = 4
+	cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{NumRetries: cqlRetries, Min: 100 * time.Millisecond, Max: 5 * time.Second}
+
+	q := u.Query()
+	consistency := q.Get("consistency")
+	if consistency == "" {
+		consistency = "local_quorum"
+	}
+	if cluster.Consistency, err = gocql.ParseConsistencyWrapper(consistency); err != nil {
+		return nil, errors.NotValidf("Cassandra consistency %q", consistency)
+	}
+	if n := q.Get("batch"); n != "" {
+		if c.batchRows, err = strconv.Atoi(n); err != nil || c.batchRows <= 0 {
+			return nil, errors.NotValidf("Cassandra batch %q", n)
+		}
+	}
+	if cluster.SslOpts, err = cqlSSLOptions(q); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if u.User != nil {
+		auth := gocql.PasswordAuthenticator{Username: u.User.Username()}
+		p, _ := u.User.Password()
+		if auth.Password, err = ResolveSecret(ctx, p); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cluster.Authenticator = auth
+	}
+
+	if c.session, err = cluster.CreateSession(); err != nil {
+		return nil, errors.Annotatef(err, "connecting to Cassandra")
+	}
+
+	return c, nil
+}
+
+// cqlSSLOptions returns the TLS options of the URI's sslmode, sslrootcert,
+// sslcert and sslkey parameters, or nil if it's disabled. verify-ca and
+// verify-full both check the host name.
+func cqlSSLOptions(q url.Values) (opts *gocql.SslOptions, err error) {
+	mode := q.Get("sslmode")
+	switch mode {
+	case "", "disable":
+		if q.Get("sslrootcert") == "" && q.Get("sslcert") == "" {
+			return nil, nil
+		}
+		if mode == "disable" {
+			return nil, errors.NotValidf("Cassandra TLS certificates with sslmode disable")
+		}
+		mode = "verify-full"
+	case "require", "verify-ca", "verify-full":
+	default:
+		return nil, errors.NotValidf("Cassandra sslmode %q", mode)
+	}
+
+	return &gocql.SslOptions{
+		Config:                 &tls.Config{MinVersion: tls.VersionTLS12},
+		CaPath:                 q.Get("sslrootcert"),
+		CertPath:               q.Get("sslcert"),
+		KeyPath:                q.Get("sslkey"),
+		EnableHostVerification: mode != "require"}, nil
+}
+
+// cassandraWriter inserts record batches' rows with a prepared statement,
+// in unlogged batches of rows of the same partition, many at a time.
+type cassandraWriter struct {
+	session   *gocql.Session
+	keyspace  string
+	table     string
+	batchRows int
+
+	insert string
+	types  []gocql.TypeInfo //Types of the insert's bound columns
+	pk     []int            //Indexes of the partition key columns
+}
+
+// cqlIdent quotes a CQL identifier.
+func cqlIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// cqlInsert returns the insert of the columns into the table.
+func cqlInsert(keyspace string, table string, columns []string) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = cqlIdent(c)
+	}
+
+	return "INSERT INTO " + cqlIdent(keyspace) + "." + cqlIdent(table) + " (" + strings.Join(names, ", ") + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+}
+
+// prepare builds the insert of the fields from the table's metadata,
+// reading the types of its columns and which make up the partition key.
+// Field names match the columns ignoring case, as unquoted CQL names are
+// stored in lower case.
+func (c *cassandraWriter) prepare(fields []Field) (err error) {
+	var ks *gocql.KeyspaceMetadata
+
+	if ks, err = c.session.KeyspaceMetadata(c.keyspace); err != nil {
+		return errors.Annotatef(err, "reading keyspace %s", c.keyspace)
+	}
+	t := ks.Tables[c.table]
+	if t == nil {
+		for name, tm := range ks.Tables {
+			if strings.EqualFold(name, c.table) {
+				t = tm
+			}
+		}
+	}
+	if t == nil {
+		return errors.NotFoundf("Cassandra table %s.%s", c.keyspace, c.table)
+	}
+
+	columns := make([]string, len(fields))
+	c.types = make([]gocql.TypeInfo, len(fields))
+	for i, f := range fields {
+		col := t.Columns[f.Name]
+		if col == nil {
+			for name, cm := range t.Columns {
+				if strings.EqualFold(name, f.Name) {
+					col = cm
+				}
+			}
+		}
+		if col == nil {
+			return errors.NotFoundf("column %s in Cassandra table %s.%s", f.Name, t.Keyspace, t.Name)
+		}
+		columns[i], c.types[i] = col.Name, col.Type
+	}
+
+	c.pk = c.pk[:0]
+	for _, k := range t.PartitionKey {
+		pos := indexOf(columns, k.Name)
+		if pos < 0 {
+			return errors.NotValidf("insert into %s.%s without partition key column %s", t.Keyspace, t.Name, k.Name)
+		}
+		c.pk = append(c.pk, pos)
+	}
+
+	c.insert = cqlInsert(t.Keyspace, t.Name, columns)
+
+	return nil
+}
+
+func (c *cassandraWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	var batches [][][]interface{}
+
+	if c.insert == "" {
+		if err = c.prepare(b.Fields); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if batches, err = c.batches(b); err != nil {
+		return errors.Trace(err)
+	}
+
+	// gocql prepares the insert once and retries batches which timed out
+	// or found too few replicas
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cqlMaxInFlight)
+	for _, rows := range batches {
+		batch := c.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		for _, args := range rows {
+			batch.Query(c.insert, args...)
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if berr := c.session.ExecuteBatch(batch); berr != nil {
+				mu.Lock()
+				if err == nil {
+					err = berr
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Annotatef(err, "writing to %s.%s", c.keyspace, c.table)
+}
+
+// batches returns the bind arguments of the rows, grouped by partition
+// key, in the order each was first seen, into batches of at most
+// batchRows rows.
+func (c *cassandraWriter) batches(b *RecordBatch) (batches [][][]interface{}, err error) {
+	var keys []rowKey
+	groups := map[rowKey][][]interface{}{}
+
+	row := make([]interface{}, len(b.Fields))
+	for i := 0; i < b.NumRows; i++ {
+		row = b.Row(i, row)
+		args := make([]interface{}, len(row))
+		for col, v := range row {
+			if args[col], err = cqlValue(c.types[col], v); err != nil {
+				return nil, errors.Annotatef(err, "row %d column %s", i+1, b.Fields[col].Name)
+			}
+		}
+
+		k := hashKey(args, c.pk)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], args)
+	}
+
+	for _, k := range keys {
+		rows := groups[k]
+		for start := 0; start < len(rows); start += c.batchRows {
+			batches = append(batches, rows[start:min(start+c.batchRows, len(rows))])
+		}
+	}
+
+	return batches, nil
+}
+
+func (c *cassandraWriter) Close() (err error) {
+	c.session.Close()
+	return nil
+}
+
+// cqlValue returns a value converted to what gocql marshals as the column
+// type, or nil for NULL.
+func cqlValue(t gocql.TypeInfo, v interface{}) (arg interface{}, err error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch t.Type() {
+	case gocql.TypeAscii, gocql.TypeVarchar, gocql.TypeText:
+		if raw, ok := v.([]byte); ok {
+			return string(raw), nil
+		}
+		return fileText(v), nil
+	case gocql.TypeBlob:
+		if raw, ok := v.([]byte); ok {
+			return raw, nil
+		}
+		return []byte(fileText(v)), nil
+	case gocql.TypeBigInt, gocql.TypeCounter, gocql.TypeInt, gocql.TypeSmallInt, gocql.TypeTinyInt:
+		var i int64
+		if i, err = recordInt(v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		bits := map[gocql.Type]uint{gocql.TypeInt: 32, gocql.TypeSmallInt: 16, gocql.TypeTinyInt: 8}[t.Type()]
+		if bits > 0 && (i < -1<<(bits-1) || i >= 1<<(bits-1)) {
+			return nil, errors.NotValidf("%d out of range of a %d bit integer", i, bits)
+		}
+		return i, nil
+	case gocql.TypeBoolean:
+		b, err := recordBool(v)
+		return b, errors.Trace(err)
+	case gocql.TypeDouble, gocql.TypeFloat:
+		f, err := recordFloat(v)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if t.Type() == gocql.TypeFloat {
+			return float32(f), nil
+		}
+		return f, nil
+	case gocql.TypeTimestamp, gocql.TypeDate:
+		tm, err := recordTime(v)
+		return tm, errors.Trace(err)
+	case gocql.TypeTime: //Nanoseconds since midnight
+		var tm time.Time
+		if tm, err = recordTime(v); err != nil {
+			if tm, err = time.Parse("15:04:05.999999999", valueText(v)); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		y, m, d := tm.Date()
+		return tm.Sub(time.Date(y, m, d, 0, 0, 0, 0, tm.Location())), nil
+	case gocql.TypeUUID, gocql.TypeTimeUUID:
+		if raw, ok := v.([]byte); ok && len(raw) == 16 {
+			id, err := gocql.UUIDFromBytes(raw)
+			return id, errors.Trace(err)
+		}
+		id, err := gocql.ParseUUID(valueText(v))
+		if err != nil {
+			return nil, errors.NotValidf("UUID %q", valueText(v))
+		}
+		return id, nil
+	case gocql.TypeVarint:
+		n, ok := new(big.Int).SetString(valueText(v), 10)
+		if !ok {
+			return nil, errors.NotValidf("varint %q", valueText(v))
+		}
+		return n, nil
+	case gocql.TypeDecimal:
+		d, ok := new(inf.Dec).SetString(valueText(v))
+		if !ok {
+			return nil, errors.NotValidf("decimal %q", valueText(v))
+		}
+		return d, nil
+	case gocql.TypeInet:
+		ip := net.ParseIP(valueText(v))
+		if ip == nil {
+			return nil, errors.NotValidf("IP address %q", valueText(v))
+		}
+		return ip, nil
+	}
+
+	return nil, errors.NotSupportedf("writing to CQL type %s", t.Type())
+}
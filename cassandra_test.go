@@ -0,0 +1,151 @@
+package godatapipe
+
+import (
+	"encoding/hex"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCQLValue(t *testing.T) {
+	tests := []struct {
+		typ  gocql.Type
+		v    interface{}
+		want string //Hex of the marshalled value
+	}{
+		{gocql.TypeVarchar, "hé", "68c3a9"},
+		{gocql.TypeVarchar, []byte("hé"), "68c3a9"},
+		{gocql.TypeVarchar, int64(7), "37"},
+		{gocql.TypeBlob, "ab", "6162"},
+		{gocql.TypeInt, "42", "0000002a"},
+		{gocql.TypeBigInt, int64(1), "0000000000000001"},
+		{gocql.TypeSmallInt, int64(-2), "fffe"},
+		{gocql.TypeTinyInt, int64(127), "7f"},
+		{gocql.TypeBoolean, "true", "01"},
+		{gocql.TypeFloat, "1.5", "3fc00000"},
+		{gocql.TypeDouble, 1.5, "3ff8000000000000"},
+		{gocql.TypeTimestamp, time.Unix(1, 0).UTC(), "00000000000003e8"},
+		{gocql.TypeTimestamp, "1970-01-01T00:00:01Z", "00000000000003e8"},
+		{gocql.TypeDate, "1970-01-02", "80000001"},
+		{gocql.TypeTime, "00:00:01", "000000003b9aca00"},
+		{gocql.TypeUUID, "01234567-89ab-cdef-0123-456789abcdef", "0123456789abcdef0123456789abcdef"},
+		{gocql.TypeUUID, []byte("0123456789abcdef"), hex.EncodeToString([]byte("0123456789abcdef"))},
+		{gocql.TypeVarint, "-129", "ff7f"},
+		{gocql.TypeVarint, "128", "0080"},
+		{gocql.TypeDecimal, "1.50", "000000020096"},
+		{gocql.TypeInet, "10.0.0.1", "0a000001"},
+		{gocql.TypeInt, nil, ""},
+	}
+
+	for _, tt := range tests {
+		info := gocql.NewNativeType(4, tt.typ, "")
+		arg, err := cqlValue(info, tt.v)
+		if err != nil {
+			t.Errorf("cqlValue(%s, %v): %s", tt.typ, tt.v, err)
+			continue
+		}
+		b, err := gocql.Marshal(info, arg)
+		if err != nil || hex.EncodeToString(b) != tt.want {
+			t.Errorf("cqlValue(%s, %v) marshalled to %x, %v, want %s", tt.typ, tt.v, b, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		typ gocql.Type
+		v   interface{}
+	}{
+		{gocql.TypeTinyInt, int64(128)},
+		{gocql.TypeInt, int64(1) << 31},
+		{gocql.TypeInt, "x"},
+		{gocql.TypeUUID, "not-a-uuid"},
+		{gocql.TypeVarint, "1.5"},
+		{gocql.TypeDecimal, "abc"},
+		{gocql.TypeInet, "host"},
+		{gocql.TypeList, "[1]"},
+	} {
+		if arg, err := cqlValue(gocql.NewNativeType(4, tt.typ, ""), tt.v); err == nil {
+			t.Errorf("cqlValue(%s, %v) = %v, want an error", tt.typ, tt.v, arg)
+		}
+	}
+}
+
+func TestCassandraBatches(t *testing.T) {
+	fields := []Field{{Name: "id", Type: ArrowInt64}, {Name: "part", Type: ArrowUtf8, Nullable: true}}
+	b, err := NewRecordBatch(fields, [][]interface{}{
+		{int64(1), "a"}, {int64(2), "b"}, {int64(3), "a"}, {int64(4), "a"}, {int64(5), "b"}, {int64(6), nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &cassandraWriter{batchRows: 2, pk: []int{1}, types: []gocql.TypeInfo{
+		gocql.NewNativeType(4, gocql.TypeInt, ""),
+		gocql.NewNativeType(4, gocql.TypeText, "")}}
+	batches, err := c.batches(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches don't span partitions and keep the order they were first
+	// seen in
+	want := [][][]interface{}{
+		{{int64(1), "a"}, {int64(3), "a"}},
+		{{int64(4), "a"}},
+		{{int64(2), "b"}, {int64(5), "b"}},
+		{{int64(6), nil}}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("batches = %v, want %v", batches, want)
+	}
+
+	c.types[0] = gocql.NewNativeType(4, gocql.TypeTinyInt, "")
+	b, _ = NewRecordBatch(fields, [][]interface{}{{int64(1000), "a"}})
+	if _, err = c.batches(b); err == nil {
+		t.Error("out of range value didn't fail")
+	}
+}
+
+func TestCQLInsert(t *testing.T) {
+	got := cqlInsert("sales", "Orders", []string{"id", `odd"name`, "select"})
+	want := `INSERT INTO "sales"."Orders" ("id", "odd""name", "select") VALUES (?, ?, ?)`
+	if got != want {
+		t.Errorf("cqlInsert = %s, want %s", got, want)
+	}
+}
+
+func TestCQLSSLOptions(t *testing.T) {
+	tests := []struct {
+		query  string
+		tls    bool
+		verify bool
+		ca     string
+		err    bool
+	}{
+		{"", false, false, "", false},
+		{"sslmode=disable", false, false, "", false},
+		{"sslmode=require", true, false, "", false},
+		{"sslmode=verify-full&sslrootcert=/ca.pem", true, true, "/ca.pem", false},
+		{"sslrootcert=/ca.pem", true, true, "/ca.pem", false},
+		{"sslmode=disable&sslrootcert=/ca.pem", false, false, "", true},
+		{"sslmode=prefer", false, false, "", true},
+	}
+
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		opts, err := cqlSSLOptions(q)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s didn't fail", tt.query)
+			}
+			continue
+		}
+		if err != nil || (opts != nil) != tt.tls {
+			t.Errorf("%s = %v, %v", tt.query, opts, err)
+			continue
+		}
+		if opts != nil && (opts.EnableHostVerification != tt.verify || opts.CaPath != tt.ca) {
+			t.Errorf("%s verifies %v with %q", tt.query, opts.EnableHostVerification, opts.CaPath)
+		}
+	}
+}
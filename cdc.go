@@ -0,0 +1,386 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// walChange is a wal2json format-version 2 change.
+type walChange struct {
+	Action   string      `json:"action"` //I, U, D or T; B and C mark transaction boundaries
+	Schema   string      `json:"schema"`
+	Table    string      `json:"table"`
+	Columns  []walColumn `json:"columns"`  //New row for inserts and updates
+	Identity []walColumn `json:"identity"` //Replica identity of the old row for updates and deletes
+}
+
+type walColumn struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// cdcChange is a change read from the slot with its position.
+type cdcChange struct {
+	lsn    string
+	change walChange
+}
+
+// cdcApplier applies the changes read from a Postgres logical replication
+// slot to the destination table.
+type cdcApplier struct {
+	cfg     *Config
+	srcConn *sql.Conn
+	dstConn *sql.Conn
+	d       *bulk.Dialect
+	keys    []string //Destination key columns
+	res     *Result
+
+	stages  map[string][]stage  //Row stages keyed by the change's column list
+	columns map[string][]string //Destination columns keyed by the change's column list
+	rowNum  int
+}
+
+// runCDC polls the replication slot for changes to the source table and
+// applies them to the destination until the pipeline is stopped or the
+// context is cancelled. The slot is only advanced once the changes are
+// committed, so after a crash changes are applied again, which upserts
+// and deletes tolerate.
+func runCDC(ctx context.Context, cfg *Config, srcConn *sql.Conn, dstConn *sql.Conn, res *Result, stop <-chan struct{}) (err error) {
+	var n int
+
+	if cfg.CDCTable == "" {
+		return errors.NotValidf("CDC without a source table")
+	}
+
+	a := &cdcApplier{
+		cfg:     cfg,
+		srcConn: srcConn,
+		dstConn: dstConn,
+		d:       bulk.DialectFor(cfg.DstDbDriver),
+		keys:    cfg.CDCKeyColumns,
+		res:     res,
+		stages:  map[string][]stage{},
+		columns: map[string][]string{}}
+
+	if len(a.keys) > 0 {
+		if a.keys, err = bulk.ResolveColumns(ctx, dstConn, a.d, cfg.DstSchema, cfg.DstTable, a.keys); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		if a.keys, err = bulk.KeyColumns(ctx, dstConn, a.d, cfg.DstSchema, cfg.DstTable); err != nil {
+			return errors.Trace(err)
+		}
+		if len(a.keys) == 0 {
+			return errors.Trace(&SchemaError{Table: cfg.DstTable, Err: errors.NotValidf("CDC without a primary key or CDC key columns")})
+		}
+	}
+
+	interval := cfg.CDCPollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return errors.Annotatef(err, "CDC cancelled after %d changes", res.RowCount)
+		}
+
+		if stopped(stop) {
+			res.Interrupted = true
+			return nil
+		}
+
+		if n, err = a.poll(ctx); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Only wait when the slot is drained
+		if n == 0 {
+			select {
+			case <-ctx.Done():
+			case <-stop:
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+// poll applies the next batch of changes in one destination transaction
+// and advances the slot past them. Returns the number of changes read.
+func (a *cdcApplier) poll(ctx context.Context) (n int, err error) {
+	var changes []cdcChange
+	var tx *sql.Tx
+
+	if changes, err = a.read(ctx); err != nil {
+		return 0, errors.Trace(err)
+	} else if len(changes) == 0 {
+		return 0, nil
+	}
+
+	if tx, err = a.dstConn.BeginTx(ctx, nil); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	applied := 0
+	for _, c := range changes {
+		var ok bool
+		if ok, err = a.apply(ctx, tx, c.change); err != nil {
+			tx.Rollback()
+			return 0, errors.Annotatef(err, "applying change at %s", c.lsn)
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	a.res.RowCount += applied
+
+	last := changes[len(changes)-1].lsn
+	if _, err = a.srcConn.ExecContext(ctx, "SELECT pg_replication_slot_advance($1, $2::pg_lsn)", a.cfg.CDCSlot, last); err != nil {
+		return 0, errors.Annotatef(err, "advancing slot %s to %s", a.cfg.CDCSlot, last)
+	}
+
+	return len(changes), nil
+}
+
+// read peeks at the next changes in the slot without consuming them.
+func (a *cdcApplier) read(ctx context.Context) (changes []cdcChange, err error) {
+	limit := a.cfg.MaxRowTxCommit
+	if limit <= 0 {
+		limit = 10000
+	}
+
+	rows, err := a.srcConn.QueryContext(ctx,
+		"SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'format-version', '2', 'add-tables', $3)",
+		a.cfg.CDCSlot, limit, a.cfg.CDCTable)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var c cdcChange
+		var data string
+
+		if err = rows.Scan(&c.lsn, &data); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		dec := json.NewDecoder(strings.NewReader(data))
+		dec.UseNumber()
+		if err = dec.Decode(&c.change); err != nil {
+			return nil, errors.Annotatef(err, "decoding change at %s", c.lsn)
+		}
+		changes = append(changes, c)
+	}
+
+	return changes, errors.Trace(rows.Err())
+}
+
+// apply writes a change to the destination, reporting whether it changed
+// a row.
+func (a *cdcApplier) apply(ctx context.Context, tx *sql.Tx, c walChange) (ok bool, err error) {
+	switch c.Action {
+	case "I":
+		if a.softDeleted(c.Columns) {
+			return false, nil
+		}
+		return a.upsert(ctx, tx, c.Columns)
+	case "U":
+		if a.softDeleted(c.Columns) {
+			if a.keyValues(c.Identity) == nil {
+				return a.delete(ctx, tx, c.Columns)
+			}
+			return a.delete(ctx, tx, c.Identity)
+		}
+		// Remove the old row first if the update changed its key
+		if old := a.keyValues(c.Identity); old != nil {
+			if nw := a.keyValues(c.Columns); nw != nil && !sameValues(old, nw) {
+				if _, err = a.delete(ctx, tx, c.Identity); err != nil {
+					return false, errors.Trace(err)
+				}
+			}
+		}
+		return a.upsert(ctx, tx, c.Columns)
+	case "D":
+		return a.delete(ctx, tx, c.Identity)
+	case "T":
+		q := "DELETE FROM " + a.d.QualifiedName(a.cfg.DstSchema, a.cfg.DstTable)
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return false, errors.Trace(err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (a *cdcApplier) upsert(ctx context.Context, tx *sql.Tx, cols []walColumn) (ok bool, err error) {
+	var stages []stage
+	var columns []string
+	var q string
+
+	names := make([]string, len(cols))
+	values := make([]interface{}, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name
+		values[i] = walValue(c.Value)
+	}
+
+	if stages, columns, err = a.stagesFor(ctx, names); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	a.rowNum++
+	if values, err = applyStages(stages, a.rowNum, values); err != nil {
+		return false, errors.Trace(err)
+	} else if values == nil {
+		return false, nil
+	}
+
+	if q, err = a.d.UpsertSQL(a.cfg.DstSchema, a.cfg.DstTable, columns, a.keys); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, q, values...); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return true, nil
+}
+
+func (a *cdcApplier) delete(ctx context.Context, tx *sql.Tx, identity []walColumn) (ok bool, err error) {
+	var q string
+
+	keys := a.keyValues(identity)
+	if keys == nil {
+		return false, errors.Errorf("delete without values for key columns %s, check the source table's REPLICA IDENTITY",
+			strings.Join(a.keys, ", "))
+	}
+
+	if q, err = a.d.DeleteSQL(a.cfg.DstSchema, a.cfg.DstTable, a.keys); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, q, keys...); err != nil {
+		return false, errors.Trace(err)
+	}
+	a.res.DeletedRows++
+
+	return true, nil
+}
+
+// stagesFor returns the row stages and destination columns for a change's
+// columns. Updates must never be dropped as duplicates, so deduplication
+// is left out.
+func (a *cdcApplier) stagesFor(ctx context.Context, names []string) (stages []stage, columns []string, err error) {
+	key := strings.Join(names, "\x00")
+	if stages, ok := a.stages[key]; ok {
+		return stages, a.columns[key], nil
+	}
+
+	cfg := *a.cfg
+	cfg.DedupeColumns = nil
+
+	var batch *batchTransformer
+	if stages, batch, columns, err = buildStages(ctx, &cfg, nil, nil, a.dstConn, names, a.res); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if batch != nil {
+		batch.release()
+		return nil, nil, errors.NotSupportedf("lookups, TransformBatch, aggregation, pivot or unpivot with change data capture")
+	}
+	if columns, err = bulk.ResolveColumns(ctx, a.dstConn, a.d, cfg.DstSchema, cfg.DstTable, columns); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	a.stages[key] = stages
+	a.columns[key] = columns
+
+	return stages, columns, nil
+}
+
+// softDeleted reports whether the new row is marked as deleted and
+// should be removed rather than upserted.
+func (a *cdcApplier) softDeleted(cols []walColumn) bool {
+	if a.cfg.SoftDeleteColumn == "" || a.cfg.SoftDeleteAction != SoftDeleteRemove {
+		return false
+	}
+
+	for _, c := range cols {
+		if c.Name == a.cfg.SoftDeleteColumn {
+			return softDeleted(walValue(c.Value))
+		}
+	}
+
+	return false
+}
+
+// keyValues returns the values of the key columns, or nil if any are
+// missing.
+func (a *cdcApplier) keyValues(cols []walColumn) (values []interface{}) {
+	for _, k := range a.keys {
+		found := false
+		for _, c := range cols {
+			if strings.EqualFold(c.Name, k) {
+				values = append(values, walValue(c.Value))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	return values
+}
+
+// walValue converts a decoded JSON value into a value the destination
+// driver accepts.
+func walValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		return t.String()
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+
+	return v
+}
+
+// sameValues reports whether two key value lists are equal.
+func sameValues(a []interface{}, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		ab, aok := a[i].([]byte)
+		bb, bok := b[i].([]byte)
+		if aok && bok {
+			if !bytes.Equal(ab, bb) {
+				return false
+			}
+		} else if aok != bok || a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,125 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// chunkedSource reads the source query in primary key order a chunk at a
+// time, each chunk being its own short query, so no server cursor is
+// held open for the whole copy.
+type chunkedSource struct {
+	conn      *sql.Conn
+	query     string
+	args      []interface{} //Bind parameters of the query
+	d         *bulk.Dialect
+	keyColumn string
+	chunkSz   int
+
+	chunk    *sqlSource
+	chunkPos int         //Rows read from the current chunk
+	lastKey  interface{} //Key of the last row read
+	keyPos   int
+
+	columns []string
+	types   []ColumnType
+}
+
+func newChunkedSource(ctx context.Context, conn *sql.Conn, cfg *Config) (s *chunkedSource, err error) {
+	s = &chunkedSource{
+		conn:      conn,
+		query:     cfg.SrcSelectSql,
+		args:      cfg.SelectArgs(),
+		d:         bulk.DialectFor(cfg.SrcDbDriver),
+		keyColumn: cfg.SrcKeyColumn,
+		chunkSz:   cfg.SrcChunkSize}
+
+	if err = s.nextChunk(ctx, true); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if s.columns, err = s.chunk.Columns(); err != nil {
+		s.chunk.Close()
+		return nil, errors.Trace(err)
+	}
+
+	if s.types, err = s.chunk.ColumnTypes(); err != nil {
+		s.chunk.Close()
+		return nil, errors.Trace(err)
+	}
+
+	if s.keyPos = indexOf(s.columns, s.keyColumn); s.keyPos < 0 {
+		s.chunk.Close()
+		return nil, errors.Trace(sourceColumnError(s.keyColumn, "key"))
+	}
+
+	return s, nil
+}
+
+// nextChunk queries the rows following the last key read.
+func (s *chunkedSource) nextChunk(ctx context.Context, first bool) (err error) {
+	args := s.args
+
+	key := s.d.QuoteIdent(s.keyColumn)
+	where := ""
+	if !first {
+		args = append(args[:len(args):len(args)], s.lastKey)
+		where = fmt.Sprintf(" WHERE %s > %s", key, s.d.Placeholder(len(args)))
+	}
+
+	q := s.d.LimitQuery(fmt.Sprintf("SELECT * FROM (%s) datapipe_chunk%s ORDER BY %s", s.query, where, key), s.chunkSz)
+
+	if s.chunk, err = newSQLSource(ctx, s.conn, q, args...); err != nil {
+		return errors.Trace(err)
+	}
+	s.chunkPos = 0
+
+	return nil
+}
+
+func (s *chunkedSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *chunkedSource) ColumnTypes() (types []ColumnType, err error) {
+	return s.types, nil
+}
+
+func (s *chunkedSource) Next(ctx context.Context) (values []interface{}, err error) {
+	for {
+		if values, err = s.chunk.Next(ctx); err == nil {
+			s.chunkPos++
+			s.lastKey = values[s.keyPos]
+			return values, nil
+		} else if err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+
+		if err = s.chunk.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// A short chunk means there's nothing left
+		if s.chunkPos < s.chunkSz {
+			s.chunk = nil
+			return nil, io.EOF
+		}
+
+		if err = s.nextChunk(ctx, false); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
+
+func (s *chunkedSource) Close() (err error) {
+	if s.chunk == nil {
+		return nil
+	}
+
+	return errors.Trace(s.chunk.Close())
+}
@@ -0,0 +1,433 @@
+// Command go-datapipe copies a database table configured by environment
+// variables, see the README.
+//
+// Usage:
+//
+//	go-datapipe [run]   copy the table once, or each of SRC_TABLES
+//	go-datapipe daemon  copy the table on SCHEDULE until interrupted
+//	go-datapipe sync    sync SRC_TABLE and the destination table both ways
+//	go-datapipe export DIR  copy the table into a snapshot directory
+//	go-datapipe import DIR  copy a snapshot directory into the table
+//	go-datapipe plan    print what a run would do without writing anything
+//	go-datapipe apply   print the plan, then run it once it's confirmed
+//	go-datapipe ddl     print a CREATE TABLE for the destination from the select
+//	go-datapipe bench   time writing a sample of the source with a range of settings
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	godatapipe "github.com/joescharf/go-datapipe"
+	_ "github.com/joescharf/go-datapipe/flightsql"
+	"github.com/juju/errors"
+	"github.com/xo/dburl"
+)
+
+// results are the jobs the command ran, for STATUS_FILE.
+var results []godatapipe.JobResult
+
+// out is where the command's output goes, stderr when DST_FILE is - so it
+// doesn't mix with the rows written to stdout.
+var out io.Writer = os.Stdout
+
+func main() {
+	cmd := "run"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	cfg := &godatapipe.Config{}
+	if err := cfg.Init(); err != nil {
+		exit(cfg, err)
+	}
+	if cfg.DstFile == "-" {
+		out = os.Stderr
+	}
+
+	var err error
+	switch cmd {
+	case "run":
+		err = run(cfg)
+	case "daemon":
+		err = daemon(cfg)
+	case "sync":
+		err = sync(cfg)
+	case "export", "import":
+		err = snapshot(cfg, cmd)
+	case "plan":
+		err = plan(cfg, false)
+	case "apply":
+		err = plan(cfg, true)
+	case "ddl":
+		err = ddl(cfg)
+	case "bench":
+		err = bench(cfg)
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [run|daemon|sync|export|import|plan|apply|ddl|bench]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	exit(cfg, err)
+}
+
+// exit shows the error, writes STATUS_FILE if it's set and exits with the
+// code of the error's class: 0 for none, 78 for config errors, 65 for
+// data which doesn't fit, 75 for transient errors worth retrying and 1
+// for anything else.
+func exit(cfg *godatapipe.Config, err error) {
+	if err != nil {
+		godatapipe.ShowError(cfg, err)
+	}
+
+	if cfg.StatusFile != "" {
+		if serr := godatapipe.NewFinalStatus(results, err).WriteFile(cfg.StatusFile); serr != nil {
+			fmt.Fprintln(os.Stderr, serr)
+		}
+	}
+
+	os.Exit(godatapipe.ClassifyError(err).ExitCode())
+}
+
+// run copies the table once, stopping gracefully on SIGINT or SIGTERM.
+func run(cfg *godatapipe.Config) (err error) {
+	var res *godatapipe.Result
+
+	if cfg.SrcTables != "" {
+		return runTables(cfg)
+	}
+
+	if cfg.ProgressInterval > 0 || len(cfg.Notifiers) > 0 {
+		cfg.OnEvent = logEvent
+	}
+
+	if err = listenStatus(context.Background(), cfg, trackStatus(cfg), nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	p := godatapipe.NewPipeline(cfg)
+	release := p.StopOnSignal()
+	defer release()
+
+	res, err = p.Run(context.Background())
+	results = []godatapipe.JobResult{{Job: &godatapipe.Job{Name: cfg.DstTable}, Result: res, Err: err}}
+	if rerr := writeReport(cfg, results); rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if res.Replayed {
+		fmt.Fprintf(out, "already run as %s with IDEMPOTENCY_KEY=%s\n", res.RunID, cfg.IdempotencyKey)
+	}
+	fmt.Fprintf(out, "%d rows copied\n", res.RowCount)
+	fmt.Fprintf(out, "read in %s, written in %s\n", res.ReadTime.Round(time.Millisecond), res.WriteTime.Round(time.Millisecond))
+	if t := res.Timings; t.Batches > 0 {
+		fmt.Fprintf(out, "%d batches in %s (slowest %s), %d commits in %s\n", t.Batches, t.BatchTime.Round(time.Millisecond),
+			t.MaxBatchTime.Round(time.Millisecond), t.Commits, t.CommitTime.Round(time.Millisecond))
+	}
+	for _, c := range res.ColumnStats {
+		fmt.Fprintf(out, "%s: %d nulls, min %v, max %v, ~%d distinct, longest %d\n", c.Name, c.NullCount, c.Min, c.Max, c.DistinctEstimate, c.MaxLength)
+	}
+	if res.Interrupted {
+		fmt.Fprintln(out, "interrupted before all rows were read")
+	}
+
+	return nil
+}
+
+// runTables copies each of the SRC_TABLES, MAX_CONCURRENT_JOBS at a time,
+// stopping gracefully on SIGINT or SIGTERM.
+func runTables(cfg *godatapipe.Config) (err error) {
+	var jobs []*godatapipe.Job
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err = listenStatus(ctx, cfg, trackStatus(cfg), nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	if jobs, err = godatapipe.TableJobs(ctx, cfg); err != nil {
+		return errors.Trace(err)
+	}
+	if len(jobs) == 0 {
+		return errors.Errorf("no tables match SRC_TABLES=%s", cfg.SrcTables)
+	}
+
+	maxJobs, _ := cfg.EnvInt("MAX_CONCURRENT_JOBS", 4)
+	s := &godatapipe.Scheduler{MaxConcurrentJobs: maxJobs}
+
+	results = s.Run(ctx, jobs)
+	if err = godatapipe.Notify(context.WithoutCancel(ctx), cfg.Notifiers, cfg.NotifyOn, results); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err = writeReport(cfg, results); err != nil {
+		return errors.Trace(err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: failed: %s\n", r.Job.Name, r.Err)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d rows copied\n", r.Job.Name, r.Result.RowCount)
+	}
+
+	if failed > 0 {
+		return errors.Annotatef(godatapipe.ResultsError(results), "%d of %d tables failed", failed, len(jobs))
+	}
+
+	return nil
+}
+
+// writeReport writes a report of the results to REPORT_FILE, if set.
+func writeReport(cfg *godatapipe.Config, results []godatapipe.JobResult) (err error) {
+	if cfg.ReportFile == "" {
+		return nil
+	}
+
+	return errors.Trace(godatapipe.NewReport(results).WriteFile(cfg.ReportFile, cfg.ReportFormat))
+}
+
+// trackStatus tracks the runs through cfg.OnEvent for /status if
+// STATUS_ADDR is set, returning nil if not.
+func trackStatus(cfg *godatapipe.Config) (st *godatapipe.Status) {
+	if cfg.StatusAddr == "" {
+		return nil
+	}
+
+	st = godatapipe.NewStatus()
+	next := cfg.OnEvent
+	cfg.OnEvent = func(e godatapipe.Event) {
+		st.Handle(e)
+		if next != nil {
+			next(e)
+		}
+	}
+
+	return st
+}
+
+// listenStatus serves /healthz and /status, and the daemon's /jobs control
+// API if there is one, on STATUS_ADDR until the context is cancelled.
+func listenStatus(ctx context.Context, cfg *godatapipe.Config, st *godatapipe.Status, d *godatapipe.Daemon) (err error) {
+	if st == nil {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", st.Handler())
+	if d != nil {
+		mux.Handle("/jobs", d.Handler())
+		mux.Handle("/jobs/", d.Handler())
+	}
+
+	return errors.Trace(godatapipe.ListenAndServe(ctx, cfg.StatusAddr, mux))
+}
+
+// daemon copies the table, or each of SRC_TABLES, on schedule until
+// SIGINT or SIGTERM, logging each run. With STATUS_ADDR the runs can also
+// be controlled over HTTP.
+func daemon(cfg *godatapipe.Config) (err error) {
+	var jobs []*godatapipe.Job
+
+	if cfg.Schedule == nil && cfg.StatusAddr == "" {
+		return errors.New("SCHEDULE or STATUS_ADDR must be set to run as a daemon")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cfg.OnEvent = logEvent
+	st := trackStatus(cfg)
+
+	if cfg.SrcTables == "" {
+		jobs = []*godatapipe.Job{{Name: cfg.DstTable, Config: cfg}}
+	} else if jobs, err = godatapipe.TableJobs(ctx, cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	d := godatapipe.NewDaemon(jobs)
+	if d.Token, err = godatapipe.ResolveSecret(ctx, cfg.ControlToken); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err = listenStatus(ctx, cfg, st, d); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(d.Run(ctx))
+}
+
+// sync syncs the tables both ways once.
+func sync(cfg *godatapipe.Config) (err error) {
+	var res *godatapipe.SyncResult
+
+	if res, err = godatapipe.Sync(context.Background(), cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintf(out, "%d rows written to the source, %d to the destination, %d conflicts\n", res.SrcRows, res.DstRows, res.Conflicts)
+	return nil
+}
+
+// snapshot exports the table to, or imports it from, the snapshot
+// directory given after the command.
+func snapshot(cfg *godatapipe.Config, cmd string) (err error) {
+	var res *godatapipe.Result
+
+	if len(os.Args) < 3 {
+		return errors.NotValidf("%s without a snapshot directory", cmd)
+	}
+
+	ctx := context.Background()
+	if cmd == "export" {
+		res, err = godatapipe.ExportSnapshot(ctx, cfg, os.Args[2])
+	} else {
+		res, err = godatapipe.ImportSnapshot(ctx, cfg, os.Args[2])
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintf(out, "%d rows copied\n", res.RowCount)
+	return nil
+}
+
+// plan prints what a run would do, and if apply is set runs it once it's
+// confirmed on stdin.
+func plan(cfg *godatapipe.Config, apply bool) (err error) {
+	var p *godatapipe.Plan
+	var res *godatapipe.Result
+
+	ctx := context.Background()
+
+	if p, err = godatapipe.NewPlan(ctx, cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprint(out, p)
+	if !apply {
+		return nil
+	}
+
+	fmt.Fprint(out, "\napply the plan? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if s := strings.ToLower(strings.TrimSpace(answer)); s != "y" && s != "yes" {
+		return errors.New("plan not applied")
+	}
+
+	if res, err = godatapipe.Apply(ctx, p); err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintf(out, "%d rows copied\n", res.RowCount)
+	return nil
+}
+
+// ddl prints the destination table DDL derived from the source select.
+func ddl(cfg *godatapipe.Config) (err error) {
+	var u *dburl.URL
+	var db *sql.DB
+	var conn *sql.Conn
+	var uri, q string
+
+	ctx := context.Background()
+
+	if uri, err = godatapipe.ResolveURI(ctx, cfg.SrcDbUri, cfg.SrcDbPassword); err != nil {
+		return errors.Trace(err)
+	}
+	if u, err = dburl.Parse(uri); err != nil {
+		return errors.Trace(err)
+	}
+	if db, err = sql.Open(u.Driver, u.DSN); err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	if conn, err = db.Conn(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if q, err = godatapipe.GenerateDDL(ctx, conn, cfg.SrcSelectSql, cfg.DstDbDriver, cfg.DstSchema, cfg.DstTable, cfg.SelectArgs()...); err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintf(out, "%s;\n", q)
+	return nil
+}
+
+// bench writes BENCH_SAMPLE_ROWS source rows to the destination table
+// with each of the default settings, and with the driver's network
+// options if BENCH_NETWORK is true, and prints the rows per second.
+func bench(cfg *godatapipe.Config) (err error) {
+	var results []godatapipe.BenchResult
+	var best *godatapipe.BenchResult
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sampleRows, _ := cfg.EnvInt("BENCH_SAMPLE_ROWS", 10000)
+	settings := godatapipe.DefaultBenchSettings()
+	if os.Getenv("BENCH_NETWORK") == "true" {
+		settings = godatapipe.NetworkBenchSettings(cfg.DstDbDriver, settings)
+	}
+	if results, best, err = godatapipe.Bench(ctx, cfg, sampleRows, settings); err != nil && results == nil {
+		return errors.Trace(err)
+	}
+
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(out, "%s: failed: %s\n", r.Settings, r.Err)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d rows in %s, %.0f rows/s\n", r.Settings, r.Rows, r.Elapsed.Round(time.Millisecond), r.RowsPerSec)
+	}
+
+	if best != nil {
+		fmt.Fprintf(out, "fastest: %s\n", best.Settings)
+	}
+
+	return errors.Trace(err)
+}
+
+func logEvent(e godatapipe.Event) {
+	ts := e.Time.Format("2006-01-02T15:04:05Z07:00")
+
+	switch e.Type {
+	case godatapipe.EventRunStarted:
+		fmt.Fprintf(out, "%s %s run %s started\n", ts, e.Pipeline, e.RunID)
+	case godatapipe.EventRunFinished:
+		fmt.Fprintf(out, "%s %s run %s finished: %d rows copied\n", ts, e.Pipeline, e.RunID, e.Result.RowCount)
+	case godatapipe.EventRunFailed:
+		fmt.Fprintf(os.Stderr, "%s %s run %s failed: %s\n", ts, e.Pipeline, e.RunID, e.Err)
+	case godatapipe.EventRunSkipped:
+		fmt.Fprintf(out, "%s %s skipped %d runs\n", ts, e.Pipeline, e.Skipped)
+	case godatapipe.EventSchemaDrift:
+		fmt.Fprintf(os.Stderr, "%s %s run %s schema drift: %s\n", ts, e.Pipeline, e.RunID, e.SchemaDiff)
+	case godatapipe.EventNotifyFailed:
+		fmt.Fprintf(os.Stderr, "%s %s %s\n", ts, e.Pipeline, e.Err)
+	case godatapipe.EventProgress:
+		p := e.Progress
+		if p.EstimatedRows > 0 {
+			fmt.Fprintf(out, "%s %s run %s %d of ~%d rows read (%.0f%%), ETA %s\n", ts, e.Pipeline, e.RunID,
+				p.RowsRead, p.EstimatedRows, p.Percent(), p.ETA().Round(time.Second))
+		} else {
+			fmt.Fprintf(out, "%s %s run %s %d rows read\n", ts, e.Pipeline, e.RunID, p.RowsRead)
+		}
+	}
+}
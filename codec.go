@@ -0,0 +1,168 @@
+package godatapipe
+
+import (
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses files as they're streamed.
+type Codec interface {
+	Name() string      //Name used to pick the codec, e.g. gzip
+	Extension() string //File extension of compressed files, e.g. .gz
+
+	NewReader(r io.Reader) (rc io.ReadCloser, err error)
+	NewWriter(w io.Writer) (wc io.WriteCloser, err error)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string      { return "gzip" }
+func (gzipCodec) Extension() string { return ".gz" }
+
+func (gzipCodec) NewReader(r io.Reader) (rc io.ReadCloser, err error) {
+	if rc, err = gzip.NewReader(r); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return rc, nil
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (wc io.WriteCloser, err error) {
+	return gzip.NewWriter(w), nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string      { return "zstd" }
+func (zstdCodec) Extension() string { return ".zst" }
+
+func (zstdCodec) NewReader(r io.Reader) (rc io.ReadCloser, err error) {
+	var d *zstd.Decoder
+
+	if d, err = zstd.NewReader(r); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return d.IOReadCloser(), nil
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (wc io.WriteCloser, err error) {
+	if wc, err = zstd.NewWriter(w); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return wc, nil
+}
+
+// snappyCodec reads and writes the snappy framing format.
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string      { return "snappy" }
+func (snappyCodec) Extension() string { return ".sz" }
+
+func (snappyCodec) NewReader(r io.Reader) (rc io.ReadCloser, err error) {
+	return io.NopCloser(snappy.NewReader(r)), nil
+}
+
+func (snappyCodec) NewWriter(w io.Writer) (wc io.WriteCloser, err error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{"gzip": gzipCodec{}, "zstd": zstdCodec{}, "snappy": snappyCodec{}}
+)
+
+// Registers a codec under its name, replacing any codec previously
+// registered with it.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+// Returns the codec with the name, or nil for none or an empty name.
+func CodecFor(name string) (c Codec, err error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	codecsMu.RLock()
+	c = codecs[name]
+	codecsMu.RUnlock()
+
+	if c != nil {
+		return c, nil
+	}
+
+	return nil, errors.NotValidf("compression %q", name)
+}
+
+// codecForPath returns the codec named, or if name is empty the one whose
+// extension the path has, and the path without the codec's extension.
+func codecForPath(name string, path string) (c Codec, base string, err error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if name == "" {
+		codecsMu.RLock()
+		for _, rc := range codecs {
+			if rc.Extension() == ext {
+				c = rc
+			}
+		}
+		codecsMu.RUnlock()
+	}
+	if c == nil {
+		if c, err = CodecFor(name); err != nil {
+			return nil, "", errors.Trace(err)
+		}
+	}
+
+	if c != nil && ext == c.Extension() {
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+
+	return c, path, nil
+}
+
+// nopWriteCloser adds a Close which does nothing to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressReader returns a reader decompressing r with the codec, if any.
+func compressReader(c Codec, r io.Reader) (rc io.ReadCloser, err error) {
+	if c == nil {
+		return io.NopCloser(r), nil
+	}
+	if rc, err = c.NewReader(r); err != nil {
+		return nil, errors.Annotatef(err, "reading %s", c.Name())
+	}
+
+	return rc, nil
+}
+
+// compressWriter returns a writer compressing to w with the codec, if any.
+// Closing it doesn't close w.
+func compressWriter(c Codec, w io.Writer) (wc io.WriteCloser, err error) {
+	if c == nil {
+		return nopWriteCloser{w}, nil
+	}
+	if wc, err = c.NewWriter(w); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return wc, nil
+}
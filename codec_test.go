@@ -0,0 +1,81 @@
+package godatapipe
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	text := strings.Repeat("id,name\n1,widget\n2,gadget\n", 1000)
+
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		c, err := CodecFor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		wc, err := compressWriter(c, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(wc, text); err != nil {
+			t.Fatal(err)
+		}
+		if err = wc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= len(text) {
+			t.Errorf("%s wrote %d bytes for %d bytes of text", name, buf.Len(), len(text))
+		}
+
+		rc, err := compressReader(c, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if string(got) != text {
+			t.Errorf("%s read back %d bytes, want %d", name, len(got), len(text))
+		}
+	}
+}
+
+func TestCodecForPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		codec string
+		base  string
+	}{
+		{"", "rows.csv.gz", "gzip", "rows.csv"},
+		{"", "rows.csv.zst", "zstd", "rows.csv"},
+		{"", "rows.jsonl.sz", "snappy", "rows.jsonl"},
+		{"", "rows.csv", "", "rows.csv"},
+		{"zstd", "rows.csv", "zstd", "rows.csv"},
+		{"none", "rows.csv.gz", "", "rows.csv.gz"},
+	}
+
+	for _, tt := range tests {
+		c, base, err := codecForPath(tt.name, tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ""
+		if c != nil {
+			name = c.Name()
+		}
+		if name != tt.codec || base != tt.base {
+			t.Errorf("codecForPath(%q, %q) = %q, %q, want %q, %q", tt.name, tt.path, name, base, tt.codec, tt.base)
+		}
+	}
+
+	if _, err := CodecFor("lzma"); err == nil {
+		t.Error("CodecFor(lzma) didn't fail")
+	}
+}
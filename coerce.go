@@ -0,0 +1,247 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// ColumnType describes a source or destination column.
+type ColumnType = bulk.ColumnType
+
+// ColumnTyper is implemented by sources which know the database types of
+// their columns, enabling coercion rules matched on the source type.
+type ColumnTyper interface {
+	ColumnTypes() (types []ColumnType, err error)
+}
+
+// Coercion converts a source value for a destination column.
+type Coercion func(v interface{}) (interface{}, error)
+
+// CoerceRule converts the values of the columns matching every non-empty
+// field. Rules are tried in order before the default coercions.
+type CoerceRule struct {
+	Column  string //Destination column name
+	SrcType string //Source database type name, case insensitive
+	DstType string //Destination database type name, case insensitive
+	Coerce  Coercion
+}
+
+// Time layouts tried in order when converting strings to times.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+	"15:04:05.999999999",
+}
+
+// Converts []byte to string, leaving other values as is.
+func CoerceString(v interface{}) (interface{}, error) {
+	if b, ok := v.([]byte); ok {
+		return string(b), nil
+	}
+
+	return v, nil
+}
+
+// Converts 16 byte UUIDs to their canonical text form and other []byte
+// values to string.
+func CoerceUUID(v interface{}) (interface{}, error) {
+	if b, ok := v.([]byte); ok {
+		if len(b) == 16 {
+			return bulk.FormatUUID(b), nil
+		}
+		return string(b), nil
+	}
+
+	return v, nil
+}
+
+// Converts string to []byte, leaving other values as is.
+func CoerceBytes(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+
+	return v, nil
+}
+
+// Converts strings and booleans to int64.
+func CoerceInt(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case []byte:
+		return strconv.ParseInt(strings.TrimSpace(string(t)), 10, 64)
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+	case bool:
+		if t {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+
+	return v, nil
+}
+
+// Converts strings to float64.
+func CoerceFloat(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case []byte:
+		return strconv.ParseFloat(strings.TrimSpace(string(t)), 64)
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(t), 64)
+	}
+
+	return v, nil
+}
+
+// Converts exact decimal values to strings so no precision is lost.
+func CoerceDecimal(v interface{}) (interface{}, error) {
+	if b, ok := v.([]byte); ok {
+		return string(b), nil
+	}
+
+	return v, nil
+}
+
+// Converts integers and strings to bool.
+func CoerceBool(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case int64:
+		return t != 0, nil
+	case []byte:
+		return strconv.ParseBool(strings.TrimSpace(string(t)))
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(t))
+	}
+
+	return v, nil
+}
+
+// Converts strings to time.Time, trying the common SQL layouts.
+func CoerceTime(v interface{}) (interface{}, error) {
+	var s string
+
+	switch t := v.(type) {
+	case []byte:
+		s = string(t)
+	case string:
+		s = t
+	default:
+		return v, nil
+	}
+
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if tm, err := time.Parse(layout, s); err == nil {
+			return tm, nil
+		}
+	}
+
+	return nil, errors.Errorf("can't parse %q as a time", s)
+}
+
+// defaultCoercion returns the coercion for values written to a
+// destination type family, or nil if values are passed through.
+func defaultCoercion(family bulk.TypeFamily) Coercion {
+	switch family {
+	case bulk.FamilyString, bulk.FamilyJSON:
+		return CoerceString
+	case bulk.FamilyUUID:
+		return CoerceUUID
+	case bulk.FamilyInt:
+		return CoerceInt
+	case bulk.FamilyDecimal:
+		return CoerceDecimal
+	case bulk.FamilyFloat:
+		return CoerceFloat
+	case bulk.FamilyBool:
+		return CoerceBool
+	case bulk.FamilyDate, bulk.FamilyTime:
+		return CoerceTime
+	case bulk.FamilyBinary:
+		return CoerceBytes
+	}
+
+	return nil
+}
+
+// matches reports whether the rule applies to the column.
+func (r *CoerceRule) matches(column string, srcType string, dstType string) bool {
+	return (r.Column == "" || r.Column == column) &&
+		(r.SrcType == "" || strings.EqualFold(r.SrcType, srcType)) &&
+		(r.DstType == "" || strings.EqualFold(r.DstType, dstType))
+}
+
+// newCoerceStage returns a stage converting the values of each column
+// according to the rules and the source and destination column types,
+// or nil if no column needs converting.
+func newCoerceStage(rules []CoerceRule, columns []string, srcTypes []ColumnType, dstTypes []ColumnType) (s stage) {
+	coercions := make([]Coercion, len(columns))
+	active := false
+
+	for i, c := range columns {
+		var srcType, dstType string
+		if i < len(srcTypes) {
+			srcType = srcTypes[i].DatabaseType
+		}
+		if i < len(dstTypes) {
+			dstType = dstTypes[i].DatabaseType
+		}
+
+		for j := range rules {
+			if rules[j].matches(c, srcType, dstType) {
+				coercions[i] = rules[j].Coerce
+				break
+			}
+		}
+
+		if coercions[i] == nil {
+			coercions[i] = defaultCoercion(bulk.Family(dstType))
+		}
+
+		active = active || coercions[i] != nil
+	}
+
+	if !active {
+		return nil
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, coerce := range coercions {
+			if coerce == nil || values[i] == nil {
+				continue
+			}
+
+			if values[i], err = coerce(values[i]); err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, columns[i])
+			}
+		}
+
+		return values, nil
+	}
+}
+
+// destColumnTypes returns the destination column types where they can
+// be found.
+func destColumnTypes(ctx context.Context, cfg *Config, dstConn *sql.Conn, columns []string) (types []ColumnType, err error) {
+	// Without a catalog to query we can only coerce by rule
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if dstConn == nil || d == bulk.Generic {
+		return nil, nil
+	}
+
+	if types, err = bulk.DestColumnTypes(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, columns); err != nil {
+		return nil, errors.Annotatef(err, "finding column types of %s", cfg.DstTable)
+	}
+
+	return types, nil
+}
@@ -0,0 +1,104 @@
+package godatapipe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoercions(t *testing.T) {
+	tests := []struct {
+		name   string
+		coerce Coercion
+		in     interface{}
+		want   interface{}
+		fails  bool
+	}{
+		{"string bytes", CoerceString, []byte("abc"), "abc", false},
+		{"string int", CoerceString, int64(1), int64(1), false},
+		{"uuid bytes", CoerceUUID, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}, "12345678-9abc-def0-1234-56789abcdef0", false},
+		{"uuid text", CoerceUUID, []byte("12345678-9abc-def0-1234-56789abcdef0"), "12345678-9abc-def0-1234-56789abcdef0", false},
+		{"bytes string", CoerceBytes, "abc", []byte("abc"), false},
+		{"int text", CoerceInt, " 42 ", int64(42), false},
+		{"int bytes", CoerceInt, []byte("-7"), int64(-7), false},
+		{"int bool", CoerceInt, true, int64(1), false},
+		{"int float", CoerceInt, 1.5, 1.5, false},
+		{"int bad", CoerceInt, "4.2", nil, true},
+		{"float text", CoerceFloat, "1.25", 1.25, false},
+		{"float bad", CoerceFloat, "abc", nil, true},
+		{"decimal bytes", CoerceDecimal, []byte("12345678901234567890.12"), "12345678901234567890.12", false},
+		{"bool int", CoerceBool, int64(0), false, false},
+		{"bool text", CoerceBool, "true", true, false},
+		{"bool bytes", CoerceBool, []byte("1"), true, false},
+		{"bool bad", CoerceBool, "yes", nil, true},
+		{"time rfc3339", CoerceTime, "2024-05-06T07:08:09.5Z", time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.UTC), false},
+		{"time sql", CoerceTime, []byte("2024-05-06 07:08:09"), time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC), false},
+		{"time offset", CoerceTime, "2024-05-06 07:08:09+02", time.Date(2024, 5, 6, 5, 8, 9, 0, time.UTC), false},
+		{"time date", CoerceTime, "2024-05-06", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), false},
+		{"time bad", CoerceTime, "06/05/2024", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.coerce(tt.in)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: coercing %v didn't fail", tt.name, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if tm, ok := got.(time.Time); ok {
+			if !tm.Equal(tt.want.(time.Time)) {
+				t.Errorf("%s = %v, want %v", tt.name, tm, tt.want)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCoerceStage(t *testing.T) {
+	upper := func(v interface{}) (interface{}, error) { return strings.ToUpper(v.(string)), nil }
+
+	columns := []string{"id", "code", "active", "note", "raw"}
+	srcTypes := []ColumnType{{DatabaseType: "TEXT"}, {DatabaseType: "TEXT"}, {DatabaseType: "INT"}, {DatabaseType: "CLOB"}, {DatabaseType: "TEXT"}}
+	dstTypes := []ColumnType{{DatabaseType: "bigint"}, {DatabaseType: "varchar"}, {DatabaseType: "boolean"}, {DatabaseType: "text"}, {DatabaseType: "interval"}}
+	rules := []CoerceRule{
+		{Column: "code", Coerce: upper},
+		{SrcType: "clob", DstType: "TEXT", Coerce: func(v interface{}) (interface{}, error) { return "clob", nil }},
+		{Column: "code", Coerce: CoerceString},
+	}
+
+	s := newCoerceStage(rules, columns, srcTypes, dstTypes)
+	if s == nil {
+		t.Fatal("no coerce stage")
+	}
+
+	row, err := s(1, []interface{}{"12", "ab", int64(1), "x", []byte("1 day")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{int64(12), "AB", true, "clob", []byte("1 day")}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("coerced row = %#v, want %#v", row, want)
+	}
+
+	row, err = s(2, []interface{}{nil, "cd", nil, nil, nil})
+	if err != nil || row[0] != nil || row[2] != nil {
+		t.Errorf("coerced NULLs = %#v, %v", row, err)
+	}
+
+	if _, err = s(3, []interface{}{"x", "ab", int64(1), "x", nil}); err == nil || !strings.Contains(err.Error(), "row 3: column id") {
+		t.Errorf("bad int error = %v", err)
+	}
+
+	if s = newCoerceStage(nil, columns, nil, []ColumnType{{DatabaseType: "interval"}}); s != nil {
+		t.Error("coerce stage without any coercions")
+	}
+}
@@ -0,0 +1,71 @@
+package godatapipe
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// newProjectStage returns a stage keeping the included columns, in the
+// order given, minus the excluded ones. Returns a nil stage if every
+// column is kept in source order.
+func newProjectStage(include []string, exclude []string, columns []string, types []ColumnType) (s stage, outColumns []string, outTypes []ColumnType, err error) {
+	var positions []int
+
+	if len(include) == 0 {
+		include = columns
+	}
+
+	for _, name := range include {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, nil, nil, errors.Trace(sourceColumnError(name, "included"))
+		}
+		if indexOf(exclude, name) < 0 {
+			positions = append(positions, pos)
+		}
+	}
+
+	for _, name := range exclude {
+		if indexOf(columns, name) < 0 {
+			return nil, nil, nil, errors.Trace(sourceColumnError(name, "excluded"))
+		}
+	}
+
+	if len(positions) == 0 {
+		return nil, nil, nil, errors.New("every source column is excluded")
+	}
+
+	identity := len(positions) == len(columns)
+	for i, pos := range positions {
+		outColumns = append(outColumns, columns[pos])
+		if pos < len(types) {
+			outTypes = append(outTypes, types[pos])
+		}
+		identity = identity && pos == i
+	}
+
+	if identity {
+		return nil, columns, types, nil
+	}
+
+	row := make([]interface{}, len(positions))
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		for i, pos := range positions {
+			row[i] = values[pos]
+		}
+		return row, nil
+	}, outColumns, outTypes, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,50 @@
+package godatapipe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestColumnLists(t *testing.T) {
+	columns := []string{"id", "name", "secret", "note"}
+	rows := [][]interface{}{{int64(1), "a", "s1", "n1"}, {int64(2), "b", "s2", "n2"}}
+
+	tests := []struct {
+		include, exclude []string
+		columns          []string
+		rows             [][]interface{}
+		err              string
+	}{
+		{nil, nil, columns, rows, ""},
+		{[]string{"note", "id"}, nil, []string{"note", "id"}, [][]interface{}{{"n1", int64(1)}, {"n2", int64(2)}}, ""},
+		{nil, []string{"secret"}, []string{"id", "name", "note"}, [][]interface{}{{int64(1), "a", "n1"}, {int64(2), "b", "n2"}}, ""},
+		{[]string{"name", "secret"}, []string{"secret"}, []string{"name"}, [][]interface{}{{"a"}, {"b"}}, ""},
+		{[]string{"missing"}, nil, nil, nil, "missing"},
+		{nil, []string{"missing"}, nil, nil, "missing"},
+		{[]string{"id"}, []string{"id"}, nil, nil, "every source column is excluded"},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{MaxRowBufSz: 10, Columns: tt.include, ExcludeColumns: tt.exclude}
+		got, written, err := copyColumns(t, cfg, columns, rows)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v minus %v error = %v, want %q", tt.include, tt.exclude, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.columns) || !reflect.DeepEqual(written, tt.rows) {
+			t.Errorf("%v minus %v = %v %v, %v, want %v %v", tt.include, tt.exclude, got, written, err, tt.columns, tt.rows)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(" a, ,b ,"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("splitList = %q", got)
+	}
+	if got := splitList(""); got != nil {
+		t.Errorf("splitList of nothing = %q", got)
+	}
+}
@@ -3,67 +3,586 @@ package godatapipe
 import (
 	"database/sql"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/joescharf/go-datapipe/bulk"
 	"github.com/juju/errors"
 )
 
 type Config struct {
 	MaxRowBufSz    int //Maximum number of rows to buffer at a time
 	MaxRowTxCommit int //Maximum number of rows to process before committing the database transaction
+	LargeValueSz   int //Size in bytes at which a row holding a large value is written on its own
+	MaxBufBytes    int //Maximum number of string and binary value bytes to buffer at a time
+	MaxBatchBytes  int //Maximum estimated size of the values in an insert batch
 
-	SrcConn      *sql.Conn // Source database connection overrides Driver/Uri
-	SrcDbDriver  string    //Source database driver name
-	SrcDbUri     string    //Source database driver URI
-	SrcSelectSql string    //Source database select SQL statement
+	HealthProbe         HealthProbe   //Checked between insert batches to pause while the destination is under pressure
+	HealthCheckInterval time.Duration //Minimum time between health probe checks
 
-	DstConn     *sql.Conn // Destination database connection overrides Driver/Uri
-	DstDbDriver string    //Destination database driver name
-	DstDbUri    string    //Destination database driver URI
-	DstSchema   string
-	DstTable    string //Destination database table name
+	BatchRetries      int  //Times a failed insert batch is retried from a savepoint
+	SkipFailedBatches bool //Skip insert batches which still fail instead of failing the copy
 
-	ShowStackTrace bool //Display stack traces on error
+	DiagnoseErrors    bool //Retry a failed insert batch row by row to report the rejected row
+	RedactErrorValues bool //Leave row values out of errors
+
+	SrcConn        *sql.Conn   //Source connection used as is, overrides SrcDB and SrcDbUri, never closed by the run
+	SrcDB          *sql.DB     //Source database a connection is taken from, overrides SrcDbUri, the connection is returned after the run
+	SrcConnOptions ConnOptions //Pool and timeout settings when the source connection is opened from SrcDbUri
+	SrcSessionSQL  []string    //Statements run on the source connection before reading, e.g. SET search_path
+	SrcDbDriver    string      //Source database driver name
+	SrcDbUri       string      //Source database driver URI
+	SrcDbPassword  string      //Source password or secret reference, replaces the URI's password
+	SrcSelectSql   string      //Source database select SQL statement
+
+	SrcSelectArgs      []interface{}          //Bind parameters of the source select
+	SrcSelectNamedArgs map[string]interface{} //Named bind parameters of the source select, for drivers supporting them
+
+	SampleRows    int     //Only copy this many source rows, for trying out a pipeline
+	SamplePercent float64 //Only copy a random sample of about this percentage of the source rows
+
+	SrcTable     string //Source table as schema.table, for reading its catalog
+	SrcTables    string //Source tables copied by TableJobs, as a schema.pattern or pattern matched with path.Match
+	IncludeViews bool   //Also copy the views matching SrcTables as tables
+	SrcKeyColumn string //Source key column the select is paginated on, read a chunk at a time
+	SrcChunkSize int    //Number of rows per chunk when SrcKeyColumn is set, or per cursor fetch
+	SrcCursor    bool   //Read the select through a server-side cursor
+	Source       Source //Custom row source overrides the Src* settings, closed once the copy is done
+
+	SrcShards     []Shard //Sources merged into the destination table instead of SrcDbUri
+	ShardColumn   string  //Destination column set to each row's shard name
+	ShardParallel int     //Number of shards read at once, 1 reads them in turn
+
+	CDCSlot         string        //Postgres logical replication slot (wal2json) to stream changes from instead of copying
+	CDCTable        string        //Source table the changes are read for, as schema.table
+	CDCKeyColumns   []string      //Destination key columns changes are applied on, defaults to the primary key
+	CDCPollInterval time.Duration //How long to wait for more changes once the slot is drained
+
+	DstConn        *sql.Conn   //Destination connection used as is, overrides DstDB and DstDbUri, never closed by the run
+	DstDB          *sql.DB     //Destination database a connection is taken from, overrides DstDbUri, the connection is returned after the run
+	DstWriter      bulk.Writer //Custom destination writer, such as bulk.MemorySink, overrides the writer for DstDbDriver
+	DstConnOptions ConnOptions //Pool and timeout settings when the destination connection is opened from DstDbUri
+	DstSessionSQL  []string    //Statements run on the destination connection before writing, e.g. SET NAMES utf8mb4
+	DstDbDriver    string      //Destination database driver name
+	DstDbUri       string      //Destination database driver URI
+	DstDbPassword  string      //Destination password or secret reference, replaces the URI's password
+	DstSchema      string
+	DstTable       string //Destination database table name
+
+	LoadMode    LoadMode //How the copied rows replace the destination rows
+	KeyColumns  []string //Destination key columns rows are matched on when mirroring or diffing, defaults to the primary key, or the business keys for LoadSCD2
+	DiffColumns []string //Columns hashed to find the rows which changed when diffing, or compared for LoadSCD2, defaults to all of them
+	HashColumn  string   //Destination column keeping each row's hash when diffing
+	HashTable   string   //Destination table keeping the row hashes when diffing without HashColumn, defaults to DstTable_hashes
+
+	EffectiveFromColumn string //Destination column of when a LoadSCD2 version became current, defaults to effective_from
+	EffectiveToColumn   string //Destination column of when a LoadSCD2 version was replaced, defaults to effective_to
+	CurrentColumn       string //Destination boolean column of whether a LoadSCD2 version is current, defaults to is_current
+
+	SyncColumn      string           //Column holding each row's last update time, for Sync
+	ConflictPolicy  ConflictPolicy   //Which row Sync keeps when it changed on both sides
+	ResolveConflict ConflictResolver //Resolves Sync's conflicts with ConflictCustom
+	MissingTable    MissingTable     //What to do when the destination table doesn't exist
+	CopyComments    bool             //Copy SrcTable's table and column comments to a table created for MissingTableCreate
+
+	PartitionColumn string //Destination column whose value names the child table each row is written to, DstTable_<value>
+	PartitionLayout string //Go time layout of time partition values in child table names, defaults to 2006_01
+
+	CreatePartitions PartitionInterval //Create the destination's missing range partitions covering the source rows' PartitionKey values, Postgres and MySQL
+	PartitionKey     string            //Source date column the created partitions cover
+
+	TimeColumn    string        //Time column of time-series destinations: a TimescaleDB hypertable's, or InfluxDB points' times
+	TagColumns    []string      //Columns identifying each series: indexed with TimeColumn on TimescaleDB, or InfluxDB points' tags
+	ChunkInterval time.Duration //Time each hypertable chunk covers, TimescaleDB's default if 0
+
+	RunLock     RunLock       //Whether runs lock the destination table against other runs
+	LockTimeout time.Duration //Longest LockWait waits for the lock, forever if 0
+
+	TruncateCascade bool //Also truncate the tables referencing the destination table when replacing, Postgres only
+	RestartIdentity bool //Reset the destination table's identity columns when replacing
+
+	SoftDeleteColumn     string           //Source column marking deleted rows, such as deleted_at
+	SoftDeleteAction     SoftDeleteAction //What happens to rows marked as deleted
+	SoftDeleteFlagColumn string           //Destination column set for SoftDeleteFlag, defaults to is_deleted
+
+	SchemaDrift SchemaDrift //What to do when the copied columns don't match the destination table
+
+	RowFilter     RowFilter //Reports whether a source row should be copied
+	RowFilterExpr string    //Filter expression over the source columns, see ParseRowFilter
+
+	DedupeColumns []string //Source key columns used to drop duplicate rows
+	DedupeMaxKeys int      //Maximum number of keys remembered for deduplication, 0 for all of them
+
+	JSONPaths []JSONPath //Columns of the values at paths in JSON source columns, added before Columns and ExcludeColumns are applied
+
+	Columns        []string //Source columns to copy, in destination order, defaults to all of them
+	ExcludeColumns []string //Source columns not to copy
+
+	IdentityInsert      bool //Allow explicit values in SQL Server identity columns while copying
+	SkipIdentityColumns bool //Leave destination identity/auto-increment columns for the database to fill
+	ResyncSequences     bool //Move Postgres serial/identity sequences past the copied values afterwards
+	CopyIndexes         bool //Recreate the source table's primary key and indexes on the destination after loading
+	CopyForeignKeys     bool //Also add the source table's foreign keys, referencing tables in DstSchema
+
+	ExtraColumns  []ExtraColumn  //Destination columns added to every row, such as constants or the copy time
+	SurrogateKeys []SurrogateKey //Destination key columns generated for every row, after ExtraColumns
+
+	NullPolicies map[string]NullPolicy //How NULL values are written, keyed by column name
+	Assertions   []*Assertion          //Checks of the destination columns' values made on each row
+	CoerceRules  []CoerceRule          //Value conversions tried before the defaults for the destination column types
+
+	TextEncoding TextEncoding //Encoding of the source text, converted to UTF-8 as it's read
+	InvalidText  InvalidText  //What happens to bytes which aren't valid in TextEncoding
+
+	GeoColumns []string  //Source geometry columns, found by type for MySQL and SQL Server but not Postgres
+	GeoFormat  GeoFormat //How geometry values are written
+
+	ColumnTransforms map[string]ValueTransform //Value rewrites such as masking, keyed by column name
+	Transform        RowTransform              //Row rewrite applied just before each row is written
+	TransformBatch   BatchTransform            //Rewrite of each batch of up to MaxRowBufSz rows, applied after Transform and Lookups
+	Lookups          []*Lookup                 //Replacements of destination columns' values by queries on other databases, applied to each batch after Transform
+
+	GroupBy    []string    //Columns rows are rolled up on, writing a row of their values and the Aggregates for each group
+	Aggregates []Aggregate //Columns computed from each group's rows, after the batch transforms
+	Pivot      *Pivot      //Turns rows into columns, after the batch transforms, instead of aggregating
+	Unpivot    *Unpivot    //Turns columns into rows, after the batch transforms and before any aggregation or pivot
+
+	TimeMode    TimeMode //How temporal values are transferred
+	SrcTimeZone string   //IANA time zone naive source times are read in for TimeConvert
+	DstTimeZone string   //IANA time zone times are written in for TimeConvert and TimeWallClock
+	TimeFormat  string   //Go time layout used to write times as strings, for dialects which round-trip them as text
+
+	StopPolicy StopPolicy //What to do with rows read so far when the pipeline is stopped
+
+	Schedule       Schedule      //When RunForever runs the pipeline
+	ScheduleJitter time.Duration //Maximum random delay added to each scheduled run
+	OnEvent        EventHandler  //Receives run events
+
+	RowEstimate      RowEstimate   //How source rows are estimated for progress events
+	ProgressInterval time.Duration //Time between progress events, 0 for none
+	StatusAddr       string        //Address the command serves /healthz and /status on, none if empty
+	ControlToken     string        //Bearer token, or secret reference, every daemon control request needs
+
+	ReportFile   string       //File the command writes a report of the run to, none if empty
+	ReportFormat ReportFormat //Format of ReportFile, by default from its extension
+
+	Notifiers []Notifier //Told the outcome of each run
+	NotifyOn  NotifyOn   //Which runs Notifiers are told about
+
+	AuditRuns  bool   //Record each run in an audit table on the destination
+	AuditTable string //Name of the audit table in DstSchema, defaults to _datapipe_runs
+
+	PipelineName   string     //Name the pipeline's state is saved under, defaults to DstTable
+	IdempotencyKey string     //Key of the run, a retry of a run with the key which succeeded returns its result without copying
+	StateStore     StateStore //Where state is kept between runs
+	StateTable     string     //Destination table to keep state in when StateStore isn't set
+
+	WatermarkColumn string //Source column whose highest copied value is saved as the pipeline's watermark
+
+	ColumnStats bool //Collect statistics of the values written to each column into Result.ColumnStats
+
+	ShowStackTrace bool   //Display stack traces on error
+	StatusFile     string //File the command writes its final status to as JSON, none if empty
+
+	SrcFile        string         //CSV, JSON lines or Avro file to read instead of a source database
+	SrcFileFormat  string         //csv, jsonl or avro, defaults to SrcFile's extension
+	SrcCompression string         //gzip, zstd, snappy or none, defaults to SrcFile's extension
+	DstFile        string         //CSV, JSON lines or Avro file to write instead of a destination database
+	DstFileFormat  string         //csv, jsonl or avro, defaults to DstFile's extension
+	DstCompression string         //gzip, zstd, snappy or none for DstFile and snapshots, or an Avro DstFile's null or deflate codec, defaults to DstFile's extension and gzip for snapshots
+	SrcRecordURI   string         //URI of an Arrow-native source queried with SrcSelectSql instead of a source database, e.g. flightsql://host:32010
+	DstRecordURI   string         //URI of an Arrow-native destination written instead of a destination database
+	AvroTypes      AvroTypes      //Avro types of the DstFile columns without an exact one
+	SchemaRegistry string         //Confluent Schema Registry URL an Avro DstFile's schema is registered with, none if empty
+	SchemaSubject  string         //Registry subject of the DstFile schema, defaults to DstFile's name followed by -value
+	SchemaLookup   bool           //Only look up the DstFile schema in the registry, failing if it isn't registered
+	EncryptionKey  string         //Secret reference to the hex or base64 AES key encrypting DstFile and snapshots, and decrypting SrcFile and imports
+	SrcAPI         RESTOptions    //Paginated HTTP API to read JSON records from instead of a source database, if its URL is set
+	DstAPI         WebhookOptions //HTTP endpoint to post batches of rows to instead of a destination database, if its URL is set
+
+	plan *Plan      //Plan the config was made for, whose templates are already rendered
+	diff *diffState //Hashes of the rows a LoadDiff run writes
 }
 
 func (c *Config) Init() (err error) {
 	if os.Getenv("SHOW_STACK_TRACE") != "" {
 		c.ShowStackTrace = true
 	}
+	c.StatusFile = os.Getenv("STATUS_FILE")
 
 	c.MaxRowBufSz, _ = c.EnvInt("MAX_ROW_BUF_SZ", 100)
 	c.MaxRowTxCommit, _ = c.EnvInt("MAX_ROW_TX_COMMIT", 500)
+	c.LargeValueSz, _ = c.EnvInt("LARGE_VALUE_SZ", 0)
+	c.MaxBufBytes, _ = c.EnvInt("MAX_BUF_BYTES", 0)
+	c.MaxBatchBytes, _ = c.EnvInt("MAX_BATCH_BYTES", 0)
+	pause := 5 * time.Second
+	if s := os.Getenv("HEALTH_PAUSE"); s != "" {
+		if pause, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("HEALTH_PAUSE", err))
+		}
+	}
+	if c.HealthProbe, err = parseHealthProbe(os.Getenv("HEALTH_PROBE"), pause); err != nil {
+		return errors.Trace(newConfigError("HEALTH_PROBE", err))
+	}
+	c.HealthCheckInterval = 5 * time.Second
+	if s := os.Getenv("HEALTH_CHECK_INTERVAL"); s != "" {
+		if c.HealthCheckInterval, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("HEALTH_CHECK_INTERVAL", err))
+		}
+	}
+
+	c.BatchRetries, _ = c.EnvInt("BATCH_RETRIES", 0)
+	c.SkipFailedBatches = os.Getenv("SKIP_FAILED_BATCHES") != ""
+	c.DiagnoseErrors = os.Getenv("DIAGNOSE_ERRORS") != ""
+	c.RedactErrorValues = os.Getenv("REDACT_ERROR_VALUES") != ""
+
+	if os.Getenv("STOP_POLICY") == "rollback" {
+		c.StopPolicy = StopRollback
+	}
+
+	c.IdentityInsert = os.Getenv("IDENTITY_INSERT") != ""
+	c.SkipIdentityColumns = os.Getenv("SKIP_IDENTITY_COLUMNS") != ""
+	c.ResyncSequences = os.Getenv("RESYNC_SEQUENCES") != ""
+	c.CopyIndexes = os.Getenv("COPY_INDEXES") != ""
+	c.CopyForeignKeys = os.Getenv("COPY_FOREIGN_KEYS") != ""
+
+	if c.LoadMode, err = ParseLoadMode(os.Getenv("LOAD_MODE")); err != nil {
+		return errors.Trace(newConfigError("LOAD_MODE", err))
+	}
+	c.KeyColumns = splitList(os.Getenv("KEY_COLUMNS"))
+	c.DiffColumns = splitList(os.Getenv("DIFF_COLUMNS"))
+	c.HashColumn = os.Getenv("HASH_COLUMN")
+	c.HashTable = os.Getenv("HASH_TABLE")
+	c.EffectiveFromColumn = os.Getenv("SCD_FROM_COLUMN")
+	c.EffectiveToColumn = os.Getenv("SCD_TO_COLUMN")
+	c.CurrentColumn = os.Getenv("SCD_CURRENT_COLUMN")
+	c.SyncColumn = os.Getenv("SYNC_COLUMN")
+	if c.ConflictPolicy, err = ParseConflictPolicy(os.Getenv("CONFLICT_POLICY")); err != nil {
+		return errors.Trace(newConfigError("CONFLICT_POLICY", err))
+	}
+	if c.MissingTable, err = ParseMissingTable(os.Getenv("MISSING_TABLE")); err != nil {
+		return errors.Trace(newConfigError("MISSING_TABLE", err))
+	}
+	c.CopyComments = os.Getenv("COPY_COMMENTS") != ""
+	c.PartitionColumn = os.Getenv("PARTITION_COLUMN")
+	c.PartitionLayout = os.Getenv("PARTITION_LAYOUT")
+	if c.CreatePartitions, err = ParsePartitionInterval(os.Getenv("CREATE_PARTITIONS")); err != nil {
+		return errors.Trace(newConfigError("CREATE_PARTITIONS", err))
+	}
+	c.PartitionKey = os.Getenv("PARTITION_KEY")
+	c.TimeColumn = os.Getenv("TIME_COLUMN")
+	c.TagColumns = splitList(os.Getenv("TAG_COLUMNS"))
+	if s := os.Getenv("CHUNK_INTERVAL"); s != "" {
+		if c.ChunkInterval, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("CHUNK_INTERVAL", err))
+		}
+	}
+	if c.RunLock, err = ParseRunLock(os.Getenv("RUN_LOCK")); err != nil {
+		return errors.Trace(newConfigError("RUN_LOCK", err))
+	}
+	if s := os.Getenv("LOCK_TIMEOUT"); s != "" {
+		if c.LockTimeout, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("LOCK_TIMEOUT", err))
+		}
+	}
+	c.TruncateCascade = os.Getenv("TRUNCATE_CASCADE") != ""
+	c.RestartIdentity = os.Getenv("RESTART_IDENTITY") != ""
+
+	c.SoftDeleteColumn = os.Getenv("SOFT_DELETE_COLUMN")
+	if c.SoftDeleteAction, err = ParseSoftDeleteAction(os.Getenv("SOFT_DELETE_ACTION")); err != nil {
+		return errors.Trace(newConfigError("SOFT_DELETE_ACTION", err))
+	}
+	c.SoftDeleteFlagColumn = os.Getenv("SOFT_DELETE_FLAG_COLUMN")
+
+	if c.SchemaDrift, err = ParseSchemaDrift(os.Getenv("SCHEMA_DRIFT")); err != nil {
+		return errors.Trace(newConfigError("SCHEMA_DRIFT", err))
+	}
+
+	c.RowFilterExpr = os.Getenv("ROW_FILTER")
+
+	c.DedupeColumns = splitList(os.Getenv("DEDUPE_COLUMNS"))
+	c.DedupeMaxKeys, _ = c.EnvInt("DEDUPE_MAX_KEYS", 0)
+
+	if c.JSONPaths, err = ParseJSONPaths(os.Getenv("JSON_PATHS")); err != nil {
+		return errors.Trace(newConfigError("JSON_PATHS", err))
+	}
+
+	c.Columns = splitList(os.Getenv("SRC_COLUMNS"))
+	c.ExcludeColumns = splitList(os.Getenv("SRC_EXCLUDE_COLUMNS"))
+
+	if c.ExtraColumns, err = ParseExtraColumns(os.Getenv("EXTRA_COLUMNS")); err != nil {
+		return errors.Trace(newConfigError("EXTRA_COLUMNS", err))
+	}
+	if c.SurrogateKeys, err = ParseSurrogateKeys(os.Getenv("SURROGATE_KEYS")); err != nil {
+		return errors.Trace(newConfigError("SURROGATE_KEYS", err))
+	}
 
-	if c.SrcDbDriver, err = c.EnvStr("SRC_DB_DRIVER"); err != nil {
+	if c.TimeMode, err = ParseTimeMode(os.Getenv("TIME_MODE")); err != nil {
+		return errors.Trace(newConfigError("TIME_MODE", err))
+	}
+	c.SrcTimeZone = os.Getenv("SRC_TIME_ZONE")
+	c.DstTimeZone = os.Getenv("DST_TIME_ZONE")
+	c.TimeFormat = os.Getenv("TIME_FORMAT")
+
+	if c.TextEncoding, err = ParseTextEncoding(os.Getenv("SRC_TEXT_ENCODING")); err != nil {
+		return errors.Trace(newConfigError("SRC_TEXT_ENCODING", err))
+	}
+	if c.InvalidText, err = ParseInvalidText(os.Getenv("INVALID_TEXT")); err != nil {
+		return errors.Trace(newConfigError("INVALID_TEXT", err))
+	}
+
+	c.GeoColumns = splitList(os.Getenv("GEO_COLUMNS"))
+	if c.GeoFormat, err = ParseGeoFormat(os.Getenv("GEO_FORMAT")); err != nil {
+		return errors.Trace(newConfigError("GEO_FORMAT", err))
+	}
+
+	if spec := os.Getenv("COLUMN_TRANSFORMS"); spec != "" {
+		if c.ColumnTransforms, err = ParseColumnTransforms(spec); err != nil {
+			return errors.Trace(newConfigError("COLUMN_TRANSFORMS", err))
+		}
+	}
+
+	if spec := os.Getenv("NULL_POLICIES"); spec != "" {
+		if c.NullPolicies, err = ParseNullPolicies(spec); err != nil {
+			return errors.Trace(newConfigError("NULL_POLICIES", err))
+		}
+	}
+
+	if c.Assertions, err = ParseAssertions(os.Getenv("ASSERTIONS")); err != nil {
+		return errors.Trace(newConfigError("ASSERTIONS", err))
+	}
+
+	c.GroupBy = splitList(os.Getenv("GROUP_BY"))
+	if c.Aggregates, err = ParseAggregates(os.Getenv("AGGREGATES")); err != nil {
+		return errors.Trace(newConfigError("AGGREGATES", err))
+	}
+
+	if columns := splitList(os.Getenv("UNPIVOT_COLUMNS")); len(columns) > 0 {
+		c.Unpivot = &Unpivot{
+			Columns:     columns,
+			NameColumn:  os.Getenv("UNPIVOT_NAME_COLUMN"),
+			ValueColumn: os.Getenv("UNPIVOT_VALUE_COLUMN"),
+			KeepNulls:   os.Getenv("UNPIVOT_KEEP_NULLS") != ""}
+	}
+	if names := splitList(os.Getenv("PIVOT_NAMES")); len(names) > 0 {
+		c.Pivot = &Pivot{Names: names, Keys: splitList(os.Getenv("PIVOT_KEYS"))}
+		if c.Pivot.NameColumn, err = c.EnvStr("PIVOT_NAME_COLUMN"); err != nil {
+			return errors.Trace(err)
+		}
+		if c.Pivot.ValueColumn, err = c.EnvStr("PIVOT_VALUE_COLUMN"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if column := os.Getenv("LOOKUP_COLUMN"); column != "" {
+		l := &Lookup{Column: column, DbPassword: c.envPassword("LOOKUP_")}
+		if l.Query, err = c.EnvStr("LOOKUP_QUERY"); err != nil {
+			return errors.Trace(err)
+		}
+		if l.DbUri, err = c.EnvStr("LOOKUP_DB_URI"); err != nil {
+			return errors.Trace(err)
+		}
+		l.CacheSize, _ = c.EnvInt("LOOKUP_CACHE_SIZE", 0)
+		if l.Missing, err = ParseLookupMissing(os.Getenv("LOOKUP_MISSING")); err != nil {
+			return errors.Trace(newConfigError("LOOKUP_MISSING", err))
+		}
+		c.Lookups = []*Lookup{l}
+	}
+
+	// Generated rows don't need a source database
+	if n, _ := c.EnvInt("SRC_GENERATE_ROWS", 0); n > 0 {
+		var columns []GenColumn
+		if columns, err = ParseGenColumns(os.Getenv("SRC_GENERATE_COLUMNS")); err != nil {
+			return errors.Trace(newConfigError("SRC_GENERATE_COLUMNS", err))
+		}
+		seed, _ := c.EnvInt("SRC_GENERATE_SEED", 1)
+		c.Source = NewGeneratorSource(n, int64(seed), columns...)
+	}
+
+	// Files don't need a source or destination database
+	c.SrcFile = os.Getenv("SRC_FILE")
+	c.SrcFileFormat = os.Getenv("SRC_FILE_FORMAT")
+	c.SrcCompression = os.Getenv("SRC_COMPRESSION")
+	c.DstFile = os.Getenv("DST_FILE")
+	c.DstFileFormat = os.Getenv("DST_FILE_FORMAT")
+	c.DstCompression = os.Getenv("DST_COMPRESSION")
+	c.EncryptionKey = os.Getenv("ENCRYPTION_KEY")
+	if c.AvroTypes, err = ParseAvroTypes(os.Getenv("AVRO_TYPES")); err != nil {
+		return errors.Trace(newConfigError("AVRO_TYPES", err))
+	}
+	c.SchemaRegistry = os.Getenv("SCHEMA_REGISTRY_URL")
+	c.SchemaSubject = os.Getenv("SCHEMA_SUBJECT")
+	c.SchemaLookup = os.Getenv("SCHEMA_LOOKUP") == "true"
+	c.SrcRecordURI = os.Getenv("SRC_RECORD_URI")
+	c.DstRecordURI = os.Getenv("DST_RECORD_URI")
+	c.SrcAPI.URL = os.Getenv("SRC_API_URL")
+	if c.SrcAPI.Pagination, err = ParsePagination(os.Getenv("SRC_API_PAGINATION")); err != nil {
+		return errors.Trace(newConfigError("SRC_API_PAGINATION", err))
+	}
+	c.SrcAPI.PageParam = os.Getenv("SRC_API_PAGE_PARAM")
+	c.SrcAPI.CursorPath = os.Getenv("SRC_API_CURSOR_PATH")
+	c.SrcAPI.RecordsPath = os.Getenv("SRC_API_RECORDS_PATH")
+	if c.SrcAPI.Columns, err = ParseRESTColumns(os.Getenv("SRC_API_COLUMNS")); err != nil {
+		return errors.Trace(newConfigError("SRC_API_COLUMNS", err))
+	}
+	c.SrcAPI.Auth = os.Getenv("SRC_API_AUTH")
+	c.DstAPI.URL = os.Getenv("DST_API_URL")
+	c.DstAPI.Auth = os.Getenv("DST_API_AUTH")
+	if c.DstAPI.Headers, err = ParseWebhookHeaders(os.Getenv("DST_API_HEADERS")); err != nil {
+		return errors.Trace(newConfigError("DST_API_HEADERS", err))
+	}
+	generated := c.Source != nil || c.SrcFile != "" || c.SrcAPI.URL != ""
+	noDstTable := c.DstFile != "" || c.DstAPI.URL != ""
+	noDstDB := noDstTable || c.DstRecordURI != ""
+
+	if c.SrcDbDriver, err = c.EnvStr("SRC_DB_DRIVER"); err != nil && !generated && c.SrcRecordURI == "" {
+		return errors.Trace(err)
+	}
+	if c.SrcShards, err = parseShards(os.Getenv("SRC_SHARDS")); err != nil {
+		return errors.Trace(newConfigError("SRC_SHARDS", err))
+	}
+	c.ShardColumn = os.Getenv("SHARD_COLUMN")
+	c.ShardParallel, _ = c.EnvInt("SHARD_PARALLEL", 1)
+
+	if c.SrcDbUri, err = c.envURI("SRC_", c.SrcDbDriver); err != nil && len(c.SrcShards) == 0 && !generated && c.SrcRecordURI == "" {
+		return errors.Trace(err)
+	}
+	c.SrcDbPassword = c.envPassword("SRC_")
+	for _, v := range splitList(os.Getenv("SRC_DB_SELECT_ARGS")) {
+		c.SrcSelectArgs = append(c.SrcSelectArgs, v)
+	}
+	for _, kv := range splitList(os.Getenv("SRC_DB_SELECT_NAMED_ARGS")) {
+		name, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return errors.Trace(newConfigError("SRC_DB_SELECT_NAMED_ARGS", errors.NotValidf("argument %q, expected name=value", kv)))
+		}
+		if c.SrcSelectNamedArgs == nil {
+			c.SrcSelectNamedArgs = map[string]interface{}{}
+		}
+		c.SrcSelectNamedArgs[name] = v
+	}
+	// Each of the tables has its own select and destination table
+	c.SrcTables = os.Getenv("SRC_TABLES")
+	c.IncludeViews = os.Getenv("INCLUDE_VIEWS") != ""
+	tables := c.SrcTables != ""
+
+	if c.SrcSelectSql, err = c.EnvStr("SRC_DB_SELECT_SQL"); err != nil && !generated && !tables {
 		return errors.Trace(err)
 	}
-	if c.SrcDbUri, err = c.EnvStr("SRC_DB_URI"); err != nil {
+
+	if c.SrcConnOptions, err = c.connOptions("SRC_"); err != nil {
 		return errors.Trace(err)
 	}
-	if c.SrcSelectSql, err = c.EnvStr("SRC_DB_SELECT_SQL"); err != nil {
+	if c.DstConnOptions, err = c.connOptions("DST_"); err != nil {
 		return errors.Trace(err)
 	}
 
-	if c.DstDbDriver, err = c.EnvStr("DST_DB_DRIVER"); err != nil {
+	c.SrcSessionSQL = splitStatements(os.Getenv("SRC_SESSION_SQL"))
+	c.DstSessionSQL = splitStatements(os.Getenv("DST_SESSION_SQL"))
+
+	c.SampleRows, _ = c.EnvInt("SAMPLE_ROWS", 0)
+	if s := os.Getenv("SAMPLE_PERCENT"); s != "" {
+		if c.SamplePercent, err = strconv.ParseFloat(s, 64); err != nil {
+			return errors.Trace(newConfigError("SAMPLE_PERCENT", err))
+		}
+	}
+
+	c.SrcTable = os.Getenv("SRC_TABLE")
+	c.SrcKeyColumn = os.Getenv("SRC_KEY_COLUMN")
+	c.SrcChunkSize, _ = c.EnvInt("SRC_CHUNK_SIZE", 10000)
+	c.SrcCursor = os.Getenv("SRC_CURSOR") == "true"
+
+	c.CDCSlot = os.Getenv("CDC_SLOT")
+	c.CDCTable = os.Getenv("CDC_TABLE")
+	c.CDCKeyColumns = splitList(os.Getenv("CDC_KEY_COLUMNS"))
+	if s := os.Getenv("CDC_POLL_INTERVAL"); s != "" {
+		if c.CDCPollInterval, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("CDC_POLL_INTERVAL", err))
+		}
+	}
+
+	if c.DstDbDriver, err = c.EnvStr("DST_DB_DRIVER"); err != nil && !noDstDB {
 		return errors.Trace(err)
 	}
-	if c.DstDbUri, err = c.EnvStr("DST_DB_URI"); err != nil {
+	if c.DstDbUri, err = c.envURI("DST_", c.DstDbDriver); err != nil && !noDstDB {
 		return errors.Trace(err)
 	}
-	if c.DstSchema, err = c.EnvStr("DST_DB_SCHEMA"); err != nil {
+	c.DstDbPassword = c.envPassword("DST_")
+	if c.DstSchema, err = c.EnvStr("DST_DB_SCHEMA"); err != nil && !noDstDB {
 		return errors.Trace(err)
 	}
-	if c.DstTable, err = c.EnvStr("DST_DB_TABLE"); err != nil {
+	if c.DstTable, err = c.EnvStr("DST_DB_TABLE"); err != nil && !tables && !noDstTable {
 		return errors.Trace(err)
 	}
 
+	c.PipelineName = os.Getenv("PIPELINE_NAME")
+	c.IdempotencyKey = os.Getenv("IDEMPOTENCY_KEY")
+	c.AuditRuns = os.Getenv("AUDIT_RUNS") != ""
+	c.AuditTable = os.Getenv("AUDIT_TABLE")
+
+	if spec := os.Getenv("SCHEDULE"); spec != "" {
+		if c.Schedule, err = ParseSchedule(spec); err != nil {
+			return errors.Trace(newConfigError("SCHEDULE", err))
+		}
+	}
+	if s := os.Getenv("SCHEDULE_JITTER"); s != "" {
+		if c.ScheduleJitter, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("SCHEDULE_JITTER", err))
+		}
+	}
+
+	if c.RowEstimate, err = ParseRowEstimate(os.Getenv("ROW_ESTIMATE")); err != nil {
+		return errors.Trace(newConfigError("ROW_ESTIMATE", err))
+	}
+	if s := os.Getenv("PROGRESS_INTERVAL"); s != "" {
+		if c.ProgressInterval, err = time.ParseDuration(s); err != nil {
+			return errors.Trace(newConfigError("PROGRESS_INTERVAL", err))
+		}
+	}
+
+	c.StatusAddr = os.Getenv("STATUS_ADDR")
+	c.ControlToken = os.Getenv("CONTROL_TOKEN")
+	c.ReportFile = os.Getenv("REPORT_FILE")
+	if c.ReportFormat, err = ParseReportFormat(os.Getenv("REPORT_FORMAT"), c.ReportFile); err != nil {
+		return errors.Trace(newConfigError("REPORT_FORMAT", err))
+	}
+
+	if s := os.Getenv("NOTIFY_WEBHOOK"); s != "" {
+		c.Notifiers = append(c.Notifiers, &WebhookNotifier{URL: s})
+	}
+	if s := os.Getenv("NOTIFY_SLACK"); s != "" {
+		c.Notifiers = append(c.Notifiers, &SlackNotifier{WebhookURL: s})
+	}
+	if s := os.Getenv("NOTIFY_EMAIL"); s != "" {
+		en := &EmailNotifier{SMTPURL: os.Getenv("SMTP_URL"), From: os.Getenv("EMAIL_FROM"), To: splitList(s),
+			Subject: os.Getenv("EMAIL_SUBJECT"), Body: os.Getenv("EMAIL_BODY")}
+		if en.SMTPURL == "" || en.From == "" {
+			return errors.Trace(newConfigError("NOTIFY_EMAIL", errors.NotValidf("email without SMTP_URL and EMAIL_FROM")))
+		}
+		mb, _ := c.EnvInt("EMAIL_MAX_ATTACHMENT_MB", 10)
+		en.MaxAttachmentSize = int64(mb) << 20
+		c.Notifiers = append(c.Notifiers, en)
+	}
+	if c.NotifyOn, err = ParseNotifyOn(os.Getenv("NOTIFY_ON")); err != nil {
+		return errors.Trace(newConfigError("NOTIFY_ON", err))
+	}
+
+	c.WatermarkColumn = os.Getenv("WATERMARK_COLUMN")
+	c.ColumnStats = os.Getenv("COLUMN_STATS") != ""
+
+	if err = c.parseStateStore(os.Getenv("STATE_STORE")); err != nil {
+		return errors.Trace(newConfigError("STATE_STORE", err))
+	}
+
 	return nil
 }
 
 func (c *Config) EnvStr(envName string) (dst string, err error) {
 	dst = os.Getenv(envName)
 	if dst == "" {
-		err = errors.Errorf("Missing ENV variable: %s", envName)
+		err = &ConfigError{Setting: envName, Err: errors.New("missing ENV variable")}
 	}
 
 	return dst, err
@@ -76,3 +595,22 @@ func (c *Config) EnvInt(envName string, defaultValue int) (dst int, err error) {
 
 	return dst, nil
 }
+
+// Returns the source select's bind parameters, the positional ones
+// followed by the named ones in name order.
+func (c *Config) SelectArgs() (args []interface{}) {
+	var names []string
+
+	args = append(args, c.SrcSelectArgs...)
+
+	for name := range c.SrcSelectNamedArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		args = append(args, sql.Named(name, c.SrcSelectNamedArgs[name]))
+	}
+
+	return args
+}
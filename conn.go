@@ -0,0 +1,266 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+	"github.com/xo/dburl"
+)
+
+// ConnOptions configures the connections a run opens itself. Zero values
+// keep the driver defaults. Timeouts are passed to the driver as DSN
+// parameters where it has them: connect_timeout for Postgres, timeout,
+// readTimeout and writeTimeout for MySQL and dial timeout and keepAlive
+// for SQL Server. Compress and PacketSize trade CPU for fewer bytes and
+// round trips on slow links between data centers.
+type ConnOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	DialTimeout time.Duration //Time allowed to establish a connection
+	ReadTimeout time.Duration //Time allowed for a network read or write, MySQL only
+	KeepAlive   time.Duration //TCP keepalive period, SQL Server only
+	Compress    bool          //Compress the protocol, MySQL only
+	PacketSize  int           //TDS packet size in bytes, 512 to 32767, SQL Server only
+
+	StatementTimeout time.Duration //Time allowed per statement, set on the session for Postgres and MySQL
+
+	TLS TLSOptions
+}
+
+// connect returns the connection a run uses: conn as given, a connection
+// taken from db, or one opened from uri. pool is the database the
+// connection came from, nil if conn was given. release returns the
+// connection, only closing what connect opened, so the caller's conn and
+// db stay open.
+func connect(ctx context.Context, conn *sql.Conn, db *sql.DB, uri string, password string, opts ConnOptions) (pool *sql.DB, c *sql.Conn, release func(), err error) {
+	switch {
+	case conn != nil:
+		return nil, conn, func() {}, nil
+	case db != nil:
+		if c, err = db.Conn(ctx); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		return db, c, func() { c.Close() }, nil
+	}
+
+	if uri, err = ResolveURI(ctx, uri, password); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	if pool, c, err = openConn(ctx, uri, opts); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+
+	return pool, c, func() {
+		c.Close()
+		pool.Close()
+	}, nil
+}
+
+// openConn opens a database from a URL with the connection options and
+// returns a connection from it. The database must be closed by the
+// caller.
+func openConn(ctx context.Context, uri string, opts ConnOptions) (db *sql.DB, conn *sql.Conn, err error) {
+	var u *dburl.URL
+
+	if u, err = dburl.Parse(uri); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	params, err := connParams(u.Driver, opts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if len(params) > 0 {
+		q := u.URL.Query()
+		for k, v := range params {
+			if q.Get(k) == "" {
+				q.Set(k, v)
+			}
+		}
+		u.URL.RawQuery = q.Encode()
+
+		if u, err = dburl.Parse(u.URL.String()); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	if db, err = sql.Open(u.Driver, u.DSN); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	if opts.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	}
+
+	if conn, err = db.Conn(ctx); err != nil {
+		db.Close()
+		return nil, nil, errors.Trace(err)
+	}
+
+	if err = setStatementTimeout(ctx, conn, u.Driver, opts.StatementTimeout); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, nil, errors.Trace(err)
+	}
+
+	return db, conn, nil
+}
+
+// execSessionSQL runs the session setup statements on a connection.
+func execSessionSQL(ctx context.Context, conn *sql.Conn, stmts []string) (err error) {
+	for _, q := range stmts {
+		if _, err = conn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "session SQL %q", q)
+		}
+	}
+
+	return nil
+}
+
+// connParams returns the DSN parameters for the driver's timeouts,
+// network and TLS settings.
+func connParams(driver string, opts ConnOptions) (params map[string]string, err error) {
+	if params, err = tlsParams(driver, opts.TLS); err != nil {
+		return nil, errors.Trace(err)
+	}
+	seconds := func(d time.Duration) string {
+		// Round up so a sub-second timeout isn't disabled
+		return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+	}
+
+	d := bulk.DialectFor(driver)
+	if opts.Compress && d != bulk.MySQL {
+		return nil, errors.NotSupportedf("protocol compression on %s", driver)
+	}
+	if opts.PacketSize > 0 && d != bulk.SQLServer {
+		return nil, errors.NotSupportedf("packet size on %s", driver)
+	}
+
+	switch d {
+	case bulk.Postgres:
+		if opts.DialTimeout > 0 {
+			params["connect_timeout"] = seconds(opts.DialTimeout)
+		}
+	case bulk.MySQL:
+		if opts.DialTimeout > 0 {
+			params["timeout"] = opts.DialTimeout.String()
+		}
+		if opts.ReadTimeout > 0 {
+			params["readTimeout"] = opts.ReadTimeout.String()
+			params["writeTimeout"] = opts.ReadTimeout.String()
+		}
+		if opts.Compress {
+			params["compress"] = "true"
+		}
+	case bulk.SQLServer:
+		if opts.DialTimeout > 0 {
+			params["dial timeout"] = seconds(opts.DialTimeout)
+		}
+		if opts.KeepAlive > 0 {
+			params["keepAlive"] = seconds(opts.KeepAlive)
+		}
+		if opts.PacketSize > 0 {
+			params["packet size"] = strconv.Itoa(opts.PacketSize)
+		}
+	}
+
+	return params, nil
+}
+
+// setStatementTimeout limits how long each statement on the session can
+// run, for the databases which have a session setting for it.
+func setStatementTimeout(ctx context.Context, conn *sql.Conn, driver string, timeout time.Duration) (err error) {
+	var q string
+
+	if timeout <= 0 {
+		return nil
+	}
+
+	ms := timeout.Milliseconds()
+	switch bulk.DialectFor(driver) {
+	case bulk.Postgres:
+		q = fmt.Sprintf("SET statement_timeout = %d", ms)
+	case bulk.MySQL:
+		q = fmt.Sprintf("SET SESSION max_execution_time = %d", ms)
+	default:
+		return nil
+	}
+
+	if _, err = conn.ExecContext(ctx, q); err != nil {
+		return errors.Annotate(err, "setting statement timeout")
+	}
+
+	return nil
+}
+
+// splitStatements splits semicolon separated statements, dropping empty
+// ones.
+func splitStatements(s string) (stmts []string) {
+	for _, q := range strings.Split(s, ";") {
+		if q = strings.TrimSpace(q); q != "" {
+			stmts = append(stmts, q)
+		}
+	}
+
+	return stmts
+}
+
+// connOptions reads the connection options from the environment
+// variables starting with prefix, such as SRC_ or DST_.
+func (c *Config) connOptions(prefix string) (opts ConnOptions, err error) {
+	opts.MaxOpenConns, _ = c.EnvInt(prefix+"MAX_OPEN_CONNS", 0)
+	opts.MaxIdleConns, _ = c.EnvInt(prefix+"MAX_IDLE_CONNS", 0)
+	opts.Compress = os.Getenv(prefix+"COMPRESS") == "true"
+	if opts.PacketSize, _ = c.EnvInt(prefix+"PACKET_SIZE", 0); opts.PacketSize != 0 && (opts.PacketSize < 512 || opts.PacketSize > 32767) {
+		return opts, errors.Trace(newConfigError(prefix+"PACKET_SIZE", errors.NotValidf("packet size %d, expected 512 to 32767", opts.PacketSize)))
+	}
+
+	durations := []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"CONN_MAX_LIFETIME", &opts.ConnMaxLifetime},
+		{"CONN_MAX_IDLE_TIME", &opts.ConnMaxIdleTime},
+		{"DIAL_TIMEOUT", &opts.DialTimeout},
+		{"READ_TIMEOUT", &opts.ReadTimeout},
+		{"KEEPALIVE", &opts.KeepAlive},
+		{"STATEMENT_TIMEOUT", &opts.StatementTimeout},
+	}
+
+	opts.TLS = TLSOptions{
+		Mode:       os.Getenv(prefix + "SSL_MODE"),
+		CAFile:     os.Getenv(prefix + "SSL_ROOT_CERT"),
+		CertFile:   os.Getenv(prefix + "SSL_CERT"),
+		KeyFile:    os.Getenv(prefix + "SSL_KEY"),
+		ServerName: os.Getenv(prefix + "SSL_SERVER_NAME")}
+
+	for _, d := range durations {
+		if s := os.Getenv(prefix + d.env); s != "" {
+			if *d.d, err = time.ParseDuration(s); err != nil {
+				return opts, errors.Trace(newConfigError(prefix+d.env, err))
+			}
+		}
+	}
+
+	return opts, nil
+}
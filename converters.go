@@ -0,0 +1,164 @@
+package godatapipe
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// ValueConverter converts the values of a column as they're read and as
+// they're written. Either function may be nil.
+type ValueConverter struct {
+	Scan  Coercion //Converts a value as read from the source, before the other stages
+	Value Coercion //Converts a value for the destination, after the coercions
+}
+
+var (
+	convertersMu     sync.RWMutex
+	columnConverters = map[string]ValueConverter{}
+	typeConverters   = map[string]ValueConverter{}
+)
+
+func init() {
+	RegisterTypeConverter("UNIQUEIDENTIFIER", ValueConverter{Scan: CoerceSQLServerUUID})
+	RegisterTypeConverter("BIT", ValueConverter{Scan: CoerceBit})
+}
+
+// Registers a converter for a column name, matched against the source
+// column for Scan and the destination column for Value. Column converters
+// take precedence over type converters. A zero converter removes it.
+func RegisterColumnConverter(column string, c ValueConverter) {
+	convertersMu.Lock()
+	defer convertersMu.Unlock()
+
+	if c.Scan == nil && c.Value == nil {
+		delete(columnConverters, column)
+		return
+	}
+
+	columnConverters[column] = c
+}
+
+// Registers a converter for a source database type name, case
+// insensitive, replacing any converter registered for the type. A zero
+// converter removes it.
+func RegisterTypeConverter(srcType string, c ValueConverter) {
+	convertersMu.Lock()
+	defer convertersMu.Unlock()
+
+	srcType = strings.ToUpper(srcType)
+	if c.Scan == nil && c.Value == nil {
+		delete(typeConverters, srcType)
+		return
+	}
+
+	typeConverters[srcType] = c
+}
+
+// lookupConverter returns the converter registered for the column, or
+// failing that its source type.
+func lookupConverter(column string, srcType string) (c ValueConverter, ok bool) {
+	convertersMu.RLock()
+	defer convertersMu.RUnlock()
+
+	if c, ok = columnConverters[column]; ok {
+		return c, true
+	}
+
+	c, ok = typeConverters[strings.ToUpper(srcType)]
+	return c, ok
+}
+
+// Converts a SQL Server uniqueidentifier, whose first three groups are
+// little endian, to its canonical text form.
+func CoerceSQLServerUUID(v interface{}) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok || len(b) != 16 {
+		return v, nil
+	}
+
+	u := []byte{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6]}
+	return bulk.FormatUUID(append(u, b[8:]...)), nil
+}
+
+// Converts a single bit BIT(1) value, read by MySQL as a byte and by
+// Postgres as the text 0 or 1, to bool. Wider bit fields are left as is.
+func CoerceBit(v interface{}) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok || len(b) != 1 {
+		return v, nil
+	}
+
+	switch b[0] {
+	case 0, '0':
+		return false, nil
+	case 1, '1':
+		return true, nil
+	}
+
+	return v, nil
+}
+
+// Converts MySQL zero dates such as 0000-00-00 and 0000-00-00 00:00:00,
+// read as text, to NULL.
+func CoerceZeroDate(v interface{}) (interface{}, error) {
+	var b []byte
+
+	switch t := v.(type) {
+	case []byte:
+		b = t
+	case string:
+		b = []byte(t)
+	default:
+		return v, nil
+	}
+
+	if bytes.HasPrefix(b, []byte("0000-00-00")) {
+		return nil, nil
+	}
+
+	return v, nil
+}
+
+// newConverterStage returns a stage applying the registered Scan
+// converters, or the Value converters if not scan, to the columns, or nil
+// if no column has one.
+func newConverterStage(columns []string, srcTypes []ColumnType, scan bool) stage {
+	convs := make([]Coercion, len(columns))
+	active := false
+
+	for i, col := range columns {
+		var srcType string
+		if i < len(srcTypes) {
+			srcType = srcTypes[i].DatabaseType
+		}
+
+		if c, ok := lookupConverter(col, srcType); ok && scan {
+			convs[i] = c.Scan
+		} else if ok {
+			convs[i] = c.Value
+		}
+		active = active || convs[i] != nil
+	}
+
+	if !active {
+		return nil
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, conv := range convs {
+			if conv == nil || values[i] == nil {
+				continue
+			}
+
+			if values[i], err = conv(values[i]); err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, columns[i])
+			}
+		}
+
+		return values, nil
+	}
+}
@@ -0,0 +1,131 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+const cursorName = "datapipe_cursor"
+
+// cursorSource reads a Postgres select through a server-side cursor,
+// fetching a chunk of rows at a time so the driver never holds the whole
+// result set.
+type cursorSource struct {
+	tx      *sql.Tx
+	fetchSz int
+
+	chunk    *sqlSource
+	chunkPos int //Rows read from the current fetch
+
+	columns []string
+	types   []ColumnType
+}
+
+func newCursorSource(ctx context.Context, conn *sql.Conn, cfg *Config) (s *cursorSource, err error) {
+	s = &cursorSource{fetchSz: cfg.SrcChunkSize}
+	if s.fetchSz < 1 {
+		s.fetchSz = 10000
+	}
+
+	// Cursors only live as long as the transaction declaring them
+	if s.tx, err = conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true}); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	q := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", cursorName, cfg.SrcSelectSql)
+	if _, err = s.tx.ExecContext(ctx, q, cfg.SelectArgs()...); err != nil {
+		s.tx.Rollback()
+		return nil, errors.Trace(err)
+	}
+
+	if err = s.fetch(ctx); err != nil {
+		s.tx.Rollback()
+		return nil, errors.Trace(err)
+	}
+
+	if s.columns, err = s.chunk.Columns(); err != nil {
+		s.Close()
+		return nil, errors.Trace(err)
+	}
+
+	if s.types, err = s.chunk.ColumnTypes(); err != nil {
+		s.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+// fetch reads the next chunk of rows from the cursor.
+func (s *cursorSource) fetch(ctx context.Context) (err error) {
+	var rows *sql.Rows
+
+	q := fmt.Sprintf("FETCH FORWARD %d FROM %s", s.fetchSz, cursorName)
+	if rows, err = s.tx.QueryContext(ctx, q); err != nil {
+		return errors.Trace(err)
+	}
+
+	if s.chunk, err = newRowsSource(rows); err != nil {
+		return errors.Trace(err)
+	}
+	s.chunkPos = 0
+
+	return nil
+}
+
+func (s *cursorSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *cursorSource) ColumnTypes() (types []ColumnType, err error) {
+	return s.types, nil
+}
+
+func (s *cursorSource) Next(ctx context.Context) (values []interface{}, err error) {
+	for {
+		if values, err = s.chunk.Next(ctx); err == nil {
+			s.chunkPos++
+			return values, nil
+		} else if err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+
+		if err = s.chunk.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.chunk = nil
+
+		// A short fetch means the cursor is exhausted
+		if s.chunkPos < s.fetchSz {
+			return nil, io.EOF
+		}
+
+		if err = s.fetch(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
+
+// Closes the cursor and ends its read only transaction.
+func (s *cursorSource) Close() (err error) {
+	if s.tx == nil {
+		return nil
+	}
+
+	if s.chunk != nil {
+		s.chunk.Close()
+		s.chunk = nil
+	}
+
+	err = s.tx.Rollback()
+	s.tx = nil
+	if err != nil && err != sql.ErrTxDone {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
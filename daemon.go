@@ -0,0 +1,348 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// RunForever runs the pipeline on Config.Schedule until the context is
+// cancelled, which stops a run in progress gracefully according to
+// Config.StopPolicy. Runs never overlap: scheduled times missed while a
+// run is still going are skipped and reported as EventRunSkipped. Failed
+// runs are reported as EventRunFailed and don't stop the schedule.
+func RunForever(ctx context.Context, cfg *Config) (err error) {
+	if cfg.Schedule == nil {
+		return errors.NotValidf("RunForever without a schedule")
+	}
+
+	return errors.Trace(NewDaemon([]*Job{{Name: cfg.pipelineName(), Config: cfg}}).Run(ctx))
+}
+
+// JobRun is the outcome of a run of a daemon's job.
+type JobRun struct {
+	RunID       string    `json:"run_id,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Triggered   bool      `json:"triggered"` //Run was asked for rather than scheduled
+	RowCount    int       `json:"row_count"`
+	Interrupted bool      `json:"interrupted"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// JobStatus is the state of a daemon's job.
+type JobStatus struct {
+	Name    string    `json:"name"`
+	Paused  bool      `json:"paused"`
+	Running bool      `json:"running"`
+	NextRun time.Time `json:"next_run"` //Next scheduled run, zero if there's no schedule
+	Runs    []JobRun  `json:"runs"`     //Most recent first
+}
+
+// daemonJob is a job and its state.
+type daemonJob struct {
+	job     *Job
+	trigger chan struct{}
+	status  JobStatus
+}
+
+// Daemon runs jobs on their Config.Schedule like RunForever, and can be
+// told to run a job now or to pause and resume its schedule, and asked for
+// the jobs' recent runs. Jobs without a schedule only run when triggered.
+// A job's runs never overlap, a trigger during a run starts another when
+// it's done.
+type Daemon struct {
+	History int    //Runs kept per job, defaults to 10
+	Token   string //Bearer token all of Handler's requests must have, none if empty
+
+	mu   sync.Mutex
+	jobs []*daemonJob
+}
+
+func NewDaemon(jobs []*Job) *Daemon {
+	d := &Daemon{}
+	for _, job := range jobs {
+		d.jobs = append(d.jobs, &daemonJob{
+			job:     job,
+			trigger: make(chan struct{}, 1),
+			status:  JobStatus{Name: job.Name, Runs: []JobRun{}}})
+	}
+
+	return d
+}
+
+// Runs the jobs until the context is cancelled, or a job's schedule has no
+// more runs.
+func (d *Daemon) Run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(d.jobs))
+	var wg sync.WaitGroup
+	for _, j := range d.jobs {
+		wg.Add(1)
+		go func(j *daemonJob) {
+			defer wg.Done()
+			if err := d.loop(ctx, j); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(j)
+	}
+	wg.Wait()
+	close(errs)
+
+	return errors.Trace(<-errs)
+}
+
+// loop runs a job on its schedule and when triggered.
+func (d *Daemon) loop(ctx context.Context, j *daemonJob) (err error) {
+	cfg := j.job.Config
+
+	var next time.Time
+	if cfg.Schedule != nil {
+		next = cfg.Schedule.Next(time.Now())
+	}
+
+	for {
+		if cfg.Schedule != nil && next.IsZero() {
+			return errors.Errorf("job %s schedule has no more runs", j.job.Name)
+		}
+		d.update(j, func(s *JobStatus) { s.NextRun = next })
+
+		var timer *time.Timer
+		var scheduled <-chan time.Time
+		if !next.IsZero() {
+			wait := time.Until(next)
+			if cfg.ScheduleJitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(cfg.ScheduleJitter)))
+			}
+			timer = time.NewTimer(wait)
+			scheduled = timer.C
+		}
+
+		triggered := false
+		select {
+		case <-ctx.Done():
+		case <-scheduled:
+		case <-j.trigger:
+			triggered = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		paused := false
+		d.update(j, func(s *JobStatus) { paused = s.Paused })
+		if triggered || !paused {
+			d.run(ctx, j, triggered)
+		}
+
+		if cfg.Schedule == nil {
+			continue
+		}
+
+		// Skip the times which passed during the run
+		if !triggered {
+			next = cfg.Schedule.Next(next)
+		}
+		skipped := 0
+		now := time.Now()
+		for ; !next.IsZero() && !next.After(now); next = cfg.Schedule.Next(next) {
+			skipped++
+		}
+		if skipped > 0 {
+			cfg.emit(Event{Type: EventRunSkipped, Skipped: skipped})
+		}
+	}
+}
+
+// run runs a job once, recording the outcome in its history.
+func (d *Daemon) run(ctx context.Context, j *daemonJob, triggered bool) {
+	d.update(j, func(s *JobStatus) { s.Running = true })
+
+	r := JobRun{StartedAt: time.Now(), Triggered: triggered}
+	res, err := runStoppable(ctx, j.job.Config)
+	r.FinishedAt = time.Now()
+	if res != nil {
+		r.RunID, r.RowCount, r.Interrupted = res.RunID, res.RowCount, res.Interrupted
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	history := d.History
+	if history <= 0 {
+		history = 10
+	}
+
+	d.update(j, func(s *JobStatus) {
+		s.Running = false
+		s.Runs = append([]JobRun{r}, s.Runs...)
+		if len(s.Runs) > history {
+			s.Runs = s.Runs[:history]
+		}
+	})
+}
+
+// update changes a job's status under the lock.
+func (d *Daemon) update(j *daemonJob, f func(s *JobStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f(&j.status)
+}
+
+// find returns the named job.
+func (d *Daemon) find(name string) (j *daemonJob, err error) {
+	for _, j = range d.jobs {
+		if j.job.Name == name {
+			return j, nil
+		}
+	}
+
+	return nil, errors.NotFoundf("job %s", name)
+}
+
+// Returns the state of the jobs.
+func (d *Daemon) Jobs() (jobs []JobStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, j := range d.jobs {
+		s := j.status
+		s.Runs = append([]JobRun{}, s.Runs...)
+		jobs = append(jobs, s)
+	}
+
+	return jobs
+}
+
+// Runs the named job now, or as soon as its current run is done, whether
+// or not it's paused.
+func (d *Daemon) Trigger(name string) (err error) {
+	j, err := d.find(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// A run is already waiting
+	}
+
+	return nil
+}
+
+// Stops the named job's scheduled runs until it's resumed. A run in
+// progress carries on.
+func (d *Daemon) Pause(name string) (err error) {
+	return errors.Trace(d.setPaused(name, true))
+}
+
+// Restarts the named job's scheduled runs.
+func (d *Daemon) Resume(name string) (err error) {
+	return errors.Trace(d.setPaused(name, false))
+}
+
+func (d *Daemon) setPaused(name string, paused bool) (err error) {
+	j, err := d.find(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	d.update(j, func(s *JobStatus) { s.Paused = paused })
+	return nil
+}
+
+// Returns a handler serving the control API: GET /jobs lists the jobs and
+// their recent runs, GET /jobs/{name} gives one, and POST to
+// /jobs/{name}/run, /pause or /resume controls it. Every request needs
+// the bearer Token if there is one, as run errors can give away DSNs.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Jobs())
+	})
+
+	mux.HandleFunc("GET /jobs/{name}", func(w http.ResponseWriter, r *http.Request) {
+		for _, s := range d.Jobs() {
+			if s.Name == r.PathValue("name") {
+				writeJSON(w, http.StatusOK, s)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+	})
+
+	actions := map[string]func(name string) error{"run": d.Trigger, "pause": d.Pause, "resume": d.Resume}
+	mux.HandleFunc("POST /jobs/{name}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		action, ok := actions[r.PathValue("action")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action"})
+			return
+		}
+
+		if err := action(r.PathValue("name")); errors.Is(err, errors.NotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	})
+
+	return d.authorize(mux)
+}
+
+// authorize answers 401 to requests without the bearer Token, comparing
+// it in constant time.
+func (d *Daemon) authorize(h http.Handler) http.Handler {
+	if d.Token == "" {
+		return h
+	}
+
+	want := []byte("Bearer " + d.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// runStoppable runs the pipeline once, stopping it gracefully if the
+// context is cancelled.
+func runStoppable(ctx context.Context, cfg *Config) (res *Result, err error) {
+	p := NewPipeline(cfg)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-done:
+		}
+	}()
+
+	// The run isn't cancelled with ctx so it can stop cleanly
+	return p.Run(context.WithoutCancel(ctx))
+}
@@ -0,0 +1,58 @@
+package godatapipe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDaemonHandler(t *testing.T) {
+	d := NewDaemon([]*Job{{Name: "orders", Config: &Config{}}})
+	d.Token = "secret"
+	h := d.Handler()
+
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		code   int
+	}{
+		{"GET", "/jobs", "", http.StatusUnauthorized},
+		{"GET", "/jobs", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "/jobs", "secret", http.StatusUnauthorized},
+		{"GET", "/jobs", "Bearer secret", http.StatusOK},
+		{"GET", "/jobs/orders", "", http.StatusUnauthorized},
+		{"GET", "/jobs/orders", "Bearer secret", http.StatusOK},
+		{"GET", "/jobs/missing", "Bearer secret", http.StatusNotFound},
+		{"POST", "/jobs/orders/pause", "", http.StatusUnauthorized},
+		{"POST", "/jobs/orders/pause", "Bearer secret", http.StatusAccepted},
+		{"POST", "/jobs/orders/resume", "Bearer secret", http.StatusAccepted},
+		{"POST", "/jobs/orders/run", "Bearer secret", http.StatusAccepted},
+		{"POST", "/jobs/orders/stop", "Bearer secret", http.StatusNotFound},
+		{"POST", "/jobs/missing/run", "Bearer secret", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s with %q = %d, want %d", tt.method, tt.path, tt.auth, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestDaemonHandlerWithoutToken(t *testing.T) {
+	h := NewDaemon([]*Job{{Name: "orders", Config: &Config{}}}).Handler()
+
+	for _, path := range []string{"/jobs", "/jobs/orders"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s without a token = %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+}
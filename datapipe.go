@@ -4,191 +4,535 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"os"
-	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v5"
 	"github.com/joescharf/go-datapipe/bulk"
 	// _ "github.com/microsoft/go-mssqldb"
 	_ "github.com/denisenkom/go-mssqldb"
-	"github.com/xo/dburl"
 
 	"github.com/juju/errors"
 )
 
-type Insert interface {
-	Append(ctx context.Context, rows *sql.Rows) (err error)
-	Flush(ctx context.Context) (totalRowCount int, err error)
-	Close() (err error)
-}
+// Insert writes rows to the destination table. Implementations are
+// registered per destination driver with bulk.Register.
+type Insert = bulk.Writer
 
+// Run copies the source rows to the destination table and returns the
+// number of rows copied.
 func Run(ctx context.Context, cfg *Config) (rowCount int, err error) {
-	var srcDb, dstDb *sql.DB
+	var res *Result
+
+	if res, err = NewPipeline(cfg).Run(ctx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return res.RowCount, nil
+}
+
+func run(ctx context.Context, cfg *Config, stop <-chan struct{}) (res *Result, err error) {
+	var dstDb *sql.DB
 	var srcConn, dstConn *sql.Conn
-	srcDBurl, err := dburl.Parse(cfg.SrcDbUri)
+	var release func()
 
-	dstDBurl, err := dburl.Parse(cfg.DstDbUri)
+	res = &Result{StartedAt: time.Now()}
+	if cfg.plan != nil {
+		res.RunID = cfg.plan.RunID
+	} else if res.RunID, err = newUUID(); err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	// If we don't already have a connection...
-	if cfg.SrcConn == nil {
-		if srcDb, err = sql.Open(srcDBurl.Driver, srcDBurl.DSN); err != nil {
-			return 0, errors.Trace(err)
+	runID := res.RunID
+	cfg.emit(Event{Type: EventRunStarted, RunID: runID})
+	defer func() {
+		if err != nil {
+			cfg.emit(Event{Type: EventRunFailed, RunID: runID, Err: err})
+		} else {
+			cfg.emit(Event{Type: EventRunFinished, RunID: runID, Result: res})
 		}
-		// Only close the connection if we opened it
-		defer srcDb.Close()
-		// Get the a DB conn.
-		srcConn, err = srcDb.Conn(ctx)
+	}()
 
-	} else {
-		srcConn = cfg.SrcConn
+	// A custom source, shards, a file or a record URI don't need a source connection
+	if cfg.Source == nil && len(cfg.SrcShards) == 0 && cfg.SrcFile == "" && cfg.SrcRecordURI == "" && cfg.SrcAPI.URL == "" || cfg.SrcConn != nil {
+		if _, srcConn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer release()
 	}
 
-	if cfg.DstConn == nil {
-		if dstDb, err = sql.Open(dstDBurl.Driver, dstDBurl.DSN); err != nil {
-			return 0, errors.Trace(err)
+	// A custom writer, a file or a record URI don't need a destination connection
+	if cfg.DstWriter == nil && cfg.DstFile == "" && cfg.DstRecordURI == "" && cfg.DstAPI.URL == "" || cfg.DstConn != nil || cfg.DstDB != nil {
+		if dstDb, dstConn, release, err = connect(ctx, cfg.DstConn, cfg.DstDB, cfg.DstDbUri, cfg.DstDbPassword, cfg.DstConnOptions); err != nil {
+			return nil, errors.Trace(err)
 		}
-		// Only close the connection if we opened it
-		defer dstDb.Close()
-		// Get a DB conn
-		dstConn, err = dstDb.Conn(ctx)
-		if err != nil {
-			return 0, errors.Trace(err)
+		defer release()
+	}
+
+	if srcConn != nil {
+		if err = execSessionSQL(ctx, srcConn, cfg.SrcSessionSQL); err != nil {
+			return nil, errors.Trace(err)
 		}
-	} else {
-		dstConn = cfg.DstConn
+	}
+	if dstConn != nil {
+		if err = execSessionSQL(ctx, dstConn, cfg.DstSessionSQL); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if err = checkWriterOnly(cfg); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	if err = clearTable(ctx, dstConn, cfg); err != nil {
-		return 0, errors.Trace(err)
+	var store StateStore
+	if store, err = openStateStore(ctx, cfg, dstConn); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	if rowCount, err = copyTable(ctx, srcConn, dstConn, cfg); err != nil {
-		return 0, errors.Trace(err)
+	// Templates are executed on a copy so the next run executes them
+	// again, a plan's config has them executed already.
+	if cfg.plan == nil {
+		if cfg, err = renderConfig(ctx, cfg, store, res); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if cfg, err = sampleConfig(cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg = unquoteConfig(cfg)
 	}
 
-	// TODO: Rowcount is being doubled for some reason
-	return rowCount / 2, nil
-}
+	if dstConn != nil {
+		var unlock func()
+		if unlock, err = lockTable(ctx, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer unlock()
+	}
 
-func clearTable(ctx context.Context, dstConn *sql.Conn, cfg *Config) (err error) {
-	q := fmt.Sprintf("TRUNCATE TABLE %s", fqSchemaTable(cfg.DstSchema, cfg.DstTable))
-	if _, err = dstConn.ExecContext(ctx, q); err != nil {
-		return errors.Trace(err)
+	if cfg.plan != nil {
+		if err = cfg.plan.check(ctx, srcConn, dstConn); err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
-	return nil
-}
 
-// fqSchemaTable concatenates schema and table
-// taking into account a null schema and whether the schema and table
-// are already quoted.
-func fqSchemaTable(schema string, table string) string {
-	schemaQuoted := strings.HasPrefix(schema, "`") && strings.HasSuffix(schema, "`")
-	tableQuoted := strings.HasPrefix(table, "`") && strings.HasSuffix(table, "`")
+	// A retry of a run which succeeded returns its result
+	var prior *Result
+	if prior, err = priorResult(ctx, cfg, store); err != nil {
+		return nil, errors.Trace(err)
+	} else if prior != nil {
+		res = prior
+		return res, nil
+	}
 
-	if schema == "" {
-		if !tableQuoted {
-			table = fmt.Sprintf("`%s`", table)
+	if cfg.AuditRuns {
+		var audit *auditLog
+		if audit, err = startAudit(ctx, dstConn, cfg, res); err != nil {
+			return nil, errors.Trace(err)
 		}
-		return table
-	} else {
-		if !schemaQuoted {
-			schema = fmt.Sprintf("`%s`", schema)
+		defer func() {
+			var conn *sql.Conn
+
+			// Record the outcome even if the run was cancelled, on a
+			// fresh connection if the run failed mid-transaction.
+			actx := context.WithoutCancel(ctx)
+			if err != nil && dstDb != nil {
+				if conn, _ = dstDb.Conn(actx); conn != nil {
+					defer conn.Close()
+				}
+			}
+
+			if auditErr := audit.finish(actx, conn, res, err); auditErr != nil && err == nil {
+				res, err = nil, errors.Trace(auditErr)
+			}
+		}()
+	}
+
+	// Change data capture applies changes to the existing rows rather
+	// than reloading the table.
+	if cfg.CDCSlot != "" {
+		if err = runCDC(ctx, cfg, srcConn, dstConn, res, stop); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return res, nil
+	}
+
+	// Routed rows' child tables are cleared as they're opened
+	if dstConn != nil && cfg.PartitionColumn == "" {
+		if err = prepareTable(ctx, srcConn, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
 		}
-		if !tableQuoted {
-			table = fmt.Sprintf("`%s`", table)
+		if err = createPartitions(ctx, srcConn, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = createHypertable(ctx, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if cfg.IdentityInsert {
+		if err = setIdentityInsert(ctx, dstConn, cfg, true); err != nil {
+			return nil, errors.Trace(err)
 		}
-		return fmt.Sprintf("%s.%s", schema, table)
+		defer setIdentityInsert(ctx, dstConn, cfg, false)
 	}
+
+	if cfg.LoadMode != LoadReplace && cfg.PartitionColumn != "" {
+		return nil, errors.NotSupportedf("LoadMirror, LoadDiff or LoadSCD2 with PartitionColumn")
+	}
+
+	switch cfg.LoadMode {
+	case LoadMirror:
+		err = runMirror(ctx, srcConn, dstConn, cfg, res, stop)
+	case LoadDiff:
+		err = runDiff(ctx, srcConn, dstConn, cfg, res, stop)
+	case LoadSCD2:
+		err = runSCD2(ctx, srcConn, dstConn, cfg, res, stop)
+	default:
+		_, err = copyTable(ctx, srcConn, dstDb, dstConn, cfg, cfg.DstSchema, cfg.DstTable, res, stop)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if cfg.CopyIndexes && !res.Interrupted {
+		if err = copyIndexes(ctx, srcConn, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if cfg.ResyncSequences {
+		if err = resyncSequences(ctx, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if !res.Interrupted {
+		if err = saveWatermark(ctx, cfg, store, res); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = saveResult(ctx, cfg, store, res); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return res, nil
+}
+
+// checkWriterOnly returns an error if the config needs a destination
+// connection, which a custom writer without DstConn doesn't have.
+func checkWriterOnly(cfg *Config) (err error) {
+	var need string
+
+	switch {
+	case cfg.CDCSlot != "":
+		need = "CDCSlot"
+	case cfg.LoadMode == LoadMirror:
+		need = "LoadMirror"
+	case cfg.LoadMode == LoadDiff:
+		need = "LoadDiff"
+	case cfg.LoadMode == LoadSCD2:
+		need = "LoadSCD2"
+	case cfg.AuditRuns:
+		need = "AuditRuns"
+	case cfg.IdentityInsert:
+		need = "IdentityInsert"
+	case cfg.CopyIndexes:
+		need = "CopyIndexes"
+	case cfg.ResyncSequences:
+		need = "ResyncSequences"
+	case cfg.RunLock != LockNone:
+		need = "RunLock"
+	default:
+		return nil
+	}
+
+	return errors.NotSupportedf("%s with DstWriter and no DstConn", need)
 }
 
-func copyTable(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config) (rowCount int, err error) {
+// clearTable deletes the destination rows the way the destination dialect
+// allows, see bulk.Dialect.ClearTableSQL.
+func clearTable(ctx context.Context, dstConn *sql.Conn, cfg *Config) (err error) {
+	var qs []string
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if qs, err = d.ClearTableSQL(cfg.DstSchema, cfg.DstTable, cfg.TruncateCascade, cfg.RestartIdentity); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, q := range qs {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "clearing %s", d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+	}
+
+	return nil
+}
+
+// copyTable writes the source rows to the schema and table, returning the
+// destination columns written.
+func copyTable(ctx context.Context, srcConn *sql.Conn, dstDb *sql.DB, dstConn *sql.Conn, cfg *Config, schema string, table string, res *Result, stop <-chan struct{}) (columns []string, err error) {
 	var ir Insert
-	var rows *sql.Rows
-	var columns []string
+	var src Source
+	var stages []stage
+	var batch *batchTransformer
 
 	readStart := time.Now()
 
-	if rows, err = srcConn.QueryContext(ctx, cfg.SrcSelectSql); err != nil {
-		return 0, errors.Trace(err)
+	if res.EstimatedRows, err = estimateSourceRows(ctx, cfg, srcConn); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	defer rows.Close()
+	if src, err = newSource(ctx, srcConn, cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	if columns, err = rows.Columns(); err != nil {
-		return 0, errors.Trace(err)
+	defer src.Close()
+
+	if columns, err = src.Columns(); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	readEnd := time.Since(readStart)
+	if stages, batch, columns, err = buildStages(ctx, cfg, src, dstDb, dstConn, columns, res); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if batch != nil {
+		defer batch.release()
+	}
+
+	if err = checkSchemaDrift(ctx, cfg, src, dstConn, columns, schema, table, res); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	res.ReadTime += time.Since(readStart)
 	writeStart := time.Now()
 
-	switch cfg.DstDbDriver {
-	case "postgres":
-		if ir, err = bulk.NewCopyIn(ctx, dstConn, columns, cfg.DstSchema, cfg.DstTable); err != nil {
-			return 0, errors.Trace(err)
+	opts := bulk.Options{
+		Driver:         cfg.DstDbDriver,
+		Schema:         schema,
+		Table:          table,
+		Columns:        columns,
+		MaxRowBufSz:    cfg.MaxRowBufSz,
+		MaxRowTxCommit: cfg.MaxRowTxCommit,
+		LargeValueSz:   cfg.LargeValueSz,
+		MaxBufBytes:    cfg.MaxBufBytes,
+		MaxBatchBytes:  cfg.MaxBatchBytes,
+
+		BatchRetries:      cfg.BatchRetries,
+		SkipFailedBatches: cfg.SkipFailedBatches,
+
+		DiagnoseErrors:    cfg.DiagnoseErrors,
+		RedactErrorValues: cfg.RedactErrorValues,
+
+		OnBatch: batchEmitter(cfg, res)}
+
+	switch {
+	case cfg.DstWriter != nil:
+		ir = cfg.DstWriter
+		if cs, ok := ir.(interface{ SetColumns(columns []string) }); ok {
+			cs.SetColumns(columns)
 		}
-	default:
-		if ir, err = bulk.NewBulk(
-			ctx, dstConn, columns,
-			cfg.DstSchema, cfg.DstTable,
-			cfg.MaxRowBufSz, cfg.MaxRowTxCommit); err != nil {
-			return 0, errors.Trace(err)
+	case cfg.DstFile != "":
+		var fw *FileWriter
+		var key []byte
+		if key, err = cfg.encryptionKey(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if fw, err = CreateFileWriter(cfg.DstFile, cfg.DstFileFormat, cfg.DstCompression, key); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if ct, ok := src.(ColumnTyper); ok {
+			var types []ColumnType
+			if types, err = ct.ColumnTypes(); err != nil {
+				fw.Close()
+				return nil, errors.Trace(err)
+			}
+			fw.SetColumnTypes(types)
+		}
+		fw.AvroTypes = cfg.AvroTypes
+		if cfg.SchemaRegistry != "" {
+			if fw.Registry, err = NewSchemaRegistry(cfg.SchemaRegistry); err != nil {
+				fw.Close()
+				return nil, errors.Trace(err)
+			}
+			fw.Registry.LookupOnly = cfg.SchemaLookup
+			fw.Subject = cfg.SchemaSubject
 		}
+		fw.SetColumns(columns)
+		ir = fw
+	case cfg.DstRecordURI != "":
+		if ir, err = newRecordURIInsert(ctx, cfg, src, table); err == nil {
+			ir.(interface{ SetColumns(columns []string) }).SetColumns(columns)
+		}
+	case cfg.DstAPI.URL != "":
+		var ww *WebhookWriter
+		if ww, err = NewWebhookWriter(ctx, cfg.DstAPI, cfg.MaxRowTxCommit); err != nil {
+			return nil, errors.Trace(newConfigError("DST_API_URL", err))
+		}
+		ww.SetColumns(columns)
+		ir = ww
+	case cfg.PartitionColumn != "":
+		ir, err = newPartitionWriter(ctx, dstDb, cfg, opts)
+	default:
+		ir, err = bulk.NewWriter(ctx, dstConn, opts)
 	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// A failed copy mustn't leave the writer's tx, file or connection open
+	closed := false
+	defer func() {
+		if !closed {
+			ir.Rollback()
+			abortWriter(ir)
+		}
+	}()
 
-	rowCount, err = copyBulkRows(ctx, dstConn, rows, ir, cfg)
+	err = copyBulkRows(ctx, src, stages, batch, ir, cfg, newHealthCheck(cfg, dstConn), res, stop)
 	if err != nil {
-		return 0, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
+	closed = true
 	if err = ir.Close(); err != nil {
-		return 0, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	writeEnd := time.Since(writeStart)
+	res.WriteTime += time.Since(writeStart)
+	if t, ok := ir.(bulk.Timer); ok {
+		res.Timings.Merge(t.Timings())
+	}
 
-	_ = writeEnd
-	_ = readEnd
+	return columns, nil
+}
 
-	// fmt.Printf("%d rows queried in %s and inserted in %s\n",
-	// 	rowCount,
-	// 	readEnd.String(),
-	// 	writeEnd.String())
+// batchEmitter returns a writer OnBatch hook sending batch events, or nil
+// if there's no event handler.
+func batchEmitter(cfg *Config, res *Result) func(t bulk.BatchTiming) {
+	if cfg.OnEvent == nil {
+		return nil
+	}
 
-	return rowCount, errors.Trace(rows.Err())
+	return func(t bulk.BatchTiming) {
+		cfg.emit(Event{Type: EventBatchWritten, RunID: res.RunID, Batch: &t})
+	}
 }
 
-func copyBulkRows(ctx context.Context, dstDb *sql.Conn, rows *sql.Rows, ir Insert, cfg *Config) (rowCount int, err error) {
-	var totalRowCount int
-	const dotLimit = 1000
+func copyBulkRows(ctx context.Context, src Source, stages []stage, batch *batchTransformer, ir Insert, cfg *Config, health *healthCheck, res *Result, stop <-chan struct{}) (err error) {
+	var rowCount int
+	var values []interface{}
+
+	batchSz := cfg.MaxRowBufSz
+	if batchSz < 1 {
+		batchSz = 1
+	}
+
+	progress := newProgressReporter(cfg, res)
+
+	for {
+		// Check for cancellation once per batch rather than per row
+		if rowCount%batchSz == 0 {
+			if err = ctx.Err(); err != nil {
+				return cancelCopy(ir, rowCount, err)
+			}
+
+			if rowCount > 0 {
+				if batch != nil {
+					if err = batch.write(ctx, ir); err != nil {
+						return errors.Trace(err)
+					}
+				}
+
+				progress.report(rowCount)
+
+				if err = health.wait(ctx, res, stop); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			if stopped(stop) {
+				res.Interrupted = true
+				break
+			}
+		}
+
+		if values, err = src.Next(ctx); err == io.EOF {
+			break
+		} else if err != nil {
+			// The source stops early when the context is cancelled
+			// mid-query, so make sure we don't flush a partial copy.
+			if ctx.Err() != nil {
+				return cancelCopy(ir, rowCount, ctx.Err())
+			}
+			return errors.Trace(err)
+		}
 
-	i := 1
+		rowCount++
 
-	for rows.Next() {
-		if err = ir.Append(ctx, rows); err != nil {
-			return 0, errors.Trace(err)
+		if values, err = applyStages(stages, rowCount, values); err != nil {
+			return errors.Trace(err)
+		} else if values == nil {
+			continue
 		}
 
-		if i%dotLimit == 0 {
-			// fmt.Print(".")
-			i = 1
+		if batch != nil {
+			batch.add(rowCount, values)
+			continue
 		}
 
-		i++
+		if err = ir.AppendValues(ctx, values); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
-	if totalRowCount, err = ir.Flush(ctx); err != nil {
-		return 0, errors.Trace(err)
+	if batch != nil {
+		if err = batch.flush(ctx, ir); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
-	if totalRowCount > dotLimit {
-		// fmt.Println()
+	finishStats(res)
+
+	if res.Interrupted && cfg.StopPolicy == StopRollback {
+		if res.RowCount, err = ir.Rollback(); err != nil {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+
+	if res.RowCount, err = ir.Flush(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if sc, ok := ir.(bulk.SkipCounter); ok {
+		res.SkippedRows = sc.SkippedRowCount()
+	}
+
+	return nil
+}
+
+// abortWriter closes a writer after its copy failed, aborting rather
+// than finishing its file if it has one.
+func abortWriter(ir Insert) error {
+	if a, ok := ir.(interface{ abort() error }); ok {
+		return a.abort()
+	}
+
+	return ir.Close()
+}
+
+// cancelCopy rolls back any uncommitted rows and annotates the
+// cancellation error with how far the copy got.
+func cancelCopy(ir Insert, rowCount int, cause error) (err error) {
+	committed, rbErr := ir.Rollback()
+	if rbErr != nil {
+		return errors.Annotatef(cause, "copy cancelled after %d rows (rollback failed: %s)", rowCount, rbErr)
 	}
 
-	return totalRowCount, errors.Trace(rows.Err())
+	return errors.Annotatef(cause, "copy cancelled after %d rows read, %d rows committed", rowCount, committed)
 }
 
-func showError(cfg *Config, err error) {
+// ShowError prints an error to stderr, with its stack trace if configured.
+func ShowError(cfg *Config, err error) {
 	if cfg.ShowStackTrace {
 		fmt.Fprintf(os.Stderr, "%s\n", errors.ErrorStack(err))
 	} else {
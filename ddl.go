@@ -0,0 +1,59 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// GenerateDDL returns a CREATE TABLE statement for the destination dialect
+// with columns holding the results of the source query. The query isn't
+// run for its rows, only its column types are read. dstDialect is a
+// driver name such as postgres or mssql. args are the query's bind
+// parameters.
+func GenerateDDL(ctx context.Context, srcConn *sql.Conn, query string, dstDialect string, schema string, table string, args ...interface{}) (ddl string, err error) {
+	var types []ColumnType
+
+	if types, err = queryColumnTypes(ctx, srcConn, query, args...); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return bulk.DialectFor(dstDialect).CreateTableSQL(schema, table, types), nil
+}
+
+// queryColumnTypes returns the column types of a query's results without
+// fetching any rows. Columns whose nullability the driver doesn't report
+// are nullable.
+func queryColumnTypes(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) (types []ColumnType, err error) {
+	var rows *sql.Rows
+	var cts []*sql.ColumnType
+
+	q := fmt.Sprintf("SELECT * FROM (%s) datapipe_ddl WHERE 1 = 0", query)
+	if rows, err = conn.QueryContext(ctx, q, args...); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer rows.Close()
+
+	if cts, err = rows.ColumnTypes(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	types = make([]ColumnType, len(cts))
+	for i, ct := range cts {
+		var ok bool
+
+		types[i].Name = ct.Name()
+		types[i].DatabaseType = ct.DatabaseTypeName()
+		types[i].Length, _ = ct.Length()
+		types[i].Precision, types[i].Scale, _ = ct.DecimalSize()
+		if types[i].Nullable, ok = ct.Nullable(); !ok {
+			types[i].Nullable = true
+		}
+	}
+
+	return types, nil
+}
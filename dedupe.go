@@ -0,0 +1,94 @@
+package godatapipe
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/juju/errors"
+)
+
+type rowKey [16]byte
+
+// keySet remembers the keys seen so far, forgetting the least recently
+// seen once it holds maxKeys of them.
+type keySet struct {
+	maxKeys int
+	keys    map[rowKey]*list.Element
+	order   *list.List //Most recently seen first
+}
+
+func newKeySet(maxKeys int) *keySet {
+	return &keySet{
+		maxKeys: maxKeys,
+		keys:    map[rowKey]*list.Element{},
+		order:   list.New()}
+}
+
+// seen reports whether the key has been seen before and remembers it.
+func (s *keySet) seen(k rowKey) bool {
+	if e, ok := s.keys[k]; ok {
+		s.order.MoveToFront(e)
+		return true
+	}
+
+	s.keys[k] = s.order.PushFront(k)
+
+	if s.maxKeys > 0 && s.order.Len() > s.maxKeys {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(rowKey))
+	}
+
+	return false
+}
+
+// hashKey hashes the values at the positions, tagging each with its type
+// so 1 and "1" don't collide.
+func hashKey(values []interface{}, positions []int) (k rowKey) {
+	h := fnv.New128a()
+
+	for _, pos := range positions {
+		v := values[pos]
+		if v == nil {
+			h.Write([]byte{0})
+			continue
+		}
+
+		fmt.Fprintf(h, "%T:", v)
+		h.Write([]byte(valueText(v)))
+		h.Write([]byte{0})
+	}
+
+	h.Sum(k[:0])
+	return k
+}
+
+// newDedupeStage returns a stage dropping rows whose key columns match
+// a row already copied, or nil if deduplication is off.
+func newDedupeStage(cfg *Config, columns []string, res *Result) (s stage, err error) {
+	var positions []int
+
+	if len(cfg.DedupeColumns) == 0 {
+		return nil, nil
+	}
+
+	for _, name := range cfg.DedupeColumns {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, errors.Trace(sourceColumnError(name, "dedupe"))
+		}
+		positions = append(positions, pos)
+	}
+
+	keys := newKeySet(cfg.DedupeMaxKeys)
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		if keys.seen(hashKey(values, positions)) {
+			res.DuplicateRows++
+			return nil, nil
+		}
+
+		return values, nil
+	}, nil
+}
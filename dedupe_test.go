@@ -0,0 +1,50 @@
+package godatapipe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	columns := []string{"id", "kind", "n"}
+	rows := [][]interface{}{
+		{int64(1), "a", int64(1)},
+		{int64(1), "b", int64(2)},
+		{int64(1), "a", int64(3)},
+		{"1", "a", int64(4)},
+		{nil, "a", int64(5)},
+		{nil, "a", int64(6)}}
+
+	res, written, err := copyRows(t, &Config{MaxRowBufSz: 10, DedupeColumns: []string{"id", "kind"}}, columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The string "1" doesn't match the integer 1 but NULLs match
+	var got []int64
+	for _, row := range written {
+		got = append(got, row[2].(int64))
+	}
+	if want := []int64{1, 2, 4, 5}; !reflect.DeepEqual(got, want) || res.DuplicateRows != 2 {
+		t.Errorf("kept %v, %d duplicates, want %v", got, res.DuplicateRows, want)
+	}
+
+	if _, _, err = copyRows(t, &Config{MaxRowBufSz: 10, DedupeColumns: []string{"missing"}}, columns, rows); err == nil {
+		t.Error("dedupe on a missing column didn't fail")
+	}
+}
+
+func TestKeySetMaxKeys(t *testing.T) {
+	s := newKeySet(2)
+	a, b, c := hashKey([]interface{}{"a"}, []int{0}), hashKey([]interface{}{"b"}, []int{0}), hashKey([]interface{}{"c"}, []int{0})
+
+	// a is seen again so b is the least recently seen when c is added
+	for i, tt := range []struct {
+		k    rowKey
+		want bool
+	}{{a, false}, {b, false}, {a, true}, {c, false}, {a, true}, {b, false}} {
+		if got := s.seen(tt.k); got != tt.want {
+			t.Errorf("step %d seen = %v, want %v", i, got, tt.want)
+		}
+	}
+}
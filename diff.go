@@ -0,0 +1,331 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// diffState is what a LoadDiff run's stage needs to drop unchanged rows.
+type diffState struct {
+	keys   []string          //Destination key columns
+	hashes map[string]string //Hash of each row written by earlier runs, by key text
+	seen   map[string]string //Hash of each source row this run, by key text
+}
+
+// runDiff hashes each source row and stages only those whose hash differs
+// from the one written by the last run, then upserts them into the
+// destination table in one transaction. The hashes are kept in
+// Config.HashColumn of the destination table or, if that's not set, in
+// Config.HashTable. Destination rows missing from the source are left
+// alone.
+func runDiff(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config, res *Result, stop <-chan struct{}) (err error) {
+	var keys, columns []string
+	var qs []string
+	var q string
+	var tx *sql.Tx
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	if keys, err = mirrorKeys(ctx, dstConn, cfg); err != nil {
+		return errors.Trace(err)
+	}
+	if keys, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, keys); err != nil {
+		return errors.Trace(err)
+	}
+
+	ds := &diffState{keys: keys, seen: map[string]string{}}
+	if ds.hashes, err = readHashes(ctx, dstConn, cfg, keys); err != nil {
+		return errors.Trace(err)
+	}
+
+	stage := "datapipe_stage"
+	if d == bulk.SQLServer {
+		stage = "#" + stage
+	}
+
+	if qs, err = d.CreateStageSQL(cfg.DstSchema, cfg.DstTable, stage); err != nil {
+		return errors.Trace(err)
+	}
+	for _, q := range qs {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotate(err, "creating staging table")
+		}
+	}
+	defer dstConn.ExecContext(context.WithoutCancel(ctx), qs[0])
+
+	c := *cfg
+	c.diff = ds
+	if columns, err = copyTable(ctx, srcConn, nil, dstConn, &c, d.StageSchema(), stage, res, stop); err != nil {
+		return errors.Trace(err)
+	}
+
+	if res.Interrupted && cfg.StopPolicy == StopRollback {
+		return nil
+	}
+
+	if columns, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, columns); err != nil {
+		return errors.Trace(err)
+	}
+
+	if tx, err = dstConn.BeginTx(ctx, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	if q, err = d.MergeSQL(cfg.DstSchema, cfg.DstTable, stage, columns, keys); err != nil {
+		tx.Rollback()
+		return errors.Trace(err)
+	}
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		tx.Rollback()
+		return errors.Annotate(err, "merging changed rows")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if cfg.HashColumn != "" {
+		return nil
+	}
+
+	// A partial copy only saw some of the rows, keep the others' hashes
+	hashes := ds.seen
+	if res.Interrupted {
+		for k, h := range ds.hashes {
+			if _, ok := hashes[k]; !ok {
+				hashes[k] = h
+			}
+		}
+	}
+
+	// If this fails the next run upserts the same rows again
+	return errors.Trace(writeHashes(ctx, dstConn, cfg, hashes))
+}
+
+// hashTable returns the name of the table keeping LoadDiff's hashes.
+func (c *Config) hashTable() string {
+	if c.HashTable != "" {
+		return c.HashTable
+	}
+
+	return c.DstTable + "_hashes"
+}
+
+// readHashes returns the hashes of the rows written by earlier runs, by
+// key text.
+func readHashes(ctx context.Context, dstConn *sql.Conn, cfg *Config, keys []string) (hashes map[string]string, err error) {
+	var rows *sql.Rows
+	var q string
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	hashes = map[string]string{}
+
+	if cfg.HashColumn != "" {
+		cols := make([]string, len(keys))
+		for i, k := range keys {
+			cols[i] = d.QuoteIdent(k)
+		}
+		q = fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(cols, ", "), d.QuoteIdent(cfg.HashColumn), d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+	} else {
+		if err = createHashTable(ctx, dstConn, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		q = fmt.Sprintf("SELECT row_key, row_hash FROM %s", d.QualifiedName(cfg.DstSchema, cfg.hashTable()))
+	}
+
+	if rows, err = dstConn.QueryContext(ctx, q); err != nil {
+		return nil, errors.Annotate(err, "reading row hashes")
+	}
+	defer rows.Close()
+
+	n := len(keys) + 1
+	if cfg.HashColumn == "" {
+		n = 2
+	}
+
+	values := make([]interface{}, n)
+	ptrs := make([]interface{}, n)
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if values[n-1] == nil {
+			continue
+		}
+
+		key := valueText(values[0])
+		if cfg.HashColumn != "" {
+			key = keyText(values[:n-1], nil)
+		}
+		hashes[key] = valueText(values[n-1])
+	}
+
+	return hashes, errors.Trace(rows.Err())
+}
+
+// createHashTable creates Config.HashTable if it doesn't exist.
+func createHashTable(ctx context.Context, dstConn *sql.Conn, cfg *Config) (err error) {
+	var types []bulk.ColumnType
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if types, err = bulk.TableColumns(ctx, dstConn, d, cfg.DstSchema, cfg.hashTable()); err != nil || len(types) > 0 {
+		return errors.Trace(err)
+	}
+
+	q := d.CreateTableSQL(cfg.DstSchema, cfg.hashTable(), []bulk.ColumnType{
+		{Name: "row_key", DatabaseType: "varchar"},
+		{Name: "row_hash", DatabaseType: "varchar", Length: 32}})
+	if _, err = dstConn.ExecContext(ctx, q); err != nil {
+		return errors.Annotatef(err, "creating hash table %s", d.QualifiedName(cfg.DstSchema, cfg.hashTable()))
+	}
+
+	return nil
+}
+
+// writeHashes replaces the contents of Config.HashTable with the hashes.
+func writeHashes(ctx context.Context, dstConn *sql.Conn, cfg *Config, hashes map[string]string) (err error) {
+	var qs []string
+	var w bulk.Writer
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if qs, err = d.ClearTableSQL(cfg.DstSchema, cfg.hashTable(), false, false); err != nil {
+		return errors.Trace(err)
+	}
+	for _, q := range qs {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "clearing hash table %s", d.QualifiedName(cfg.DstSchema, cfg.hashTable()))
+		}
+	}
+
+	if w, err = bulk.NewWriter(ctx, dstConn, bulk.Options{
+		Driver:         cfg.DstDbDriver,
+		Schema:         cfg.DstSchema,
+		Table:          cfg.hashTable(),
+		Columns:        []string{"row_key", "row_hash"},
+		MaxRowBufSz:    cfg.MaxRowBufSz,
+		MaxRowTxCommit: cfg.MaxRowTxCommit}); err != nil {
+		return errors.Trace(err)
+	}
+
+	for k, h := range hashes {
+		if err = w.AppendValues(ctx, []interface{}{k, h}); err != nil {
+			w.Rollback()
+			return errors.Annotate(err, "writing row hashes")
+		}
+	}
+	if _, err = w.Flush(ctx); err != nil {
+		return errors.Annotate(err, "writing row hashes")
+	}
+
+	return errors.Trace(w.Close())
+}
+
+// keyText returns the text of the values at the positions, or of all the
+// values if positions is nil, for matching keys read from the source and
+// destination.
+func keyText(values []interface{}, positions []int) string {
+	var b strings.Builder
+
+	if positions == nil {
+		positions = make([]int, len(values))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+
+	for i, pos := range positions {
+		if i > 0 {
+			b.WriteByte(0x1f)
+		}
+		if values[pos] != nil {
+			b.WriteString(valueText(values[pos]))
+		}
+	}
+
+	return b.String()
+}
+
+// newDiffStage returns a stage dropping the rows whose hash matches the
+// one written by the last run, appending the hash if Config.HashColumn is
+// set, or nil if this isn't a LoadDiff run.
+func newDiffStage(cfg *Config, columns []string, res *Result) (s stage, dstColumns []string, err error) {
+	ds := cfg.diff
+	if ds == nil {
+		return nil, columns, nil
+	}
+
+	keys := make([]int, len(ds.keys))
+	for i, k := range ds.keys {
+		if keys[i] = indexOfFold(columns, k); keys[i] < 0 {
+			return nil, nil, errors.Trace(sourceColumnError(k, "key"))
+		}
+	}
+
+	hashed := make([]int, 0, len(columns))
+	if len(cfg.DiffColumns) == 0 {
+		for i, c := range columns {
+			if !strings.EqualFold(c, cfg.HashColumn) {
+				hashed = append(hashed, i)
+			}
+		}
+	}
+	for _, name := range cfg.DiffColumns {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, nil, errors.Trace(sourceColumnError(name, "diff"))
+		}
+		hashed = append(hashed, pos)
+	}
+
+	// The hash replaces any source column of the same name
+	hashPos := -1
+	dstColumns = columns
+	if cfg.HashColumn != "" {
+		if hashPos = indexOfFold(columns, cfg.HashColumn); hashPos < 0 {
+			hashPos = len(columns)
+			dstColumns = append(append([]string{}, columns...), cfg.HashColumn)
+		}
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		k := hashKey(values, hashed)
+		hash := hex.EncodeToString(k[:])
+		key := keyText(values, keys)
+
+		ds.seen[key] = hash
+		if ds.hashes[key] == hash {
+			res.UnchangedRows++
+			return nil, nil
+		}
+
+		switch {
+		case hashPos == len(values):
+			values = append(values, hash)
+		case hashPos >= 0:
+			values[hashPos] = hash
+		}
+		return values, nil
+	}, dstColumns, nil
+}
+
+// indexOfFold returns the position of name in columns ignoring case, as
+// destination column names may be spelled differently, or -1.
+func indexOfFold(columns []string, name string) int {
+	for i, c := range columns {
+		if strings.EqualFold(c, name) {
+			return i
+		}
+	}
+
+	return -1
+}
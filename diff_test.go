@@ -0,0 +1,146 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// openSQLite returns a connection to a new in-memory SQLite database
+// after running the statements.
+func openSQLite(t *testing.T, qs ...string) (conn *sql.Conn) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	if conn, err = db.Conn(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	for _, q := range qs {
+		if _, err = conn.ExecContext(ctx, q); err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+	}
+
+	return conn
+}
+
+// queryRows returns the rows of a query, with integers as int64 and text
+// as string.
+func queryRows(t *testing.T, conn *sql.Conn, q string) (rows [][]interface{}) {
+	t.Helper()
+
+	rs, err := conn.QueryContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	columns, _ := rs.Columns()
+	for rs.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rs.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		rows = append(rows, values)
+	}
+	if err = rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+// copyToSQLite runs the pipeline from the rows to the SQLite connection.
+func copyToSQLite(t *testing.T, cfg *Config, conn *sql.Conn, columns []string, rows [][]interface{}) (res *Result) {
+	t.Helper()
+
+	c := *cfg
+	c.Source = &sliceSource{columns: columns, rows: rows}
+	c.DstConn = conn
+	c.DstDbDriver = "sqlite"
+
+	res, err := NewPipeline(&c).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestLoadDiff(t *testing.T) {
+	conn := openSQLite(t, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price INTEGER)")
+	cfg := &Config{DstTable: "items", LoadMode: LoadDiff, MaxRowBufSz: 2}
+	columns := []string{"id", "name", "price"}
+
+	res := copyToSQLite(t, cfg, conn, columns, [][]interface{}{
+		{int64(1), "widget", int64(10)},
+		{int64(2), "gadget", int64(20)},
+		{int64(3), nil, int64(30)}})
+	if res.RowCount != 3 || res.UnchangedRows != 0 {
+		t.Errorf("first run wrote %d rows, %d unchanged", res.RowCount, res.UnchangedRows)
+	}
+
+	// Row 2 changes, row 3's NULL becomes empty, row 4 is new and row 1
+	// is unchanged
+	res = copyToSQLite(t, cfg, conn, columns, [][]interface{}{
+		{int64(1), "widget", int64(10)},
+		{int64(2), "gadget", int64(25)},
+		{int64(3), "", int64(30)},
+		{int64(4), "gizmo", int64(40)}})
+	if res.RowCount != 3 || res.UnchangedRows != 1 {
+		t.Errorf("second run wrote %d rows, %d unchanged", res.RowCount, res.UnchangedRows)
+	}
+
+	want := [][]interface{}{
+		{int64(1), "widget", int64(10)},
+		{int64(2), "gadget", int64(25)},
+		{int64(3), "", int64(30)},
+		{int64(4), "gizmo", int64(40)}}
+	if got := queryRows(t, conn, "SELECT id, name, price FROM items ORDER BY id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("items = %v, want %v", got, want)
+	}
+	if got := queryRows(t, conn, "SELECT COUNT(*) FROM items_hashes"); got[0][0] != int64(4) {
+		t.Errorf("hashes kept = %v", got[0][0])
+	}
+}
+
+func TestLoadDiffHashColumn(t *testing.T) {
+	conn := openSQLite(t, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, row_hash TEXT)")
+	cfg := &Config{DstTable: "items", LoadMode: LoadDiff, HashColumn: "row_hash", MaxRowBufSz: 2}
+	columns := []string{"id", "name"}
+
+	copyToSQLite(t, cfg, conn, columns, [][]interface{}{{int64(1), "widget"}, {int64(2), "gadget"}})
+	res := copyToSQLite(t, cfg, conn, columns, [][]interface{}{{int64(1), "widget"}, {int64(2), "gizmo"}})
+	if res.RowCount != 1 || res.UnchangedRows != 1 {
+		t.Errorf("second run wrote %d rows, %d unchanged", res.RowCount, res.UnchangedRows)
+	}
+
+	got := queryRows(t, conn, "SELECT id, name, length(row_hash) FROM items ORDER BY id")
+	want := [][]interface{}{{int64(1), "widget", int64(32)}, {int64(2), "gizmo", int64(32)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("items = %v, want %v", got, want)
+	}
+	if got := queryRows(t, conn, "SELECT name FROM sqlite_master WHERE name = 'items_hashes'"); len(got) != 0 {
+		t.Error("hash table created with a hash column")
+	}
+}
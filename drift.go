@@ -0,0 +1,234 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// SchemaDrift determines what a run does when the source columns don't
+// match the destination table.
+type SchemaDrift int
+
+const (
+	DriftIgnore SchemaDrift = iota //Don't compare the schemas
+	DriftReport                    //Report differences in the Result and an EventSchemaDrift
+	DriftFail                      //Fail the run if columns are missing or mismatched
+	DriftAlter                     //Add missing columns to the destination as nullable columns
+)
+
+// Parses a SchemaDrift name: ignore, report, fail or alter.
+func ParseSchemaDrift(s string) (m SchemaDrift, err error) {
+	switch s {
+	case "", "ignore":
+		return DriftIgnore, nil
+	case "report":
+		return DriftReport, nil
+	case "fail":
+		return DriftFail, nil
+	case "alter":
+		return DriftAlter, nil
+	}
+
+	return DriftIgnore, errors.NotValidf("schema drift mode %q", s)
+}
+
+// TypeMismatch is a column whose source values may not fit the
+// destination column.
+type TypeMismatch struct {
+	Column  string
+	SrcType ColumnType
+	DstType ColumnType
+	Reason  string
+}
+
+// SchemaDiff describes how the copied columns differ from the destination
+// table.
+type SchemaDiff struct {
+	Missing    []ColumnType   //Copied columns the destination doesn't have
+	Extra      []ColumnType   //Destination columns which aren't copied
+	Mismatches []TypeMismatch //Columns whose types don't match
+	Added      []string       //Missing columns added by DriftAlter
+}
+
+// Reports whether the schemas match.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mismatches) == 0
+}
+
+func (d *SchemaDiff) String() string {
+	var parts []string
+
+	for _, c := range d.Missing {
+		parts = append(parts, fmt.Sprintf("missing column %s", c.Name))
+	}
+	for _, c := range d.Extra {
+		parts = append(parts, fmt.Sprintf("extra column %s", c.Name))
+	}
+	for _, m := range d.Mismatches {
+		parts = append(parts, fmt.Sprintf("column %s %s", m.Column, m.Reason))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Compares the copied columns with the destination table's columns,
+// matching names case-insensitively. Source columns without a known type
+// aren't checked for type mismatches.
+func CompareSchema(src []ColumnType, dst []ColumnType) (diff *SchemaDiff) {
+	diff = &SchemaDiff{}
+
+	found := make([]bool, len(dst))
+	for _, s := range src {
+		pos := -1
+		for i, d := range dst {
+			if strings.EqualFold(s.Name, d.Name) {
+				pos = i
+				break
+			}
+		}
+
+		if pos < 0 {
+			diff.Missing = append(diff.Missing, s)
+			continue
+		}
+		found[pos] = true
+
+		if reason := typeMismatch(s, dst[pos]); reason != "" {
+			diff.Mismatches = append(diff.Mismatches, TypeMismatch{
+				Column:  s.Name,
+				SrcType: s,
+				DstType: dst[pos],
+				Reason:  reason})
+		}
+	}
+
+	for i, d := range dst {
+		if !found[i] {
+			diff.Extra = append(diff.Extra, d)
+		}
+	}
+
+	return diff
+}
+
+// typeMismatch describes why source values may not fit the destination
+// column, or returns "" if they do.
+func typeMismatch(src ColumnType, dst ColumnType) string {
+	sf, df := bulk.Family(src.DatabaseType), bulk.Family(dst.DatabaseType)
+	if sf == bulk.FamilyUnknown || df == bulk.FamilyUnknown {
+		return ""
+	}
+
+	if !compatibleFamilies(sf, df) {
+		return fmt.Sprintf("is %s in the source but %s in the destination", src.DatabaseType, dst.DatabaseType)
+	}
+
+	if sf == bulk.FamilyString && df == bulk.FamilyString && src.Length > 0 && dst.Length > 0 && src.Length > dst.Length {
+		return fmt.Sprintf("may be truncated from %d to %d characters", src.Length, dst.Length)
+	}
+
+	if sf == bulk.FamilyDecimal && df == bulk.FamilyDecimal && dst.Precision > 0 {
+		if src.Scale > dst.Scale {
+			return fmt.Sprintf("may lose scale from %d to %d", src.Scale, dst.Scale)
+		}
+		if src.Precision-src.Scale > dst.Precision-dst.Scale {
+			return fmt.Sprintf("may overflow from precision %d to %d", src.Precision, dst.Precision)
+		}
+	}
+
+	return ""
+}
+
+// compatibleFamilies reports whether source values of one family can be
+// written to a destination column of another.
+func compatibleFamilies(src bulk.TypeFamily, dst bulk.TypeFamily) bool {
+	if src == dst {
+		return true
+	}
+
+	switch dst {
+	case bulk.FamilyString:
+		return src != bulk.FamilyBinary
+	case bulk.FamilyDecimal:
+		return src == bulk.FamilyInt
+	case bulk.FamilyFloat:
+		return src == bulk.FamilyInt || src == bulk.FamilyDecimal
+	case bulk.FamilyInt, bulk.FamilyBool:
+		return src == bulk.FamilyInt || src == bulk.FamilyBool
+	case bulk.FamilyTime:
+		return src == bulk.FamilyDate
+	case bulk.FamilyJSON, bulk.FamilyUUID, bulk.FamilyBinary:
+		return src == bulk.FamilyString
+	}
+
+	return false
+}
+
+// checkSchemaDrift compares the copied columns with the destination table
+// before anything is written, adding missing columns to the table and to
+// writeTable, the table actually written, when altering.
+func checkSchemaDrift(ctx context.Context, cfg *Config, src Source, dstConn *sql.Conn, columns []string, writeSchema string, writeTable string, res *Result) (err error) {
+	var srcTypes, dstTypes []ColumnType
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if cfg.SchemaDrift == DriftIgnore || dstConn == nil || d == bulk.Generic {
+		return nil
+	}
+
+	if dstTypes, err = bulk.TableColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Annotatef(err, "finding columns of %s", cfg.DstTable)
+	} else if len(dstTypes) == 0 {
+		return nil
+	}
+
+	if ct, ok := src.(ColumnTyper); ok {
+		if srcTypes, err = ct.ColumnTypes(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Columns added by the stages have no source type
+	types := make([]ColumnType, len(columns))
+	for i, c := range columns {
+		types[i].Name = c
+		for _, t := range srcTypes {
+			if t.Name == c {
+				types[i] = t
+				break
+			}
+		}
+	}
+
+	diff := CompareSchema(types, dstTypes)
+	if diff.Empty() {
+		return nil
+	}
+
+	if cfg.SchemaDrift == DriftAlter {
+		for _, ct := range diff.Missing {
+			if _, err = dstConn.ExecContext(ctx, d.AddColumnSQL(cfg.DstSchema, cfg.DstTable, ct)); err != nil {
+				return errors.Annotatef(err, "adding column %s", ct.Name)
+			}
+			if writeTable != cfg.DstTable || writeSchema != cfg.DstSchema {
+				if _, err = dstConn.ExecContext(ctx, d.AddColumnSQL(writeSchema, writeTable, ct)); err != nil {
+					return errors.Annotatef(err, "adding column %s", ct.Name)
+				}
+			}
+			diff.Added = append(diff.Added, ct.Name)
+		}
+	}
+
+	res.SchemaDiff = diff
+	cfg.emit(Event{Type: EventSchemaDrift, RunID: res.RunID, SchemaDiff: diff})
+
+	if cfg.SchemaDrift == DriftFail && (len(diff.Missing) > 0 || len(diff.Mismatches) > 0) {
+		return errors.Trace(&SchemaError{Table: cfg.DstTable, Diff: diff, Err: errors.Errorf("schema drift: %s", diff)})
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package godatapipe
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// DSN holds the parts of a database URL so they can be set separately
+// without hand encoding special characters in the password.
+type DSN struct {
+	Driver   string //Database driver name
+	Host     string
+	Port     int //0 for the driver's default port
+	User     string
+	Password string
+	Database string
+	Params   map[string]string //Extra driver parameters
+}
+
+// Returns the database URL for the DSN, which can be used as SrcDbUri or
+// DstDbUri.
+func (d DSN) URL() (uri string, err error) {
+	if d.Driver == "" || d.Host == "" {
+		return "", errors.NotValidf("DSN without a driver and host")
+	}
+
+	u := url.URL{Scheme: d.Driver, Host: d.Host}
+	if d.Port > 0 {
+		u.Host = net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	}
+
+	if d.Password != "" {
+		u.User = url.UserPassword(d.User, d.Password)
+	} else if d.User != "" {
+		u.User = url.User(d.User)
+	}
+
+	q := url.Values{}
+	for k, v := range d.Params {
+		q.Set(k, v)
+	}
+
+	// SQL Server URLs take the instance name as the path
+	if bulk.DialectFor(d.Driver) == bulk.SQLServer {
+		if d.Database != "" {
+			q.Set("database", d.Database)
+		}
+	} else if d.Database != "" {
+		u.Path = "/" + d.Database
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// TLSOptions configures encrypted connections. Mode is one of disable,
+// require, verify-ca or verify-full as for Postgres' sslmode, and is
+// translated to the driver's own settings.
+type TLSOptions struct {
+	Mode       string
+	CAFile     string //CA bundle the server certificate is verified with
+	CertFile   string //Client certificate
+	KeyFile    string //Client certificate key
+	ServerName string //Name the server certificate is verified against, if not the host
+}
+
+// tlsParams returns the DSN parameters for the driver's TLS settings.
+func tlsParams(driver string, t TLSOptions) (params map[string]string, err error) {
+	params = map[string]string{}
+
+	switch t.Mode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return nil, errors.NotValidf("TLS mode %q", t.Mode)
+	}
+
+	switch bulk.DialectFor(driver) {
+	case bulk.Postgres:
+		set := map[string]string{"sslmode": t.Mode, "sslrootcert": t.CAFile, "sslcert": t.CertFile, "sslkey": t.KeyFile}
+		for k, v := range set {
+			if v != "" {
+				params[k] = v
+			}
+		}
+		if t.ServerName != "" {
+			return nil, errors.NotSupportedf("TLS server name for postgres")
+		}
+	case bulk.MySQL:
+		if t.CAFile != "" || t.CertFile != "" {
+			return nil, errors.NotSupportedf("TLS certificate files for mysql, register a tls.Config with the driver")
+		}
+		switch t.Mode {
+		case "disable":
+			params["tls"] = "false"
+		case "require":
+			params["tls"] = "skip-verify"
+		case "verify-ca", "verify-full":
+			params["tls"] = "true"
+		}
+	case bulk.SQLServer:
+		if t.CertFile != "" {
+			return nil, errors.NotSupportedf("TLS client certificates for sqlserver")
+		}
+		switch t.Mode {
+		case "disable":
+			params["encrypt"] = "disable"
+		case "require":
+			params["encrypt"] = "true"
+			params["TrustServerCertificate"] = "true"
+		case "verify-ca", "verify-full":
+			params["encrypt"] = "true"
+		}
+		if t.CAFile != "" {
+			params["certificate"] = t.CAFile
+		}
+		if t.ServerName != "" {
+			params["hostNameInCertificate"] = t.ServerName
+		}
+	default:
+		if t != (TLSOptions{}) {
+			return nil, errors.NotSupportedf("TLS options for %s", driver)
+		}
+	}
+
+	return params, nil
+}
+
+// envURI returns the database URL from the environment: the prefix's
+// DB_URI variable, or a URL built from its DB_HOST, DB_PORT, DB_USER
+// and DB_NAME variables. The password is kept separately, see
+// envPassword.
+func (c *Config) envURI(prefix string, driver string) (uri string, err error) {
+	if uri = os.Getenv(prefix + "DB_URI"); uri != "" || os.Getenv(prefix+"DB_HOST") == "" {
+		return c.EnvStr(prefix + "DB_URI")
+	}
+
+	d := DSN{
+		Driver:   driver,
+		Host:     os.Getenv(prefix + "DB_HOST"),
+		User:     os.Getenv(prefix + "DB_USER"),
+		Database: os.Getenv(prefix + "DB_NAME")}
+
+	if s := os.Getenv(prefix + "DB_PORT"); s != "" {
+		if d.Port, err = strconv.Atoi(s); err != nil {
+			return "", errors.Trace(newConfigError(prefix+"DB_PORT", err))
+		}
+	}
+
+	return d.URL()
+}
+
+// envPassword returns the prefix's DB_PASSWORD variable, or a file
+// reference to its DB_PASSWORD_FILE.
+func (c *Config) envPassword(prefix string) (password string) {
+	if path := os.Getenv(prefix + "DB_PASSWORD_FILE"); path != "" {
+		return "file://" + path
+	}
+
+	return os.Getenv(prefix + "DB_PASSWORD")
+}
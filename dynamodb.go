@@ -0,0 +1,259 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DynamoDB takes at most 25 items per BatchWriteItem request.
+const dynamoBatchItems = 25
+
+// Times a request's unprocessed or throttled items are retried.
+const dynamoRetries = 8
+
+// dynamoDriver writes to Amazon DynamoDB. URIs are dynamodb://REGION, or
+// dynamodb:// to use AWS_REGION, with optional query parameters: keys,
+// comma separated attribute=column pairs renaming the key columns to the
+// table's key attributes, time, iso (the default) or epoch for how times
+// are written, and endpoint, e.g. http://localhost:8000 for DynamoDB
+// Local. Credentials come from the AWS environment variables.
+type dynamoDriver struct{}
+
+func (dynamoDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from DynamoDB")
+}
+
+func (dynamoDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	d := &dynamoWriter{table: table, region: u.Host, keys: map[string]string{}}
+	if d.region == "" {
+		d.region = os.Getenv("AWS_REGION")
+	}
+	if d.region == "" {
+		return nil, errors.NotValidf("DynamoDB URI %q without a region", uri)
+	}
+	if d.creds, err = envAWSCredentials(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	q := u.Query()
+	d.endpoint = q.Get("endpoint")
+	if d.endpoint == "" {
+		d.endpoint = "https://dynamodb." + d.region + ".amazonaws.com"
+	}
+	for _, kv := range splitList(q.Get("keys")) {
+		attr, column, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errors.NotValidf("DynamoDB key %q, expected attribute=column", kv)
+		}
+		d.keys[strings.ToLower(column)] = attr
+	}
+	switch d.epoch = q.Get("time") == "epoch"; q.Get("time") {
+	case "", "iso", "epoch":
+	default:
+		return nil, errors.NotValidf("DynamoDB time %q", q.Get("time"))
+	}
+
+	return d, nil
+}
+
+// dynamoWriter puts record batches' rows as items with BatchWriteItem.
+type dynamoWriter struct {
+	table    string
+	region   string
+	endpoint string
+	creds    awsCredentials
+	keys     map[string]string //Key attributes, by lower case column name
+	epoch    bool              //Write times as Unix seconds rather than RFC 3339
+}
+
+// dynamoError is an error response from DynamoDB.
+type dynamoError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoError) Error() string {
+	t := e.Type
+	if i := strings.LastIndexByte(t, '#'); i >= 0 {
+		t = t[i+1:]
+	}
+
+	return fmt.Sprintf("dynamodb: %s: %s", t, e.Message)
+}
+
+// retryable returns whether the request can be retried as it was.
+func (e *dynamoError) retryable() bool {
+	for _, t := range []string{"ProvisionedThroughputExceeded", "Throttling", "RequestLimitExceeded", "InternalServerError", "ServiceUnavailable"} {
+		if strings.Contains(e.Type, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *dynamoWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	var requests []interface{}
+	var keyAttrs []string
+
+	names := make([]string, len(b.Fields))
+	for i, f := range b.Fields {
+		names[i] = f.Name
+		if attr, ok := d.keys[strings.ToLower(f.Name)]; ok {
+			names[i] = attr
+			keyAttrs = append(keyAttrs, attr)
+		}
+	}
+
+	// Items with the same key can't be in one request, the last one wins
+	at := map[string]int{}
+	row := make([]interface{}, len(b.Fields))
+	for i := 0; i < b.NumRows; i++ {
+		row = b.Row(i, row)
+		item := map[string]interface{}{}
+		for c, v := range row {
+			if av := d.attributeValue(b.Fields[c].Type, v); av != nil {
+				item[names[c]] = av
+			}
+		}
+
+		var key strings.Builder
+		for _, attr := range keyAttrs {
+			if item[attr] == nil {
+				return errors.Errorf("row %d has no value for key attribute %s", i+1, attr)
+			}
+			k, _ := json.Marshal(item[attr])
+			key.Write(k)
+		}
+
+		req := map[string]interface{}{"PutRequest": map[string]interface{}{"Item": item}}
+		if n, ok := at[key.String()]; ok && len(keyAttrs) > 0 {
+			requests[n] = req
+			continue
+		}
+		at[key.String()] = len(requests)
+		requests = append(requests, req)
+	}
+
+	for start := 0; start < len(requests); start += dynamoBatchItems {
+		if err = d.batchWrite(ctx, requests[start:min(start+dynamoBatchItems, len(requests))]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// batchWrite writes the requests, retrying unprocessed and throttled ones
+// with backoff.
+func (d *dynamoWriter) batchWrite(ctx context.Context, requests []interface{}) (err error) {
+	for attempt := 0; ; attempt++ {
+		var out struct {
+			UnprocessedItems map[string][]interface{}
+		}
+
+		err = d.call(ctx, "BatchWriteItem", map[string]interface{}{"RequestItems": map[string]interface{}{d.table: requests}}, &out)
+
+		var de *dynamoError
+		switch {
+		case err == nil && len(out.UnprocessedItems[d.table]) == 0:
+			return nil
+		case err == nil:
+			requests = out.UnprocessedItems[d.table]
+		case !errors.As(err, &de) || !de.retryable():
+			return errors.Annotatef(err, "writing to DynamoDB table %s", d.table)
+		}
+
+		if attempt >= dynamoRetries {
+			if err == nil {
+				err = errors.Errorf("%d items still unprocessed", len(requests))
+			}
+			return errors.Annotatef(err, "writing to DynamoDB table %s", d.table)
+		}
+		if err = sleepBackoff(ctx, attempt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// call sends a DynamoDB API request.
+func (d *dynamoWriter) call(ctx context.Context, op string, in interface{}, out interface{}) (err error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	signAWS(req, body, "dynamodb", d.region, d.creds, time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		de := &dynamoError{}
+		json.NewDecoder(resp.Body).Decode(de)
+		if de.Type == "" {
+			de.Type = resp.Status
+			if resp.StatusCode >= 500 {
+				de.Type = "ServiceUnavailable"
+			}
+		}
+		return errors.Trace(de)
+	}
+
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// attributeValue returns a value as a DynamoDB attribute value, or nil for
+// NULL, which is left out of the item.
+func (d *dynamoWriter) attributeValue(t ArrowType, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch t {
+	case ArrowInt64, ArrowFloat64:
+		return map[string]string{"N": valueText(v)}
+	case ArrowBoolean:
+		return map[string]interface{}{"BOOL": v}
+	case ArrowBinary:
+		return map[string]string{"B": base64.StdEncoding.EncodeToString(v.([]byte))}
+	case ArrowTimestamp:
+		tm := v.(time.Time)
+		if d.epoch {
+			return map[string]string{"N": strconv.FormatInt(tm.Unix(), 10)}
+		}
+		return map[string]string{"S": tm.Format(time.RFC3339Nano)}
+	}
+
+	return map[string]string{"S": valueText(v)}
+}
+
+func (d *dynamoWriter) Close() (err error) {
+	return nil
+}
@@ -0,0 +1,278 @@
+package godatapipe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Default email subject and body templates.
+const (
+	emailSubject = `Copy {{ if .Failed }}failed{{ else }}finished{{ end }}: {{ .RowCount }} rows`
+	emailBody    = `{{ .Summary }}`
+)
+
+// Default bytes of attachments an email holds.
+const emailMaxAttachments = 10 << 20
+
+// errAttachmentSize stops compressing a file too large to attach.
+var errAttachmentSize = errors.New("attachment too large")
+
+// EmailNotifier emails the report's summary with the export files of the
+// tables which copied, gzipped unless they're already compressed, so
+// scheduled extracts are delivered to people rather than left on disk.
+type EmailNotifier struct {
+	SMTPURL string   //smtp://[user[:password]@]host:587 with STARTTLS, or smtps:// for TLS on connecting, whose password or password query parameter can be a secret reference
+	From    string   //Sender's address
+	To      []string //Recipients' addresses
+	Subject string   //Template of the subject, executed with the Report
+	Body    string   //Template of the plain text body, executed with the Report
+
+	MaxAttachmentSize int64 //Bytes of compressed attachments, files which don't fit are listed in the body instead, defaults to 10MiB
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	var subject, body string
+	var msg bytes.Buffer
+
+	if subject, err = executeReportTemplate("email subject", n.Subject, emailSubject, r); err != nil {
+		return errors.Trace(err)
+	}
+	if body, err = executeReportTemplate("email body", n.Body, emailBody, r); err != nil {
+		return errors.Trace(err)
+	}
+
+	boundary := make([]byte, 16)
+	rand.Read(boundary)
+	mw := multipart.NewWriter(&msg)
+	mw.SetBoundary(hex.EncodeToString(boundary))
+
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		n.From, strings.Join(n.To, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z), mw.Boundary())
+
+	// Files are compressed first so the body can list those left out
+	var parts []emailAttachment
+	var left []string
+	budget := n.MaxAttachmentSize
+	if budget <= 0 {
+		budget = emailMaxAttachments
+	}
+	for _, t := range r.Tables {
+		if t.File == "" || t.Status() != "ok" {
+			continue
+		}
+		a, err := newEmailAttachment(t.File, budget)
+		if errors.Is(err, errAttachmentSize) {
+			left = append(left, filepath.Base(t.File))
+			continue
+		} else if err != nil {
+			return errors.Annotatef(err, "attaching %s", t.File)
+		}
+		budget -= int64(len(a.data))
+		parts = append(parts, a)
+	}
+	if len(left) > 0 {
+		body += "\n\nToo large to attach: " + strings.Join(left, ", ")
+	}
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	qw := quotedprintable.NewWriter(pw)
+	io.WriteString(qw, body)
+	qw.Close()
+
+	for _, a := range parts {
+		if pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})}}); err != nil {
+			return errors.Trace(err)
+		}
+		// Base64 lines are at most 76 characters
+		encoded := base64.StdEncoding.EncodeToString(a.data)
+		for len(encoded) > 76 {
+			io.WriteString(pw, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		io.WriteString(pw, encoded+"\r\n")
+	}
+	if err = mw.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Annotate(n.send(ctx, msg.Bytes()), "sending email")
+}
+
+// executeReportTemplate executes a template with the report, or the
+// default template if it's empty.
+func executeReportTemplate(name string, text string, def string, r *Report) (s string, err error) {
+	var t *template.Template
+	var buf bytes.Buffer
+
+	if text == "" {
+		text = def
+	}
+	if t, err = template.New(name).Parse(text); err != nil {
+		return "", errors.Annotatef(err, "parsing %s template", name)
+	}
+	if err = t.Execute(&buf, r); err != nil {
+		return "", errors.Annotatef(err, "executing %s template", name)
+	}
+
+	return buf.String(), nil
+}
+
+// emailAttachment is a file's content as it's attached.
+type emailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// newEmailAttachment reads a file, gzipping it unless it's compressed
+// already, failing with errAttachmentSize once it's larger than max.
+func newEmailAttachment(path string, max int64) (a emailAttachment, err error) {
+	var f *os.File
+
+	if f, err = os.Open(path); err != nil {
+		return a, errors.Trace(err)
+	}
+	defer f.Close()
+
+	a.name = filepath.Base(path)
+	buf := &emailBuffer{max: max}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz", ".zst", ".sz", ".zip", ".xlsx", ".enc":
+		a.contentType = mime.TypeByExtension(filepath.Ext(path))
+		_, err = io.Copy(buf, f)
+	default:
+		a.name += ".gz"
+		a.contentType = "application/gzip"
+		zw := gzip.NewWriter(buf)
+		if _, err = io.Copy(zw, f); err == nil {
+			err = zw.Close()
+		}
+	}
+	if err != nil {
+		return a, errors.Trace(err)
+	}
+	if a.contentType == "" {
+		a.contentType = "application/octet-stream"
+	}
+	a.data = buf.Bytes()
+
+	return a, nil
+}
+
+// emailBuffer is a buffer failing writes past its maximum size.
+type emailBuffer struct {
+	bytes.Buffer
+	max int64
+}
+
+func (b *emailBuffer) Write(p []byte) (n int, err error) {
+	if int64(b.Len()+len(p)) > b.max {
+		return 0, errAttachmentSize
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// send sends the message over SMTP.
+func (n *EmailNotifier) send(ctx context.Context, msg []byte) (err error) {
+	var u *url.URL
+	var d net.Dialer
+	var conn net.Conn
+	var c *smtp.Client
+
+	if u, err = url.Parse(n.SMTPURL); err != nil {
+		return errors.Trace(err)
+	}
+	host := u.Hostname()
+	addr := u.Host
+	if u.Port() == "" && u.Scheme == "smtps" {
+		addr = net.JoinHostPort(host, "465")
+	} else if u.Port() == "" {
+		addr = net.JoinHostPort(host, "587")
+	}
+
+	if conn, err = d.DialContext(ctx, "tcp", addr); err != nil {
+		return errors.Trace(err)
+	}
+	if u.Scheme == "smtps" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c, err = smtp.NewClient(conn, host); err != nil {
+		conn.Close()
+		return errors.Annotatef(err, "connecting to %s", addr)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && u.Scheme != "smtps" {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if u.User != nil && u.User.Username() != "" {
+		password, ok := u.User.Password()
+		if !ok {
+			password = u.Query().Get("password")
+		}
+		if password, err = ResolveSecret(ctx, password); err != nil {
+			return errors.Trace(err)
+		}
+		// Plain auth refuses to send the password without TLS, other than
+		// to localhost
+		if err = c.Auth(smtp.PlainAuth("", u.User.Username(), password, host)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err = c.Mail(n.From); err != nil {
+		return errors.Trace(err)
+	}
+	for _, to := range n.To {
+		if err = c.Rcpt(to); err != nil {
+			return errors.Annotatef(err, "recipient %s", to)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return errors.Trace(err)
+	}
+	if err = w.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(c.Quit())
+}
@@ -0,0 +1,226 @@
+package godatapipe
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// TextEncoding is the character encoding of source text columns.
+type TextEncoding int
+
+const (
+	EncodingNone        TextEncoding = iota //Copy text as is
+	EncodingUTF8                            //Validate UTF-8, handling invalid bytes by InvalidText
+	EncodingLatin1                          //ISO-8859-1
+	EncodingWindows1252                     //Windows code page 1252
+	EncodingUTF16LE                         //Little endian UTF-16
+	EncodingUTF16BE                         //Big endian UTF-16
+)
+
+// Parses a TextEncoding name: utf8, latin1, windows1252, utf16le or
+// utf16be. utf16 is little endian unless the text starts with a byte
+// order mark.
+func ParseTextEncoding(s string) (e TextEncoding, err error) {
+	switch strings.ToLower(strings.Replace(s, "-", "", -1)) {
+	case "":
+		return EncodingNone, nil
+	case "utf8":
+		return EncodingUTF8, nil
+	case "latin1", "iso88591":
+		return EncodingLatin1, nil
+	case "windows1252", "cp1252":
+		return EncodingWindows1252, nil
+	case "utf16", "utf16le":
+		return EncodingUTF16LE, nil
+	case "utf16be":
+		return EncodingUTF16BE, nil
+	}
+
+	return EncodingNone, errors.NotValidf("text encoding %q", s)
+}
+
+// InvalidText determines what happens to bytes which aren't valid in the
+// source encoding.
+type InvalidText int
+
+const (
+	InvalidReplace InvalidText = iota //Replace them with U+FFFD
+	InvalidDrop                       //Leave them out
+	InvalidError                      //Fail the copy
+)
+
+// Parses an InvalidText name: replace, drop or error.
+func ParseInvalidText(s string) (a InvalidText, err error) {
+	switch s {
+	case "", "replace":
+		return InvalidReplace, nil
+	case "drop":
+		return InvalidDrop, nil
+	case "error":
+		return InvalidError, nil
+	}
+
+	return InvalidReplace, errors.NotValidf("invalid text action %q", s)
+}
+
+// The windows-1252 characters for 0x80 to 0x9f, 0 where undefined.
+var windows1252 = [32]rune{
+	0x20ac, 0, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021, 0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017d, 0,
+	0, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014, 0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0, 0x017e, 0x0178,
+}
+
+// textDecoder converts encoded text to UTF-8.
+type textDecoder struct {
+	enc     TextEncoding
+	invalid InvalidText
+}
+
+// invalidByte writes the replacement for an invalid byte sequence, or
+// returns an error.
+func (d *textDecoder) invalidByte(b *strings.Builder, pos int) (err error) {
+	switch d.invalid {
+	case InvalidReplace:
+		b.WriteRune(utf8.RuneError)
+	case InvalidError:
+		return errors.Errorf("invalid text at byte %d", pos)
+	}
+
+	return nil
+}
+
+// decode returns the text as UTF-8.
+func (d *textDecoder) decode(p []byte) (s string, err error) {
+	var b strings.Builder
+
+	switch d.enc {
+	case EncodingUTF8:
+		if utf8.Valid(p) {
+			return string(p), nil
+		}
+
+		for i := 0; i < len(p); {
+			r, sz := utf8.DecodeRune(p[i:])
+			if r == utf8.RuneError && sz == 1 {
+				if err = d.invalidByte(&b, i); err != nil {
+					return "", errors.Trace(err)
+				}
+			} else {
+				b.WriteRune(r)
+			}
+			i += sz
+		}
+	case EncodingLatin1:
+		for _, c := range p {
+			b.WriteRune(rune(c))
+		}
+	case EncodingWindows1252:
+		for i, c := range p {
+			if c < 0x80 || c > 0x9f {
+				b.WriteRune(rune(c))
+			} else if r := windows1252[c-0x80]; r != 0 {
+				b.WriteRune(r)
+			} else if err = d.invalidByte(&b, i); err != nil {
+				return "", errors.Trace(err)
+			}
+		}
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if err = d.decodeUTF16(&b, p); err != nil {
+			return "", errors.Trace(err)
+		}
+	default:
+		return string(p), nil
+	}
+
+	return b.String(), nil
+}
+
+// decodeUTF16 writes UTF-16 text, honouring a byte order mark.
+func (d *textDecoder) decodeUTF16(b *strings.Builder, p []byte) (err error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if d.enc == EncodingUTF16BE {
+		order = binary.BigEndian
+	}
+
+	start := 0
+	if len(p) >= 2 && p[0] == 0xff && p[1] == 0xfe {
+		order, start = binary.LittleEndian, 2
+	} else if len(p) >= 2 && p[0] == 0xfe && p[1] == 0xff {
+		order, start = binary.BigEndian, 2
+	}
+
+	for i := start; i < len(p); i += 2 {
+		if i+1 >= len(p) {
+			return errors.Trace(d.invalidByte(b, i))
+		}
+
+		r := rune(order.Uint16(p[i:]))
+		if !utf16.IsSurrogate(r) {
+			b.WriteRune(r)
+			continue
+		}
+
+		if i+3 < len(p) {
+			if dr := utf16.DecodeRune(r, rune(order.Uint16(p[i+2:]))); dr != utf8.RuneError {
+				b.WriteRune(dr)
+				i += 2
+				continue
+			}
+		}
+
+		if err = d.invalidByte(b, i); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// newEncodingStage returns a stage converting the text columns from the
+// source encoding to UTF-8, or nil if no encoding is set. []byte values
+// are only converted in columns with a text source type, or every column
+// if the source types aren't known, so binary columns are left alone.
+func newEncodingStage(cfg *Config, columns []string, srcTypes []ColumnType) stage {
+	if cfg.TextEncoding == EncodingNone {
+		return nil
+	}
+
+	d := &textDecoder{enc: cfg.TextEncoding, invalid: cfg.InvalidText}
+
+	text := make([]bool, len(columns))
+	for i := range columns {
+		text[i] = i >= len(srcTypes)
+		if !text[i] {
+			f := bulk.Family(srcTypes[i].DatabaseType)
+			text[i] = f == bulk.FamilyString || f == bulk.FamilyJSON
+		}
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, v := range values {
+			var p []byte
+
+			switch t := v.(type) {
+			case []byte:
+				if !text[i] {
+					continue
+				}
+				p = t
+			case string:
+				p = []byte(t)
+			default:
+				continue
+			}
+
+			if values[i], err = d.decode(p); err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, columns[i])
+			}
+		}
+
+		return values, nil
+	}
+}
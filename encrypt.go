@@ -0,0 +1,249 @@
+package godatapipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Encrypted files start with the magic and a random nonce prefix, followed
+// by AES-GCM sealed chunks of encryptChunk bytes, the last one shorter or
+// empty. Each chunk's nonce is the prefix, its big endian number and 1 if
+// it's the last, so chunks can't be reordered, dropped or truncated.
+var encryptMagic = []byte("DPENC\x01")
+
+const (
+	encryptChunk  = 64 << 10
+	encryptPrefix = 7
+)
+
+// encryptExt is the extension of encrypted files, ignored when taking
+// their format and compression from their names.
+const encryptExt = ".enc"
+
+// Returns the AES key a secret reference resolves to, given as hex or
+// base64 of 16, 24 or 32 bytes.
+func EncryptionKey(ctx context.Context, ref string) (key []byte, err error) {
+	var s string
+
+	if s, err = ResolveSecret(ctx, ref); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s = strings.TrimSpace(s)
+
+	if key, err = hex.DecodeString(s); err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.NotValidf("encryption key, expected hex or base64")
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+
+	return nil, errors.NotValidf("%d byte encryption key", len(key))
+}
+
+// encryptionKey returns the key Config.EncryptionKey resolves to, or nil
+// if it isn't set.
+func (c *Config) encryptionKey(ctx context.Context) (key []byte, err error) {
+	if c.EncryptionKey == "" {
+		return nil, nil
+	}
+	if key, err = EncryptionKey(ctx, c.EncryptionKey); err != nil {
+		return nil, errors.Trace(newConfigError("ENCRYPTION_KEY", err))
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	var block cipher.Block
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return aead, nil
+}
+
+// chunkNonce returns the nonce of the numbered chunk.
+func chunkNonce(nonce []byte, prefix []byte, n uint32, last bool) []byte {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefix:], n)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// encryptWriter seals what's written to it in chunks. Closing it writes
+// the last chunk but doesn't close the underlying writer.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	nonce  []byte
+	n      uint32 //Number of the next chunk
+	buf    []byte
+	out    []byte
+}
+
+// encryptTo returns a writer encrypting to w with the key.
+func encryptTo(w io.Writer, key []byte) (wc io.WriteCloser, err error) {
+	e := &encryptWriter{w: w, prefix: make([]byte, encryptPrefix), buf: make([]byte, 0, encryptChunk)}
+	if e.aead, err = newAEAD(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	e.nonce = make([]byte, e.aead.NonceSize())
+
+	if _, err = rand.Read(e.prefix); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err = w.Write(append(append([]byte{}, encryptMagic...), e.prefix...)); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return e, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// Only a full chunk followed by more data isn't the last one
+		if len(e.buf) == encryptChunk {
+			if err = e.seal(false); err != nil {
+				return n, errors.Trace(err)
+			}
+		}
+
+		c := copy(e.buf[len(e.buf):encryptChunk], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (e *encryptWriter) Close() (err error) {
+	if e.buf == nil {
+		return nil
+	}
+	err = e.seal(true)
+	e.buf = nil
+
+	return errors.Trace(err)
+}
+
+func (e *encryptWriter) seal(last bool) (err error) {
+	if e.n == ^uint32(0) {
+		return errors.Errorf("encrypted file too large")
+	}
+
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.nonce, e.prefix, e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+
+	_, err = e.w.Write(e.out)
+	return errors.Trace(err)
+}
+
+// decryptReader opens the chunks of an encrypted file as they're read.
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	nonce  []byte
+	n      uint32
+	in     []byte
+	plain  []byte
+	done   bool
+}
+
+// isEncrypted returns whether the reader is at the start of an encrypted
+// file.
+func isEncrypted(r *bufio.Reader) bool {
+	b, _ := r.Peek(len(encryptMagic))
+	return bytes.Equal(b, encryptMagic)
+}
+
+// decryptFrom returns a reader decrypting r, which must be at the start
+// of an encrypted file, with the key.
+func decryptFrom(r *bufio.Reader, key []byte) (rd io.Reader, err error) {
+	d := &decryptReader{r: r, prefix: make([]byte, encryptPrefix)}
+	if d.aead, err = newAEAD(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	d.nonce = make([]byte, d.aead.NonceSize())
+	d.in = make([]byte, encryptChunk+d.aead.Overhead())
+
+	if _, err = r.Discard(len(encryptMagic)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err = io.ReadFull(r, d.prefix); err != nil {
+		return nil, errors.Annotate(err, "reading encryption header")
+	}
+
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (n int, err error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		var c int
+		last := false
+		if c, err = io.ReadFull(d.r, d.in); err == io.EOF || err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			return 0, errors.Trace(err)
+		} else if _, err = d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+
+		if d.plain, err = d.aead.Open(d.in[:0], chunkNonce(d.nonce, d.prefix, d.n, last), d.in[:c], nil); err != nil {
+			return 0, errors.Errorf("decrypting chunk %d: wrong key, or the file is damaged or truncated", d.n)
+		}
+		d.n++
+		d.done = last
+	}
+
+	n = copy(p, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+// decryptReaderFor returns r decrypted if it's encrypted, which needs a
+// key, or r if it isn't and there's no key.
+func decryptReaderFor(r io.Reader, key []byte) (rd io.Reader, err error) {
+	br := bufio.NewReader(r)
+
+	switch enc := isEncrypted(br); {
+	case enc && key == nil:
+		return nil, errors.NotValidf("encrypted file without an encryption key")
+	case !enc && key != nil:
+		return nil, errors.NotValidf("unencrypted file with an encryption key")
+	case enc:
+		return decryptFrom(br, key)
+	}
+
+	return br, nil
+}
@@ -0,0 +1,92 @@
+package godatapipe
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/joescharf/go-datapipe/bulk"
+)
+
+// BatchError reports a batch of rows the destination rejected. Use
+// errors.As to find it in an error returned by a run.
+type BatchError = bulk.BatchError
+
+// RowRange is the rows of a BatchError.
+type RowRange = bulk.RowRange
+
+// RowError reports the row of a BatchError the destination rejected,
+// found when Config.DiagnoseErrors is set.
+type RowError = bulk.RowError
+
+// SchemaError reports a column missing from, or not matching, the source
+// or destination.
+type SchemaError struct {
+	Table  string      //Destination table, empty if the column is missing from the source
+	Column string      //Column, empty if the error is about the whole table
+	Diff   *SchemaDiff //Differences found by the schema drift check, if that's what failed
+	Err    error
+}
+
+func (e *SchemaError) Error() string {
+	switch {
+	case e.Table == "" && e.Column != "":
+		return fmt.Sprintf("source column %s: %s", e.Column, e.Err)
+	case e.Column != "":
+		return fmt.Sprintf("%s column %s: %s", e.Table, e.Column, e.Err)
+	case e.Table != "":
+		return fmt.Sprintf("%s: %s", e.Table, e.Err)
+	}
+
+	return e.Err.Error()
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// TableNotFoundError reports a destination table which doesn't exist.
+type TableNotFoundError struct {
+	Table string //Qualified destination table name
+}
+
+func (e *TableNotFoundError) Error() string {
+	return fmt.Sprintf("table %s not found", e.Table)
+}
+
+// TableLockedError reports a destination table locked by another run.
+type TableLockedError struct {
+	Table string //Qualified destination table name
+}
+
+func (e *TableLockedError) Error() string {
+	return fmt.Sprintf("table %s is locked by another run", e.Table)
+}
+
+// ConfigError reports a missing or invalid setting.
+type ConfigError struct {
+	Setting string //Environment variable name
+	Value   string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s: %s", e.Setting, e.Err)
+	}
+
+	return fmt.Sprintf("%s=%q: %s", e.Setting, e.Value, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// newConfigError reports an invalid environment variable.
+func newConfigError(env string, err error) *ConfigError {
+	return &ConfigError{Setting: env, Value: os.Getenv(env), Err: err}
+}
+
+// sourceColumnError reports a configured column which isn't in the source.
+func sourceColumnError(column string, what string) *SchemaError {
+	return &SchemaError{Column: column, Err: fmt.Errorf("%s column isn't in the source", what)}
+}
@@ -0,0 +1,132 @@
+package godatapipe
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+)
+
+// EventType identifies what happened to a pipeline.
+type EventType int
+
+const (
+	EventRunStarted   EventType = iota //A run started
+	EventRunFinished                   //A run finished, Result is set
+	EventRunFailed                     //A run failed, Err is set
+	EventRunSkipped                    //Scheduled runs were skipped as the previous run overran, Skipped is set
+	EventSchemaDrift                   //The source columns don't match the destination table, SchemaDiff is set
+	EventProgress                      //A copy is under way, Progress is set
+	EventBatchWritten                  //A destination batch was written or committed, Batch is set
+	EventNotifyFailed                  //A run's notifiers couldn't all be told, Err is set
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRunStarted:
+		return "run_started"
+	case EventRunFinished:
+		return "run_finished"
+	case EventRunFailed:
+		return "run_failed"
+	case EventRunSkipped:
+		return "run_skipped"
+	case EventSchemaDrift:
+		return "schema_drift"
+	case EventProgress:
+		return "progress"
+	case EventBatchWritten:
+		return "batch_written"
+	case EventNotifyFailed:
+		return "notify_failed"
+	}
+
+	return "unknown"
+}
+
+// Event reports progress of a pipeline to Config.OnEvent.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Pipeline string //Pipeline name
+	RunID    string
+
+	Result  *Result //Outcome of a finished run
+	Err     error   //Reason a run or its notification failed
+	Skipped int     //Number of scheduled runs skipped
+
+	SchemaDiff *SchemaDiff //Differences between the source and destination columns
+	Progress   *Progress   //How far a copy has got
+
+	Batch *bulk.BatchTiming //Time taken to write or commit a batch
+}
+
+// EventHandler receives pipeline events. It's called synchronously so it
+// should return quickly.
+type EventHandler func(e Event)
+
+// emit sends an event to the configured handler, if there is one.
+func (c *Config) emit(e Event) {
+	if c.OnEvent == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Pipeline = c.pipelineName()
+	c.OnEvent(e)
+}
+
+// Metrics counts pipeline events. Its Handle method can be used as
+// Config.OnEvent.
+type Metrics struct {
+	mu sync.Mutex
+
+	Runs        int           //Number of runs started
+	Failures    int           //Number of runs which failed
+	SkippedRuns int           //Number of scheduled runs skipped
+	RowCount    int           //Rows committed over all runs
+	SlowBatch   time.Duration //Longest destination batch write over all runs
+	LastRun     time.Time     //Time the last run finished or failed
+	LastResult  *Result       //Result of the last successful run
+	LastError   error         //Error of the last failed run
+}
+
+func (m *Metrics) Handle(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e.Type {
+	case EventRunStarted:
+		m.Runs++
+	case EventRunFinished:
+		m.RowCount += e.Result.RowCount
+		m.LastRun = e.Time
+		m.LastResult = e.Result
+	case EventRunFailed:
+		m.Failures++
+		m.LastRun = e.Time
+		m.LastError = e.Err
+	case EventRunSkipped:
+		m.SkippedRuns += e.Skipped
+	case EventBatchWritten:
+		if !e.Batch.Commit && e.Batch.Elapsed > m.SlowBatch {
+			m.SlowBatch = e.Batch.Elapsed
+		}
+	}
+}
+
+// Returns a copy of the counters which is safe to read.
+func (m *Metrics) Snapshot() (s Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return Metrics{
+		Runs:        m.Runs,
+		Failures:    m.Failures,
+		SkippedRuns: m.SkippedRuns,
+		RowCount:    m.RowCount,
+		SlowBatch:   m.SlowBatch,
+		LastRun:     m.LastRun,
+		LastResult:  m.LastResult,
+		LastError:   m.LastError}
+}
@@ -0,0 +1,196 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrorClass groups run errors by what a wrapper retrying runs should do
+// about them.
+type ErrorClass int
+
+const (
+	ClassNone       ErrorClass = iota //No error
+	ClassFailure                      //Any other error
+	ClassConfig                       //Missing, invalid or unsupported settings, retrying won't help
+	ClassValidation                   //The data or schemas don't fit the destination, retrying won't help
+	ClassTransient                    //Lost connections, timeouts, deadlocks, locked tables and the like, worth retrying
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNone:
+		return ""
+	case ClassConfig:
+		return "config"
+	case ClassValidation:
+		return "validation"
+	case ClassTransient:
+		return "transient"
+	}
+
+	return "failure"
+}
+
+// Returns the command's exit code for the class, from sysexits.h: 78
+// EX_CONFIG, 65 EX_DATAERR and 75 EX_TEMPFAIL, or 1 for other failures.
+func (c ErrorClass) ExitCode() int {
+	switch c {
+	case ClassNone:
+		return 0
+	case ClassConfig:
+		return 78
+	case ClassValidation:
+		return 65
+	case ClassTransient:
+		return 75
+	}
+
+	return 1
+}
+
+// Postgres SQLSTATEs, or their classes, of errors worth retrying.
+var transientSQLStates = []string{"08", "40001", "40P01", "53300", "55P03", "57P01", "57P02", "57P03"}
+
+// SQL Server error numbers worth retrying: deadlock victim, lock timeout
+// and Azure SQL's unavailable and throttled databases.
+var transientSQLServerErrors = []int32{1205, 1222, 40197, 40501, 40613}
+
+// Returns the class of a run error. Connection and lock errors are
+// transient even when they fail a batch.
+func ClassifyError(err error) ErrorClass {
+	var netErr net.Error
+	var lockErr *TableLockedError
+	var pgErr interface{ SQLState() string }
+	var msErr interface{ SQLErrorNumber() int32 }
+
+	if err == nil {
+		return ClassNone
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE), errors.As(err, &netErr), errors.As(err, &lockErr):
+		return ClassTransient
+	case errors.As(err, &pgErr):
+		for _, s := range transientSQLStates {
+			if strings.HasPrefix(pgErr.SQLState(), s) {
+				return ClassTransient
+			}
+		}
+	case errors.As(err, &msErr):
+		for _, n := range transientSQLServerErrors {
+			if msErr.SQLErrorNumber() == n {
+				return ClassTransient
+			}
+		}
+	}
+
+	var cfgErr *ConfigError
+	var schemaErr *SchemaError
+	var tableErr *TableNotFoundError
+	var batchErr *BatchError
+	var rowErr *RowError
+	var assertErr *AssertionError
+
+	switch {
+	case errors.As(err, &cfgErr), errors.Is(err, errors.NotValid), errors.Is(err, errors.NotSupported):
+		return ClassConfig
+	case errors.As(err, &schemaErr), errors.As(err, &tableErr), errors.As(err, &batchErr), errors.As(err, &rowErr),
+		errors.As(err, &assertErr):
+		return ClassValidation
+	}
+
+	return ClassFailure
+}
+
+// FinalStatus is the outcome of a command, written to Config.StatusFile
+// for wrappers deciding whether to retry.
+type FinalStatus struct {
+	Status     string        `json:"status"`                //ok, interrupted or failed
+	ErrorClass string        `json:"error_class,omitempty"` //config, validation, transient or failure
+	ExitCode   int           `json:"exit_code"`
+	Error      string        `json:"error,omitempty"`
+	RowCount   int           `json:"row_count"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Tables     []TableReport `json:"tables,omitempty"`
+}
+
+// Returns the final status of a command which ran the jobs, if any, and
+// returned err.
+func NewFinalStatus(results []JobResult, err error) *FinalStatus {
+	class := ClassifyError(err)
+	r := NewReport(results)
+
+	s := &FinalStatus{
+		Status:     "ok",
+		ErrorClass: class.String(),
+		ExitCode:   class.ExitCode(),
+		RowCount:   r.RowCount,
+		FinishedAt: time.Now().UTC(),
+		Tables:     r.Tables}
+
+	for _, t := range r.Tables {
+		if t.Interrupted {
+			s.Status = "interrupted"
+		}
+	}
+	if err != nil {
+		s.Status, s.Error = "failed", err.Error()
+	}
+
+	return s
+}
+
+// Writes the status as JSON to a file, replacing it in one step so it's
+// never seen half written.
+func (s *FinalStatus) WriteFile(path string) (err error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return errors.Trace(err)
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Annotatef(os.Rename(tmp.Name(), path), "writing status %s", path)
+}
+
+// Returns the error of the failed jobs that decides the run's class: the
+// first which isn't transient, so a retry is only suggested when every
+// failure might go away, or nil if none failed.
+func ResultsError(results []JobResult) (err error) {
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		if err == nil || ClassifyError(err) == ClassTransient && ClassifyError(r.Err) != ClassTransient {
+			err = r.Err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,115 @@
+package godatapipe
+
+import (
+	"crypto/rand"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// ColumnFunc computes an extra column value from a source row.
+type ColumnFunc func(columns []string, values []interface{}) (v interface{}, err error)
+
+// ExtraValue is a placeholder for an ExtraColumn value filled in at run
+// time.
+type ExtraValue int
+
+const (
+	CopyTimeValue ExtraValue = iota + 1 //Time the run started
+	RunIDValue                          //UUID of the run
+)
+
+// ExtraColumn is a destination column which isn't in the source, added
+// to every row.
+type ExtraColumn struct {
+	Name  string
+	Value interface{} //Constant value, or CopyTimeValue or RunIDValue
+	Func  ColumnFunc  //Computes the value per row, overrides Value
+}
+
+// Parses extra columns in the form "name=value,..." where value is a
+// constant, "@copy_time" or "@run_id".
+func ParseExtraColumns(spec string) (extras []ExtraColumn, err error) {
+	for _, entry := range splitList(spec) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid extra column %q", entry)
+		}
+
+		e := ExtraColumn{Name: parts[0], Value: parts[1]}
+		switch parts[1] {
+		case "@copy_time":
+			e.Value = CopyTimeValue
+		case "@run_id":
+			e.Value = RunIDValue
+		}
+
+		extras = append(extras, e)
+	}
+
+	return extras, nil
+}
+
+// newExtraStage returns a stage appending the extra columns to each row,
+// and the resulting columns, or a nil stage if there are none.
+func newExtraStage(extras []ExtraColumn, columns []string, res *Result) (s stage, outColumns []string, err error) {
+	if len(extras) == 0 {
+		return nil, columns, nil
+	}
+
+	outColumns = append([]string{}, columns...)
+	consts := make([]interface{}, len(extras))
+
+	for i, e := range extras {
+		if indexOf(outColumns, e.Name) >= 0 {
+			return nil, nil, errors.Errorf("extra column %s is already a column", e.Name)
+		}
+		outColumns = append(outColumns, e.Name)
+
+		switch e.Value {
+		case CopyTimeValue:
+			consts[i] = res.StartedAt
+		case RunIDValue:
+			consts[i] = res.RunID
+		default:
+			consts[i] = e.Value
+		}
+	}
+
+	n := len(columns)
+	row := make([]interface{}, len(outColumns))
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		copy(row, values)
+
+		for i, e := range extras {
+			if e.Func == nil {
+				row[n+i] = consts[i]
+				continue
+			}
+
+			v, err := e.Func(columns, values)
+			if err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, e.Name)
+			}
+			row[n+i] = v
+		}
+
+		return row, nil
+	}, outColumns, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (id string, err error) {
+	var b [16]byte
+
+	if _, err = rand.Read(b[:]); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return bulk.FormatUUID(b[:]), nil
+}
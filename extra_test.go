@@ -0,0 +1,69 @@
+package godatapipe
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExtraColumns(t *testing.T) {
+	got, err := ParseExtraColumns("source=crm, loaded=@copy_time,run=@run_id,empty=")
+	want := []ExtraColumn{
+		{Name: "source", Value: "crm"},
+		{Name: "loaded", Value: CopyTimeValue},
+		{Name: "run", Value: RunIDValue},
+		{Name: "empty", Value: ""}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseExtraColumns = %v, %v, want %v", got, err, want)
+	}
+
+	if _, err = ParseExtraColumns("source"); err == nil {
+		t.Error("extra column without a value parsed")
+	}
+}
+
+func TestExtraColumns(t *testing.T) {
+	cfg := &Config{MaxRowBufSz: 10, ExtraColumns: []ExtraColumn{
+		{Name: "source", Value: "crm"},
+		{Name: "loaded", Value: CopyTimeValue},
+		{Name: "run", Value: RunIDValue},
+		{Name: "upper", Func: func(columns []string, values []interface{}) (interface{}, error) {
+			return strings.ToUpper(values[1].(string)), nil
+		}}}}
+
+	got, written, err := copyColumns(t, cfg, []string{"id", "name"}, [][]interface{}{{int64(1), "a"}, {int64(2), "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id", "name", "source", "loaded", "run", "upper"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for i, row := range written {
+		if row[2] != "crm" || row[5] != strings.ToUpper(row[1].(string)) {
+			t.Errorf("row %d = %v", i, row)
+		}
+		if loaded, ok := row[3].(time.Time); !ok || loaded.IsZero() || loaded != written[0][3] {
+			t.Errorf("row %d copy time = %v", i, row[3])
+		}
+		if run, _ := row[4].(string); !uuid.MatchString(run) || run != written[0][4] {
+			t.Errorf("row %d run ID = %v", i, row[4])
+		}
+	}
+
+	cfg = &Config{MaxRowBufSz: 10, ExtraColumns: []ExtraColumn{{Name: "bad", Func: func(columns []string, values []interface{}) (interface{}, error) {
+		return nil, errors.New("no value")
+	}}}}
+	if _, _, err = copyColumns(t, cfg, []string{"id"}, intRows(1)); err == nil || !strings.Contains(err.Error(), "column bad") {
+		t.Errorf("failing column error = %v", err)
+	}
+
+	cfg = &Config{MaxRowBufSz: 10, ExtraColumns: []ExtraColumn{{Name: "id", Value: 1}}}
+	if _, _, err = copyColumns(t, cfg, []string{"id"}, intRows(1)); err == nil || !strings.Contains(err.Error(), "already a column") {
+		t.Errorf("duplicate column error = %v", err)
+	}
+}
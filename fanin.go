@@ -0,0 +1,283 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Shard is one of several sources whose rows are merged into the
+// destination table.
+type Shard struct {
+	Name       string    //Value of ShardColumn for the shard's rows
+	DbUri      string    //Shard database URI, with the source connection options
+	DbPassword string    //Password or secret reference, replaces the URI's password
+	SelectSql  string    //Select statement, defaults to SrcSelectSql
+	Conn       *sql.Conn //Shard database connection overrides DbUri
+}
+
+// shardReader reads the rows of one shard.
+type shardReader struct {
+	name string
+	db   *sql.DB //Only set if the reader opened the database
+	src  *sqlSource
+}
+
+// fanInSource merges the rows of the shards, reading ShardParallel of
+// them at once, or one after another.
+type fanInSource struct {
+	cfg     *Config
+	columns []string
+
+	// Sequential reads
+	cur  *shardReader
+	next int //Index of the next shard to read
+
+	// Parallel reads
+	rows   chan []interface{}
+	errs   chan error
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newFanInSource(ctx context.Context, cfg *Config) (s *fanInSource, err error) {
+	var first *shardReader
+
+	s = &fanInSource{cfg: cfg}
+
+	if first, err = openShard(ctx, cfg, cfg.SrcShards[0]); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.columns = first.src.columns
+	s.next = 1
+
+	if cfg.ShardParallel <= 1 {
+		s.cur = first
+		return s, nil
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.rows = make(chan []interface{}, cfg.ShardParallel)
+	s.errs = make(chan error, len(cfg.SrcShards))
+	sem := make(chan struct{}, cfg.ShardParallel)
+
+	for i, sh := range cfg.SrcShards {
+		s.wg.Add(1)
+		go func(i int, sh Shard) {
+			defer s.wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				if i == 0 {
+					first.Close()
+				}
+				return
+			}
+
+			var err error
+
+			r := first
+			if i > 0 {
+				if r, err = s.open(ctx, sh); err != nil {
+					s.fail(err)
+					return
+				}
+			}
+			defer r.Close()
+
+			for {
+				values, err := s.read(ctx, r)
+				// Each row is sent on, so it needs its own slice
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					s.fail(err)
+					return
+				}
+
+				select {
+				case s.rows <- append([]interface{}(nil), values...):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i, sh)
+	}
+
+	go func() {
+		s.wg.Wait()
+		close(s.rows)
+	}()
+
+	return s, nil
+}
+
+// openShard opens a shard's connection, unless it has one, and runs its
+// select.
+func openShard(ctx context.Context, cfg *Config, sh Shard) (r *shardReader, err error) {
+	conn := sh.Conn
+	r = &shardReader{name: sh.Name}
+
+	if conn == nil {
+		uri, err := ResolveURI(ctx, sh.DbUri, sh.DbPassword)
+		if err != nil {
+			return nil, errors.Annotatef(err, "shard %s", sh.Name)
+		}
+		if r.db, conn, err = openConn(ctx, uri, cfg.SrcConnOptions); err != nil {
+			return nil, errors.Annotatef(err, "shard %s", sh.Name)
+		}
+		if err = execSessionSQL(ctx, conn, cfg.SrcSessionSQL); err != nil {
+			r.Close()
+			return nil, errors.Annotatef(err, "shard %s", sh.Name)
+		}
+	}
+
+	query := sh.SelectSql
+	if query == "" {
+		query = cfg.SrcSelectSql
+	}
+
+	if r.src, err = newSQLSource(ctx, conn, query, cfg.SelectArgs()...); err != nil {
+		r.Close()
+		return nil, errors.Annotatef(err, "shard %s", sh.Name)
+	}
+
+	return r, nil
+}
+
+func (r *shardReader) Close() (err error) {
+	if r.src != nil {
+		err = r.src.Close()
+	}
+	if r.db != nil {
+		r.db.Close()
+	}
+
+	return errors.Trace(err)
+}
+
+// open opens a shard after the first, checking it has the same columns.
+func (s *fanInSource) open(ctx context.Context, sh Shard) (r *shardReader, err error) {
+	if r, err = openShard(ctx, s.cfg, sh); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	same := len(r.src.columns) == len(s.columns)
+	for i := 0; same && i < len(s.columns); i++ {
+		same = strings.EqualFold(r.src.columns[i], s.columns[i])
+	}
+	if !same {
+		r.Close()
+		return nil, errors.NotValidf("shard %s columns %v, expected %v", sh.Name, r.src.columns, s.columns)
+	}
+
+	return r, nil
+}
+
+// read returns the shard's next row with the shard column appended.
+func (s *fanInSource) read(ctx context.Context, r *shardReader) (values []interface{}, err error) {
+	if values, err = r.src.Next(ctx); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Annotatef(err, "shard %s", r.name)
+	}
+
+	if s.cfg.ShardColumn != "" {
+		values = append(values, r.name)
+	}
+
+	return values, nil
+}
+
+// fail records a shard's error and stops the other shards.
+func (s *fanInSource) fail(err error) {
+	s.errs <- err
+	s.cancel()
+}
+
+func (s *fanInSource) Columns() (columns []string, err error) {
+	if s.cfg.ShardColumn != "" {
+		return append(append([]string(nil), s.columns...), s.cfg.ShardColumn), nil
+	}
+
+	return s.columns, nil
+}
+
+func (s *fanInSource) Next(ctx context.Context) (values []interface{}, err error) {
+	if s.rows != nil {
+		select {
+		case values, ok := <-s.rows:
+			if ok {
+				return values, nil
+			}
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+
+		select {
+		case err = <-s.errs:
+			return nil, errors.Trace(err)
+		default:
+			return nil, io.EOF
+		}
+	}
+
+	for {
+		if s.cur == nil {
+			if s.next >= len(s.cfg.SrcShards) {
+				return nil, io.EOF
+			}
+			if s.cur, err = s.open(ctx, s.cfg.SrcShards[s.next]); err != nil {
+				return nil, errors.Trace(err)
+			}
+			s.next++
+		}
+
+		values, err = s.read(ctx, s.cur)
+		if err != io.EOF {
+			return values, err
+		}
+
+		if err = s.cur.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.cur = nil
+	}
+}
+
+func (s *fanInSource) Close() (err error) {
+	if s.rows != nil {
+		s.cancel()
+		for range s.rows {
+		}
+	}
+
+	if s.cur != nil {
+		err = s.cur.Close()
+		s.cur = nil
+	}
+
+	return errors.Trace(err)
+}
+
+// parseShards parses whitespace separated name=uri shards.
+func parseShards(spec string) (shards []Shard, err error) {
+	for _, field := range strings.Fields(spec) {
+		name, uri, ok := strings.Cut(field, "=")
+		if !ok || name == "" || uri == "" {
+			return nil, errors.NotValidf("shard %q, expected name=uri", field)
+		}
+
+		shards = append(shards, Shard{Name: name, DbUri: uri})
+	}
+
+	return shards, nil
+}
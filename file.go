@@ -0,0 +1,585 @@
+package godatapipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// FileFormat is the format of a source or destination file.
+type FileFormat int
+
+const (
+	FormatCSV   FileFormat = iota //Comma separated values with a header row, empty values are NULL
+	FormatJSONL                   //A JSON object per line, the first line's keys are the columns
+	FormatAvro                    //Avro object container file of records, whose fields are the columns
+	FormatXLSX                    //Excel workbook with a header row, which can only be written
+)
+
+// Parses a FileFormat name: csv, jsonl, avro or xlsx. An empty name takes the format
+// from the path's extension, ignoring any compression extension, or is csv
+// for stdin or stdout's path -.
+func ParseFileFormat(s string, path string) (f FileFormat, err error) {
+	if s == "" && path == "-" {
+		return FormatCSV, nil
+	}
+	if s == "" {
+		_, base, _ := codecForPath("", path)
+		s = strings.TrimPrefix(strings.ToLower(filepath.Ext(base)), ".")
+	}
+
+	switch s {
+	case "csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson":
+		return FormatJSONL, nil
+	case "avro":
+		return FormatAvro, nil
+	case "xlsx":
+		return FormatXLSX, nil
+	}
+
+	return FormatCSV, errors.NotValidf("file format %q", s)
+}
+
+// FileSource reads rows from a CSV, JSON lines or Avro file, decompressing
+// it if its extension or compression names a codec.
+type FileSource struct {
+	format  FileFormat
+	file    io.Closer
+	r       io.ReadCloser
+	csv     *csv.Reader
+	lines   *bufio.Reader
+	avro    *avroReader
+	columns []string
+	values  []interface{}
+	first   []interface{} //JSON lines' first row, read for its columns
+}
+
+// Opens a file source. format and compression are names, which if empty
+// are taken from the path's extensions, ignoring any .enc. An encrypted
+// file needs its key.
+func OpenFileSource(path string, format string, compression string, key []byte) (s *FileSource, err error) {
+	var f io.ReadCloser
+	var c Codec
+
+	name := strings.TrimSuffix(remoteName(path), encryptExt)
+	if c, _, err = codecForPath(compression, name); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s = &FileSource{}
+	if s.format, err = ParseFileFormat(format, name); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.format == FormatXLSX {
+		return nil, errors.NotSupportedf("reading xlsx files")
+	}
+
+	if f, err = openFile(context.Background(), path); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = s.open(f, f, c, key); err != nil {
+		f.Close()
+		return nil, errors.Annotatef(err, "reading %s", remoteName(path))
+	}
+
+	return s, nil
+}
+
+// open reads the columns from the start of r.
+func (s *FileSource) open(r io.Reader, file io.Closer, c Codec, key []byte) (err error) {
+	s.file = file
+	if r, err = decryptReaderFor(r, key); err != nil {
+		return errors.Trace(err)
+	}
+	if s.r, err = compressReader(c, r); err != nil {
+		return errors.Trace(err)
+	}
+
+	switch s.format {
+	case FormatCSV:
+		s.csv = csv.NewReader(bufio.NewReader(s.r))
+		s.csv.ReuseRecord = true
+		s.csv.FieldsPerRecord = 0
+		var header []string
+		if header, err = s.csv.Read(); err != nil && err != io.EOF {
+			return errors.Trace(err)
+		}
+		s.columns = append([]string{}, header...)
+	case FormatJSONL:
+		s.lines = bufio.NewReader(s.r)
+		var line []byte
+		if line, err = s.readLine(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if s.first, err = s.decodeFirst(line); err != nil {
+			return errors.Trace(err)
+		}
+	case FormatAvro:
+		if s.avro, s.columns, err = newAvroReader(s.r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *FileSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *FileSource) Next(ctx context.Context) (values []interface{}, err error) {
+	if s.values == nil {
+		s.values = make([]interface{}, len(s.columns))
+	}
+
+	switch s.format {
+	case FormatCSV:
+		var record []string
+		if record, err = s.csv.Read(); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for i, v := range record {
+			s.values[i] = nil
+			if v != "" {
+				s.values[i] = v
+			}
+		}
+	case FormatJSONL:
+		if s.first != nil {
+			copy(s.values, s.first)
+			s.first = nil
+			return s.values, nil
+		}
+
+		var line []byte
+		var obj map[string]json.RawMessage
+		if line, err = s.readLine(); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = json.Unmarshal(line, &obj); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for i, c := range s.columns {
+			if s.values[i], err = decodeJSONValue(obj[c]); err != nil {
+				return nil, errors.Annotatef(err, "column %s", c)
+			}
+		}
+	case FormatAvro:
+		if err = s.avro.next(s.values); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return s.values, nil
+}
+
+func (s *FileSource) Close() (err error) {
+	s.r.Close()
+	return errors.Trace(s.file.Close())
+}
+
+// readLine returns the next line which isn't blank, or io.EOF.
+func (s *FileSource) readLine() (line []byte, err error) {
+	for {
+		if line, err = s.lines.ReadBytes('\n'); err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// decodeFirst sets the columns from the keys of the first object, in
+// order, returning its values.
+func (s *FileSource) decodeFirst(line []byte) (values []interface{}, err error) {
+	var t json.Token
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if t, err = dec.Token(); err != nil {
+		return nil, errors.Trace(err)
+	} else if t != json.Delim('{') {
+		return nil, errors.NotValidf("JSON line which isn't an object")
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		var v interface{}
+
+		if t, err = dec.Token(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = dec.Decode(&raw); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if v, err = decodeJSONValue(raw); err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.columns = append(s.columns, t.(string))
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// decodeJSONValue returns a JSON value as an int64, float64, bool, string
+// or nil, with objects and arrays kept as JSON text.
+func decodeJSONValue(raw json.RawMessage) (v interface{}, err error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	switch raw[0] {
+	case '{', '[':
+		return string(raw), nil
+	case '"':
+		var s string
+		err = json.Unmarshal(raw, &s)
+		return s, errors.Trace(err)
+	case 't', 'f':
+		return raw[0] == 't', nil
+	}
+
+	n := json.Number(raw)
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	if v, err = n.Float64(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return v, nil
+}
+
+// FileWriter writes rows to a CSV, JSON lines, Avro or xlsx file, compressing it
+// if its extension or compression names a codec and encrypting it if given
+// a key. Rows can't be rolled back.
+type FileWriter struct {
+	AvroTypes AvroTypes       //Avro types of the columns without an exact one
+	Registry  *SchemaRegistry //Schema registry an Avro file's schema is registered with, if any
+	Subject   string          //Registry subject of the schema, defaults to the file's name followed by -value
+
+	format  FileFormat
+	file    io.Closer
+	enc     io.WriteCloser //Encryption, if any
+	w       io.WriteCloser
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	columns []string
+	record  []string
+	rows    int
+	header  bool
+
+	types     []ColumnType //Column types the Avro schema is derived from
+	avroCodec string
+	avro      *avroWriter
+	schemaID  int    //Registry ID of the Avro schema
+	table     string //Avro record or xlsx sheet name
+
+	xlsx *xlsxWriter
+}
+
+// Creates a file writer. format and compression are names, which if empty
+// are taken from the path's extensions, ignoring any .enc. An Avro file's
+// compression is its codec, null or deflate, and its other compression
+// only comes from its extension. The file is encrypted with AES-GCM if
+// there's a key.
+func CreateFileWriter(path string, format string, compression string, key []byte) (w *FileWriter, err error) {
+	var f io.WriteCloser
+	var c Codec
+
+	name := strings.TrimSuffix(remoteName(path), encryptExt)
+	w = &FileWriter{}
+	if w.format, err = ParseFileFormat(format, name); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if w.format == FormatAvro {
+		w.avroCodec, compression = compression, ""
+	}
+	if w.format == FormatAvro || w.format == FormatXLSX {
+		_, base, _ := codecForPath("", name)
+		w.table = strings.TrimSuffix(filepath.Base(base), filepath.Ext(base))
+	}
+	if c, _, err = codecForPath(compression, name); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if f, err = createFile(context.Background(), path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = w.open(f, f, c, key); err != nil {
+		abortFile(f)
+		return nil, errors.Trace(err)
+	}
+
+	return w, nil
+}
+
+func (w *FileWriter) open(out io.Writer, file io.Closer, c Codec, key []byte) (err error) {
+	w.file = file
+	if key != nil {
+		if w.enc, err = encryptTo(out, key); err != nil {
+			return errors.Trace(err)
+		}
+		out = w.enc
+	}
+	if w.w, err = compressWriter(c, out); err != nil {
+		return errors.Trace(err)
+	}
+
+	w.buf = bufio.NewWriter(w.w)
+	switch w.format {
+	case FormatCSV:
+		w.csv = csv.NewWriter(w.buf)
+	case FormatXLSX:
+		if w.xlsx, err = newXLSXWriter(w.buf, w.table); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Sets the column names, called by the pipeline before the first row.
+func (w *FileWriter) SetColumns(columns []string) {
+	w.columns = columns
+}
+
+// Sets the column types an Avro file's schema is derived from. Without
+// them the types are guessed from the first row's values.
+func (w *FileWriter) SetColumnTypes(types []ColumnType) {
+	w.types = types
+}
+
+// Returns the registry ID of an Avro file's schema, zero until it's
+// registered.
+func (w *FileWriter) SchemaID() int {
+	return w.schemaID
+}
+
+// openAvro writes the Avro header with the schema for the row's values,
+// first registering the schema if there's a registry.
+func (w *FileWriter) openAvro(ctx context.Context, values []interface{}) (err error) {
+	var schema []byte
+	var t *avroType
+
+	types := make([]ColumnType, len(w.columns))
+	for i, name := range w.columns {
+		types[i] = ColumnType{Name: name, DatabaseType: snapshotKindType[""]}
+		for _, ct := range w.types {
+			if ct.Name == name {
+				types[i].DatabaseType = ct.DatabaseType
+			}
+		}
+		if types[i].DatabaseType == snapshotKindType[""] && i < len(values) {
+			c := SnapshotColumn{}
+			encodeSnapshotValue(&c, values[i])
+			types[i].DatabaseType = snapshotKindType[c.Kind]
+		}
+	}
+
+	if schema, t, err = avroSchemaFor(w.table, types, w.AvroTypes); err != nil {
+		return errors.Trace(err)
+	}
+	if w.Registry != nil {
+		subject := w.Subject
+		if subject == "" {
+			subject = SubjectName(w.table, false)
+		}
+		if w.schemaID, err = w.Registry.schemaID(ctx, subject, schema); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if w.avro, err = newAvroWriter(w.buf, schema, t, w.avroCodec); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (w *FileWriter) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	switch w.format {
+	case FormatCSV:
+		if !w.header {
+			if err = w.csv.Write(w.columns); err != nil {
+				return errors.Trace(err)
+			}
+			w.header = true
+		}
+
+		if len(w.record) != len(values) {
+			w.record = make([]string, len(values))
+		}
+		for i, v := range values {
+			w.record[i] = fileText(v)
+		}
+		if err = w.csv.Write(w.record); err != nil {
+			return errors.Trace(err)
+		}
+	case FormatAvro:
+		if w.avro == nil {
+			if err = w.openAvro(ctx, values); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err = w.avro.append(values); err != nil {
+			return errors.Trace(err)
+		}
+	case FormatXLSX:
+		if !w.header {
+			if err = w.xlsx.header(w.columns); err != nil {
+				return errors.Trace(err)
+			}
+			w.header = true
+		}
+		if err = w.xlsx.row(values, 0); err != nil {
+			return errors.Trace(err)
+		}
+	case FormatJSONL:
+		w.buf.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			var k, b []byte
+			if k, err = json.Marshal(w.columns[i]); err != nil {
+				return errors.Trace(err)
+			}
+			if b, err = json.Marshal(fileJSONValue(v)); err != nil {
+				return errors.Annotatef(err, "column %s", w.columns[i])
+			}
+			w.buf.Write(k)
+			w.buf.WriteByte(':')
+			w.buf.Write(b)
+		}
+		if _, err = w.buf.WriteString("}\n"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	w.rows++
+	return nil
+}
+
+func (w *FileWriter) Flush(ctx context.Context) (totalRowCount int, err error) {
+	if w.avro != nil {
+		if err = w.avro.flush(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if w.xlsx != nil {
+		if err = w.xlsx.flush(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if w.csv != nil {
+		w.csv.Flush()
+		if err = w.csv.Error(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if err = w.buf.Flush(); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return w.rows, nil
+}
+
+func (w *FileWriter) Rollback() (committedRowCount int, err error) {
+	if committedRowCount, err = w.Flush(context.Background()); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return committedRowCount, nil
+}
+
+func (w *FileWriter) Close() (err error) {
+	// An empty Avro file still has its schema
+	if w.format == FormatAvro && w.avro == nil {
+		if err = w.openAvro(context.Background(), nil); err != nil {
+			abortFile(w.file)
+			return errors.Trace(err)
+		}
+	}
+	if w.xlsx != nil {
+		if !w.header {
+			err = w.xlsx.header(w.columns)
+		}
+		if err == nil {
+			err = w.xlsx.close()
+		}
+		if err != nil {
+			abortFile(w.file)
+			return errors.Trace(err)
+		}
+	}
+	if _, err = w.Flush(context.Background()); err != nil {
+		abortFile(w.file)
+		return errors.Trace(err)
+	}
+	if err = w.w.Close(); err != nil {
+		abortFile(w.file)
+		return errors.Trace(err)
+	}
+	if w.enc != nil {
+		if err = w.enc.Close(); err != nil {
+			abortFile(w.file)
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(w.file.Close())
+}
+
+// abort closes the file after a failed copy, removing a local file so a
+// partial one isn't left behind.
+func (w *FileWriter) abort() (err error) {
+	if f, ok := w.file.(*os.File); ok {
+		f.Close()
+		return errors.Trace(os.Remove(f.Name()))
+	}
+
+	return errors.Trace(abortFile(w.file))
+}
+
+// fileText returns a CSV value's text, empty for NULL.
+func fileText(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+
+	return valueText(v)
+}
+
+// fileJSONValue returns the value as it's written to JSON, with binary
+// values as text.
+func fileJSONValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+
+	return v
+}
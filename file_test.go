@@ -0,0 +1,28 @@
+package godatapipe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileWriterAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.csv")
+
+	w, err := CreateFileWriter(path, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetColumns([]string{"id"})
+	if err = w.AppendValues(context.Background(), []interface{}{int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = abortWriter(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("aborted file %s still exists: %v", path, err)
+	}
+}
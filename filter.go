@@ -0,0 +1,457 @@
+package godatapipe
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/juju/errors"
+)
+
+// RowFilter reports whether a source row should be copied.
+type RowFilter func(columns []string, values []interface{}) bool
+
+// Compiles a filter expression over the source columns, for example
+//
+//	status = 'active' AND (amount >= 100 OR vip) AND deleted_at IS NULL
+//
+// Supported are the comparisons =, !=, <>, <, <=, >, >=, IS [NOT] NULL
+// and [NOT] IN (...), combined with AND, OR, NOT and parentheses. A
+// column on its own is true if its value is true or non-zero. Comparisons
+// with NULL are false, as in SQL.
+func ParseRowFilter(expr string, columns []string) (f RowFilter, err error) {
+	var pred predicate
+
+	p := &filterParser{columns: columns}
+	if p.tokens, err = tokenizeFilter(expr); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if pred, err = p.parseOr(); err != nil {
+		return nil, errors.Annotatef(err, "row filter %q", expr)
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("row filter %q: unexpected %q", expr, p.tokens[p.pos].text)
+	}
+
+	return func(columns []string, values []interface{}) bool {
+		return pred(values)
+	}, nil
+}
+
+type predicate func(values []interface{}) bool
+type operand func(values []interface{}) interface{}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokString
+	tokNumber
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+}
+
+// tokenizeFilter splits a filter expression into tokens.
+func tokenizeFilter(expr string) (tokens []filterToken, err error) {
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '\'':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, errors.Errorf("unterminated string in %q", expr)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			tokens = append(tokens, filterToken{tokString, sb.String()})
+			i++
+
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, errors.Errorf("unterminated identifier in %q", expr)
+			}
+			tokens = append(tokens, filterToken{tokIdent, string(runes[i+1 : end])})
+			i = end + 1
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokNumber, string(runes[i:end])})
+			i = end
+
+		case unicode.IsLetter(r) || r == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_' || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokIdent, string(runes[i:end])})
+			i = end
+
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "<=" || two == ">=" || two == "!=" || two == "<>" {
+					op = two
+				}
+			}
+			switch op {
+			case "=", "<", ">", "<=", ">=", "!=", "<>", "(", ")", ",":
+			default:
+				return nil, errors.Errorf("unexpected %q in %q", op, expr)
+			}
+			tokens = append(tokens, filterToken{tokOp, op})
+			i += len(op)
+		}
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens  []filterToken
+	pos     int
+	columns []string
+}
+
+// keyword reports whether the next token is the keyword, consuming it
+// if so.
+func (p *filterParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokIdent && strings.EqualFold(p.tokens[p.pos].text, word) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+// op reports whether the next token is the operator, consuming it if so.
+func (p *filterParser) op(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokOp && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *filterParser) parseOr() (pred predicate, err error) {
+	if pred, err = p.parseAnd(); err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		var right predicate
+		if right, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		left := pred
+		pred = func(values []interface{}) bool { return left(values) || right(values) }
+	}
+
+	return pred, nil
+}
+
+func (p *filterParser) parseAnd() (pred predicate, err error) {
+	if pred, err = p.parseNot(); err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		var right predicate
+		if right, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		left := pred
+		pred = func(values []interface{}) bool { return left(values) && right(values) }
+	}
+
+	return pred, nil
+}
+
+func (p *filterParser) parseNot() (pred predicate, err error) {
+	if p.keyword("NOT") {
+		var inner predicate
+		if inner, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		return func(values []interface{}) bool { return !inner(values) }, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (pred predicate, err error) {
+	var left, right operand
+
+	if p.op("(") {
+		if pred, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if !p.op(")") {
+			return nil, errors.New("missing )")
+		}
+		return pred, nil
+	}
+
+	if left, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, errors.New("expected NULL after IS")
+		}
+		return func(values []interface{}) bool { return (left(values) == nil) != not }, nil
+	}
+
+	if not := p.keyword("NOT"); not || p.keyword("IN") {
+		if not && !p.keyword("IN") {
+			return nil, errors.New("expected IN after NOT")
+		}
+		return p.parseIn(left, not)
+	}
+
+	for _, op := range []string{"=", "!=", "<>", "<=", ">=", "<", ">"} {
+		if !p.op(op) {
+			continue
+		}
+
+		if right, err = p.parseOperand(); err != nil {
+			return nil, err
+		}
+
+		return func(values []interface{}) bool {
+			cmp, ok := compareValues(left(values), right(values))
+			if !ok {
+				return false
+			}
+
+			switch op {
+			case "=":
+				return cmp == 0
+			case "!=", "<>":
+				return cmp != 0
+			case "<":
+				return cmp < 0
+			case "<=":
+				return cmp <= 0
+			case ">":
+				return cmp > 0
+			}
+			return cmp >= 0
+		}, nil
+	}
+
+	// A column on its own
+	return func(values []interface{}) bool { return truthy(left(values)) }, nil
+}
+
+func (p *filterParser) parseIn(left operand, not bool) (pred predicate, err error) {
+	var list []operand
+
+	if !p.op("(") {
+		return nil, errors.New("expected ( after IN")
+	}
+
+	for {
+		var item operand
+		if item, err = p.parseOperand(); err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+
+		if p.op(")") {
+			break
+		}
+		if !p.op(",") {
+			return nil, errors.New("expected , or ) in IN list")
+		}
+	}
+
+	return func(values []interface{}) bool {
+		v := left(values)
+		if v == nil {
+			return false
+		}
+
+		for _, item := range list {
+			if cmp, ok := compareValues(v, item(values)); ok && cmp == 0 {
+				return !not
+			}
+		}
+
+		return not
+	}, nil
+}
+
+func (p *filterParser) parseOperand() (o operand, err error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case tokString:
+		return func([]interface{}) interface{} { return t.text }, nil
+
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return func([]interface{}) interface{} { return f }, nil
+
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "NULL":
+			return func([]interface{}) interface{} { return nil }, nil
+		case "TRUE":
+			return func([]interface{}) interface{} { return true }, nil
+		case "FALSE":
+			return func([]interface{}) interface{} { return false }, nil
+		}
+
+		pos := indexOf(p.columns, t.text)
+		if pos < 0 {
+			return nil, errors.Errorf("unknown column %s", t.text)
+		}
+		return func(values []interface{}) interface{} { return values[pos] }, nil
+	}
+
+	return nil, errors.Errorf("unexpected %q", t.text)
+}
+
+// compareValues compares two values numerically, as times or as text.
+// ok is false if either value is NULL.
+func compareValues(a interface{}, b interface{}) (cmp int, ok bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	if ta, isTime := a.(time.Time); isTime {
+		if tb, err := CoerceTime(b); err == nil {
+			if tb, isTime := tb.(time.Time); isTime {
+				return ta.Compare(tb), true
+			}
+		}
+	}
+
+	if fa, okA := numericValue(a); okA {
+		if fb, okB := numericValue(b); okB {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	return strings.Compare(valueText(a), valueText(b)), true
+}
+
+// numericValue returns the value as a float64 if it's a number, bool or
+// numeric text.
+func numericValue(v interface{}) (f float64, ok bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case []byte, string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(valueText(t)), 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// truthy reports whether a value is true or non-zero.
+func truthy(v interface{}) bool {
+	if f, ok := numericValue(v); ok {
+		return f != 0
+	}
+
+	if s, ok := v.(string); ok {
+		b, _ := strconv.ParseBool(s)
+		return b
+	}
+
+	return false
+}
+
+// newFilterStage returns a stage dropping the rows the filters reject,
+// or nil if there are no filters.
+func newFilterStage(cfg *Config, columns []string, res *Result) (s stage, err error) {
+	filters := []RowFilter{}
+
+	if cfg.RowFilter != nil {
+		filters = append(filters, cfg.RowFilter)
+	}
+
+	if cfg.RowFilterExpr != "" {
+		var f RowFilter
+		if f, err = ParseRowFilter(cfg.RowFilterExpr, columns); err != nil {
+			return nil, errors.Trace(err)
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for _, f := range filters {
+			if !f(columns, values) {
+				res.FilteredRows++
+				return nil, nil
+			}
+		}
+
+		return values, nil
+	}, nil
+}
@@ -0,0 +1,151 @@
+package godatapipe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRowFilter(t *testing.T) {
+	columns := []string{"id", "status", "amount", "vip", "deleted_at", "name", "order date"}
+	at := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	row := []interface{}{int64(7), "active", 150.0, true, nil, "O'Brien", at}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"id = 7", true},
+		{"id != 7", false},
+		{"id <> 8", true},
+		{"amount >= 150 AND amount <= 150.0", true},
+		{"amount > 150 OR amount < 100", false},
+		{"id = -7", false},
+		{"status = 'active'", true},
+		{"status = 'active' and vip", true},
+		{"status = 'Active'", false},
+		{"name = 'O''Brien'", true},
+		{`"order date" >= '2024-05-06'`, true},
+		{`"order date" < '2024-05-06T00:00:00Z'`, false},
+		{"vip", true},
+		{"NOT vip", false},
+		{"vip = TRUE", true},
+		{"vip = false", false},
+
+		// AND binds tighter than OR, NOT tighter than AND
+		{"id = 1 AND status = 'x' OR vip", true},
+		{"vip OR id = 1 AND status = 'x'", true},
+		{"(vip OR id = 1) AND status = 'x'", false},
+		{"NOT id = 1 AND vip", true},
+		{"NOT (id = 7 AND vip)", false},
+		{"NOT NOT vip", true},
+
+		{"deleted_at IS NULL", true},
+		{"deleted_at IS NOT NULL", false},
+		{"id is not null", true},
+		{"deleted_at = NULL", false},
+		{"deleted_at != 1", false},
+		{"deleted_at < 1 OR deleted_at >= 1", false},
+		{"deleted_at", false},
+		{"deleted_at IN (1, NULL)", false},
+		{"deleted_at NOT IN (1, 2)", false},
+
+		{"id IN (1, 7, 9)", true},
+		{"id NOT IN (1, 7, 9)", false},
+		{"status in ('active', 'pending')", true},
+		{"status NOT IN ('closed')", true},
+		{"id IN (amount, 7)", true},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseRowFilter(tt.expr, columns)
+		if err != nil {
+			t.Errorf("ParseRowFilter(%q): %s", tt.expr, err)
+			continue
+		}
+		if got := f(columns, row); got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseRowFilterErrors(t *testing.T) {
+	columns := []string{"id", "status"}
+
+	for _, expr := range []string{
+		"",
+		"missing = 1",
+		"status = 'active",
+		`"status = 1`,
+		"id = ",
+		"id = 1 AND",
+		"(id = 1",
+		"id = 1)",
+		"id IS 1",
+		"id NOT 1",
+		"id IN 1",
+		"id IN (1 2)",
+		"id IN (1,",
+		"id == 1",
+		"id ~ 1",
+		"id = 1 status = 2",
+	} {
+		if _, err := ParseRowFilter(expr, columns); err == nil {
+			t.Errorf("ParseRowFilter(%q) didn't fail", expr)
+		}
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		cmp  int
+		ok   bool
+	}{
+		{int64(2), 10.0, -1, true},
+		{"10", int64(9), 1, true},
+		{[]byte("1.5"), 1.5, 0, true},
+		{"b", "a", 1, true},
+		{"abc", int64(1), 1, true},
+		{true, int64(1), 0, true},
+		{nil, nil, 0, false},
+		{int64(1), nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		if cmp, ok := compareValues(tt.a, tt.b); cmp != tt.cmp || ok != tt.ok {
+			t.Errorf("compareValues(%v, %v) = %d, %t, want %d, %t", tt.a, tt.b, cmp, ok, tt.cmp, tt.ok)
+		}
+	}
+}
+
+func TestFilterStage(t *testing.T) {
+	columns := []string{"id", "status"}
+	cfg := &Config{
+		RowFilterExpr: "status != 'deleted'",
+		RowFilter:     func(columns []string, values []interface{}) bool { return values[0].(int64) > 1 }}
+	res := &Result{}
+
+	s, err := newFilterStage(cfg, columns, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kept []int64
+	for i, row := range [][]interface{}{{int64(1), "new"}, {int64(2), "deleted"}, {int64(3), "new"}, {int64(4), nil}} {
+		out, err := s(i+1, row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			kept = append(kept, out[0].(int64))
+		}
+	}
+
+	if len(kept) != 1 || kept[0] != 3 || res.FilteredRows != 3 {
+		t.Errorf("kept %v with %d filtered, want [3] with 3 filtered", kept, res.FilteredRows)
+	}
+
+	if s, err = newFilterStage(&Config{}, columns, res); s != nil || err != nil {
+		t.Errorf("filter stage without filters = %v, %v", s != nil, err)
+	}
+}
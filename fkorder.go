@@ -0,0 +1,279 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// fkPlan orders jobs so each table is loaded after the tables its
+// destination foreign keys reference.
+type fkPlan struct {
+	order    []int   //Job indexes in load order
+	deps     [][]int //Jobs each job waits for
+	deferred []deferredFK
+	failed   map[int]error //Jobs which can't be ordered
+}
+
+// deferredFK is a foreign key in a cycle of jobs, dropped while they
+// load and added back once they're done.
+type deferredFK struct {
+	job int
+	fk  bulk.ForeignKey
+}
+
+// planForeignKeys reads the destination foreign keys of the jobs' tables
+// and orders the jobs by them, largest first where the order is free.
+// Postgres tables referencing each other in a cycle have the cycle's
+// foreign keys deferred, other databases can't load them.
+func planForeignKeys(ctx context.Context, jobs []*Job) (plan *fkPlan, err error) {
+	plan = &fkPlan{deps: make([][]int, len(jobs)), failed: map[int]error{}}
+	fks := make([][]bulk.ForeignKey, len(jobs))
+	refs := make([][]int, len(jobs)) //Job each foreign key references, -1 if none
+
+	find := func(schema string, table string, from *Config) int {
+		if schema == "" {
+			schema = from.DstSchema
+		}
+		for i, job := range jobs {
+			if strings.EqualFold(job.Config.DstTable, table) && strings.EqualFold(job.Config.DstSchema, schema) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	err = eachDst(ctx, jobs, nil, func(i int, conn *sql.Conn) (err error) {
+		cfg := jobs[i].Config
+		if fks[i], err = bulk.ForeignKeys(ctx, conn, bulk.DialectFor(cfg.DstDbDriver), cfg.DstSchema, cfg.DstTable); err != nil {
+			return errors.Annotatef(err, "reading foreign keys of %s", cfg.DstTable)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for i := range jobs {
+		refs[i] = make([]int, len(fks[i]))
+		for k, fk := range fks[i] {
+			refs[i][k] = find(fk.RefSchema, fk.RefTable, jobs[i].Config)
+			if j := refs[i][k]; j >= 0 && j != i {
+				plan.deps[i] = append(plan.deps[i], j)
+			}
+		}
+	}
+
+	// Break the cycles by deferring the foreign keys within them
+	for _, scc := range stronglyConnected(plan.deps) {
+		if len(scc) < 2 {
+			continue
+		}
+
+		in := map[int]bool{}
+		for _, i := range scc {
+			in[i] = true
+		}
+
+		for _, i := range scc {
+			if bulk.DialectFor(jobs[i].Config.DstDbDriver) != bulk.Postgres {
+				plan.failed[i] = errors.NotSupportedf("loading %s, its foreign keys form a cycle", jobs[i].Config.DstTable)
+			}
+
+			var deps []int
+			for _, j := range plan.deps[i] {
+				if !in[j] {
+					deps = append(deps, j)
+				}
+			}
+			plan.deps[i] = deps
+
+			for k, fk := range fks[i] {
+				if j := refs[i][k]; j != i && in[j] && plan.failed[i] == nil {
+					plan.deferred = append(plan.deferred, deferredFK{job: i, fk: fk})
+				}
+			}
+		}
+	}
+
+	// Topological order, taking the largest ready job each time
+	waiting := make([]int, len(jobs))
+	dependents := make([][]int, len(jobs))
+	for i, deps := range plan.deps {
+		waiting[i] = len(deps)
+		for _, j := range deps {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	var ready []int
+	for i := range jobs {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	for len(ready) > 0 {
+		sort.SliceStable(ready, func(a, b int) bool {
+			return jobs[ready[a]].EstimatedRows > jobs[ready[b]].EstimatedRows
+		})
+
+		i := ready[0]
+		ready = ready[1:]
+		plan.order = append(plan.order, i)
+
+		for _, j := range dependents[i] {
+			if waiting[j]--; waiting[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// stronglyConnected returns the strongly connected components of the
+// graph of edges from each node, using Tarjan's algorithm.
+func stronglyConnected(edges [][]int) (sccs [][]int) {
+	index := make([]int, len(edges))
+	low := make([]int, len(edges))
+	onStack := make([]bool, len(edges))
+	var stack []int
+	next := 1
+
+	var visit func(v int)
+	visit = func(v int) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, w := range edges[v] {
+			if index[w] == 0 {
+				visit(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+
+		if low[v] == index[v] {
+			var scc []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				scc = append(scc, w)
+				if w == v {
+					break
+				}
+			}
+			sccs = append(sccs, scc)
+		}
+	}
+
+	for v := range edges {
+		if index[v] == 0 {
+			visit(v)
+		}
+	}
+
+	return sccs
+}
+
+// deferredJobs returns the jobs with deferred foreign keys.
+func (p *fkPlan) deferredJobs() (idxs []int) {
+	for _, df := range p.deferred {
+		if n := len(idxs); n == 0 || idxs[n-1] != df.job {
+			idxs = append(idxs, df.job)
+		}
+	}
+
+	return idxs
+}
+
+// dropDeferred drops the deferred foreign keys.
+func (p *fkPlan) dropDeferred(ctx context.Context, jobs []*Job) (err error) {
+	return eachDst(ctx, jobs, p.deferredJobs(), func(i int, conn *sql.Conn) (err error) {
+		cfg := jobs[i].Config
+
+		for _, df := range p.deferred {
+			if df.job != i {
+				continue
+			}
+
+			q, err := bulk.DialectFor(cfg.DstDbDriver).DropForeignKeySQL(cfg.DstSchema, cfg.DstTable, df.fk.Name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if _, err = conn.ExecContext(ctx, q); err != nil {
+				return errors.Annotatef(err, "deferring foreign key %s", df.fk.Name)
+			}
+		}
+
+		return nil
+	})
+}
+
+// restoreDeferred adds the deferred foreign keys back, which checks the
+// loaded rows against them, recording any failure against the job.
+func (p *fkPlan) restoreDeferred(ctx context.Context, jobs []*Job, results []JobResult) {
+	err := eachDst(ctx, jobs, p.deferredJobs(), func(i int, conn *sql.Conn) (err error) {
+		cfg := jobs[i].Config
+
+		for _, df := range p.deferred {
+			if df.job != i {
+				continue
+			}
+
+			q, err := bulk.DialectFor(cfg.DstDbDriver).AddForeignKeySQL(cfg.DstSchema, cfg.DstTable, df.fk)
+			if err == nil {
+				_, err = conn.ExecContext(ctx, q)
+			}
+			if err != nil && results[i].Err == nil {
+				results[i].Err = errors.Annotatef(err, "restoring foreign key %s", df.fk.Name)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		for _, i := range p.deferredJobs() {
+			if results[i].Err == nil {
+				results[i].Err = errors.Annotate(err, "restoring foreign keys")
+			}
+		}
+	}
+}
+
+// eachDst calls fn with the destination connection of each of the jobs,
+// or all of them if idxs is nil, opening one at a time for the jobs
+// without a connection of their own.
+func eachDst(ctx context.Context, jobs []*Job, idxs []int, fn func(i int, conn *sql.Conn) error) (err error) {
+	if idxs == nil {
+		for i := range jobs {
+			idxs = append(idxs, i)
+		}
+	}
+
+	for _, i := range idxs {
+		cfg := jobs[i].Config
+
+		_, conn, release, err := connect(ctx, cfg.DstConn, cfg.DstDB, cfg.DstDbUri, cfg.DstDbPassword, cfg.DstConnOptions)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = fn(i, conn)
+		release()
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package godatapipe
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// RecordDriver opens Arrow-native endpoints, such as Arrow Flight SQL
+// servers, by URI.
+type RecordDriver interface {
+	// Returns a reader of the query's result.
+	OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error)
+	// Returns a writer appending to the table, taking its fields from the
+	// first batch.
+	OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error)
+}
+
+var (
+	recordDriversMu sync.RWMutex
+	recordDrivers   = map[string]RecordDriver{
+		"spanner":          spannerDriver{},
+		"dynamodb":         dynamoDriver{},
+		"redis":            redisDriver{},
+		"sheets":           sheetsDriver{},
+		"cassandra":        cassandraDriver{},
+		"scylladb":         cassandraDriver{},
+		"influxdb":         influxDriver{},
+		"influxdb+https":   influxDriver{},
+		"neo4j+http":       neo4jDriver{},
+		"neo4j+https":      neo4jDriver{},
+		"clickhouse":       clickhouseDriver{},
+		"clickhouse+https": clickhouseDriver{}}
+)
+
+// Schemes of the record drivers registered by importing packages of
+// their own, keeping their dependencies out of programs which don't.
+var unregisteredRecordDrivers = map[string]string{
+	"flightsql":     "github.com/joescharf/go-datapipe/flightsql",
+	"flightsql+tls": "github.com/joescharf/go-datapipe/flightsql"}
+
+// Registers a record driver for URIs starting with scheme://, replacing
+// any driver previously registered for that scheme. Importing
+// github.com/joescharf/go-datapipe/flightsql registers the Arrow Flight
+// SQL driver for the flightsql and flightsql+tls schemes.
+func RegisterRecordDriver(scheme string, d RecordDriver) {
+	recordDriversMu.Lock()
+	defer recordDriversMu.Unlock()
+
+	if d == nil {
+		delete(recordDrivers, scheme)
+		return
+	}
+
+	recordDrivers[scheme] = d
+}
+
+// recordDriverFor returns the driver registered for the URI's scheme.
+func recordDriverFor(uri string) (d RecordDriver, err error) {
+	scheme, _, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, errors.NotValidf("record URI %q without a scheme", uri)
+	}
+
+	recordDriversMu.RLock()
+	d = recordDrivers[scheme]
+	recordDriversMu.RUnlock()
+
+	if d != nil {
+		return d, nil
+	}
+	if pkg, ok := unregisteredRecordDrivers[scheme]; ok {
+		return nil, errors.NotSupportedf("%s without importing %s", scheme, pkg)
+	}
+
+	return nil, errors.NotSupportedf("record URI scheme %q", scheme)
+}
+
+// newRecordURISource returns a source reading Config.SrcSelectSql's rows
+// from Config.SrcRecordURI.
+func newRecordURISource(ctx context.Context, cfg *Config) (src Source, err error) {
+	var d RecordDriver
+	var r RecordReader
+
+	if d, err = recordDriverFor(cfg.SrcRecordURI); err != nil {
+		return nil, errors.Trace(newConfigError("SRC_RECORD_URI", err))
+	}
+	if r, err = d.OpenReader(ctx, cfg.SrcRecordURI, cfg.SrcSelectSql); err != nil {
+		return nil, errors.Annotate(err, "opening record source")
+	}
+	if src, err = NewRecordSource(r); err != nil {
+		r.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return src, nil
+}
+
+// newRecordURIInsert returns an Insert writing to the table at
+// Config.DstRecordURI in batches of Config.MaxRowTxCommit rows, as each
+// is committed on its own, typing the columns with the source's column
+// types if it has them.
+func newRecordURIInsert(ctx context.Context, cfg *Config, src Source, table string) (ir Insert, err error) {
+	var d RecordDriver
+	var w RecordWriter
+	var fields []Field
+
+	if d, err = recordDriverFor(cfg.DstRecordURI); err != nil {
+		return nil, errors.Trace(newConfigError("DST_RECORD_URI", err))
+	}
+	if ct, ok := src.(ColumnTyper); ok {
+		var types []ColumnType
+		if types, err = ct.ColumnTypes(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		fields = ArrowSchema(types)
+	}
+
+	if w, err = d.OpenWriter(ctx, cfg.DstRecordURI, table); err != nil {
+		return nil, errors.Annotate(err, "opening record destination")
+	}
+	if ts, ok := w.(interface{ setTimeSeries(string, []string) }); ok {
+		ts.setTimeSeries(cfg.TimeColumn, cfg.TagColumns)
+	}
+
+	return NewRecordInsert(w, fields, cfg.MaxRowTxCommit), nil
+}
@@ -0,0 +1,363 @@
+// Package flightsql registers a godatapipe record driver reading from
+// and writing to Arrow Flight SQL servers, such as Dremio or InfluxDB IOx,
+// for flightsql:// and flightsql+tls:// URIs. It's a package of its own so
+// only programs using it take on gRPC and the Arrow library; import it for
+// its side effect:
+//
+//	import _ "github.com/joescharf/go-datapipe/flightsql"
+package flightsql
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/url"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/flight/flightsql"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	godatapipe "github.com/joescharf/go-datapipe"
+	"github.com/juju/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func init() {
+	godatapipe.RegisterRecordDriver("flightsql", Driver{})
+	godatapipe.RegisterRecordDriver("flightsql+tls", Driver{})
+}
+
+// Driver opens Arrow Flight SQL servers by URI:
+// flightsql://[user[:password]@]host:port[?token=T&catalog=C&schema=S], or
+// flightsql+tls:// for TLS. A user and password log in with basic
+// authentication, while a token is sent as a bearer token; either secret
+// can be a secret reference. Queries' results are read from every
+// endpoint through the server they were sent to. Writes use Flight SQL
+// bulk ingestion, creating the table from the first batch's fields if it
+// doesn't exist, in the catalog and schema if given.
+type Driver struct{}
+
+// conn is a logged in client and the URI's ingestion options.
+type conn struct {
+	client  *flightsql.Client
+	ctx     context.Context //Carries the authorization header
+	catalog string
+	schema  string
+}
+
+// connect dials the server the URI names and logs in.
+func connect(ctx context.Context, uri string) (c *conn, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "flightsql+tls" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	c = &conn{ctx: ctx, catalog: u.Query().Get("catalog"), schema: u.Query().Get("schema")}
+	if c.client, err = flightsql.NewClientCtx(ctx, u.Host, nil, nil, grpc.WithTransportCredentials(creds)); err != nil {
+		return nil, errors.Annotatef(err, "connecting to %s", u.Host)
+	}
+
+	if token := u.Query().Get("token"); token != "" {
+		if token, err = godatapipe.ResolveSecret(ctx, token); err != nil {
+			c.client.Close()
+			return nil, errors.Trace(err)
+		}
+		c.ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	} else if u.User != nil {
+		password, _ := u.User.Password()
+		if password, err = godatapipe.ResolveSecret(ctx, password); err != nil {
+			c.client.Close()
+			return nil, errors.Trace(err)
+		}
+		if c.ctx, err = c.client.Client.AuthenticateBasicToken(ctx, u.User.Username(), password); err != nil {
+			c.client.Close()
+			return nil, errors.Annotatef(err, "logging in to %s", u.Host)
+		}
+	}
+
+	return c, nil
+}
+
+// authorized returns ctx carrying the login's authorization header.
+func (c *conn) authorized(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(c.ctx); ok {
+		return metadata.NewOutgoingContext(ctx, md)
+	}
+
+	return ctx
+}
+
+func (Driver) OpenReader(ctx context.Context, uri string, query string) (r godatapipe.RecordReader, err error) {
+	var c *conn
+	var info *flight.FlightInfo
+
+	if c, err = connect(ctx, uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if info, err = c.client.Execute(c.authorized(ctx), query); err != nil {
+		c.client.Close()
+		return nil, errors.Annotate(err, "executing query")
+	}
+
+	fr := &reader{conn: c, endpoints: info.Endpoint}
+	if len(info.Schema) > 0 {
+		if fr.schema, err = flight.DeserializeSchema(info.Schema, memory.DefaultAllocator); err != nil {
+			c.client.Close()
+			return nil, errors.Annotate(err, "reading result schema")
+		}
+	}
+
+	return fr, nil
+}
+
+// reader reads the record batches of each of a query's endpoints in turn.
+type reader struct {
+	*conn
+	schema    *arrow.Schema
+	endpoints []*flight.FlightEndpoint
+	stream    *flight.Reader
+}
+
+// next opens the next endpoint's stream, returning io.EOF after the last.
+func (r *reader) next(ctx context.Context) (err error) {
+	if r.stream != nil {
+		r.stream.Release()
+		r.stream = nil
+	}
+	if len(r.endpoints) == 0 {
+		return io.EOF
+	}
+
+	if r.stream, err = r.client.DoGet(r.authorized(ctx), r.endpoints[0].Ticket); err != nil {
+		return errors.Annotate(err, "reading query result")
+	}
+	r.endpoints = r.endpoints[1:]
+	if r.schema == nil {
+		r.schema = r.stream.Schema()
+	}
+
+	return nil
+}
+
+func (r *reader) Fields() (fields []godatapipe.Field, err error) {
+	if r.schema == nil {
+		if err = r.next(r.ctx); err != nil && err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+		if r.schema == nil {
+			return nil, errors.NotFoundf("result schema")
+		}
+	}
+
+	for _, f := range r.schema.Fields() {
+		fields = append(fields, godatapipe.Field{Name: f.Name, Type: arrowType(f.Type), Nullable: f.Nullable})
+	}
+
+	return fields, nil
+}
+
+func (r *reader) NextRecord(ctx context.Context) (b *godatapipe.RecordBatch, err error) {
+	var fields []godatapipe.Field
+
+	for r.stream == nil || !r.stream.Next() {
+		if r.stream != nil && r.stream.Err() != nil {
+			return nil, errors.Annotate(r.stream.Err(), "reading query result")
+		}
+		if err = r.next(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if fields, err = r.Fields(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	rec := r.stream.Record()
+	rows := make([][]interface{}, rec.NumRows())
+	for i := range rows {
+		rows[i] = make([]interface{}, rec.NumCols())
+		for c, col := range rec.Columns() {
+			rows[i][c] = value(col, i)
+		}
+	}
+
+	return godatapipe.NewRecordBatch(fields, rows)
+}
+
+func (r *reader) Close() (err error) {
+	if r.stream != nil {
+		r.stream.Release()
+	}
+
+	return errors.Trace(r.client.Close())
+}
+
+// arrowType returns the record batch type Arrow values are read as.
+// Decimals and types without a record batch type are read as text.
+func arrowType(t arrow.DataType) godatapipe.ArrowType {
+	switch t.ID() {
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64, arrow.UINT8, arrow.UINT16, arrow.UINT32:
+		return godatapipe.ArrowInt64
+	case arrow.FLOAT32, arrow.FLOAT64:
+		return godatapipe.ArrowFloat64
+	case arrow.BOOL:
+		return godatapipe.ArrowBoolean
+	case arrow.TIMESTAMP, arrow.DATE32, arrow.DATE64:
+		return godatapipe.ArrowTimestamp
+	case arrow.BINARY, arrow.LARGE_BINARY, arrow.FIXED_SIZE_BINARY:
+		return godatapipe.ArrowBinary
+	}
+
+	return godatapipe.ArrowUtf8
+}
+
+// value returns the value at i of an Arrow array as a database row value.
+func value(a arrow.Array, i int) interface{} {
+	if a.IsNull(i) {
+		return nil
+	}
+
+	switch t := a.(type) {
+	case *array.Int8:
+		return int64(t.Value(i))
+	case *array.Int16:
+		return int64(t.Value(i))
+	case *array.Int32:
+		return int64(t.Value(i))
+	case *array.Int64:
+		return t.Value(i)
+	case *array.Uint8:
+		return int64(t.Value(i))
+	case *array.Uint16:
+		return int64(t.Value(i))
+	case *array.Uint32:
+		return int64(t.Value(i))
+	case *array.Float32:
+		return float64(t.Value(i))
+	case *array.Float64:
+		return t.Value(i)
+	case *array.Boolean:
+		return t.Value(i)
+	case *array.String:
+		return t.Value(i)
+	case *array.LargeString:
+		return t.Value(i)
+	case *array.Binary:
+		return append([]byte{}, t.Value(i)...)
+	case *array.LargeBinary:
+		return append([]byte{}, t.Value(i)...)
+	case *array.FixedSizeBinary:
+		return append([]byte{}, t.Value(i)...)
+	case *array.Timestamp:
+		return t.Value(i).ToTime(t.DataType().(*arrow.TimestampType).Unit).UTC()
+	case *array.Date32:
+		return t.Value(i).ToTime()
+	case *array.Date64:
+		return t.Value(i).ToTime()
+	case *array.Decimal128:
+		return t.Value(i).ToString(t.DataType().(*arrow.Decimal128Type).Scale)
+	}
+
+	return a.ValueStr(i)
+}
+
+func (Driver) OpenWriter(ctx context.Context, uri string, table string) (w godatapipe.RecordWriter, err error) {
+	var c *conn
+
+	if c, err = connect(ctx, uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &writer{conn: c, table: table}, nil
+}
+
+// writer ingests each record batch into the table.
+type writer struct {
+	*conn
+	table string
+}
+
+func (w *writer) WriteRecord(ctx context.Context, b *godatapipe.RecordBatch) (err error) {
+	var rdr array.RecordReader
+
+	if b.NumRows == 0 {
+		return nil
+	}
+
+	rec := record(b)
+	defer rec.Release()
+	if rdr, err = array.NewRecordReader(rec.Schema(), []arrow.Record{rec}); err != nil {
+		return errors.Trace(err)
+	}
+	defer rdr.Release()
+
+	opts := &flightsql.ExecuteIngestOpts{
+		Table: w.table,
+		TableDefinitionOptions: &flightsql.TableDefinitionOptions{
+			IfNotExist: flightsql.TableDefinitionOptionsTableNotExistOptionCreate,
+			IfExists:   flightsql.TableDefinitionOptionsTableExistsOptionAppend}}
+	if w.catalog != "" {
+		opts.Catalog = &w.catalog
+	}
+	if w.schema != "" {
+		opts.Schema = &w.schema
+	}
+
+	_, err = w.client.ExecuteIngest(w.authorized(ctx), rdr, opts)
+	return errors.Annotatef(err, "ingesting %d rows into %s", b.NumRows, w.table)
+}
+
+func (w *writer) Close() (err error) {
+	return errors.Trace(w.client.Close())
+}
+
+// Arrow types of the record batch types, whose values have the same
+// layout.
+var arrowTypes = map[godatapipe.ArrowType]arrow.DataType{
+	godatapipe.ArrowUtf8:      arrow.BinaryTypes.String,
+	godatapipe.ArrowInt64:     arrow.PrimitiveTypes.Int64,
+	godatapipe.ArrowFloat64:   arrow.PrimitiveTypes.Float64,
+	godatapipe.ArrowBoolean:   arrow.FixedWidthTypes.Boolean,
+	godatapipe.ArrowBinary:    arrow.BinaryTypes.Binary,
+	godatapipe.ArrowTimestamp: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}}
+
+// record returns an Arrow record sharing the record batch's buffers.
+func record(b *godatapipe.RecordBatch) arrow.Record {
+	fields := make([]arrow.Field, len(b.Fields))
+	cols := make([]arrow.Array, len(b.Fields))
+
+	for i, f := range b.Fields {
+		a := b.Columns[i]
+		fields[i] = arrow.Field{Name: f.Name, Type: arrowTypes[f.Type], Nullable: f.Nullable}
+
+		buffers := []*memory.Buffer{memory.NewBufferBytes(a.Validity)}
+		switch a.Type {
+		case godatapipe.ArrowUtf8, godatapipe.ArrowBinary:
+			buffers = append(buffers,
+				memory.NewBufferBytes(arrow.Int32Traits.CastToBytes(a.Offsets)),
+				memory.NewBufferBytes(a.Data))
+		default:
+			buffers = append(buffers, memory.NewBufferBytes(a.Values))
+		}
+
+		data := array.NewData(fields[i].Type, a.Len, buffers, nil, a.NullCount, 0)
+		cols[i] = array.MakeFromData(data)
+		data.Release()
+	}
+
+	rec := array.NewRecord(arrow.NewSchema(fields, nil), cols, int64(b.NumRows))
+	for _, c := range cols {
+		c.Release()
+	}
+
+	return rec
+}
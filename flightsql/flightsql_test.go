@@ -0,0 +1,138 @@
+package flightsql
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/flight/flightsql"
+	godatapipe "github.com/joescharf/go-datapipe"
+)
+
+// memServer is a Flight SQL server holding ingested tables in memory,
+// answering "SELECT * FROM table" queries.
+type memServer struct {
+	flightsql.BaseServer
+
+	mu     sync.Mutex
+	tables map[string][]arrow.Record
+}
+
+func (s *memServer) GetFlightInfoStatement(ctx context.Context, q flightsql.StatementQuery, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	ticket, err := flightsql.CreateStatementQueryTicket([]byte(q.GetQuery()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &flight.FlightInfo{
+		FlightDescriptor: desc,
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: ticket}}},
+		TotalRecords:     -1,
+		TotalBytes:       -1}, nil
+}
+
+func (s *memServer) DoGetStatement(ctx context.Context, t flightsql.StatementQueryTicket) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	s.mu.Lock()
+	recs := s.tables[strings.TrimPrefix(string(t.GetStatementHandle()), "SELECT * FROM ")]
+	s.mu.Unlock()
+
+	ch := make(chan flight.StreamChunk, len(recs))
+	for _, rec := range recs {
+		rec.Retain()
+		ch <- flight.StreamChunk{Data: rec}
+	}
+	close(ch)
+
+	return recs[0].Schema(), ch, nil
+}
+
+func (s *memServer) DoPutCommandStatementIngest(ctx context.Context, cmd flightsql.StatementIngest, rdr flight.MessageReader) (n int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for rdr.Next() {
+		rec := rdr.Record()
+		rec.Retain()
+		s.tables[cmd.GetTable()] = append(s.tables[cmd.GetTable()], rec)
+		n += rec.NumRows()
+	}
+
+	return n, rdr.Err()
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := flight.NewServerWithMiddleware(nil)
+	if err := srv.Init("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	srv.RegisterFlightService(flightsql.NewFlightServer(&memServer{tables: map[string][]arrow.Record{}}))
+	go srv.Serve()
+	defer srv.Shutdown()
+
+	ctx := context.Background()
+	uri := "flightsql://" + srv.Addr().String()
+
+	fields := []godatapipe.Field{
+		{Name: "id", Type: godatapipe.ArrowInt64},
+		{Name: "name", Type: godatapipe.ArrowUtf8, Nullable: true},
+		{Name: "price", Type: godatapipe.ArrowFloat64, Nullable: true},
+		{Name: "active", Type: godatapipe.ArrowBoolean, Nullable: true},
+		{Name: "data", Type: godatapipe.ArrowBinary, Nullable: true},
+		{Name: "at", Type: godatapipe.ArrowTimestamp, Nullable: true}}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+	rows := [][]interface{}{
+		{int64(1), "widget", 9.5, true, []byte{1, 2}, at},
+		{int64(2), nil, nil, nil, nil, nil},
+		{int64(3), "gadget", 0.25, false, []byte{}, at.Add(time.Hour)}}
+
+	b, err := godatapipe.NewRecordBatch(fields, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Driver{}.OpenWriter(ctx, uri, "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecord(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Driver{}.OpenReader(ctx, uri, "SELECT * FROM items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got, err := r.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, fields) {
+		t.Errorf("fields = %+v, want %+v", got, fields)
+	}
+
+	var read [][]interface{}
+	for {
+		b, err := r.NextRecord(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, b.Rows()...)
+	}
+	if !reflect.DeepEqual(read, rows) {
+		t.Errorf("rows = %v, want %v", read, rows)
+	}
+}
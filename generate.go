@@ -0,0 +1,162 @@
+package godatapipe
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// GenType is the type of a generated column.
+type GenType int
+
+const (
+	GenInt     GenType = iota //int64, the row number for the first int column
+	GenString                 //Random letters of Length characters
+	GenTime                   //time.Time within the year from 2020-01-01 UTC
+	GenDecimal                //Decimal string with Length fractional digits
+)
+
+// GenColumn describes a generated column.
+type GenColumn struct {
+	Name   string
+	Type   GenType
+	Length int //String length or decimal scale, defaulting to 16 and 2
+}
+
+// GeneratorSource produces rows of synthetic data, the same rows for the
+// same seed, for benchmarking writers without a source database.
+type GeneratorSource struct {
+	columns []GenColumn
+	rows    int
+
+	rnd    *rand.Rand
+	rowNum int
+	values []interface{}
+	buf    []byte
+}
+
+var genEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const genLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Returns a source generating rows rows of the columns from the seed.
+func NewGeneratorSource(rows int, seed int64, columns ...GenColumn) *GeneratorSource {
+	s := &GeneratorSource{
+		columns: columns,
+		rows:    rows,
+		rnd:     rand.New(rand.NewSource(seed)),
+		values:  make([]interface{}, len(columns))}
+
+	for i := range s.columns {
+		if s.columns[i].Length <= 0 {
+			switch s.columns[i].Type {
+			case GenString:
+				s.columns[i].Length = 16
+			case GenDecimal:
+				s.columns[i].Length = 2
+			}
+		}
+	}
+
+	return s
+}
+
+func (s *GeneratorSource) Columns() (columns []string, err error) {
+	for _, c := range s.columns {
+		columns = append(columns, c.Name)
+	}
+
+	return columns, nil
+}
+
+func (s *GeneratorSource) ColumnTypes() (types []ColumnType, err error) {
+	for _, c := range s.columns {
+		ct := ColumnType{Name: c.Name}
+
+		switch c.Type {
+		case GenInt:
+			ct.DatabaseType = "BIGINT"
+		case GenString:
+			ct.DatabaseType, ct.Length = "VARCHAR", int64(c.Length)
+		case GenTime:
+			ct.DatabaseType = "TIMESTAMP"
+		case GenDecimal:
+			ct.DatabaseType, ct.Precision, ct.Scale = "NUMERIC", 18, int64(c.Length)
+		}
+
+		types = append(types, ct)
+	}
+
+	return types, nil
+}
+
+func (s *GeneratorSource) Next(ctx context.Context) (values []interface{}, err error) {
+	if s.rowNum >= s.rows {
+		return nil, io.EOF
+	}
+	s.rowNum++
+
+	first := true
+	for i, c := range s.columns {
+		switch c.Type {
+		case GenInt:
+			if first {
+				s.values[i] = int64(s.rowNum)
+				first = false
+			} else {
+				s.values[i] = s.rnd.Int63n(1 << 31)
+			}
+		case GenString:
+			s.buf = s.buf[:0]
+			for n := 0; n < c.Length; n++ {
+				s.buf = append(s.buf, genLetters[s.rnd.Intn(len(genLetters))])
+			}
+			s.values[i] = string(s.buf)
+		case GenTime:
+			s.values[i] = genEpoch.Add(time.Duration(s.rnd.Int63n(int64(365 * 24 * time.Hour))).Truncate(time.Microsecond))
+		case GenDecimal:
+			s.values[i] = strconv.FormatFloat(float64(s.rnd.Int63n(1e12))/1e4, 'f', c.Length, 64)
+		}
+	}
+
+	return s.values, nil
+}
+
+func (s *GeneratorSource) Close() (err error) {
+	return nil
+}
+
+// ParseGenColumns parses whitespace separated name:type[:length] columns,
+// e.g. "id:int name:string:20 created_at:time amount:decimal:2".
+func ParseGenColumns(spec string) (columns []GenColumn, err error) {
+	types := map[string]GenType{"int": GenInt, "string": GenString, "time": GenTime, "decimal": GenDecimal}
+
+	for _, field := range strings.Fields(spec) {
+		parts := strings.Split(field, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, errors.NotValidf("generated column %q, expected name:type[:length]", field)
+		}
+
+		c := GenColumn{Name: parts[0]}
+
+		var ok bool
+		if c.Type, ok = types[parts[1]]; !ok {
+			return nil, errors.NotValidf("generated column type %q", parts[1])
+		}
+
+		if len(parts) == 3 {
+			if c.Length, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, errors.Annotatef(err, "generated column %s length", c.Name)
+			}
+		}
+
+		columns = append(columns, c)
+	}
+
+	return columns, nil
+}
@@ -0,0 +1,394 @@
+package godatapipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// GeoFormat determines how geometry values are written.
+type GeoFormat int
+
+const (
+	GeoAuto GeoFormat = iota //Hex EWKB for Postgres, MySQL's internal format for MySQL, WKT otherwise
+	GeoWKB                   //ISO well-known binary, without the SRID
+	GeoWKT                   //Well-known text, without the SRID
+	GeoEWKT                  //Well-known text prefixed with SRID=n; if there is one
+)
+
+// Parses a GeoFormat name: auto, wkb, wkt or ewkt.
+func ParseGeoFormat(s string) (f GeoFormat, err error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return GeoAuto, nil
+	case "wkb":
+		return GeoWKB, nil
+	case "wkt":
+		return GeoWKT, nil
+	case "ewkt":
+		return GeoEWKT, nil
+	}
+
+	return GeoAuto, errors.NotValidf("geometry format %q", s)
+}
+
+// WKB geometry types, which are also the WKT names' index.
+var wkbTypeNames = []string{"", "POINT", "LINESTRING", "POLYGON", "MULTIPOINT", "MULTILINESTRING", "MULTIPOLYGON", "GEOMETRYCOLLECTION"}
+
+// geometry is a decoded geometry value.
+type geometry struct {
+	srid int
+	wkb  []byte //ISO WKB, little endian
+	wkt  string
+}
+
+// decodeGeometry reads a source geometry value: PostGIS hex or binary
+// EWKB, MySQL's internal format of a little endian SRID followed by WKB,
+// or WKB such as SQL Server's STAsBinary(). mysql is set for MySQL
+// sources as their values can't be told apart from WKB.
+func decodeGeometry(v interface{}, mysql bool) (g *geometry, err error) {
+	var b []byte
+
+	switch t := v.(type) {
+	case []byte:
+		b = t
+	case string:
+		b = []byte(t)
+	default:
+		return nil, errors.NotValidf("geometry value of type %T", v)
+	}
+
+	if !mysql && len(b) > 0 && len(b)%2 == 0 && (b[0] == '0') {
+		if dec, err := hex.DecodeString(string(b)); err == nil {
+			b = dec
+		}
+	}
+
+	g = &geometry{}
+	if mysql {
+		if len(b) < 5 {
+			return nil, errors.NotValidf("MySQL geometry of %d bytes", len(b))
+		}
+		g.srid = int(binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	}
+
+	r := &wkbReader{b: b}
+	var out bytes.Buffer
+	var wkt strings.Builder
+
+	if err = r.geometry(&out, &wkt, g, true); err != nil {
+		return nil, errors.Annotate(err, "reading geometry, SQL Server values must be selected with STAsBinary()")
+	}
+
+	g.wkb, g.wkt = out.Bytes(), wkt.String()
+	return g, nil
+}
+
+// encode returns the geometry in the format for the destination dialect.
+func (g *geometry) encode(f GeoFormat, d *bulk.Dialect) interface{} {
+	if f == GeoAuto {
+		switch d {
+		case bulk.Postgres:
+			return hex.EncodeToString(g.ewkb())
+		case bulk.MySQL:
+			b := binary.LittleEndian.AppendUint32(nil, uint32(g.srid))
+			return append(b, g.wkb...)
+		}
+		f = GeoWKT
+	}
+
+	switch f {
+	case GeoWKB:
+		return g.wkb
+	case GeoEWKT:
+		if g.srid != 0 {
+			return "SRID=" + strconv.Itoa(g.srid) + ";" + g.wkt
+		}
+	}
+
+	return g.wkt
+}
+
+// ewkb returns the geometry as EWKB, with the SRID if it has one.
+func (g *geometry) ewkb() []byte {
+	if g.srid == 0 {
+		return g.wkb
+	}
+
+	// Move the ISO dimensions into the EWKB flags of the outer type
+	t := binary.LittleEndian.Uint32(g.wkb[1:])
+	flags := uint32(0x20000000)
+	switch t / 1000 {
+	case 1:
+		flags |= 0x80000000
+	case 2:
+		flags |= 0x40000000
+	case 3:
+		flags |= 0xc0000000
+	}
+
+	b := []byte{1}
+	b = binary.LittleEndian.AppendUint32(b, t%1000|flags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(g.srid))
+	return append(b, g.wkb[5:]...)
+}
+
+// wkbReader reads WKB or EWKB.
+type wkbReader struct {
+	b     []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) uint32() (n uint32, err error) {
+	if r.pos+4 > len(r.b) {
+		return 0, errors.New("geometry truncated")
+	}
+	n = r.order.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return n, nil
+}
+
+func (r *wkbReader) float() (f float64, err error) {
+	if r.pos+8 > len(r.b) {
+		return 0, errors.New("geometry truncated")
+	}
+	f = math.Float64frombits(r.order.Uint64(r.b[r.pos:]))
+	r.pos += 8
+	return f, nil
+}
+
+// geometry reads one geometry, writing it as little endian ISO WKB to out
+// and as WKT to wkt, the type name only if named. A SRID is stored in g.
+func (r *wkbReader) geometry(out *bytes.Buffer, wkt *strings.Builder, g *geometry, named bool) (err error) {
+	var t uint32
+
+	if r.pos >= len(r.b) {
+		return errors.New("geometry truncated")
+	}
+	switch r.b[r.pos] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return errors.NotValidf("WKB byte order %d", r.b[r.pos])
+	}
+	r.pos++
+
+	if t, err = r.uint32(); err != nil {
+		return errors.Trace(err)
+	}
+
+	// EWKB flags the dimensions and SRID, ISO WKB adds 1000s to the type
+	z, m := t&0x80000000 != 0, t&0x40000000 != 0
+	if t&0x20000000 != 0 {
+		srid, err := r.uint32()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		g.srid = int(srid)
+	}
+	t &= 0x0fffffff
+	z, m = z || t/1000 == 1 || t/1000 == 3, m || t/1000 == 2 || t/1000 == 3
+	kind := t % 1000
+	if kind < 1 || int(kind) >= len(wkbTypeNames) {
+		return errors.NotValidf("WKB geometry type %d", t)
+	}
+
+	dims, iso, suffix := 2, kind, ""
+	switch {
+	case z && m:
+		dims, iso, suffix = 4, kind+3000, " ZM"
+	case z:
+		dims, iso, suffix = 3, kind+1000, " Z"
+	case m:
+		dims, iso, suffix = 3, kind+2000, " M"
+	}
+
+	out.WriteByte(1)
+	out.Write(binary.LittleEndian.AppendUint32(nil, iso))
+
+	if named {
+		wkt.WriteString(wkbTypeNames[kind] + suffix + " ")
+	}
+
+	switch kind {
+	case 1:
+		return errors.Trace(r.points(out, wkt, dims, 1, false))
+	case 2:
+		return errors.Trace(r.points(out, wkt, dims, -1, true))
+	case 3:
+		return errors.Trace(r.rings(out, wkt, dims))
+	}
+
+	// Multi geometries and collections hold whole geometries
+	n, err := r.uint32()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	out.Write(binary.LittleEndian.AppendUint32(nil, n))
+	if n == 0 {
+		wkt.WriteString("EMPTY")
+		return nil
+	}
+
+	wkt.WriteString("(")
+	for i := uint32(0); i < n; i++ {
+		if i > 0 {
+			wkt.WriteString(",")
+		}
+		if err = r.geometry(out, wkt, g, kind == 7); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	wkt.WriteString(")")
+
+	return nil
+}
+
+// points reads n points, or a count followed by that many points if n is
+// negative, writing them in parentheses.
+func (r *wkbReader) points(out *bytes.Buffer, wkt *strings.Builder, dims int, n int, counted bool) (err error) {
+	if counted {
+		var c uint32
+		if c, err = r.uint32(); err != nil {
+			return errors.Trace(err)
+		}
+		out.Write(binary.LittleEndian.AppendUint32(nil, c))
+		n = int(c)
+	}
+	if n == 0 {
+		wkt.WriteString("EMPTY")
+		return nil
+	}
+
+	start := wkt.Len()
+	wkt.WriteString("(")
+	empty := true
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			wkt.WriteString(",")
+		}
+		for j := 0; j < dims; j++ {
+			f, err := r.float()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			out.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+
+			empty = empty && math.IsNaN(f)
+			if j > 0 {
+				wkt.WriteString(" ")
+			}
+			wkt.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	}
+	wkt.WriteString(")")
+
+	// An empty point is written with NaN coordinates
+	if !counted && empty {
+		s := wkt.String()[:start]
+		wkt.Reset()
+		wkt.WriteString(s + "EMPTY")
+	}
+
+	return nil
+}
+
+// rings reads a polygon's rings.
+func (r *wkbReader) rings(out *bytes.Buffer, wkt *strings.Builder, dims int) (err error) {
+	var n uint32
+
+	if n, err = r.uint32(); err != nil {
+		return errors.Trace(err)
+	}
+	out.Write(binary.LittleEndian.AppendUint32(nil, n))
+	if n == 0 {
+		wkt.WriteString("EMPTY")
+		return nil
+	}
+
+	wkt.WriteString("(")
+	for i := uint32(0); i < n; i++ {
+		if i > 0 {
+			wkt.WriteString(",")
+		}
+		if err = r.points(out, wkt, dims, -1, true); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	wkt.WriteString(")")
+
+	return nil
+}
+
+// newGeoStage returns a stage converting the geometry columns, those with
+// a geometry source type or listed in cfg.GeoColumns, for the destination,
+// or nil if there are none. Values which are already WKT, such as those
+// selected with ST_AsText, are left as is.
+func newGeoStage(cfg *Config, columns []string, srcTypes []ColumnType) stage {
+	geo := make([]bool, len(columns))
+	typed := make([]bool, len(columns)) //Source type is a geometry, so values can't be WKT
+	active := false
+
+	for i, c := range columns {
+		typed[i] = i < len(srcTypes) && bulk.Family(srcTypes[i].DatabaseType) == bulk.FamilyGeometry
+		geo[i] = typed[i] || indexOf(cfg.GeoColumns, c) >= 0
+		active = active || geo[i]
+	}
+
+	if !active {
+		return nil
+	}
+
+	mysql := bulk.DialectFor(cfg.SrcDbDriver) == bulk.MySQL
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, v := range values {
+			// A MySQL SRID can look like text
+			if !geo[i] || v == nil || !(mysql && typed[i]) && isWKT(v) {
+				continue
+			}
+
+			g, err := decodeGeometry(v, mysql)
+			if err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, columns[i])
+			}
+			values[i] = g.encode(cfg.GeoFormat, d)
+		}
+
+		return values, nil
+	}
+}
+
+// isWKT reports whether a value is text starting with a letter, as WKT
+// and EWKT do, rather than WKB or hex.
+func isWKT(v interface{}) bool {
+	var c byte
+
+	switch t := v.(type) {
+	case string:
+		if t == "" {
+			return false
+		}
+		c = t[0]
+	case []byte:
+		if len(t) == 0 {
+			return false
+		}
+		c = t[0]
+	default:
+		return false
+	}
+
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
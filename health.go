@@ -0,0 +1,138 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// HealthProbe checks whether the destination can take more writes. It's
+// called between batches and returns how long to pause before checking
+// again, or 0 to carry on writing.
+type HealthProbe interface {
+	Check(ctx context.Context, dstConn *sql.Conn) (pause time.Duration, err error)
+}
+
+// HealthProbeFunc adapts a function to a HealthProbe.
+type HealthProbeFunc func(ctx context.Context, dstConn *sql.Conn) (pause time.Duration, err error)
+
+func (f HealthProbeFunc) Check(ctx context.Context, dstConn *sql.Conn) (pause time.Duration, err error) {
+	return f(ctx, dstConn)
+}
+
+// PostgresReplicationLag pauses for pause while the replay lag of any
+// Postgres standby is over max.
+func PostgresReplicationLag(max time.Duration, pause time.Duration) HealthProbe {
+	return HealthProbeFunc(func(ctx context.Context, dstConn *sql.Conn) (time.Duration, error) {
+		var lag float64
+
+		q := "SELECT COALESCE(EXTRACT(EPOCH FROM MAX(replay_lag)), 0) FROM pg_stat_replication"
+		if err := dstConn.QueryRowContext(ctx, q).Scan(&lag); err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if time.Duration(lag*float64(time.Second)) > max {
+			return pause, nil
+		}
+
+		return 0, nil
+	})
+}
+
+// MySQLThreadsRunning pauses for pause while more than max MySQL threads
+// are running.
+func MySQLThreadsRunning(max int, pause time.Duration) HealthProbe {
+	return HealthProbeFunc(func(ctx context.Context, dstConn *sql.Conn) (time.Duration, error) {
+		var name string
+		var running int
+
+		q := "SHOW GLOBAL STATUS LIKE 'Threads_running'"
+		if err := dstConn.QueryRowContext(ctx, q).Scan(&name, &running); err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if running > max {
+			return pause, nil
+		}
+
+		return 0, nil
+	})
+}
+
+// healthCheck runs the health probe at most once an interval.
+type healthCheck struct {
+	probe    HealthProbe
+	conn     *sql.Conn
+	interval time.Duration
+	last     time.Time
+}
+
+func newHealthCheck(cfg *Config, dstConn *sql.Conn) *healthCheck {
+	if cfg.HealthProbe == nil || dstConn == nil {
+		return nil
+	}
+
+	return &healthCheck{probe: cfg.HealthProbe, conn: dstConn, interval: cfg.HealthCheckInterval}
+}
+
+// wait pauses for as long as the probe asks, adding the time paused to
+// the result. It returns early if the copy is cancelled or stopped.
+func (h *healthCheck) wait(ctx context.Context, res *Result, stop <-chan struct{}) (err error) {
+	var pause time.Duration
+
+	if h == nil || time.Since(h.last) < h.interval {
+		return nil
+	}
+
+	for {
+		h.last = time.Now()
+
+		if pause, err = h.probe.Check(ctx, h.conn); err != nil {
+			return errors.Annotate(err, "destination health probe")
+		}
+		if pause <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(pause)
+		select {
+		case <-t.C:
+			res.Throttled += pause
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-stop:
+			t.Stop()
+			return nil
+		}
+	}
+}
+
+// parseHealthProbe parses a HEALTH_PROBE value, replication_lag:<duration>
+// or threads_running:<count>.
+func parseHealthProbe(spec string, pause time.Duration) (probe HealthProbe, err error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	switch kind {
+	case "":
+		return nil, nil
+	case "replication_lag":
+		var max time.Duration
+		if max, err = time.ParseDuration(arg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return PostgresReplicationLag(max, pause), nil
+	case "threads_running":
+		var max int
+		if max, err = strconv.Atoi(arg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return MySQLThreadsRunning(max, pause), nil
+	}
+
+	return nil, errors.NotValidf("health probe %q", spec)
+}
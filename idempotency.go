@@ -0,0 +1,71 @@
+package godatapipe
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/juju/errors"
+)
+
+// State keys of the last successful run's idempotency key and result.
+const (
+	idempotencyKey    = "idempotency_key"
+	idempotencyResult = "idempotency_result"
+)
+
+// priorResult returns the result of the last successful run if it had the
+// config's IdempotencyKey, or nil if the run should go ahead. Only the
+// latest key is kept, enough for a workflow engine retrying a task.
+func priorResult(ctx context.Context, cfg *Config, store StateStore) (res *Result, err error) {
+	var state State
+
+	if cfg.IdempotencyKey == "" {
+		return nil, nil
+	}
+	if store == nil {
+		return nil, errors.NotValidf("IdempotencyKey without a state store")
+	}
+
+	if state, err = store.Get(ctx, cfg.pipelineName()); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if state[idempotencyKey] != cfg.IdempotencyKey {
+		return nil, nil
+	}
+
+	res = &Result{}
+	if err = json.Unmarshal([]byte(state[idempotencyResult]), res); err != nil {
+		return nil, errors.Annotatef(err, "reading the result of run %s", cfg.IdempotencyKey)
+	}
+	res.Replayed = true
+
+	return res, nil
+}
+
+// saveResult records a successful run's result under its IdempotencyKey.
+// A run which fails after committing but before this is copied again by
+// a retry.
+func saveResult(ctx context.Context, cfg *Config, store StateStore, res *Result) (err error) {
+	var state State
+	var data []byte
+
+	if cfg.IdempotencyKey == "" || store == nil {
+		return nil
+	}
+
+	if data, err = json.Marshal(res); err != nil {
+		return errors.Trace(err)
+	}
+
+	if state, err = store.Get(ctx, cfg.pipelineName()); err != nil {
+		return errors.Trace(err)
+	}
+	if state == nil {
+		state = State{}
+	}
+
+	state[idempotencyKey] = cfg.IdempotencyKey
+	state[idempotencyResult] = string(data)
+
+	return errors.Trace(store.Set(ctx, cfg.pipelineName(), state))
+}
@@ -0,0 +1,63 @@
+package godatapipe
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	run := func(key string, rows int, fail bool) (res *Result, written int, err error) {
+		cfg := &Config{DstTable: "orders", StateStore: store, IdempotencyKey: key}
+		if fail {
+			cfg.Transform = func(columns []string, values []interface{}) ([]interface{}, error) {
+				return nil, errors.New("bad row")
+			}
+		}
+
+		res, w, err := copyRows(t, cfg, []string{"id"}, intRows(rows))
+		return res, len(w), err
+	}
+
+	tests := []struct {
+		key      string
+		rows     int
+		fail     bool
+		rowCount int
+		written  int
+		replayed bool
+	}{
+		{"k1", 3, false, 3, 3, false},
+		{"k1", 5, false, 3, 0, true},
+		{"k2", 4, true, 0, 0, false},
+		{"k2", 4, false, 4, 4, false},
+		{"k2", 6, false, 4, 0, true},
+		{"k1", 2, false, 2, 2, false},
+		{"", 2, false, 2, 2, false},
+	}
+
+	for i, tt := range tests {
+		res, written, err := run(tt.key, tt.rows, tt.fail)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("run %d didn't fail", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("run %d: %s", i+1, err)
+		}
+		if res.RowCount != tt.rowCount || written != tt.written || res.Replayed != tt.replayed {
+			t.Errorf("run %d with %q = %d rows, %d written, replayed %t, want %d, %d, %t",
+				i+1, tt.key, res.RowCount, written, res.Replayed, tt.rowCount, tt.written, tt.replayed)
+		}
+	}
+}
+
+func TestIdempotencyKeyWithoutStore(t *testing.T) {
+	if _, err := priorResult(context.Background(), &Config{IdempotencyKey: "k"}, nil); err == nil {
+		t.Error("IdempotencyKey without a state store didn't fail")
+	}
+}
@@ -0,0 +1,78 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// setIdentityInsert allows explicit values to be written to a SQL Server
+// identity column for the rest of the session.
+func setIdentityInsert(ctx context.Context, dstConn *sql.Conn, cfg *Config, on bool) (err error) {
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if d != bulk.SQLServer {
+		return nil
+	}
+
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+
+	q := fmt.Sprintf("SET IDENTITY_INSERT %s %s", d.QualifiedName(cfg.DstSchema, cfg.DstTable), state)
+	if _, err = dstConn.ExecContext(ctx, q); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// resyncSequences moves the sequences behind Postgres serial and identity
+// columns past the largest value copied, so later inserts don't collide.
+func resyncSequences(ctx context.Context, dstConn *sql.Conn, cfg *Config) (err error) {
+	var columns []string
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if d != bulk.Postgres {
+		return nil
+	}
+
+	if columns, err = bulk.IdentityColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Trace(err)
+	}
+
+	table := d.QualifiedName(cfg.DstSchema, cfg.DstTable)
+	for _, c := range columns {
+		q := fmt.Sprintf("SELECT setval(pg_get_serial_sequence($1, $2), COALESCE(MAX(%s), 0) + 1, false) FROM %s",
+			d.QuoteIdent(c), table)
+		if _, err = dstConn.ExecContext(ctx, q, table, c); err != nil {
+			return errors.Annotatef(err, "resyncing sequence for %s", c)
+		}
+	}
+
+	return nil
+}
+
+// identityExclusions returns the source columns matching destination
+// identity columns.
+func identityExclusions(ctx context.Context, dstConn *sql.Conn, cfg *Config, columns []string) (exclude []string, err error) {
+	var identities []string
+
+	if identities, err = bulk.IdentityColumns(ctx, dstConn, bulk.DialectFor(cfg.DstDbDriver), cfg.DstSchema, cfg.DstTable); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, c := range columns {
+		for _, id := range identities {
+			if strings.EqualFold(c, id) {
+				exclude = append(exclude, c)
+			}
+		}
+	}
+
+	return exclude, nil
+}
@@ -0,0 +1,135 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// copyIndexes recreates the source table's primary key and indexes, and
+// foreign keys if configured, on the destination table once it's loaded.
+// Those the destination already has are skipped, so it's safe to repeat.
+func copyIndexes(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config) (err error) {
+	var srcIndexes, dstIndexes []bulk.Index
+	var q string
+
+	if srcConn == nil || cfg.SrcTable == "" {
+		return errors.NotValidf("copying indexes without a source table")
+	}
+
+	srcDialect := bulk.DialectFor(cfg.SrcDbDriver)
+	dstDialect := bulk.DialectFor(cfg.DstDbDriver)
+	srcSchema, srcTable := splitTableName(cfg.SrcTable)
+
+	if srcIndexes, err = bulk.Indexes(ctx, srcConn, srcDialect, srcSchema, srcTable); err != nil {
+		return errors.Annotatef(err, "reading indexes of %s", cfg.SrcTable)
+	}
+	if dstIndexes, err = bulk.Indexes(ctx, dstConn, dstDialect, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Annotatef(err, "reading indexes of %s", cfg.DstTable)
+	}
+
+	for _, ix := range srcIndexes {
+		if hasIndex(dstIndexes, ix) {
+			continue
+		}
+
+		if q, err = dstDialect.CreateIndexSQL(cfg.DstSchema, cfg.DstTable, ix); err != nil {
+			return errors.Annotatef(err, "index %s", ix.Name)
+		}
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "creating index %s", ix.Name)
+		}
+	}
+
+	if !cfg.CopyForeignKeys {
+		return nil
+	}
+
+	return errors.Trace(copyForeignKeys(ctx, srcConn, dstConn, cfg))
+}
+
+// copyForeignKeys adds the source table's foreign keys to the destination
+// table, referencing tables of the same name in the destination schema.
+func copyForeignKeys(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config) (err error) {
+	var srcFKs, dstFKs []bulk.ForeignKey
+	var q string
+
+	srcDialect := bulk.DialectFor(cfg.SrcDbDriver)
+	dstDialect := bulk.DialectFor(cfg.DstDbDriver)
+	srcSchema, srcTable := splitTableName(cfg.SrcTable)
+
+	if srcFKs, err = bulk.ForeignKeys(ctx, srcConn, srcDialect, srcSchema, srcTable); err != nil {
+		return errors.Annotatef(err, "reading foreign keys of %s", cfg.SrcTable)
+	}
+	if dstFKs, err = bulk.ForeignKeys(ctx, dstConn, dstDialect, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Annotatef(err, "reading foreign keys of %s", cfg.DstTable)
+	}
+
+	for _, fk := range srcFKs {
+		exists := false
+		for _, d := range dstFKs {
+			if strings.EqualFold(d.Name, fk.Name) || sameColumns(d.Columns, fk.Columns) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		fk.RefSchema = cfg.DstSchema
+		if q, err = dstDialect.AddForeignKeySQL(cfg.DstSchema, cfg.DstTable, fk); err != nil {
+			return errors.Annotatef(err, "foreign key %s", fk.Name)
+		}
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "adding foreign key %s", fk.Name)
+		}
+	}
+
+	return nil
+}
+
+// hasIndex reports whether an equivalent index is already in indexes.
+func hasIndex(indexes []bulk.Index, ix bulk.Index) bool {
+	for _, d := range indexes {
+		if ix.Primary && d.Primary {
+			return true
+		}
+		if strings.EqualFold(d.Name, ix.Name) {
+			return true
+		}
+		if d.Unique == ix.Unique && sameColumns(d.Columns, ix.Columns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameColumns reports whether two column lists match in order, ignoring
+// case.
+func sameColumns(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitTableName splits a schema qualified table name.
+func splitTableName(name string) (schema string, table string) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return "", name
+}
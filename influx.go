@@ -0,0 +1,203 @@
+package godatapipe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// influxDriver writes to InfluxDB with the v2 write API, which InfluxDB
+// 1.8 also has. URIs are influxdb://host:8086, or influxdb+https://, with
+// query parameters: bucket, or a 1.x database/retention policy, org, and
+// token, a secret reference to an API token or a 1.x user:password. The
+// table is the measurement. Time and tag columns are given by time and
+// tags parameters, or Config.TimeColumn and Config.TagColumns.
+type influxDriver struct{}
+
+func (influxDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from InfluxDB")
+}
+
+func (influxDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	q := u.Query()
+	if q.Get("bucket") == "" {
+		return nil, errors.NotValidf("InfluxDB URI without a bucket")
+	}
+
+	scheme := "http"
+	if u.Scheme == "influxdb+https" {
+		scheme = "https"
+	}
+	write := url.Values{"bucket": {q.Get("bucket")}, "precision": {"ns"}}
+	if org := q.Get("org"); org != "" {
+		write.Set("org", org)
+	}
+
+	i := &influxWriter{
+		url:         scheme + "://" + u.Host + "/api/v2/write?" + write.Encode(),
+		measurement: influxEscape(table, ", "),
+		tags:        map[string]bool{},
+		header:      http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Encoding": {"gzip"}}}
+	i.setTimeSeries(q.Get("time"), splitList(q.Get("tags")))
+
+	if ref := q.Get("token"); ref != "" {
+		var token string
+		if token, err = ResolveSecret(ctx, ref); err != nil {
+			return nil, errors.Trace(err)
+		}
+		i.header.Set("Authorization", "Token "+token)
+	}
+
+	return i, nil
+}
+
+// influxWriter writes each record batch as a gzipped request of points
+// in line protocol.
+type influxWriter struct {
+	url         string
+	header      http.Header
+	measurement string          //Escaped measurement name
+	timeColumn  string          //Column of the points' times, the server's time if empty
+	tags        map[string]bool //Tag columns, by lower case name
+}
+
+// setTimeSeries sets the time and tag columns, unless the URI did.
+func (i *influxWriter) setTimeSeries(timeColumn string, tags []string) {
+	if i.timeColumn == "" {
+		i.timeColumn = timeColumn
+	}
+	if len(i.tags) == 0 {
+		for _, t := range tags {
+			i.tags[strings.ToLower(t)] = true
+		}
+	}
+}
+
+func (i *influxWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	var buf bytes.Buffer
+	var line []byte
+
+	timeAt := -1
+	keys := make([]string, len(b.Fields))
+	for c, f := range b.Fields {
+		keys[c] = influxEscape(f.Name, ",= ")
+		if strings.EqualFold(f.Name, i.timeColumn) {
+			timeAt = c
+		}
+	}
+	if i.timeColumn != "" && timeAt < 0 {
+		return errors.Trace(sourceColumnError(i.timeColumn, "InfluxDB time"))
+	}
+
+	zw := gzip.NewWriter(&buf)
+	row := make([]interface{}, len(b.Fields))
+	for r := 0; r < b.NumRows; r++ {
+		row = b.Row(r, row)
+
+		line = append(line[:0], i.measurement...)
+		for c, v := range row {
+			if i.tags[strings.ToLower(b.Fields[c].Name)] && v != nil && fileText(v) != "" {
+				line = append(line, ',')
+				line = append(line, keys[c]...)
+				line = append(line, '=')
+				line = append(line, influxEscape(fileText(v), ",= ")...)
+			}
+		}
+
+		sep := byte(' ')
+		for c, v := range row {
+			if v == nil || c == timeAt || i.tags[strings.ToLower(b.Fields[c].Name)] {
+				continue
+			}
+			field := influxField(v)
+			if field == "" {
+				continue
+			}
+			line = append(line, sep)
+			line = append(line, keys[c]...)
+			line = append(line, '=')
+			line = append(line, field...)
+			sep = ','
+		}
+		// A point needs a field
+		if sep == ' ' {
+			continue
+		}
+
+		if timeAt >= 0 {
+			var t time.Time
+			if row[timeAt] == nil {
+				return errors.NotValidf("row %d without a time in %s", r+1, i.timeColumn)
+			}
+			if t, err = recordTime(row[timeAt]); err != nil {
+				return errors.Annotatef(err, "row %d column %s", r+1, i.timeColumn)
+			}
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, t.UnixNano(), 10)
+		}
+		line = append(line, '\n')
+		zw.Write(line)
+	}
+	if err = zw.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Annotatef(postRetrying(ctx, i.url, i.header, buf.Bytes()), "writing %d points to InfluxDB", b.NumRows)
+}
+
+func (i *influxWriter) Close() (err error) {
+	return nil
+}
+
+// influxField returns a value as a line protocol field value, or empty if
+// it can't be one.
+func influxField(v interface{}) string {
+	switch t := v.(type) {
+	case bool:
+		return strconv.FormatBool(t)
+	case int64, int32, int16, int8, int, uint32, uint16, uint8:
+		return valueText(t) + "i"
+	case float64, float32:
+		if f, _ := recordFloat(t); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return ""
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fileText(v)) + `"`
+}
+
+// influxEscape returns a name or tag value with the characters escaped
+// with a backslash, and newlines, which can't be escaped, as spaces.
+func influxEscape(s string, chars string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r == '\n' || r == '\r':
+			r = ' '
+			if strings.ContainsRune(chars, ' ') {
+				b.WriteByte('\\')
+			}
+		case strings.ContainsRune(chars, r):
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
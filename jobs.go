@@ -0,0 +1,311 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Job is one pipeline run by a Scheduler.
+type Job struct {
+	Name          string
+	Config        *Config
+	EstimatedRows int64 //Size the jobs are ordered by, estimated from Config.SrcTable's statistics if 0
+}
+
+// JobResult is the outcome of a job.
+type JobResult struct {
+	Job    *Job
+	Result *Result
+	Err    error
+}
+
+// Scheduler runs many jobs at once within limits on the number of jobs
+// and connections, largest jobs first so the long ones aren't left until
+// last. Zero limits are unlimited.
+type Scheduler struct {
+	MaxConcurrentJobs int
+	MaxSrcConns       int //Source connections open at once across all jobs
+	MaxDstConns       int //Destination connections open at once across all jobs
+
+	OrderByForeignKeys bool //Load tables after the tables their destination foreign keys reference
+}
+
+// Runs the jobs and returns their results in the order given. Cancelling
+// the context stops the running jobs gracefully and skips the rest. Jobs
+// waiting on a job which failed are skipped.
+func (s *Scheduler) Run(ctx context.Context, jobs []*Job) (results []JobResult) {
+	results = make([]JobResult, len(jobs))
+	order := make([]int, len(jobs))
+	deps := make([][]int, len(jobs))
+	done := make([]chan struct{}, len(jobs))
+
+	for i, job := range jobs {
+		results[i].Job = job
+		order[i] = i
+		done[i] = make(chan struct{})
+
+		if job.EstimatedRows == 0 {
+			job.EstimatedRows, _ = estimateRows(ctx, job.Config)
+		}
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return jobs[order[a]].EstimatedRows > jobs[order[b]].EstimatedRows
+	})
+
+	if s.OrderByForeignKeys {
+		plan, err := planForeignKeys(ctx, jobs)
+		if err == nil {
+			err = plan.dropDeferred(ctx, jobs)
+			defer plan.restoreDeferred(context.WithoutCancel(ctx), jobs, results)
+		}
+		if err != nil {
+			for i := range results {
+				results[i].Err = errors.Trace(err)
+			}
+			return results
+		}
+
+		order, deps = plan.order, plan.deps
+		for i, err := range plan.failed {
+			results[i].Err = errors.Trace(err)
+		}
+	}
+
+	workers := s.MaxConcurrentJobs
+	if workers <= 0 || workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	srcConns := newBudget(s.MaxSrcConns)
+	dstConns := newBudget(s.MaxDstConns)
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				s.runJob(ctx, jobs, i, deps[i], done, results, srcConns, dstConns)
+			}
+		}()
+	}
+
+	for _, i := range order {
+		if ctx.Err() != nil {
+			results[i].Err = errors.Annotatef(ctx.Err(), "job %s not started", jobs[i].Name)
+			close(done[i])
+			continue
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return results
+}
+
+// runJob runs a job once the jobs it depends on are done, closing its
+// done channel when it's finished.
+func (s *Scheduler) runJob(ctx context.Context, jobs []*Job, i int, deps []int, done []chan struct{}, results []JobResult, srcConns *budget, dstConns *budget) {
+	defer close(done[i])
+
+	for _, j := range deps {
+		<-done[j]
+		if results[j].Err != nil && results[i].Err == nil {
+			results[i].Err = errors.Errorf("job %s not started, job %s failed", jobs[i].Name, jobs[j].Name)
+		}
+	}
+	if results[i].Err != nil {
+		return
+	}
+
+	cfg := jobs[i].Config
+	src, dst := srcConnCount(cfg), 1
+
+	if err := srcConns.acquire(ctx, src); err != nil {
+		results[i].Err = errors.Trace(err)
+		return
+	}
+	defer srcConns.release(src)
+
+	if err := dstConns.acquire(ctx, dst); err != nil {
+		results[i].Err = errors.Trace(err)
+		return
+	}
+	defer dstConns.release(dst)
+
+	results[i].Result, results[i].Err = runStoppable(ctx, cfg)
+}
+
+// Returns a job per source table whose name matches cfg.SrcTables, a
+// schema.pattern or pattern in path.Match syntax, and its views too if
+// cfg.IncludeViews is set. Each job copies SELECT * from its table to the
+// destination table of the same name, so views are materialized as
+// tables. The jobs don't notify cfg.Notifiers, so the results can be
+// reported together with Notify.
+func TableJobs(ctx context.Context, cfg *Config) (jobs []*Job, err error) {
+	var conn *sql.Conn
+	var release func()
+	var tables []bulk.Table
+
+	schema, pattern := splitTableName(cfg.SrcTables)
+	if _, err = path.Match(pattern, ""); err != nil {
+		return nil, errors.Trace(&ConfigError{Setting: "SRC_TABLES", Value: cfg.SrcTables, Err: err})
+	}
+
+	if _, conn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer release()
+
+	d := bulk.DialectFor(cfg.SrcDbDriver)
+	if tables, err = bulk.Tables(ctx, conn, d, schema, cfg.IncludeViews); err != nil {
+		return nil, errors.Annotatef(err, "listing the tables of %s", cfg.SrcTables)
+	}
+
+	for _, t := range tables {
+		if ok, _ := path.Match(pattern, t.Name); !ok {
+			continue
+		}
+
+		c := *cfg
+		c.SrcTables = ""
+		c.SrcTable = t.Name
+		if t.Schema != "" {
+			c.SrcTable = t.Schema + "." + t.Name
+		}
+		c.SrcSelectSql = "SELECT * FROM " + d.QualifiedName(t.Schema, t.Name)
+		c.DstTable = t.Name
+		c.Notifiers = nil
+		if cfg.PipelineName != "" {
+			c.PipelineName = cfg.PipelineName + "." + t.Name
+		}
+
+		jobs = append(jobs, &Job{Name: c.SrcTable, Config: &c})
+	}
+
+	return jobs, nil
+}
+
+// srcConnCount returns the number of source connections a run opens.
+func srcConnCount(cfg *Config) int {
+	switch {
+	case cfg.Source != nil || cfg.SrcConn != nil || cfg.SrcFile != "" || cfg.SrcRecordURI != "" || cfg.SrcAPI.URL != "":
+		return 0
+	case len(cfg.SrcShards) > 0 && cfg.ShardParallel > 1:
+		return min(cfg.ShardParallel, len(cfg.SrcShards))
+	}
+
+	return 1
+}
+
+// budget is a counting semaphore whose holders can take more than one
+// unit. Requests larger than the budget get all of it.
+type budget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func newBudget(limit int) *budget {
+	b := &budget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+func (b *budget) acquire(ctx context.Context, n int) (err error) {
+	if b.limit <= 0 || n == 0 {
+		return nil
+	}
+	n = min(n, b.limit)
+
+	// Wake the waiters if the context is cancelled while they wait
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	defer stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used+n > b.limit {
+		if err = ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+
+	return nil
+}
+
+func (b *budget) release(n int) {
+	if b.limit <= 0 || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= min(n, b.limit)
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// estimateRows returns the source table's row count from the database's
+// statistics, without counting its rows.
+func estimateRows(ctx context.Context, cfg *Config) (rows int64, err error) {
+	var conn *sql.Conn
+	var release func()
+	var q string
+
+	if cfg.SrcTable == "" || cfg.Source != nil {
+		return 0, nil
+	}
+
+	if _, conn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer release()
+
+	schema, table := splitTableName(cfg.SrcTable)
+	d := bulk.DialectFor(cfg.SrcDbDriver)
+	args := []interface{}{table}
+
+	switch d {
+	case bulk.Postgres:
+		q = "SELECT COALESCE(SUM(c.reltuples), 0)::bigint FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relname = $1"
+		if schema != "" {
+			q += " AND n.nspname = $2"
+			args = append(args, schema)
+		}
+	case bulk.MySQL:
+		q = "SELECT COALESCE(SUM(table_rows), 0) FROM information_schema.tables WHERE table_name = ?"
+		if schema != "" {
+			q += " AND table_schema = ?"
+			args = append(args, schema)
+		}
+	case bulk.SQLServer:
+		q = "SELECT COALESCE(SUM(row_count), 0) FROM sys.dm_db_partition_stats WHERE object_id = OBJECT_ID(@p1) AND index_id < 2"
+		args = []interface{}{d.QualifiedName(schema, table)}
+	default:
+		return 0, errors.NotSupportedf("row estimates for %s", cfg.SrcDbDriver)
+	}
+
+	if err = conn.QueryRowContext(ctx, q, args...).Scan(&rows); err != nil {
+		return 0, errors.Annotatef(err, "estimating rows of %s", cfg.SrcTable)
+	}
+
+	return max(rows, 0), nil
+}
@@ -0,0 +1,240 @@
+package godatapipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Default type of the values projected from JSON.
+const jsonPathType = "text"
+
+// JSONPath is a destination column holding the value at a path in a JSON
+// source column, so semi-structured columns can be flattened as they're
+// copied. Missing paths and JSON nulls are written as NULL.
+type JSONPath struct {
+	Name   string //Destination column
+	Column string //Source column holding JSON text, or values already decoded into maps and slices
+	Path   string //Dotted object keys and [n] array indexes, e.g. customer.address.city or items[0].sku
+	Type   string //Database type the value is converted to, e.g. bigint, numeric, boolean or timestamptz, defaults to text. Objects and arrays are written as JSON text
+}
+
+// jsonStep is an object key, or an array index when key is empty.
+type jsonStep struct {
+	key   string
+	index int
+}
+
+// Parses JSON paths in the form "name=column.path[:type],..." where the
+// column is the text before the first "." or "[" and type is a database
+// type name.
+func ParseJSONPaths(spec string) (paths []JSONPath, err error) {
+	for _, entry := range splitList(spec) {
+		name, path, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, errors.NotValidf("JSON path %q", entry)
+		}
+
+		p := JSONPath{Name: name}
+		path, p.Type, _ = strings.Cut(path, ":")
+		i := strings.IndexAny(path, ".[")
+		if i <= 0 {
+			return nil, errors.NotValidf("JSON path %q without a column and path", entry)
+		}
+		p.Column, p.Path = path[:i], strings.TrimPrefix(path[i:], ".")
+		if _, err = parseJSONSteps(p.Path); err != nil {
+			return nil, errors.Annotatef(err, "JSON path for column %s", name)
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// parseJSONSteps splits a path into its keys and indexes.
+func parseJSONSteps(path string) (steps []jsonStep, err error) {
+	if path == "" {
+		return nil, errors.NotValidf("empty JSON path")
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		key, rest := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key, rest = part[:i], part[i:]
+		}
+		if key == "" && rest == "" {
+			return nil, errors.NotValidf("JSON path %q", path)
+		}
+		if key != "" {
+			steps = append(steps, jsonStep{key: key})
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(strings.TrimPrefix(rest, "["), "]")
+			if !ok || !strings.HasPrefix(rest, "[") {
+				return nil, errors.NotValidf("JSON path %q", path)
+			}
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return nil, errors.NotValidf("JSON array index %q", index)
+			}
+			steps = append(steps, jsonStep{index: n})
+			rest = after
+		}
+	}
+
+	return steps, nil
+}
+
+// jsonColumn is a projected path's steps and conversion.
+type jsonColumn struct {
+	srcPos int
+	steps  []jsonStep
+	family bulk.TypeFamily
+	coerce Coercion
+}
+
+// newJSONStage returns a stage appending the values at the JSON paths to
+// each row, and the resulting columns and types, or a nil stage if there
+// are none. Each JSON column is decoded once per row, however many paths
+// are read from it.
+func newJSONStage(paths []JSONPath, columns []string, types []ColumnType) (s stage, outColumns []string, outTypes []ColumnType, err error) {
+	if len(paths) == 0 {
+		return nil, columns, types, nil
+	}
+
+	outColumns = append([]string{}, columns...)
+	if len(types) == len(columns) {
+		outTypes = append([]ColumnType{}, types...)
+	}
+	cols := make([]jsonColumn, len(paths))
+
+	for i, p := range paths {
+		c := &cols[i]
+		if c.srcPos = indexOf(columns, p.Column); c.srcPos < 0 {
+			return nil, nil, nil, errors.Trace(sourceColumnError(p.Column, "JSON"))
+		}
+		if c.steps, err = parseJSONSteps(p.Path); err != nil {
+			return nil, nil, nil, errors.Annotatef(err, "JSON path for column %s", p.Name)
+		}
+		if indexOf(outColumns, p.Name) >= 0 {
+			return nil, nil, nil, errors.Errorf("JSON path column %s is already a column", p.Name)
+		}
+		typ := p.Type
+		if typ == "" {
+			typ = jsonPathType
+		}
+		if c.family = bulk.Family(typ); c.family == bulk.FamilyUnknown {
+			return nil, nil, nil, errors.NotSupportedf("JSON path type %q for column %s", typ, p.Name)
+		}
+		c.coerce = defaultCoercion(c.family)
+
+		outColumns = append(outColumns, p.Name)
+		if outTypes != nil {
+			outTypes = append(outTypes, ColumnType{Name: p.Name, DatabaseType: typ, Nullable: true})
+		}
+	}
+
+	n := len(columns)
+	row := make([]interface{}, len(outColumns))
+	docs := map[int]interface{}{}
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		copy(row, values)
+		clear(docs)
+
+		for i, c := range cols {
+			doc, ok := docs[c.srcPos]
+			if !ok {
+				var err error
+				if doc, err = decodeJSON(values[c.srcPos]); err != nil {
+					return nil, errors.Annotatef(err, "row %d: column %s", rowNum, paths[i].Column)
+				}
+				docs[c.srcPos] = doc
+			}
+
+			v, err := c.value(doc)
+			if err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, paths[i].Name)
+			}
+			row[n+i] = v
+		}
+
+		return row, nil
+	}, outColumns, outTypes, nil
+}
+
+// decodeJSON decodes JSON text, keeping numbers as json.Number so none
+// lose precision. Values which were already decoded are returned as is.
+func decodeJSON(v interface{}) (doc interface{}, err error) {
+	var b []byte
+
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		b = []byte(t)
+	case []byte:
+		b = t
+	default:
+		return v, nil
+	}
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&doc); err != nil {
+		return nil, errors.Annotate(err, "decoding JSON")
+	}
+
+	return doc, nil
+}
+
+// value returns the value at the path in the document, converted to the
+// column's type.
+func (c *jsonColumn) value(doc interface{}) (v interface{}, err error) {
+	v = doc
+	for _, step := range c.steps {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[step.key]
+		case []interface{}:
+			if step.key != "" || step.index >= len(t) {
+				return nil, nil
+			}
+			v = t[step.index]
+		default:
+			return nil, nil
+		}
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		v = t.String()
+	case bool:
+		if c.family != bulk.FamilyBool && c.family != bulk.FamilyInt {
+			v = strconv.FormatBool(t)
+		}
+	case map[string]interface{}, []interface{}:
+		var b []byte
+		if b, err = json.Marshal(t); err != nil {
+			return nil, errors.Trace(err)
+		}
+		v = string(b)
+	}
+
+	if c.coerce == nil {
+		return v, nil
+	}
+
+	return c.coerce(v)
+}
@@ -0,0 +1,67 @@
+package godatapipe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONPaths(t *testing.T) {
+	got, err := ParseJSONPaths("city=doc.customer.address.city, sku=doc.items[0].sku:text,first=tags[0],qty=doc.items[1][2]:bigint")
+	want := []JSONPath{
+		{Name: "city", Column: "doc", Path: "customer.address.city"},
+		{Name: "sku", Column: "doc", Path: "items[0].sku", Type: "text"},
+		{Name: "first", Column: "tags", Path: "[0]"},
+		{Name: "qty", Column: "doc", Path: "items[1][2]", Type: "bigint"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseJSONPaths = %v, %v, want %v", got, err, want)
+	}
+
+	for _, spec := range []string{"city", "=doc.city", "city=doc", "city=.doc", "city=doc.a..b", "city=doc.a[x]", "city=doc.a[-1]", "city=doc.a[0"} {
+		if _, err = ParseJSONPaths(spec); err == nil {
+			t.Errorf("ParseJSONPaths(%q) didn't fail", spec)
+		}
+	}
+}
+
+func TestJSONPaths(t *testing.T) {
+	paths, err := ParseJSONPaths("city=doc.customer.city,sku=doc.items[1].sku,qty=doc.items[0].qty:bigint,paid=doc.paid:boolean,flag=doc.paid,items=doc.items,big=doc.big:numeric")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := [][]interface{}{
+		{int64(1), `{"customer": {"city": "Oslo"}, "items": [{"qty": 2}, {"sku": "b-1"}], "paid": true, "big": 12345678901234567890.5}`},
+		{int64(2), []byte(`{"customer": null, "items": []}`)},
+		{int64(3), nil},
+		{int64(4), map[string]interface{}{"customer": map[string]interface{}{"city": "Rome"}}}}
+
+	got, written, err := copyColumns(t, &Config{MaxRowBufSz: 10, JSONPaths: paths, ExcludeColumns: []string{"doc"}}, []string{"id", "doc"}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id", "city", "sku", "qty", "paid", "flag", "items", "big"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	// Numbers keep their precision, objects and arrays are written as
+	// JSON, and missing paths are NULL
+	want := [][]interface{}{
+		{int64(1), "Oslo", "b-1", int64(2), true, "true", `[{"qty":2},{"sku":"b-1"}]`, "12345678901234567890.5"},
+		{int64(2), nil, nil, nil, nil, nil, "[]", nil},
+		{int64(3), nil, nil, nil, nil, nil, nil, nil},
+		{int64(4), "Rome", nil, nil, nil, nil, nil, nil}}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written %v, want %v", written, want)
+	}
+
+	bad := []JSONPath{{Name: "x", Column: "doc", Path: "a"}}
+	if _, _, err = copyColumns(t, &Config{MaxRowBufSz: 10, JSONPaths: bad}, []string{"id", "doc"}, [][]interface{}{{int64(1), "{"}}); err == nil || !strings.Contains(err.Error(), "row 1: column doc") {
+		t.Errorf("invalid JSON error = %v", err)
+	}
+
+	bad = []JSONPath{{Name: "x", Column: "doc", Path: "a", Type: "widget"}}
+	if _, _, err = copyColumns(t, &Config{MaxRowBufSz: 10, JSONPaths: bad}, []string{"id", "doc"}, nil); err == nil {
+		t.Error("unknown JSON path type didn't fail")
+	}
+}
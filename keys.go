@@ -0,0 +1,253 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// SurrogateKind is how a surrogate key's values are generated.
+type SurrogateKind int
+
+const (
+	KeySequence  SurrogateKind = iota //Values of a destination sequence, fetched in blocks
+	KeyUUIDv7                         //Time ordered UUIDs
+	KeySnowflake                      //64-bit IDs of the time, node and a per millisecond count
+)
+
+// Default values fetched from a sequence at once.
+const sequenceBlockSize = 1000
+
+// Snowflake IDs' epoch, 2010-11-04 01:42:54.657 UTC, as Twitter's.
+const snowflakeEpoch = 1288834974657
+
+// SurrogateKey is a destination key column which isn't in the source,
+// generated for each row.
+type SurrogateKey struct {
+	Column    string
+	Kind      SurrogateKind
+	Sequence  string //Destination sequence for KeySequence, Postgres or SQL Server only
+	BlockSize int    //Values fetched from the sequence at once, defaults to 1000
+	Node      int    //Node ID from 0 to 1023 for KeySnowflake, so concurrent loads don't collide
+}
+
+// Parses surrogate keys in the form "column=kind,..." where kind is
+// "sequence:name[:block_size]", "uuid7" or "snowflake[:node]".
+func ParseSurrogateKeys(spec string) (keys []SurrogateKey, err error) {
+	for _, entry := range splitList(spec) {
+		column, kind, ok := strings.Cut(entry, "=")
+		if !ok || column == "" {
+			return nil, errors.NotValidf("surrogate key %q", entry)
+		}
+
+		k := SurrogateKey{Column: column}
+		parts := strings.Split(kind, ":")
+		switch {
+		case parts[0] == "uuid7" && len(parts) == 1:
+			k.Kind = KeyUUIDv7
+		case parts[0] == "snowflake" && len(parts) <= 2:
+			k.Kind = KeySnowflake
+			if len(parts) == 2 {
+				if k.Node, err = strconv.Atoi(parts[1]); err != nil || k.Node < 0 || k.Node > 1023 {
+					return nil, errors.NotValidf("snowflake node %q for column %s", parts[1], column)
+				}
+			}
+		case parts[0] == "sequence" && len(parts) >= 2 && len(parts) <= 3 && parts[1] != "":
+			k.Kind = KeySequence
+			k.Sequence = parts[1]
+			if len(parts) == 3 {
+				if k.BlockSize, err = strconv.Atoi(parts[2]); err != nil || k.BlockSize < 1 {
+					return nil, errors.NotValidf("sequence block size %q for column %s", parts[2], column)
+				}
+			}
+		default:
+			return nil, errors.NotValidf("surrogate key %q", entry)
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// newSurrogateKeyStage returns a stage appending the generated keys to
+// each row, and the resulting columns, or a nil stage if there are none.
+// Sequences are read through the destination pool, as the destination
+// connection is busy writing.
+func newSurrogateKeyStage(ctx context.Context, cfg *Config, dstDb *sql.DB, columns []string) (s stage, outColumns []string, err error) {
+	if len(cfg.SurrogateKeys) == 0 {
+		return nil, columns, nil
+	}
+
+	outColumns = append([]string{}, columns...)
+	gens := make([]func() (interface{}, error), len(cfg.SurrogateKeys))
+
+	for i, k := range cfg.SurrogateKeys {
+		if indexOf(outColumns, k.Column) >= 0 {
+			return nil, nil, errors.Errorf("surrogate key %s is already a column", k.Column)
+		}
+		outColumns = append(outColumns, k.Column)
+
+		switch k.Kind {
+		case KeyUUIDv7:
+			gens[i] = func() (interface{}, error) { return newUUIDv7() }
+		case KeySnowflake:
+			gen := &snowflake{node: int64(k.Node)}
+			gens[i] = func() (interface{}, error) { return gen.next(), nil }
+		case KeySequence:
+			db := dstDb
+			if db == nil {
+				db = cfg.DstDB
+			}
+			if db == nil {
+				return nil, nil, errors.NotSupportedf("sequence key %s without a destination database", k.Column)
+			}
+			seq := &sequenceBlock{db: db, dialect: bulk.DialectFor(cfg.DstDbDriver), name: k.Sequence, size: k.BlockSize}
+			if seq.dialect != bulk.Postgres && seq.dialect != bulk.SQLServer {
+				return nil, nil, errors.NotSupportedf("sequence keys for %s", cfg.DstDbDriver)
+			}
+			if seq.size <= 0 {
+				seq.size = sequenceBlockSize
+			}
+			gens[i] = func() (interface{}, error) { return seq.next(ctx) }
+		default:
+			return nil, nil, errors.NotValidf("surrogate key kind %d for column %s", k.Kind, k.Column)
+		}
+	}
+
+	n := len(columns)
+	row := make([]interface{}, len(outColumns))
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		copy(row, values)
+
+		for i, gen := range gens {
+			v, err := gen()
+			if err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, cfg.SurrogateKeys[i].Column)
+			}
+			row[n+i] = v
+		}
+
+		return row, nil
+	}, outColumns, nil
+}
+
+// newUUIDv7 returns a time ordered (version 7) UUID, whose 12 bits after
+// the millisecond timestamp are the fraction of the millisecond.
+func newUUIDv7() (id string, err error) {
+	var b [16]byte
+
+	if _, err = rand.Read(b[6:]); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	now := time.Now()
+	ms := uint64(now.UnixMilli())
+	frac := uint64(now.Nanosecond()%1e6) * 4096 / 1e6
+	binary.BigEndian.PutUint64(b[:8], ms<<16|frac)
+	b[6] = (b[6] & 0x0f) | 0x70
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return bulk.FormatUUID(b[:]), nil
+}
+
+// snowflake generates IDs of 41 bits of milliseconds since the epoch, 10
+// bits of node and 12 bits counting the IDs in each millisecond.
+type snowflake struct {
+	mu    sync.Mutex
+	node  int64
+	ms    int64 //Millisecond of the last ID
+	count int64 //IDs generated in the millisecond
+}
+
+func (s *snowflake) next() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := time.Now().UnixMilli() - snowflakeEpoch
+	// The clock going back reuses the last millisecond
+	if ms < s.ms {
+		ms = s.ms
+	}
+	if ms == s.ms {
+		if s.count++; s.count == 4096 {
+			for ms <= s.ms {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Now().UnixMilli() - snowflakeEpoch
+			}
+			s.count = 0
+		}
+	} else {
+		s.count = 0
+	}
+	s.ms = ms
+
+	return ms<<22 | s.node<<12 | s.count
+}
+
+// sequenceBlock hands out values of a destination sequence, fetching a
+// block of them at a time.
+type sequenceBlock struct {
+	db      *sql.DB
+	dialect *bulk.Dialect
+	name    string
+	size    int
+
+	values []int64
+}
+
+func (s *sequenceBlock) next(ctx context.Context) (v int64, err error) {
+	if len(s.values) == 0 {
+		if err = s.fetch(ctx); err != nil {
+			return 0, errors.Annotatef(err, "fetching values of sequence %s", s.name)
+		}
+	}
+	v, s.values = s.values[0], s.values[1:]
+
+	return v, nil
+}
+
+// fetch fetches the next block of values.
+func (s *sequenceBlock) fetch(ctx context.Context) (err error) {
+	if s.dialect == bulk.SQLServer {
+		var first, increment int64
+
+		// The range is reserved in one call, its values stepping by the
+		// sequence's increment
+		if err = s.db.QueryRowContext(ctx, `DECLARE @first sql_variant, @increment sql_variant;
+EXEC sp_sequence_get_range @sequence_name = @p1, @range_size = @p2,
+	@range_first_value = @first OUTPUT, @sequence_increment = @increment OUTPUT;
+SELECT CAST(@first AS bigint), CAST(@increment AS bigint)`, s.name, s.size).Scan(&first, &increment); err != nil {
+			return errors.Trace(err)
+		}
+		for i := 0; i < s.size; i++ {
+			s.values = append(s.values, first+int64(i)*increment)
+		}
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT nextval($1) FROM generate_series(1, $2)", s.name, s.size)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			return errors.Trace(err)
+		}
+		s.values = append(s.values, v)
+	}
+
+	return errors.Trace(rows.Err())
+}
@@ -0,0 +1,86 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// RunLock determines whether runs lock their destination table so runs
+// from other processes can't interleave with them.
+type RunLock int
+
+const (
+	LockNone RunLock = iota //Don't lock
+	LockWait                //Wait up to LockTimeout for another run to finish, forever if 0
+	LockFail                //Fail with a TableLockedError if another run holds the lock
+)
+
+// Parses a RunLock name: wait, fail or empty for none.
+func ParseRunLock(s string) (l RunLock, err error) {
+	switch s {
+	case "", "none":
+		return LockNone, nil
+	case "wait":
+		return LockWait, nil
+	case "fail":
+		return LockFail, nil
+	}
+
+	return LockNone, errors.NotValidf("run lock %q", s)
+}
+
+// lockPoll is the time between attempts to take a lock held by another
+// run.
+const lockPoll = time.Second
+
+// lockTable takes the destination's session lock on the table, with
+// Postgres and MySQL advisory locks or SQL Server application locks, and
+// returns the function releasing it. The lock is released even if the
+// context has been cancelled, so it isn't left on a pooled connection.
+func lockTable(ctx context.Context, conn *sql.Conn, cfg *Config) (release func(), err error) {
+	var got int
+
+	release = func() {}
+	if cfg.RunLock == LockNone {
+		return release, nil
+	}
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	table := d.QualifiedName(cfg.DstSchema, cfg.DstTable)
+	lock, unlock, key, err := d.LockSQL("datapipe:" + table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var deadline time.Time
+	if cfg.RunLock == LockWait && cfg.LockTimeout > 0 {
+		deadline = time.Now().Add(cfg.LockTimeout)
+	}
+
+	for {
+		if err = conn.QueryRowContext(ctx, lock, key).Scan(&got); err != nil {
+			return nil, errors.Annotatef(err, "locking %s", table)
+		}
+		if got == 1 {
+			break
+		}
+
+		if cfg.RunLock == LockFail || !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, errors.Trace(&TableLockedError{Table: table})
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		case <-time.After(lockPoll):
+		}
+	}
+
+	return func() {
+		conn.ExecContext(context.WithoutCancel(ctx), unlock, key)
+	}, nil
+}
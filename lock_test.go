@@ -0,0 +1,159 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockDriver is a database/sql driver holding advisory locks the way
+// pg_try_advisory_lock does, each connection its own session.
+type lockDriver struct {
+	mu    sync.Mutex
+	held  map[string]*lockConn
+	calls int
+}
+
+func (d *lockDriver) Open(name string) (driver.Conn, error) { return &lockConn{d: d}, nil }
+
+type lockConn struct{ d *lockDriver }
+
+func (c *lockConn) Prepare(query string) (driver.Stmt, error) { return &lockStmt{c, query}, nil }
+func (c *lockConn) Close() error                              { return nil }
+func (c *lockConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type lockStmt struct {
+	c     *lockConn
+	query string
+}
+
+func (s *lockStmt) Close() error  { return nil }
+func (s *lockStmt) NumInput() int { return -1 }
+
+func (s *lockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.d.mu.Lock()
+	defer s.c.d.mu.Unlock()
+
+	if key := args[0].(string); strings.Contains(s.query, "unlock") && s.c.d.held[key] == s.c {
+		delete(s.c.d.held, key)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *lockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.d.mu.Lock()
+	defer s.c.d.mu.Unlock()
+
+	s.c.d.calls++
+	key := args[0].(string)
+	if c := s.c.d.held[key]; c != nil && c != s.c {
+		return &lockRows{got: 0}, nil
+	}
+	s.c.d.held[key] = s.c
+	return &lockRows{got: 1}, nil
+}
+
+type lockRows struct {
+	got  int64
+	done bool
+}
+
+func (r *lockRows) Columns() []string { return []string{"got"} }
+func (r *lockRows) Close() error      { return nil }
+
+func (r *lockRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.got
+	return nil
+}
+
+func TestLockTable(t *testing.T) {
+	d := &lockDriver{held: map[string]*lockConn{}}
+	sql.Register("datapipe_lock", d)
+	db, err := sql.Open("datapipe_lock", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn1, _ := db.Conn(ctx)
+	defer conn1.Close()
+	conn2, _ := db.Conn(ctx)
+	defer conn2.Close()
+
+	cfg := &Config{DstDbDriver: "postgres", DstSchema: "public", DstTable: "orders"}
+	release, err := lockTable(ctx, conn1, cfg)
+	if err != nil || d.calls != 0 {
+		t.Fatalf("LockNone locked: %d calls, %v", d.calls, err)
+	}
+	release()
+
+	cfg.RunLock = LockFail
+	release1, err := lockTable(ctx, conn1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.held[`datapipe:"public"."orders"`] == nil {
+		t.Errorf("locks held = %v", d.held)
+	}
+
+	var locked *TableLockedError
+	if _, err = lockTable(ctx, conn2, cfg); !errors.As(err, &locked) || locked.Table != `"public"."orders"` {
+		t.Errorf("second lock error = %v", err)
+	}
+
+	// Another table isn't locked
+	other := *cfg
+	other.DstTable = "items"
+	if release2, err := lockTable(ctx, conn2, &other); err != nil {
+		t.Errorf("locking another table: %s", err)
+	} else {
+		release2()
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	cfg.RunLock = LockWait
+	if _, err = lockTable(cctx, conn2, cfg); err == nil {
+		t.Error("waiting for a lock with a cancelled context didn't fail")
+	}
+
+	// A waiting run gets the lock once it's released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		release1()
+	}()
+	release2, err := lockTable(ctx, conn2, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	if len(d.held) != 0 {
+		t.Errorf("locks held after release = %v", d.held)
+	}
+
+	if _, err = lockTable(ctx, conn1, &Config{DstDbDriver: "sqlite3", DstTable: "t", RunLock: LockFail}); err == nil {
+		t.Error("locking on SQLite didn't fail")
+	}
+}
+
+func TestParseRunLock(t *testing.T) {
+	for s, want := range map[string]RunLock{"": LockNone, "none": LockNone, "wait": LockWait, "fail": LockFail} {
+		if l, err := ParseRunLock(s); err != nil || l != want {
+			t.Errorf("ParseRunLock(%q) = %d, %v, want %d", s, l, err, want)
+		}
+	}
+	if _, err := ParseRunLock("WAIT"); err == nil {
+		t.Error("ParseRunLock(WAIT) didn't fail")
+	}
+}
@@ -0,0 +1,245 @@
+package godatapipe
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+	"github.com/xo/dburl"
+)
+
+// LookupMissing determines what happens to a value a lookup doesn't find.
+type LookupMissing int
+
+const (
+	LookupNull LookupMissing = iota //Replace the value with NULL
+	LookupKeep                      //Keep the value as it is
+	LookupSkip                      //Drop the row
+	LookupFail                      //Fail the copy
+)
+
+// Parses a LookupMissing name: null, keep, skip or fail.
+func ParseLookupMissing(s string) (m LookupMissing, err error) {
+	switch strings.ToLower(s) {
+	case "", "null":
+		return LookupNull, nil
+	case "keep":
+		return LookupKeep, nil
+	case "skip":
+		return LookupSkip, nil
+	case "fail":
+		return LookupFail, nil
+	}
+
+	return LookupNull, errors.NotValidf("lookup missing action %q", s)
+}
+
+// Default most values a lookup caches.
+const lookupCacheSize = 100000
+
+// Most values bound to one lookup query.
+const lookupQueryKeys = 500
+
+// Lookup replaces a destination column's values with those a query on
+// another database maps them to, such as natural keys to a dimension's
+// surrogate keys. The values of each batch which aren't cached are looked
+// up together. NULLs are left as they are.
+type Lookup struct {
+	Column     string  //Destination column whose values are replaced
+	Query      string  //Query returning key and value rows for the keys bound in place of {keys}, e.g. SELECT code, id FROM customers WHERE code IN ({keys})
+	DbUri      string  //Database driver URI the query runs on
+	DbPassword string  //Password, or secret reference, for DbUri
+	DB         *sql.DB //Database the query runs on, overrides DbUri
+	Driver     string  //Driver name of DB, giving its placeholders
+
+	CacheSize int           //Most values cached, the least recently used are forgotten first, defaults to 100000
+	Missing   LookupMissing //What happens to values the query doesn't return
+}
+
+// lookupEntry is a looked up value.
+type lookupEntry struct {
+	key   string
+	value interface{}
+	found bool
+}
+
+// lookupCache remembers looked up values, forgetting the least recently
+// used once it holds maxKeys of them.
+type lookupCache struct {
+	maxKeys int
+	entries map[string]*list.Element
+	order   *list.List //Most recently used first
+}
+
+func newLookupCache(maxKeys int) *lookupCache {
+	return &lookupCache{
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		order:   list.New()}
+}
+
+func (c *lookupCache) get(key string) (e *lookupEntry, ok bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+
+	return el.Value.(*lookupEntry), true
+}
+
+func (c *lookupCache) put(e *lookupEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[e.key] = c.order.PushFront(e)
+
+	if c.order.Len() > c.maxKeys {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupEntry).key)
+	}
+}
+
+// newLookupTransform returns a BatchTransform applying a lookup to the
+// column, and a function releasing its connection. Values are matched to
+// the query's keys by their text, so an integer column can be looked up
+// by a query returning its keys as strings.
+func newLookupTransform(ctx context.Context, l *Lookup, columns []string) (t BatchTransform, release func(), err error) {
+	var conn *sql.Conn
+
+	pos := indexOf(columns, l.Column)
+	if pos < 0 {
+		return nil, nil, errors.Trace(sourceColumnError(l.Column, "lookup"))
+	}
+	if !strings.Contains(l.Query, "{keys}") {
+		return nil, nil, errors.NotValidf("lookup query for %s without {keys}", l.Column)
+	}
+
+	driver := l.Driver
+	if l.DB == nil {
+		var u *dburl.URL
+		if u, err = dburl.Parse(l.DbUri); err != nil {
+			return nil, nil, errors.Annotatef(err, "lookup database for %s", l.Column)
+		}
+		driver = u.Driver
+	}
+	dialect := bulk.DialectFor(driver)
+	chunk := lookupQueryKeys
+	if n := dialect.MaxRowsPerStatement(1); n > 0 && n < chunk {
+		chunk = n
+	}
+
+	size := l.CacheSize
+	if size <= 0 {
+		size = lookupCacheSize
+	}
+	cache := newLookupCache(size)
+
+	if _, conn, release, err = connect(ctx, nil, l.DB, l.DbUri, l.DbPassword, ConnOptions{}); err != nil {
+		return nil, nil, errors.Annotatef(err, "connecting to lookup database for %s", l.Column)
+	}
+
+	// query looks up the keys, caching and returning what's found for each
+	query := func(keys []interface{}, found map[string]*lookupEntry) (err error) {
+		var rows *sql.Rows
+
+		placeholders := make([]string, len(keys))
+		for i := range keys {
+			placeholders[i] = dialect.Placeholder(i + 1)
+		}
+		q := strings.Replace(l.Query, "{keys}", strings.Join(placeholders, ", "), -1)
+		if rows, err = conn.QueryContext(ctx, q, keys...); err != nil {
+			return errors.Trace(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key, value interface{}
+			if err = rows.Scan(&key, &value); err != nil {
+				return errors.Trace(err)
+			}
+			e := &lookupEntry{key: valueText(key), value: value, found: true}
+			// Drivers may reuse the scanned bytes
+			if b, ok := value.([]byte); ok {
+				e.value = append([]byte(nil), b...)
+			}
+			found[e.key] = e
+			cache.put(e)
+		}
+		if err = rows.Err(); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Values which weren't found are cached too, so they aren't
+		// looked up again
+		for _, k := range keys {
+			if key := valueText(k); found[key] == nil {
+				found[key] = &lookupEntry{key: key}
+				cache.put(found[key])
+			}
+		}
+
+		return nil
+	}
+
+	t = func(columns []string, batch [][]interface{}) (rows [][]interface{}, err error) {
+		var keys []interface{}
+
+		// Entries are kept for the batch as the cache may forget them
+		// before it's done
+		found := map[string]*lookupEntry{}
+		for _, row := range batch {
+			if row[pos] == nil {
+				continue
+			}
+			key := valueText(row[pos])
+			if _, ok := found[key]; ok {
+				continue
+			}
+			if e, ok := cache.get(key); ok {
+				found[key] = e
+				continue
+			}
+			found[key] = nil
+			keys = append(keys, row[pos])
+		}
+		for len(keys) > 0 {
+			n := min(len(keys), chunk)
+			if err = query(keys[:n], found); err != nil {
+				return nil, errors.Annotatef(err, "looking up %s", l.Column)
+			}
+			keys = keys[n:]
+		}
+
+		rows = batch[:0]
+		for _, row := range batch {
+			if row[pos] == nil {
+				rows = append(rows, row)
+				continue
+			}
+			e := found[valueText(row[pos])]
+			switch {
+			case e.found:
+				row[pos] = e.value
+			case l.Missing == LookupNull:
+				row[pos] = nil
+			case l.Missing == LookupSkip:
+				continue
+			case l.Missing == LookupFail:
+				return nil, errors.NotFoundf("%s value %q in lookup", l.Column, e.key)
+			}
+			rows = append(rows, row)
+		}
+
+		return rows, nil
+	}
+
+	return t, release, nil
+}
@@ -0,0 +1,130 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// LoadMode determines how the copied rows replace the destination rows.
+type LoadMode int
+
+const (
+	LoadReplace LoadMode = iota //Truncate the destination table and insert the source rows
+	LoadMirror                  //Upsert the source rows and delete destination rows missing from the source
+	LoadDiff                    //Upsert only the source rows which changed since the last run
+	LoadSCD2                    //End-date the current versions of changed rows and insert new versions, as a type 2 slowly changing dimension
+)
+
+// Parses a LoadMode name: replace, mirror, diff or scd2.
+func ParseLoadMode(s string) (m LoadMode, err error) {
+	switch s {
+	case "", "replace":
+		return LoadReplace, nil
+	case "mirror":
+		return LoadMirror, nil
+	case "diff":
+		return LoadDiff, nil
+	case "scd2":
+		return LoadSCD2, nil
+	}
+
+	return LoadReplace, errors.NotValidf("load mode %q", s)
+}
+
+// runMirror copies the source rows into a temporary staging table, then
+// in one transaction upserts them into the destination table and deletes
+// the destination rows whose keys weren't staged. The destination stays
+// readable throughout, unlike a truncate and reload.
+func runMirror(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config, res *Result, stop <-chan struct{}) (err error) {
+	var keys, columns []string
+	var qs []string
+	var q string
+	var tx *sql.Tx
+	var del sql.Result
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	if keys, err = mirrorKeys(ctx, dstConn, cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	stage := "datapipe_stage"
+	if d == bulk.SQLServer {
+		stage = "#" + stage
+	}
+
+	if qs, err = d.CreateStageSQL(cfg.DstSchema, cfg.DstTable, stage); err != nil {
+		return errors.Trace(err)
+	}
+	for _, q := range qs {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotate(err, "creating staging table")
+		}
+	}
+	defer dstConn.ExecContext(context.WithoutCancel(ctx), qs[0])
+
+	if columns, err = copyTable(ctx, srcConn, nil, dstConn, cfg, d.StageSchema(), stage, res, stop); err != nil {
+		return errors.Trace(err)
+	}
+
+	if res.Interrupted && cfg.StopPolicy == StopRollback {
+		return nil
+	}
+
+	// The staging table was copied from the destination so it has the
+	// destination's spelling of the column names.
+	if columns, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, columns); err != nil {
+		return errors.Trace(err)
+	}
+	if keys, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, keys); err != nil {
+		return errors.Trace(err)
+	}
+
+	if tx, err = dstConn.BeginTx(ctx, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	if q, err = d.MergeSQL(cfg.DstSchema, cfg.DstTable, stage, columns, keys); err != nil {
+		tx.Rollback()
+		return errors.Trace(err)
+	}
+	if _, err = tx.ExecContext(ctx, q); err != nil {
+		tx.Rollback()
+		return errors.Annotate(err, "merging staged rows")
+	}
+
+	// A partial copy can't tell which rows are missing from the source
+	if !res.Interrupted {
+		if q, err = d.AntiJoinDeleteSQL(cfg.DstSchema, cfg.DstTable, stage, keys); err != nil {
+			tx.Rollback()
+			return errors.Trace(err)
+		}
+		if del, err = tx.ExecContext(ctx, q); err != nil {
+			tx.Rollback()
+			return errors.Annotate(err, "deleting rows missing from the source")
+		}
+		n, _ := del.RowsAffected()
+		res.DeletedRows += int(n)
+	}
+
+	return errors.Trace(tx.Commit())
+}
+
+// mirrorKeys returns the configured key columns, or the destination
+// table's primary key.
+func mirrorKeys(ctx context.Context, dstConn *sql.Conn, cfg *Config) (keys []string, err error) {
+	if len(cfg.KeyColumns) > 0 {
+		return cfg.KeyColumns, nil
+	}
+
+	if keys, err = bulk.KeyColumns(ctx, dstConn, bulk.DialectFor(cfg.DstDbDriver), cfg.DstSchema, cfg.DstTable); err != nil {
+		return nil, errors.Trace(err)
+	} else if len(keys) == 0 {
+		return nil, errors.Trace(&SchemaError{Table: cfg.DstTable, Err: errors.NotValidf("mirroring without a primary key or key columns")})
+	}
+
+	return keys, nil
+}
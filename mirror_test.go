@@ -0,0 +1,39 @@
+package godatapipe
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLoadMirror(t *testing.T) {
+	conn := openSQLite(t,
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO items VALUES (1, 'old'), (2, 'gone'), (3, 'same')")
+	cfg := &Config{DstTable: "items", LoadMode: LoadMirror, MaxRowBufSz: 2}
+
+	res := copyToSQLite(t, cfg, conn, []string{"id", "name"}, [][]interface{}{
+		{int64(1), "new"},
+		{int64(3), "same"},
+		{int64(4), "added"}})
+	if res.RowCount != 3 || res.DeletedRows != 1 {
+		t.Errorf("copied %d rows, deleted %d", res.RowCount, res.DeletedRows)
+	}
+
+	want := [][]interface{}{{int64(1), "new"}, {int64(3), "same"}, {int64(4), "added"}}
+	if got := queryRows(t, conn, "SELECT id, name FROM items ORDER BY id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("items = %v, want %v", got, want)
+	}
+}
+
+func TestLoadMirrorWithoutKeys(t *testing.T) {
+	conn := openSQLite(t, "CREATE TABLE items (id INTEGER, name TEXT)")
+	cfg := &Config{Source: &sliceSource{columns: []string{"id", "name"}},
+		DstConn: conn, DstDbDriver: "sqlite", DstTable: "items", LoadMode: LoadMirror, MaxRowBufSz: 2}
+
+	var se *SchemaError
+	if _, err := NewPipeline(cfg).Run(context.Background()); !errors.As(err, &se) {
+		t.Errorf("mirroring without keys: %v", err)
+	}
+}
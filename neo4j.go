@@ -0,0 +1,265 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Times a transaction Neo4j failed with a transient error is retried.
+const neo4jRetries = 5
+
+// neo4jDriver merges rows into Neo4j as nodes or relationships through
+// its HTTP API. URIs are neo4j+http://[user[:password]@]host:7474[/database],
+// or neo4j+https://, whose password, or password query parameter, can be a
+// secret reference, with query parameters describing the mapping:
+//
+//   - label and key, a node's label and the properties it's merged on
+//   - or type, from and to, a relationship's type and the nodes it joins
+//     such as Person:id=person_id, which are merged on those properties
+//   - props, the properties set from the other columns, all of them by
+//     default
+//
+// Properties are property=column, or column for one of the same name.
+type neo4jDriver struct{}
+
+func (neo4jDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from Neo4j")
+}
+
+func (neo4jDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	scheme := "http"
+	if u.Scheme == "neo4j+https" {
+		scheme = "https"
+	}
+	database := strings.Trim(u.Path, "/")
+	if database == "" {
+		database = "neo4j"
+	}
+
+	q := u.Query()
+	n := &neo4jWriter{url: scheme + "://" + u.Host + "/db/" + url.PathEscape(database) + "/tx/commit"}
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = q.Get("password")
+		}
+		if password, err = ResolveSecret(ctx, password); err != nil {
+			return nil, errors.Trace(err)
+		}
+		n.user, n.password = u.User.Username(), password
+	}
+
+	n.props = neo4jProperties(q.Get("props"))
+	switch {
+	case q.Get("label") != "" && q.Get("type") == "":
+		if n.key = neo4jProperties(q.Get("key")); len(n.key) == 0 {
+			return nil, errors.NotValidf("Neo4j node without key properties")
+		}
+		n.cypher = "UNWIND $rows AS row MERGE (n:" + neo4jName(q.Get("label")) + " " + neo4jMap(n.key, "row.k") + ") SET n += row.p"
+	case q.Get("type") != "" && q.Get("label") == "":
+		fromLabel, from, ok1 := strings.Cut(q.Get("from"), ":")
+		toLabel, to, ok2 := strings.Cut(q.Get("to"), ":")
+		if n.from, n.to = neo4jProperties(from), neo4jProperties(to); !ok1 || !ok2 || len(n.from) == 0 || len(n.to) == 0 {
+			return nil, errors.NotValidf("Neo4j relationship from %q to %q, expected Label:property=column", q.Get("from"), q.Get("to"))
+		}
+		n.cypher = "UNWIND $rows AS row MERGE (a:" + neo4jName(fromLabel) + " " + neo4jMap(n.from, "row.f") + ")" +
+			" MERGE (b:" + neo4jName(toLabel) + " " + neo4jMap(n.to, "row.t") + ")" +
+			" MERGE (a)-[r:" + neo4jName(q.Get("type")) + "]->(b) SET r += row.p"
+	default:
+		return nil, errors.NotValidf("Neo4j URI without either a label or a relationship type")
+	}
+
+	return n, nil
+}
+
+// neo4jProperty is a property set from a column.
+type neo4jProperty struct {
+	name   string
+	column string
+}
+
+// neo4jProperties parses a comma separated list of property=column, or
+// column for one of the same name.
+func neo4jProperties(s string) (props []neo4jProperty) {
+	for _, item := range splitList(s) {
+		name, column, ok := strings.Cut(item, "=")
+		if !ok {
+			column = name
+		}
+		props = append(props, neo4jProperty{name: strings.TrimSpace(name), column: strings.TrimSpace(column)})
+	}
+
+	return props
+}
+
+// neo4jName returns a label, type or property name quoted for Cypher.
+func neo4jName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// neo4jMap returns a map literal of the properties, whose values are the
+// prefix's numbered entries.
+func neo4jMap(props []neo4jProperty, prefix string) string {
+	var entries []string
+	for i, p := range props {
+		entries = append(entries, fmt.Sprintf("%s: %s%d", neo4jName(p.name), prefix, i))
+	}
+
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// neo4jWriter merges each record batch's rows in a transaction of its own.
+type neo4jWriter struct {
+	url      string
+	user     string
+	password string
+	cypher   string
+
+	key   []neo4jProperty //A node's merge properties
+	from  []neo4jProperty //A relationship's start node's merge properties
+	to    []neo4jProperty //A relationship's end node's merge properties
+	props []neo4jProperty //Properties set, by default the columns not merged on
+}
+
+// neo4jError is an error in a Neo4j response.
+type neo4jError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *neo4jError) Error() string {
+	return fmt.Sprintf("neo4j: %s: %s", e.Code, e.Message)
+}
+
+func (n *neo4jWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	at := map[string]int{}
+	for i, f := range b.Fields {
+		at[strings.ToLower(f.Name)] = i
+	}
+	index := func(props []neo4jProperty) (columns []int, err error) {
+		for _, p := range props {
+			i, ok := at[strings.ToLower(p.column)]
+			if !ok {
+				return nil, errors.Trace(sourceColumnError(p.column, "Neo4j property "+p.name))
+			}
+			columns = append(columns, i)
+		}
+		return columns, nil
+	}
+
+	var key, from, to, props []int
+	if key, err = index(n.key); err != nil {
+		return errors.Trace(err)
+	}
+	if from, err = index(n.from); err != nil {
+		return errors.Trace(err)
+	}
+	if to, err = index(n.to); err != nil {
+		return errors.Trace(err)
+	}
+	names := n.props
+	if len(names) == 0 {
+		merged := map[int]bool{}
+		for _, i := range append(append(append([]int{}, key...), from...), to...) {
+			merged[i] = true
+		}
+		for i, f := range b.Fields {
+			if !merged[i] {
+				names = append(names, neo4jProperty{name: f.Name, column: f.Name})
+			}
+		}
+	}
+	if props, err = index(names); err != nil {
+		return errors.Trace(err)
+	}
+
+	rows := make([]map[string]interface{}, b.NumRows)
+	row := make([]interface{}, len(b.Fields))
+	for r := range rows {
+		row = b.Row(r, row)
+		entry := map[string]interface{}{}
+		for prefix, columns := range map[string][]int{"k": key, "f": from, "t": to} {
+			for i, c := range columns {
+				entry[fmt.Sprint(prefix, i)] = fileJSONValue(row[c])
+			}
+		}
+		p := map[string]interface{}{}
+		for i, c := range props {
+			p[names[i].name] = fileJSONValue(row[c])
+		}
+		entry["p"] = p
+		rows[r] = entry
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"statements": []interface{}{
+		map[string]interface{}{"statement": n.cypher, "parameters": map[string]interface{}{"rows": rows}}}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = n.commit(ctx, body); err == nil {
+			return nil
+		}
+		var ne *neo4jError
+		if !errors.As(err, &ne) || !strings.HasPrefix(ne.Code, "Neo.TransientError.") || attempt >= neo4jRetries {
+			return errors.Annotatef(err, "merging %d rows into Neo4j", b.NumRows)
+		}
+		if err = sleepBackoff(ctx, attempt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// commit runs the statements in a transaction, returning the first error
+// Neo4j reports.
+func (n *neo4jWriter) commit(ctx context.Context, body []byte) (err error) {
+	var res struct {
+		Errors []neo4jError `json:"errors"`
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if n.user != "" {
+		req.SetBasicAuth(n.user, n.password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil && resp.StatusCode/100 == 2 {
+		return errors.Trace(err)
+	}
+	if len(res.Errors) > 0 {
+		return errors.Trace(&res.Errors[0])
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("neo4j returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (n *neo4jWriter) Close() (err error) {
+	return nil
+}
@@ -0,0 +1,149 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Notifier is told the outcome of finished and failed runs.
+type Notifier interface {
+	Notify(ctx context.Context, r *Report) error
+}
+
+// NotifyOn determines which runs notifiers are told about.
+type NotifyOn int
+
+const (
+	NotifyAlways  NotifyOn = iota //Every finished or failed run
+	NotifyFailure                 //Runs which failed or were interrupted
+)
+
+// Parses a NotifyOn name: always or failure.
+func ParseNotifyOn(s string) (n NotifyOn, err error) {
+	switch s {
+	case "", "always":
+		return NotifyAlways, nil
+	case "failure":
+		return NotifyFailure, nil
+	}
+
+	return NotifyAlways, errors.NotValidf("notify on %q", s)
+}
+
+// WebhookNotifier posts the report as JSON to a URL.
+type WebhookNotifier struct {
+	URL    string      //URL or secret reference to one
+	Header http.Header //Extra request headers, such as Authorization
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	var body bytes.Buffer
+
+	if err = r.Write(&body, ReportJSON); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(postNotification(ctx, n.URL, n.Header, &body))
+}
+
+// SlackNotifier posts a summary of the report to a Slack incoming
+// webhook.
+type SlackNotifier struct {
+	WebhookURL string //URL or secret reference to one
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	body, err := json.Marshal(map[string]string{"text": r.Summary()})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(postNotification(ctx, n.WebhookURL, nil, bytes.NewReader(body)))
+}
+
+// postNotification posts a JSON body to a URL, failing on any response
+// other than 2xx.
+func postNotification(ctx context.Context, url string, header http.Header, body io.Reader) (err error) {
+	if url, err = ResolveSecret(ctx, url); err != nil {
+		return errors.Trace(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("notification returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Summary returns a few lines describing the report, listing the tables
+// which failed or were interrupted.
+func (r *Report) Summary() string {
+	var b strings.Builder
+
+	status := "finished"
+	if r.Failed > 0 {
+		status = "failed"
+	}
+	fmt.Fprintf(&b, "Copy %s: %d rows copied, %d of %d tables failed", status, r.RowCount, r.Failed, len(r.Tables))
+
+	for _, t := range r.Tables {
+		switch t.Status() {
+		case "failed":
+			fmt.Fprintf(&b, "\n%s failed: %s", t.Name, t.Error)
+		case "interrupted":
+			fmt.Fprintf(&b, "\n%s interrupted after %d rows", t.Name, t.RowCount)
+		}
+	}
+
+	return b.String()
+}
+
+// Tells the notifiers about the job results, all of them or only failed
+// or interrupted ones if on is NotifyFailure. Every notifier is tried,
+// the first error is returned.
+func Notify(ctx context.Context, notifiers []Notifier, on NotifyOn, results []JobResult) (err error) {
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	r := NewReport(results)
+	if on == NotifyFailure {
+		ok := true
+		for _, t := range r.Tables {
+			ok = ok && t.Status() == "ok"
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	for _, n := range notifiers {
+		if nerr := n.Notify(ctx, r); nerr != nil && err == nil {
+			err = errors.Annotate(nerr, "notifying")
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+package godatapipe
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// NullAction determines how NULL source values are written.
+type NullAction int
+
+const (
+	NullPassThrough NullAction = iota //Write NULL as is
+	NullDefault                       //Write NullPolicy.Default instead
+	NullError                         //Fail the copy
+)
+
+// NullPolicy determines how NULL values in a column are written. This
+// gives a clear error, or a sensible value, when copying into NOT NULL
+// destination columns.
+type NullPolicy struct {
+	Action  NullAction
+	Default interface{} //Value written in place of NULL when Action is NullDefault
+}
+
+// Parses null policies in the form "column:action[:default],..." where
+// action is one of "pass", "default" or "error". The default action needs
+// a value, which may be empty as in "column:default:".
+func ParseNullPolicies(spec string) (policies map[string]NullPolicy, err error) {
+	policies = map[string]NullPolicy{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 {
+			return nil, errors.Errorf("invalid null policy %q", entry)
+		}
+
+		var p NullPolicy
+		switch parts[1] {
+		case "pass":
+			p.Action = NullPassThrough
+		case "default":
+			p.Action = NullDefault
+			if len(parts) < 3 {
+				return nil, errors.NotValidf("null policy default for column %s without a value, use %s:default: for an empty string", parts[0], parts[0])
+			}
+			p.Default = parts[2]
+		case "error":
+			p.Action = NullError
+		default:
+			return nil, errors.Errorf("invalid null policy action %q for column %s", parts[1], parts[0])
+		}
+
+		policies[parts[0]] = p
+	}
+
+	return policies, nil
+}
+
+// newNullStage returns a stage applying the null policies, or nil if
+// none of them do anything.
+func newNullStage(policies map[string]NullPolicy, columns []string) (s stage, err error) {
+	actions := make([]NullPolicy, len(columns))
+	active := false
+
+	for name, p := range policies {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, errors.Trace(sourceColumnError(name, "null policy"))
+		}
+
+		actions[pos] = p
+		active = active || p.Action != NullPassThrough
+	}
+
+	if !active {
+		return nil, nil
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, p := range actions {
+			if values[i] != nil {
+				continue
+			}
+
+			switch p.Action {
+			case NullDefault:
+				values[i] = p.Default
+			case NullError:
+				return nil, errors.Errorf("row %d: column %s is NULL", rowNum, columns[i])
+			}
+		}
+
+		return values, nil
+	}, nil
+}
+
+// indexOf returns the position of name in columns or -1.
+func indexOf(columns []string, name string) int {
+	for i, c := range columns {
+		if c == name {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,61 @@
+package godatapipe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNullPolicies(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]NullPolicy
+		err  string
+	}{
+		{"", map[string]NullPolicy{}, ""},
+		{"a:pass", map[string]NullPolicy{"a": {Action: NullPassThrough}}, ""},
+		{"a:default:0, b:error", map[string]NullPolicy{"a": {Action: NullDefault, Default: "0"}, "b": {Action: NullError}}, ""},
+		{"a:default:", map[string]NullPolicy{"a": {Action: NullDefault, Default: ""}}, ""},
+		{"a:default:x:y", map[string]NullPolicy{"a": {Action: NullDefault, Default: "x:y"}}, ""},
+		{"a:default", nil, "without a value"},
+		{"a", nil, "invalid null policy"},
+		{"a:skip", nil, "invalid null policy action"},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNullPolicies(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseNullPolicies(%q) error = %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseNullPolicies(%q) = %v, %v, want %v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestNullPolicies(t *testing.T) {
+	columns := []string{"id", "name", "note"}
+	rows := [][]interface{}{{int64(1), nil, nil}, {int64(2), "b", "x"}}
+
+	cfg := &Config{MaxRowBufSz: 10, NullPolicies: map[string]NullPolicy{
+		"name": {Action: NullDefault, Default: "unknown"},
+		"note": {Action: NullPassThrough}}}
+	_, written, err := copyRows(t, cfg, columns, rows)
+	want := [][]interface{}{{int64(1), "unknown", nil}, {int64(2), "b", "x"}}
+	if err != nil || !reflect.DeepEqual(written, want) {
+		t.Errorf("written %v, %v, want %v", written, err, want)
+	}
+
+	cfg = &Config{MaxRowBufSz: 10, NullPolicies: map[string]NullPolicy{"note": {Action: NullError}}}
+	if _, _, err = copyRows(t, cfg, columns, rows); err == nil || !strings.Contains(err.Error(), "note") {
+		t.Errorf("NULL with the error policy: %v", err)
+	}
+
+	cfg = &Config{MaxRowBufSz: 10, NullPolicies: map[string]NullPolicy{"missing": {Action: NullError}}}
+	if _, _, err = copyRows(t, cfg, columns, rows); err == nil {
+		t.Error("policy of a missing column didn't fail")
+	}
+}
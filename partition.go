@@ -0,0 +1,449 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// partitionWriter routes each row to the child table named after its
+// PartitionColumn value, such as events_2024_05, with a writer and
+// connection per child. Tables using the database's own partitioning
+// don't need it as rows written to the parent are routed by the database.
+type partitionWriter struct {
+	ctx  context.Context
+	db   *sql.DB
+	cfg  *Config
+	opts bulk.Options
+
+	col     int    //Position of the partition column in the destination columns
+	layout  string //Time layout of child table suffixes
+	writers map[string]bulk.Writer
+	conns   []*sql.Conn
+	tables  []string //Child tables in the order they were opened
+}
+
+func newPartitionWriter(ctx context.Context, db *sql.DB, cfg *Config, opts bulk.Options) (w *partitionWriter, err error) {
+	if db == nil {
+		return nil, errors.NotSupportedf("PartitionColumn with DstConn, set DstDB or DstDbUri so each partition has a connection")
+	}
+
+	w = &partitionWriter{
+		ctx:     ctx,
+		db:      db,
+		cfg:     cfg,
+		opts:    opts,
+		layout:  cfg.PartitionLayout,
+		writers: map[string]bulk.Writer{}}
+
+	if w.layout == "" {
+		w.layout = "2006_01"
+	}
+
+	if w.col = indexOf(opts.Columns, cfg.PartitionColumn); w.col < 0 {
+		return nil, errors.Trace(&SchemaError{Table: opts.Table, Column: cfg.PartitionColumn, Err: errors.New("partition column isn't copied")})
+	}
+
+	return w, nil
+}
+
+// partitionTable returns the name of the child table holding a row with
+// the partition value: the parent table's name and the value, formatted
+// with the layout if it's a time, joined by an underscore.
+func partitionTable(table string, layout string, v interface{}) (child string, err error) {
+	var suffix string
+
+	switch t := v.(type) {
+	case nil:
+		return "", errors.NotValidf("NULL partition value")
+	case time.Time:
+		suffix = t.Format(layout)
+	case []byte:
+		suffix = string(t)
+	default:
+		suffix = fmt.Sprint(t)
+	}
+
+	// Keep the name a plain identifier
+	suffix = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, suffix)
+
+	return table + "_" + suffix, nil
+}
+
+// writer returns the writer for a child table, opening it on its own
+// connection and clearing the table first when replacing.
+func (w *partitionWriter) writer(table string) (ir bulk.Writer, err error) {
+	var conn *sql.Conn
+
+	if ir = w.writers[table]; ir != nil {
+		return ir, nil
+	}
+
+	if conn, err = w.db.Conn(w.ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	w.conns = append(w.conns, conn)
+
+	if w.cfg.LoadMode == LoadReplace {
+		c := *w.cfg
+		c.DstTable = table
+		if err = clearTable(w.ctx, conn, &c); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	opts := w.opts
+	opts.Table = table
+	if ir, err = bulk.NewWriter(w.ctx, conn, opts); err != nil {
+		return nil, errors.Annotatef(err, "opening partition %s", table)
+	}
+
+	w.writers[table] = ir
+	w.tables = append(w.tables, table)
+
+	return ir, nil
+}
+
+func (w *partitionWriter) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	var table string
+	var ir bulk.Writer
+
+	if table, err = partitionTable(w.opts.Table, w.layout, values[w.col]); err != nil {
+		return errors.Annotatef(err, "column %s", w.cfg.PartitionColumn)
+	}
+
+	if ir, err = w.writer(table); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(ir.AppendValues(ctx, values))
+}
+
+func (w *partitionWriter) Flush(ctx context.Context) (totalRowCount int, err error) {
+	for _, table := range w.tables {
+		n, err := w.writers[table].Flush(ctx)
+		if err != nil {
+			return totalRowCount, errors.Annotatef(err, "partition %s", table)
+		}
+		totalRowCount += n
+	}
+
+	return totalRowCount, nil
+}
+
+func (w *partitionWriter) Rollback() (committedRowCount int, err error) {
+	for _, table := range w.tables {
+		n, rbErr := w.writers[table].Rollback()
+		if rbErr != nil && err == nil {
+			err = errors.Annotatef(rbErr, "partition %s", table)
+		}
+		committedRowCount += n
+	}
+	w.closeConns()
+
+	return committedRowCount, err
+}
+
+func (w *partitionWriter) Close() (err error) {
+	for _, table := range w.tables {
+		if cerr := w.writers[table].Close(); cerr != nil && err == nil {
+			err = errors.Annotatef(cerr, "partition %s", table)
+		}
+	}
+	w.closeConns()
+
+	return err
+}
+
+// closeConns returns the partitions' connections to the pool.
+func (w *partitionWriter) closeConns() {
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+	w.conns = nil
+}
+
+func (w *partitionWriter) SkippedRowCount() (n int) {
+	for _, ir := range w.writers {
+		if sc, ok := ir.(bulk.SkipCounter); ok {
+			n += sc.SkippedRowCount()
+		}
+	}
+
+	return n
+}
+
+func (w *partitionWriter) Timings() (t bulk.Timings) {
+	for _, ir := range w.writers {
+		if tm, ok := ir.(bulk.Timer); ok {
+			t.Merge(tm.Timings())
+		}
+	}
+
+	return t
+}
+
+// PartitionInterval is the span of the date partitions created to hold
+// the copied rows.
+type PartitionInterval int
+
+const (
+	PartitionNone  PartitionInterval = iota //Don't create partitions
+	PartitionDay                            //A partition per day, named DstTable_2006_01_02
+	PartitionMonth                          //A partition per month, named DstTable_2006_01
+	PartitionYear                           //A partition per year, named DstTable_2006
+)
+
+// Parses a PartitionInterval name: day, month or year.
+func ParsePartitionInterval(s string) (p PartitionInterval, err error) {
+	switch strings.ToLower(s) {
+	case "":
+		return PartitionNone, nil
+	case "day", "daily":
+		return PartitionDay, nil
+	case "month", "monthly":
+		return PartitionMonth, nil
+	case "year", "yearly":
+		return PartitionYear, nil
+	}
+
+	return PartitionNone, errors.NotValidf("partition interval %q", s)
+}
+
+// start returns the start of the interval holding t.
+func (p PartitionInterval) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+
+	switch p {
+	case PartitionMonth:
+		d = 1
+	case PartitionYear:
+		m, d = time.January, 1
+	}
+
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// next returns the start of the interval after the one starting at t.
+func (p PartitionInterval) next(t time.Time) time.Time {
+	switch p {
+	case PartitionDay:
+		return t.AddDate(0, 0, 1)
+	case PartitionMonth:
+		return t.AddDate(0, 1, 0)
+	}
+
+	return t.AddDate(1, 0, 0)
+}
+
+// suffix returns the partition name suffix of the interval starting at t.
+func (p PartitionInterval) suffix(t time.Time) string {
+	switch p {
+	case PartitionDay:
+		return t.Format("2006_01_02")
+	case PartitionMonth:
+		return t.Format("2006_01")
+	}
+
+	return t.Format("2006")
+}
+
+// partitionBounds converts between times and the bound expressions of a
+// range partition key.
+type partitionBounds struct {
+	format func(t time.Time) string
+	parse  func(s string) (time.Time, error)
+}
+
+// boundsFor returns the bounds of a destination partition key, Postgres
+// and MySQL's RANGE COLUMNS taking dates and MySQL's RANGE the value of
+// TO_DAYS, UNIX_TIMESTAMP or YEAR.
+func boundsFor(d *bulk.Dialect, key string, interval PartitionInterval) (b *partitionBounds, err error) {
+	lower := strings.ToLower(key)
+	if !strings.HasPrefix(lower, "range") {
+		return nil, errors.NotSupportedf("creating partitions of a table partitioned by %s", key)
+	}
+
+	b = &partitionBounds{
+		format: func(t time.Time) string { return t.Format("'2006-01-02'") },
+		parse: func(s string) (time.Time, error) {
+			v, err := CoerceTime(strings.Trim(s, "'"))
+			if err != nil {
+				return time.Time{}, errors.Trace(err)
+			}
+			return v.(time.Time), nil
+		}}
+
+	if d != bulk.MySQL || strings.HasPrefix(lower, "range columns") {
+		return b, nil
+	}
+
+	// MySQL's RANGE partitions by an integer expression of the column
+	var fn string
+	var toTime func(n int64) time.Time
+
+	switch {
+	case strings.Contains(lower, "to_days("):
+		// TO_DAYS('1970-01-01') is 719528
+		fn, toTime = "TO_DAYS", func(n int64) time.Time { return time.Unix((n-719528)*86400, 0).UTC() }
+	case strings.Contains(lower, "unix_timestamp("):
+		fn, toTime = "UNIX_TIMESTAMP", func(n int64) time.Time { return time.Unix(n, 0).UTC() }
+	case strings.Contains(lower, "year(") && interval == PartitionYear:
+		b.format = func(t time.Time) string { return strconv.Itoa(t.Year()) }
+		toTime = func(n int64) time.Time { return time.Date(int(n), time.January, 1, 0, 0, 0, 0, time.UTC) }
+	default:
+		return nil, errors.NotSupportedf("creating partitions of a table partitioned by %s", key)
+	}
+
+	if fn != "" {
+		b.format = func(t time.Time) string { return fn + t.Format("('2006-01-02')") }
+	}
+	b.parse = func(s string) (time.Time, error) {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		return toTime(n), nil
+	}
+
+	return b, nil
+}
+
+// partitionRange returns the earliest and latest PartitionKey values of
+// the source rows, ok false if there are none.
+func partitionRange(ctx context.Context, srcConn *sql.Conn, cfg *Config) (lo time.Time, hi time.Time, ok bool, err error) {
+	var first, last interface{}
+
+	key := bulk.DialectFor(cfg.SrcDbDriver).QuoteIdent(cfg.PartitionKey)
+	q := fmt.Sprintf("SELECT MIN(%[1]s), MAX(%[1]s) FROM (%[2]s) datapipe_range", key, cfg.SrcSelectSql)
+	if err = srcConn.QueryRowContext(ctx, q, cfg.SelectArgs()...).Scan(&first, &last); err != nil {
+		return lo, hi, false, errors.Annotatef(err, "reading the range of %s", cfg.PartitionKey)
+	}
+	if first == nil || last == nil {
+		return lo, hi, false, nil
+	}
+
+	for _, p := range []struct {
+		v interface{}
+		t *time.Time
+	}{{first, &lo}, {last, &hi}} {
+		v, err := CoerceTime(p.v)
+		if err != nil {
+			return lo, hi, false, errors.Annotatef(err, "column %s", cfg.PartitionKey)
+		}
+		t, isTime := v.(time.Time)
+		if !isTime {
+			return lo, hi, false, errors.NotValidf("partition key %s of type %T", cfg.PartitionKey, v)
+		}
+		*p.t = t
+	}
+
+	return lo, hi, true, nil
+}
+
+// createPartitions adds the CreatePartitions partitions the destination
+// table is missing for the source rows' PartitionKey range, so rows aren't
+// rejected partway through the copy. Postgres gets a partition for each
+// interval not overlapping an existing one. MySQL's partitions only extend
+// past the last, which a MAXVALUE partition already covers.
+func createPartitions(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config) (err error) {
+	var key string
+	var parts []bulk.RangePartition
+	var bounds *partitionBounds
+	var lo, hi time.Time
+	var ok bool
+
+	if cfg.CreatePartitions == PartitionNone {
+		return nil
+	}
+	if cfg.PartitionKey == "" {
+		return errors.NotValidf("CreatePartitions without PartitionKey")
+	}
+	if srcConn == nil {
+		return errors.NotSupportedf("CreatePartitions without a source connection")
+	}
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	name := d.QualifiedName(cfg.DstSchema, cfg.DstTable)
+
+	if key, parts, err = bulk.RangePartitions(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Annotatef(err, "reading the partitions of %s", name)
+	}
+	if key == "" {
+		return errors.NotValidf("CreatePartitions on %s which isn't partitioned", name)
+	}
+	if bounds, err = boundsFor(d, key, cfg.CreatePartitions); err != nil {
+		return errors.Trace(err)
+	}
+
+	if lo, hi, ok, err = partitionRange(ctx, srcConn, cfg); err != nil || !ok {
+		return errors.Trace(err)
+	}
+
+	// Existing partitions' ranges, MySQL's only mattering past the last
+	type span struct{ from, to time.Time }
+	var spans []span
+	var last time.Time
+
+	for _, p := range parts {
+		var s span
+		switch {
+		case p.Default:
+			continue
+		case p.To == "MAXVALUE" && d == bulk.MySQL:
+			return nil
+		case p.To == "MAXVALUE":
+			s.to = time.Unix(1<<62, 0)
+		default:
+			if s.to, err = bounds.parse(p.To); err != nil {
+				return errors.Annotatef(err, "partition %s upper bound", p.Name)
+			}
+		}
+		switch p.From {
+		case "", "MINVALUE":
+			s.from = time.Unix(-1<<62, 0)
+		default:
+			if s.from, err = bounds.parse(p.From); err != nil {
+				return errors.Annotatef(err, "partition %s lower bound", p.Name)
+			}
+		}
+		spans = append(spans, s)
+		if s.to.After(last) {
+			last = s.to
+		}
+	}
+
+	for start := cfg.CreatePartitions.start(lo); !start.After(hi); start = cfg.CreatePartitions.next(start) {
+		end := cfg.CreatePartitions.next(start)
+
+		covered := d == bulk.MySQL && !end.After(last)
+		for _, s := range spans {
+			covered = covered || d != bulk.MySQL && start.Before(s.to) && s.from.Before(end)
+		}
+		if covered {
+			continue
+		}
+
+		child := cfg.DstTable + "_" + cfg.CreatePartitions.suffix(start)
+		q, err := d.AddPartitionSQL(cfg.DstSchema, cfg.DstTable, child, bounds.format(start), bounds.format(end))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "creating partition %s of %s", child, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package godatapipe
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// StopPolicy determines what happens to the rows read so far when a
+// pipeline is stopped before the source is exhausted.
+type StopPolicy int
+
+const (
+	StopCommit   StopPolicy = iota //Flush and commit the rows read so far
+	StopRollback                   //Roll back the open destination transaction
+)
+
+// Result describes the outcome of a pipeline run.
+type Result struct {
+	RunID     string    //UUID identifying the run
+	StartedAt time.Time //Time the run started
+
+	EstimatedRows int64 //Estimated number of source rows, 0 if not estimated
+
+	RowCount        int //Number of rows committed to the destination
+	FilteredRows    int //Number of source rows dropped by the row filters
+	DuplicateRows   int //Number of source rows dropped as duplicates
+	DeletedRows     int //Number of destination rows deleted
+	SoftDeletedRows int //Number of source rows marked as deleted
+	SkippedRows     int //Number of rows in failed batches which were skipped
+	UnchangedRows   int //Number of source rows not written as they hadn't changed since the last LoadDiff run, or whose LoadSCD2 version is current
+	ExpiredRows     int //Number of destination versions end-dated by a LoadSCD2 run
+
+	AssertionFailures map[string]int //Number of rows failing each of Config.Assertions, by the assertion's text
+
+	Watermark   string        //Highest WatermarkColumn value copied
+	Throttled   time.Duration //Time spent paused by the health probe
+	Interrupted bool          //Pipeline was stopped before the source was exhausted
+
+	ReadTime  time.Duration //Time to run the source query and prepare the copy
+	WriteTime time.Duration //Time to copy the rows to the destination
+	Timings   bulk.Timings  //Destination batch write and commit times, if the writer records them
+
+	SchemaDiff  *SchemaDiff   //Differences between the source and destination columns, if checked and any
+	ColumnStats []ColumnStats //Statistics of the values written to each destination column, if Config.ColumnStats is set
+
+	Replayed bool //Result of an earlier run with the same Config.IdempotencyKey, nothing was copied
+}
+
+// Pipeline is a single copy run which can be stopped gracefully from
+// another goroutine. A stopped pipeline can't be restarted.
+type Pipeline struct {
+	cfg *Config
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewPipeline(cfg *Config) *Pipeline {
+	return &Pipeline{
+		cfg:  cfg,
+		stop: make(chan struct{})}
+}
+
+// Copies the source rows to the destination table, then tells
+// Config.Notifiers how it went. If the pipeline is stopped the returned
+// Result is flagged as interrupted and holds the number of rows committed
+// according to Config.StopPolicy.
+func (p *Pipeline) Run(ctx context.Context) (res *Result, err error) {
+	res, err = run(ctx, p.cfg, p.stop)
+
+	job := &Job{Name: p.cfg.pipelineName(), Config: p.cfg}
+	if nerr := Notify(ctx, p.cfg.Notifiers, p.cfg.NotifyOn, []JobResult{{Job: job, Result: res, Err: err}}); nerr != nil {
+		p.cfg.emit(Event{Type: EventNotifyFailed, Err: nerr})
+	}
+
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res, nil
+}
+
+// Asks a running pipeline to stop reading at the next batch boundary.
+// Safe to call more than once.
+func (p *Pipeline) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// Stops the pipeline when one of the given signals is received,
+// defaulting to SIGINT and SIGTERM. The returned function stops
+// listening for the signals.
+func (p *Pipeline) StopOnSignal(sigs ...os.Signal) (release func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		select {
+		case <-ch:
+			p.Stop()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// stopped reports whether the stop channel has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,151 @@
+package godatapipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/joescharf/go-datapipe/bulk"
+)
+
+// sliceSource is a Source reading rows from a slice.
+type sliceSource struct {
+	columns []string
+	rows    [][]interface{}
+	pos     int
+	closed  bool
+
+	onRow func(n int) //Called with each row's number before it's returned, if set
+}
+
+func (s *sliceSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *sliceSource) Next(ctx context.Context) (values []interface{}, err error) {
+	if s.pos >= len(s.rows) {
+		return nil, io.EOF
+	}
+	s.pos++
+	if s.onRow != nil {
+		s.onRow(s.pos)
+	}
+
+	// Sources reuse their rows' slices
+	return append([]interface{}(nil), s.rows[s.pos-1]...), nil
+}
+
+func (s *sliceSource) Close() (err error) {
+	s.closed = true
+	return nil
+}
+
+// copyRows runs the pipeline from the rows to a memory sink, returning
+// the result and the rows written.
+func copyRows(t *testing.T, cfg *Config, columns []string, rows [][]interface{}) (res *Result, written [][]interface{}, err error) {
+	t.Helper()
+
+	sink := bulk.NewMemorySink()
+	cfg.Source = &sliceSource{columns: columns, rows: rows}
+	cfg.DstWriter = sink
+	if cfg.DstTable == "" {
+		cfg.DstTable = "t"
+	}
+
+	res, err = NewPipeline(cfg).Run(context.Background())
+	return res, sink.Rows(), err
+}
+
+// copyColumns runs the pipeline from the rows to a memory sink, returning
+// the destination columns and the rows written.
+func copyColumns(t *testing.T, cfg *Config, columns []string, rows [][]interface{}) (dstColumns []string, written [][]interface{}, err error) {
+	t.Helper()
+
+	sink := bulk.NewMemorySink()
+	cfg.Source = &sliceSource{columns: columns, rows: rows}
+	cfg.DstWriter = sink
+	if cfg.DstTable == "" {
+		cfg.DstTable = "t"
+	}
+
+	_, err = NewPipeline(cfg).Run(context.Background())
+	return sink.Columns(), sink.Rows(), err
+}
+
+// intRows returns n rows of a single int64 column numbered from 1.
+func intRows(n int) (rows [][]interface{}) {
+	for i := 1; i <= n; i++ {
+		rows = append(rows, []interface{}{int64(i)})
+	}
+
+	return rows
+}
+
+func TestPipelineRun(t *testing.T) {
+	rows := [][]interface{}{{int64(1), "a"}, {int64(2), "b"}}
+
+	res, written, err := copyRows(t, &Config{}, []string{"id", "name"}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RowCount != 2 || res.Interrupted || len(written) != 2 || written[1][1] != "b" {
+		t.Errorf("copied %d rows %v", res.RowCount, written)
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	tests := []struct {
+		policy  StopPolicy
+		rows    int
+		written int
+	}{
+		{StopCommit, 4, 4},
+		{StopRollback, 0, 0},
+	}
+
+	for _, tt := range tests {
+		sink := bulk.NewMemorySink()
+		src := &sliceSource{columns: []string{"id"}, rows: intRows(10)}
+		p := NewPipeline(&Config{Source: src, DstWriter: sink, DstTable: "t", MaxRowBufSz: 2, StopPolicy: tt.policy})
+
+		// Stopping mid-batch finishes the batch
+		src.onRow = func(n int) {
+			if n == 3 {
+				p.Stop()
+			}
+		}
+
+		res, err := p.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Interrupted || res.RowCount != tt.rows || len(sink.Rows()) != tt.written {
+			t.Errorf("policy %d stopped with %d rows, %d written, interrupted %t", tt.policy, res.RowCount, len(sink.Rows()), res.Interrupted)
+		}
+		if !src.closed {
+			t.Errorf("policy %d left the source open", tt.policy)
+		}
+		p.Stop()
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := bulk.NewMemorySink()
+	src := &sliceSource{columns: []string{"id"}, rows: intRows(10), onRow: func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}}
+
+	_, err := NewPipeline(&Config{Source: src, DstWriter: sink, DstTable: "t", MaxRowBufSz: 2}).Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled run error = %v", err)
+	}
+	if len(sink.Rows()) != 0 || !src.closed {
+		t.Errorf("cancelled run wrote %d rows, closed source %t", len(sink.Rows()), src.closed)
+	}
+}
@@ -0,0 +1,242 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Plan is what a run of a config will do, worked out without writing to
+// the destination so it can be checked before it's applied.
+type Plan struct {
+	RunID     string    //ID the applied run will have
+	CreatedAt time.Time //Time the plan was made, templates are rendered as of then
+
+	Config *Config //Config the run uses, with its templates rendered and sampling applied
+
+	SelectSQL     string       //Source query
+	SrcColumns    []ColumnType //Columns of the source query, empty for a custom Source or shards
+	Table         string       //Qualified destination table
+	DstColumns    []ColumnType //Columns of the destination table, empty if it doesn't exist yet
+	Statements    []string     //Statements run on the destination before the rows are copied
+	EstimatedRows int64        //Estimated number of source rows, 0 if they can't be estimated
+}
+
+// Works out what a run of the config would do: connects to the source and
+// destination, renders the config's templates, and reads the source and
+// destination columns, the statements preparing the destination and the
+// estimated number of rows. The rows are counted if Config.RowEstimate
+// isn't set. Nothing is written apart from the state table, if the
+// config's templates read state from one.
+func NewPlan(ctx context.Context, cfg *Config) (p *Plan, err error) {
+	var srcConn, dstConn *sql.Conn
+	var release func()
+
+	res := &Result{StartedAt: time.Now()}
+	if res.RunID, err = newUUID(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if cfg.Source == nil && len(cfg.SrcShards) == 0 && cfg.SrcFile == "" && cfg.SrcRecordURI == "" && cfg.SrcAPI.URL == "" || cfg.SrcConn != nil {
+		if _, srcConn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer release()
+
+		if err = execSessionSQL(ctx, srcConn, cfg.SrcSessionSQL); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if cfg.DstWriter == nil && cfg.DstFile == "" && cfg.DstRecordURI == "" && cfg.DstAPI.URL == "" || cfg.DstConn != nil || cfg.DstDB != nil {
+		if _, dstConn, release, err = connect(ctx, cfg.DstConn, cfg.DstDB, cfg.DstDbUri, cfg.DstDbPassword, cfg.DstConnOptions); err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer release()
+
+		if err = execSessionSQL(ctx, dstConn, cfg.DstSessionSQL); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if err = checkWriterOnly(cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var store StateStore
+	if store, err = openStateStore(ctx, cfg, dstConn); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if cfg, err = renderConfig(ctx, cfg, store, res); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cfg, err = sampleConfig(cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg = unquoteConfig(cfg)
+
+	c := *cfg
+	p = &Plan{
+		RunID:     res.RunID,
+		CreatedAt: res.StartedAt,
+		Config:    &c,
+		SelectSQL: c.SrcSelectSql,
+		Table:     bulk.DialectFor(c.DstDbDriver).QualifiedName(c.DstSchema, c.DstTable)}
+	c.plan = p
+
+	if srcConn != nil && cfg.Source == nil && len(cfg.SrcShards) == 0 {
+		if p.SrcColumns, err = queryColumnTypes(ctx, srcConn, cfg.SrcSelectSql, cfg.SelectArgs()...); err != nil {
+			return nil, errors.Annotate(err, "reading the source columns")
+		}
+	}
+
+	if dstConn != nil && cfg.CDCSlot == "" && cfg.PartitionColumn == "" {
+		if p.DstColumns, p.Statements, err = planTable(ctx, dstConn, cfg, p.SrcColumns); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	estimate := *cfg
+	if estimate.RowEstimate == EstimateNone {
+		estimate.RowEstimate = EstimateCount
+	}
+	if p.EstimatedRows, err = estimateSourceRows(ctx, &estimate, srcConn); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return p, nil
+}
+
+// planTable returns the destination table's columns and the statements
+// prepareTable would run on it.
+func planTable(ctx context.Context, dstConn *sql.Conn, cfg *Config, srcColumns []ColumnType) (columns []ColumnType, stmts []string, err error) {
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	if columns, err = bulk.TableColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	switch {
+	case len(columns) > 0 && cfg.LoadMode == LoadReplace:
+		if stmts, err = d.ClearTableSQL(cfg.DstSchema, cfg.DstTable, cfg.TruncateCascade, cfg.RestartIdentity); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	case len(columns) > 0, cfg.MissingTable == MissingTableSkip:
+	case cfg.MissingTable == MissingTableCreate:
+		if len(srcColumns) == 0 {
+			return nil, nil, errors.NotSupportedf("creating %s without a source connection", d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+		stmts = []string{d.CreateTableSQL(cfg.DstSchema, cfg.DstTable, srcColumns)}
+	default:
+		return nil, nil, errors.Trace(&TableNotFoundError{Table: d.QualifiedName(cfg.DstSchema, cfg.DstTable)})
+	}
+
+	var hyper []string
+	if hyper, err = hypertableSQL(cfg); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return columns, append(stmts, hyper...), nil
+}
+
+// Runs the plan, which fails without writing anything if the source or
+// destination columns have changed since it was made. The plan's Config
+// can also be run with NewPipeline to stop it gracefully.
+func Apply(ctx context.Context, p *Plan) (res *Result, err error) {
+	if res, err = NewPipeline(p.Config).Run(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res, nil
+}
+
+// check returns a SchemaError if the source or destination columns differ
+// from the plan's.
+func (p *Plan) check(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn) (err error) {
+	var columns []ColumnType
+
+	cfg := p.Config
+	if len(p.SrcColumns) > 0 {
+		if columns, err = queryColumnTypes(ctx, srcConn, cfg.SrcSelectSql, cfg.SelectArgs()...); err != nil {
+			return errors.Annotate(err, "reading the source columns")
+		}
+		if !sameColumnTypes(columns, p.SrcColumns) {
+			return errors.Trace(&SchemaError{Err: errors.New("source columns changed since the plan was made")})
+		}
+	}
+
+	if dstConn != nil && cfg.CDCSlot == "" && cfg.PartitionColumn == "" {
+		if columns, err = bulk.TableColumns(ctx, dstConn, bulk.DialectFor(cfg.DstDbDriver), cfg.DstSchema, cfg.DstTable); err != nil {
+			return errors.Trace(err)
+		}
+		if !sameColumnTypes(columns, p.DstColumns) {
+			return errors.Trace(&SchemaError{Table: p.Table, Err: errors.New("columns changed since the plan was made")})
+		}
+	}
+
+	return nil
+}
+
+// sameColumnTypes reports whether two lists of columns are the same.
+func sameColumnTypes(a []ColumnType, b []ColumnType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the plan as text for a person to check.
+func (p *Plan) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "run %s planned at %s\n", p.RunID, p.CreatedAt.Format(time.RFC3339))
+	if p.SelectSQL != "" {
+		fmt.Fprintf(&b, "\nsource query:\n  %s\n", p.SelectSQL)
+	}
+	if len(p.SrcColumns) > 0 {
+		fmt.Fprintf(&b, "\nsource columns:\n")
+		writeColumns(&b, p.SrcColumns)
+	}
+
+	fmt.Fprintf(&b, "\ndestination %s", p.Table)
+	if len(p.DstColumns) == 0 {
+		fmt.Fprintf(&b, " doesn't exist\n")
+	} else {
+		fmt.Fprintf(&b, " columns:\n")
+		writeColumns(&b, p.DstColumns)
+	}
+
+	if len(p.Statements) > 0 {
+		fmt.Fprintf(&b, "\nstatements run before copying:\n")
+		for _, q := range p.Statements {
+			fmt.Fprintf(&b, "  %s;\n", q)
+		}
+	}
+
+	if p.EstimatedRows > 0 {
+		fmt.Fprintf(&b, "\nabout %d rows to copy\n", p.EstimatedRows)
+	}
+
+	return b.String()
+}
+
+// writeColumns writes a column per line with its type.
+func writeColumns(b *strings.Builder, columns []ColumnType) {
+	for _, c := range columns {
+		null := ""
+		if !c.Nullable {
+			null = " not null"
+		}
+		fmt.Fprintf(b, "  %s %s%s\n", c.Name, c.DatabaseType, null)
+	}
+}
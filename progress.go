@@ -0,0 +1,118 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// RowEstimate is how the number of source rows is estimated before a
+// copy, for reporting progress.
+type RowEstimate int
+
+const (
+	EstimateNone  RowEstimate = iota //Don't estimate
+	EstimateCount                    //Count the select's rows
+	EstimateStats                    //Read SrcTable's row count from the database statistics
+)
+
+// Parses a ROW_ESTIMATE value: count, stats or empty for none.
+func ParseRowEstimate(s string) (e RowEstimate, err error) {
+	switch s {
+	case "", "none":
+		return EstimateNone, nil
+	case "count":
+		return EstimateCount, nil
+	case "stats":
+		return EstimateStats, nil
+	}
+
+	return EstimateNone, errors.NotValidf("row estimate %q", s)
+}
+
+// Progress is how far a running copy has got.
+type Progress struct {
+	RowsRead      int           //Source rows read so far
+	EstimatedRows int64         //Estimated source rows, 0 if unknown
+	Elapsed       time.Duration //Time since the copy started
+}
+
+// Returns the percentage of the estimated rows read, or -1 if there's no
+// estimate.
+func (p Progress) Percent() float64 {
+	if p.EstimatedRows <= 0 {
+		return -1
+	}
+
+	return min(100, float64(p.RowsRead)*100/float64(p.EstimatedRows))
+}
+
+// Returns the estimated time left at the rate read so far, or -1 if it
+// can't be estimated.
+func (p Progress) ETA() time.Duration {
+	if p.EstimatedRows <= 0 || p.RowsRead == 0 {
+		return -1
+	}
+
+	left := max(0, p.EstimatedRows-int64(p.RowsRead))
+	return time.Duration(float64(p.Elapsed) * float64(left) / float64(p.RowsRead))
+}
+
+// progressReporter emits progress events at most once an interval.
+type progressReporter struct {
+	cfg      *Config
+	res      *Result
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+}
+
+func newProgressReporter(cfg *Config, res *Result) *progressReporter {
+	if cfg.ProgressInterval <= 0 || cfg.OnEvent == nil {
+		return nil
+	}
+
+	now := time.Now()
+	return &progressReporter{cfg: cfg, res: res, interval: cfg.ProgressInterval, start: now, last: now}
+}
+
+// report emits a progress event if the interval has passed.
+func (p *progressReporter) report(rowsRead int) {
+	if p == nil || time.Since(p.last) < p.interval {
+		return
+	}
+	p.last = time.Now()
+
+	p.cfg.emit(Event{
+		Type:  EventProgress,
+		RunID: p.res.RunID,
+		Progress: &Progress{
+			RowsRead:      rowsRead,
+			EstimatedRows: p.res.EstimatedRows,
+			Elapsed:       time.Since(p.start)}})
+}
+
+// estimateSourceRows estimates the number of rows the copy reads. Sources
+// which can't be estimated give 0.
+func estimateSourceRows(ctx context.Context, cfg *Config, srcConn *sql.Conn) (rows int64, err error) {
+	switch cfg.RowEstimate {
+	case EstimateCount:
+		if srcConn == nil || cfg.Source != nil {
+			return 0, nil
+		}
+
+		q := fmt.Sprintf("SELECT COUNT(*) FROM (%s) datapipe_count", cfg.SrcSelectSql)
+		if err = srcConn.QueryRowContext(ctx, q, cfg.SelectArgs()...).Scan(&rows); err != nil {
+			return 0, errors.Annotate(err, "counting source rows")
+		}
+	case EstimateStats:
+		if rows, err = estimateRows(ctx, cfg); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return rows, nil
+}
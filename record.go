@@ -0,0 +1,483 @@
+package godatapipe
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// ArrowType is the Apache Arrow type of a record batch column. Record
+// batches keep Arrow's memory layout, validity bitmaps and value, offset
+// and data buffers, so their buffers can be handed to Arrow libraries
+// without copying the values. Decimals are kept as text.
+type ArrowType int
+
+const (
+	ArrowUtf8      ArrowType = iota //Offsets into UTF-8 data
+	ArrowInt64                      //Little endian int64 values
+	ArrowFloat64                    //Little endian float64 values
+	ArrowBoolean                    //Bitmap of values
+	ArrowBinary                     //Offsets into binary data
+	ArrowTimestamp                  //Microseconds since the Unix epoch in UTC, as int64 values
+)
+
+var arrowTypeNames = []string{"utf8", "int64", "float64", "bool", "binary", "timestamp[us, tz=UTC]"}
+
+func (t ArrowType) String() string {
+	return arrowTypeNames[t]
+}
+
+// Field is a record batch column.
+type Field struct {
+	Name     string
+	Type     ArrowType
+	Nullable bool
+}
+
+// Returns the record batch fields for the column types.
+func ArrowSchema(types []ColumnType) (fields []Field) {
+	for _, ct := range types {
+		f := Field{Name: ct.Name, Nullable: ct.Nullable}
+		switch bulk.Family(ct.DatabaseType) {
+		case bulk.FamilyInt:
+			f.Type = ArrowInt64
+		case bulk.FamilyFloat:
+			f.Type = ArrowFloat64
+		case bulk.FamilyBool:
+			f.Type = ArrowBoolean
+		case bulk.FamilyDate, bulk.FamilyTime:
+			f.Type = ArrowTimestamp
+		case bulk.FamilyBinary, bulk.FamilyGeometry:
+			f.Type = ArrowBinary
+		}
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// Array is a column of a record batch, with Arrow's buffers. Values holds
+// the int64, float64 and timestamp values little endian, and the bitmap of
+// boolean values. Offsets and Data hold utf8 and binary values.
+type Array struct {
+	Type      ArrowType
+	Len       int
+	NullCount int
+	Validity  []byte //Bitmap of the values which aren't NULL
+	Values    []byte
+	Offsets   []int32
+	Data      []byte
+}
+
+// Returns whether the value at i is NULL.
+func (a *Array) IsNull(i int) bool {
+	return a.Validity[i>>3]&(1<<(i&7)) == 0
+}
+
+// Returns the value at i as a database row value: int64, float64, bool,
+// string, []byte, time.Time or nil.
+func (a *Array) Value(i int) interface{} {
+	if a.IsNull(i) {
+		return nil
+	}
+
+	switch a.Type {
+	case ArrowInt64:
+		return int64(binary.LittleEndian.Uint64(a.Values[i*8:]))
+	case ArrowFloat64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(a.Values[i*8:]))
+	case ArrowBoolean:
+		return a.Values[i>>3]&(1<<(i&7)) != 0
+	case ArrowTimestamp:
+		return time.UnixMicro(int64(binary.LittleEndian.Uint64(a.Values[i*8:]))).UTC()
+	case ArrowBinary:
+		return append([]byte{}, a.Data[a.Offsets[i]:a.Offsets[i+1]]...)
+	}
+
+	return string(a.Data[a.Offsets[i]:a.Offsets[i+1]])
+}
+
+// append adds a value, converting it to the array's type.
+func (a *Array) append(v interface{}) (err error) {
+	if a.Len%8 == 0 {
+		a.Validity = append(a.Validity, 0)
+		if a.Type == ArrowBoolean {
+			a.Values = append(a.Values, 0)
+		}
+	}
+	if a.Offsets == nil && (a.Type == ArrowUtf8 || a.Type == ArrowBinary) {
+		a.Offsets = append(a.Offsets, 0)
+	}
+
+	if v != nil {
+		a.Validity[a.Len>>3] |= 1 << (a.Len & 7)
+		if err = a.appendValue(v); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		a.NullCount++
+		switch a.Type {
+		case ArrowInt64, ArrowFloat64, ArrowTimestamp:
+			a.Values = binary.LittleEndian.AppendUint64(a.Values, 0)
+		}
+	}
+	if a.Offsets != nil {
+		a.Offsets = append(a.Offsets, int32(len(a.Data)))
+	}
+
+	a.Len++
+	return nil
+}
+
+func (a *Array) appendValue(v interface{}) (err error) {
+	switch a.Type {
+	case ArrowInt64:
+		var i int64
+		if i, err = recordInt(v); err != nil {
+			return errors.Trace(err)
+		}
+		a.Values = binary.LittleEndian.AppendUint64(a.Values, uint64(i))
+	case ArrowFloat64:
+		var f float64
+		if f, err = recordFloat(v); err != nil {
+			return errors.Trace(err)
+		}
+		a.Values = binary.LittleEndian.AppendUint64(a.Values, math.Float64bits(f))
+	case ArrowBoolean:
+		var b bool
+		if b, err = recordBool(v); err != nil {
+			return errors.Trace(err)
+		}
+		if b {
+			a.Values[a.Len>>3] |= 1 << (a.Len & 7)
+		}
+	case ArrowTimestamp:
+		var t time.Time
+		if t, err = recordTime(v); err != nil {
+			return errors.Trace(err)
+		}
+		a.Values = binary.LittleEndian.AppendUint64(a.Values, uint64(t.UnixMicro()))
+	case ArrowBinary:
+		if b, ok := v.([]byte); ok {
+			a.Data = append(a.Data, b...)
+		} else {
+			a.Data = append(a.Data, valueText(v)...)
+		}
+	default:
+		if t, ok := v.(time.Time); ok {
+			a.Data = t.AppendFormat(a.Data, time.RFC3339Nano)
+		} else {
+			a.Data = append(a.Data, valueText(v)...)
+		}
+	}
+	if len(a.Data) > math.MaxInt32 {
+		return errors.Errorf("record batch column holds more than 2GiB")
+	}
+
+	return nil
+}
+
+func recordInt(v interface{}) (i int64, err error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int8:
+		return int64(t), nil
+	case uint32:
+		return int64(t), nil
+	case uint16:
+		return int64(t), nil
+	case uint8:
+		return int64(t), nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	if i, err = strconv.ParseInt(valueText(v), 10, 64); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return i, nil
+}
+
+func recordBool(v interface{}) (b bool, err error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case int64:
+		return t != 0, nil
+	}
+
+	if b, err = strconv.ParseBool(valueText(v)); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return b, nil
+}
+
+func recordFloat(v interface{}) (f float64, err error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	}
+
+	if f, err = strconv.ParseFloat(valueText(v), 64); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return f, nil
+}
+
+func recordTime(v interface{}) (t time.Time, err error) {
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+
+	s := valueText(v)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", time.DateOnly} {
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errors.NotValidf("timestamp %q", s)
+}
+
+// RecordBatch is a batch of rows held by column.
+type RecordBatch struct {
+	Fields  []Field
+	Columns []*Array
+	NumRows int
+}
+
+// Returns a record batch of the rows, whose values are converted to the
+// fields' types.
+func NewRecordBatch(fields []Field, rows [][]interface{}) (b *RecordBatch, err error) {
+	b = newRecordBatch(fields)
+	for _, row := range rows {
+		if err = b.appendRow(row); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return b, nil
+}
+
+func newRecordBatch(fields []Field) *RecordBatch {
+	b := &RecordBatch{Fields: fields, Columns: make([]*Array, len(fields))}
+	for i, f := range fields {
+		b.Columns[i] = &Array{Type: f.Type}
+	}
+
+	return b
+}
+
+func (b *RecordBatch) appendRow(row []interface{}) (err error) {
+	if len(row) != len(b.Fields) {
+		return errors.Errorf("row has %d values for %d fields", len(row), len(b.Fields))
+	}
+
+	for i, v := range row {
+		if err = b.Columns[i].append(v); err != nil {
+			return errors.Annotatef(err, "column %s", b.Fields[i].Name)
+		}
+	}
+
+	b.NumRows++
+	return nil
+}
+
+// Returns the row at i, reusing values if it's long enough.
+func (b *RecordBatch) Row(i int, values []interface{}) []interface{} {
+	if len(values) != len(b.Columns) {
+		values = make([]interface{}, len(b.Columns))
+	}
+	for c, a := range b.Columns {
+		values[c] = a.Value(i)
+	}
+
+	return values
+}
+
+// Returns the rows of the batch.
+func (b *RecordBatch) Rows() (rows [][]interface{}) {
+	rows = make([][]interface{}, b.NumRows)
+	for i := range rows {
+		rows[i] = b.Row(i, nil)
+	}
+
+	return rows
+}
+
+// RecordReader is a source of record batches, such as an Arrow-native
+// engine. Use NewRecordSource to read its rows in a pipeline.
+type RecordReader interface {
+	Fields() (fields []Field, err error)
+	NextRecord(ctx context.Context) (b *RecordBatch, err error) //Returns io.EOF after the last batch
+	Close() (err error)
+}
+
+// RecordWriter is a destination taking record batches, such as an
+// Arrow-native engine. Use NewRecordInsert to write rows to it.
+type RecordWriter interface {
+	WriteRecord(ctx context.Context, b *RecordBatch) (err error)
+	Close() (err error)
+}
+
+// recordSource reads the rows of a RecordReader's batches.
+type recordSource struct {
+	r      RecordReader
+	fields []Field
+	batch  *RecordBatch
+	row    int
+	values []interface{}
+}
+
+// Returns a Source reading the rows of the record batches.
+func NewRecordSource(r RecordReader) (src Source, err error) {
+	s := &recordSource{r: r}
+	if s.fields, err = r.Fields(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+func (s *recordSource) Columns() (columns []string, err error) {
+	for _, f := range s.fields {
+		columns = append(columns, f.Name)
+	}
+
+	return columns, nil
+}
+
+func (s *recordSource) ColumnTypes() (types []ColumnType, err error) {
+	for _, f := range s.fields {
+		types = append(types, ColumnType{Name: f.Name, DatabaseType: snapshotKindType[arrowKinds[f.Type]], Nullable: f.Nullable})
+	}
+
+	return types, nil
+}
+
+// Snapshot kinds of the Arrow types, for their database types.
+var arrowKinds = map[ArrowType]string{
+	ArrowUtf8: "string", ArrowInt64: "int", ArrowFloat64: "float",
+	ArrowBoolean: "bool", ArrowBinary: "bytes", ArrowTimestamp: "time"}
+
+func (s *recordSource) Next(ctx context.Context) (values []interface{}, err error) {
+	for s.batch == nil || s.row >= s.batch.NumRows {
+		if s.batch, err = s.r.NextRecord(ctx); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.row = 0
+	}
+
+	s.values = s.batch.Row(s.row, s.values)
+	s.row++
+
+	return s.values, nil
+}
+
+func (s *recordSource) Close() (err error) {
+	return errors.Trace(s.r.Close())
+}
+
+// recordInsert collects rows into record batches for a RecordWriter.
+type recordInsert struct {
+	w         RecordWriter
+	fields    []Field
+	batchRows int
+	batch     *RecordBatch
+	rows      int //Rows written
+}
+
+// Returns an Insert writing rows to the RecordWriter in batches of up to
+// batchRows rows with the fields' types. The fields' names are replaced
+// by the pipeline's columns.
+func NewRecordInsert(w RecordWriter, fields []Field, batchRows int) Insert {
+	if batchRows <= 0 {
+		batchRows = 10000
+	}
+
+	return &recordInsert{w: w, fields: fields, batchRows: batchRows}
+}
+
+// Sets the column names, called by the pipeline before the first row.
+// Columns without a field are utf8.
+func (r *recordInsert) SetColumns(columns []string) {
+	fields := make([]Field, len(columns))
+	for i, name := range columns {
+		fields[i] = Field{Name: name, Nullable: true}
+		for _, f := range r.fields {
+			if f.Name == name {
+				fields[i] = f
+			}
+		}
+	}
+	r.fields = fields
+}
+
+func (r *recordInsert) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	if r.batch == nil {
+		r.batch = newRecordBatch(r.fields)
+	}
+	if err = r.batch.appendRow(values); err != nil {
+		return errors.Trace(err)
+	}
+	if r.batch.NumRows >= r.batchRows {
+		_, err = r.Flush(ctx)
+	}
+
+	return errors.Trace(err)
+}
+
+func (r *recordInsert) Flush(ctx context.Context) (totalRowCount int, err error) {
+	if r.batch != nil && r.batch.NumRows > 0 {
+		if err = r.w.WriteRecord(ctx, r.batch); err != nil {
+			return r.rows, errors.Trace(err)
+		}
+		r.rows += r.batch.NumRows
+	}
+	r.batch = nil
+
+	return r.rows, nil
+}
+
+// Rollback drops the rows not yet written, as written batches can't be
+// taken back.
+func (r *recordInsert) Rollback() (committedRowCount int, err error) {
+	r.batch = nil
+	return r.rows, nil
+}
+
+func (r *recordInsert) Close() (err error) {
+	if _, err = r.Flush(context.Background()); err != nil {
+		r.w.Close()
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(r.w.Close())
+}
@@ -0,0 +1,276 @@
+package godatapipe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// redisConn is a minimal Redis client speaking RESP over a single
+// connection. It isn't safe for concurrent use.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialRedis connects to a redis://[user:password@]host[:port][/db] URL.
+func dialRedis(ctx context.Context, uri string) (c *redisConn, err error) {
+	var u *url.URL
+	var d net.Dialer
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.NotValidf("redis URL %q", uri)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	c = &redisConn{}
+	if c.conn, err = d.DialContext(ctx, "tcp", addr); err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.r = bufio.NewReader(c.conn)
+	c.w = bufio.NewWriter(c.conn)
+
+	if u.User != nil {
+		args := []string{"AUTH"}
+		if u.User.Username() != "" {
+			args = append(args, u.User.Username())
+		}
+		password, _ := u.User.Password()
+		if _, err = c.do(append(args, password)...); err != nil {
+			c.Close()
+			return nil, errors.Annotate(err, "redis auth")
+		}
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err = c.do("SELECT", db); err != nil {
+			c.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return c, nil
+}
+
+// do sends a command and returns its reply, which is nil, a string, an
+// int64 or a []interface{} of replies.
+func (c *redisConn) do(args ...string) (reply interface{}, err error) {
+	c.send(args...)
+	if err = c.w.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return c.readReply()
+}
+
+// pipeline sends the commands together, then reads all their replies,
+// returning the first error.
+func (c *redisConn) pipeline(cmds [][]string) (err error) {
+	for _, args := range cmds {
+		c.send(args...)
+	}
+	if err = c.w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+
+	for range cmds {
+		if _, rerr := c.readReply(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return errors.Trace(err)
+}
+
+// send buffers a command.
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func (c *redisConn) readReply() (reply interface{}, err error) {
+	var line string
+
+	if line, err = c.r.ReadString('\n'); err != nil {
+		return nil, errors.Trace(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.Errorf("redis: %s", line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		return n, errors.Trace(err)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		} else if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		} else if n < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return replies, nil
+	}
+
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisConn) Close() (err error) {
+	return errors.Trace(c.conn.Close())
+}
+
+// redisDriver writes rows as Redis hashes. URIs are
+// redis://[user:password@]host[:port][/db] with query parameters: key, a
+// template naming each row's key such as customer:{id}, whose {column}s
+// are replaced by the row's values, and optionally ttl, a duration after
+// which the keys expire.
+type redisDriver struct{}
+
+func (redisDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from Redis")
+}
+
+func (redisDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r := &redisWriter{key: u.Query().Get("key")}
+	if r.key == "" {
+		return nil, errors.NotValidf("Redis URI without a key template")
+	}
+	if ttl := u.Query().Get("ttl"); ttl != "" {
+		var d time.Duration
+		if d, err = time.ParseDuration(ttl); err != nil || d < time.Millisecond {
+			return nil, errors.NotValidf("Redis ttl %q", ttl)
+		}
+		r.ttl = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+
+	u.RawQuery = ""
+	if r.conn, err = dialRedis(ctx, u.String()); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return r, nil
+}
+
+// redisWriter replaces a hash for each row, a batch at a time in one
+// pipelined transaction.
+type redisWriter struct {
+	conn *redisConn
+	key  string //Key template
+	ttl  string //Milliseconds the keys live for, or empty
+}
+
+func (r *redisWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	var parts []string
+	var columns []int
+
+	// The template's literal text alternates with its columns' positions
+	rest := r.key
+	for {
+		before, after, ok := strings.Cut(rest, "{")
+		if !ok {
+			parts = append(parts, rest)
+			break
+		}
+		name, after, ok := strings.Cut(after, "}")
+		if !ok {
+			return errors.NotValidf("Redis key template %q", r.key)
+		}
+		pos := -1
+		for i, f := range b.Fields {
+			if strings.EqualFold(f.Name, name) {
+				pos = i
+			}
+		}
+		if pos < 0 {
+			return errors.Trace(sourceColumnError(name, "Redis key"))
+		}
+		parts, columns, rest = append(parts, before), append(columns, pos), after
+	}
+
+	cmds := [][]string{{"MULTI"}}
+	row := make([]interface{}, len(b.Fields))
+	for i := 0; i < b.NumRows; i++ {
+		row = b.Row(i, row)
+
+		var key strings.Builder
+		for p, part := range parts {
+			key.WriteString(part)
+			if p < len(columns) {
+				key.WriteString(fileText(row[columns[p]]))
+			}
+		}
+
+		hset := []string{"HSET", key.String()}
+		for c, v := range row {
+			if v != nil {
+				hset = append(hset, b.Fields[c].Name, fileText(v))
+			}
+		}
+
+		cmds = append(cmds, []string{"DEL", key.String()})
+		if len(hset) > 2 {
+			cmds = append(cmds, hset)
+			if r.ttl != "" {
+				cmds = append(cmds, []string{"PEXPIRE", key.String(), r.ttl})
+			}
+		}
+	}
+	cmds = append(cmds, []string{"EXEC"})
+
+	if err = r.conn.pipeline(cmds); err != nil {
+		return errors.Annotate(err, "writing Redis hashes")
+	}
+
+	return nil
+}
+
+func (r *redisWriter) Close() (err error) {
+	return errors.Trace(r.conn.Close())
+}
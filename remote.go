@@ -0,0 +1,219 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/juju/errors"
+)
+
+// isRemotePath returns whether a file path is an sftp://, ftps:// or
+// ftp:// URL of a file on a server.
+func isRemotePath(path string) bool {
+	scheme, _, ok := strings.Cut(path, "://")
+
+	return ok && (scheme == "sftp" || scheme == "ftps" || scheme == "ftp")
+}
+
+// remoteName returns the path part of a remote file's URL, whose
+// extensions give its format and compression, or a local path as it is.
+func remoteName(path string) string {
+	if !isRemotePath(path) {
+		return path
+	}
+	if u, err := url.Parse(path); err == nil {
+		return u.Path
+	}
+
+	return path
+}
+
+// openFile opens a local or remote file for reading, or stdin for -.
+func openFile(ctx context.Context, path string) (r io.ReadCloser, err error) {
+	var u *url.URL
+
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if !isRemotePath(path) {
+		return os.Open(path)
+	}
+	if u, err = url.Parse(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Scheme == "sftp" {
+		return openSFTPFile(ctx, u)
+	}
+
+	return openFTPFile(ctx, u)
+}
+
+// createFile creates a local or remote file, or writes to stdout for -.
+// Remote files are written as .part files renamed once they're closed.
+func createFile(ctx context.Context, path string) (w io.WriteCloser, err error) {
+	var u *url.URL
+
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	if !isRemotePath(path) {
+		return os.Create(path)
+	}
+	if u, err = url.Parse(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Scheme == "sftp" {
+		return createSFTPFile(ctx, u)
+	}
+
+	return createFTPFile(ctx, u)
+}
+
+// abortFile closes a file being written after it failed, so a remote file
+// isn't renamed into place.
+func abortFile(file io.Closer) error {
+	if a, ok := file.(interface{ abort() error }); ok {
+		return a.abort()
+	}
+
+	return file.Close()
+}
+
+// ftpFile reads or writes a file over an FTP data connection.
+type ftpFile struct {
+	c    *ftp.ServerConn
+	r    *ftp.Response  //Data being read, nil for writing
+	w    *io.PipeWriter //Data being written, nil for reading
+	done chan error     //Result of the upload
+	path string         //File renamed to on closing, empty for reading
+	part string         //File written to until it's closed
+}
+
+// dialFTP connects and logs in to the server in an ftp:// or ftps:// URL
+// as its user, anonymous by default, with the password in the URL or the
+// secret reference in a password query parameter. ftps:// upgrades the
+// connection with AUTH TLS, verifying the server's certificate, and
+// protects data connections too. Data connections are passive, to the
+// control connection's host as passive replies' addresses are often wrong
+// behind NAT.
+func dialFTP(ctx context.Context, u *url.URL) (c *ftp.ServerConn, err error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	opts := []ftp.DialOption{ftp.DialWithContext(ctx)}
+	if u.Scheme == "ftps" {
+		// Servers often need data connections to resume the control
+		// connection's TLS session
+		opts = append(opts, ftp.DialWithExplicitTLS(&tls.Config{ServerName: u.Hostname(), ClientSessionCache: tls.NewLRUClientSessionCache(1)}))
+	}
+	if c, err = ftp.Dial(addr, opts...); err != nil {
+		return nil, errors.Annotatef(err, "connecting to %s", addr)
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil && u.User.Username() != "" {
+		var ok bool
+		user = u.User.Username()
+		if password, ok = u.User.Password(); !ok {
+			password = u.Query().Get("password")
+		}
+	}
+	if password, err = ResolveSecret(ctx, password); err != nil {
+		c.Quit()
+		return nil, errors.Trace(err)
+	}
+	if err = c.Login(user, password); err != nil {
+		c.Quit()
+		return nil, errors.Annotatef(err, "logging in to %s as %s", addr, user)
+	}
+
+	return c, nil
+}
+
+// ftpPath returns a URL's path relative to the login directory, or
+// absolute if it starts with /%2F.
+func ftpPath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// openFTPFile opens the file in an ftp:// or ftps:// URL for reading.
+func openFTPFile(ctx context.Context, u *url.URL) (f *ftpFile, err error) {
+	f = &ftpFile{}
+	if f.c, err = dialFTP(ctx, u); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.r, err = f.c.Retr(ftpPath(u)); err != nil {
+		f.c.Quit()
+		return nil, errors.Annotatef(err, "RETR %s", ftpPath(u))
+	}
+
+	return f, nil
+}
+
+// createFTPFile creates the file in an ftp:// or ftps:// URL, which is
+// written as a .part file renamed to it once it's closed.
+func createFTPFile(ctx context.Context, u *url.URL) (f *ftpFile, err error) {
+	var r *io.PipeReader
+
+	f = &ftpFile{path: ftpPath(u), part: ftpPath(u) + ".part", done: make(chan error, 1)}
+	if f.c, err = dialFTP(ctx, u); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// A failed upload stops reading, so writes fail rather than block
+	r, f.w = io.Pipe()
+	go func() {
+		err := f.c.Stor(f.part, r)
+		r.CloseWithError(errors.Annotatef(err, "STOR %s", f.part))
+		f.done <- err
+	}()
+
+	return f, nil
+}
+
+func (f *ftpFile) Read(p []byte) (n int, err error) {
+	return f.r.Read(p)
+}
+
+func (f *ftpFile) Write(p []byte) (n int, err error) {
+	return f.w.Write(p)
+}
+
+// Closes the file once the server confirms the transfer, renaming a file
+// written to its name.
+func (f *ftpFile) Close() (err error) {
+	defer f.c.Quit()
+
+	// A read stopped early is aborted, so its reply doesn't matter
+	if f.path == "" {
+		f.r.Close()
+		return nil
+	}
+
+	f.w.Close()
+	if err = <-f.done; err != nil {
+		return errors.Annotatef(err, "writing %s", f.part)
+	}
+	if err = f.c.Rename(f.part, f.path); err != nil {
+		return errors.Annotatef(err, "renaming %s", f.part)
+	}
+
+	return nil
+}
+
+// abort closes a file being written without renaming it, leaving the
+// .part file.
+func (f *ftpFile) abort() (err error) {
+	f.w.CloseWithError(errors.New("aborted"))
+	<-f.done
+
+	return errors.Trace(f.c.Quit())
+}
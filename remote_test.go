@@ -0,0 +1,340 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTP serves SFTP on a local port to user etl with password
+// secret, returning its address and host key fingerprint.
+func startSFTP(t *testing.T) (addr string, fingerprint string) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if c.User() != "etl" || string(password) != "secret" {
+			return nil, fmt.Errorf("wrong password for %s", c.User())
+		}
+		return nil, nil
+	}}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(nc, cfg)
+		}
+	}()
+
+	return ln.Addr().String(), ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+// serveSSH serves the sftp subsystem on an SSH connection's sessions.
+func serveSSH(nc net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if srv, err := sftp.NewServer(ch); err == nil {
+						srv.Serve()
+					}
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPFile(t *testing.T) {
+	addr, fingerprint := startSFTP(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.csv")
+	uri := "sftp://etl:secret@" + addr + filepath.ToSlash(path) + "?host_key=" + url.QueryEscape(fingerprint)
+	ctx := context.Background()
+
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads replace the file once they're closed
+	data := strings.Repeat("id,name\n1,widget\n", 10000)
+	w, err := createFile(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "old\n" {
+		t.Error("file replaced before the upload was closed")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != data {
+		t.Errorf("uploaded %d bytes, want %d", len(b), len(data))
+	}
+	if _, err = os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf(".part file left after renaming: %v", err)
+	}
+
+	r, err := openFile(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != data {
+		t.Errorf("read %d bytes, %v, want %d", len(b), err, len(data))
+	}
+
+	// An aborted upload leaves the .part file and not the file
+	aborted := filepath.Join(dir, "aborted.csv")
+	if w, err = createFile(ctx, strings.Replace(uri, filepath.ToSlash(path), filepath.ToSlash(aborted), 1)); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+	if err = abortFile(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(aborted); !os.IsNotExist(err) {
+		t.Errorf("aborted upload renamed: %v", err)
+	}
+	if _, err = os.Stat(aborted + ".part"); err != nil {
+		t.Errorf("aborted upload's .part file: %v", err)
+	}
+}
+
+func TestSFTPHostKeyMismatch(t *testing.T) {
+	addr, _ := startSFTP(t)
+	ctx := context.Background()
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(other)
+	uri := "sftp://etl:secret@" + addr + "/tmp/x.csv?host_key=" + url.QueryEscape(ssh.FingerprintSHA256(signer.PublicKey()))
+	if _, err := createFile(ctx, uri); err == nil || !strings.Contains(err.Error(), "host key") {
+		t.Errorf("wrong host key error = %v", err)
+	}
+
+	// The known hosts file has another key for the host
+	known := filepath.Join(t.TempDir(), "known_hosts")
+	host, port, _ := net.SplitHostPort(addr)
+	line := fmt.Sprintf("[%s]:%s %s", host, port, ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err := os.WriteFile(known, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	uri = "sftp://etl:secret@" + addr + "/tmp/x.csv?known_hosts=" + url.QueryEscape(known)
+	if _, err := openFile(ctx, uri); err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("known hosts mismatch error = %v", err)
+	}
+}
+
+// fakeFTP is an FTP server keeping files in memory, which only supports
+// PASV and replies with an unreachable address as servers behind NAT do.
+type fakeFTP struct {
+	mu    sync.Mutex
+	files map[string]string
+	cmds  []string
+}
+
+// startFTP serves FTP on a local port to user etl with password secret.
+func startFTP(t *testing.T) (addr string, srv *fakeFTP) {
+	t.Helper()
+
+	srv = &fakeFTP{files: map[string]string{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(nc)
+		}
+	}()
+
+	return ln.Addr().String(), srv
+}
+
+func (s *fakeFTP) serve(nc net.Conn) {
+	var data net.Listener
+	var from string
+
+	ctrl := textproto.NewConn(nc)
+	defer ctrl.Close()
+	ctrl.PrintfLine("220 ready")
+
+	for {
+		line, err := ctrl.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		s.cmds = append(s.cmds, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "USER":
+			ctrl.PrintfLine("331 password please")
+		case "PASS":
+			if arg != "secret" {
+				ctrl.PrintfLine("530 wrong password")
+				continue
+			}
+			ctrl.PrintfLine("230 logged in")
+		case "TYPE":
+			ctrl.PrintfLine("200 binary")
+		case "PASV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				ctrl.PrintfLine("425 no data port")
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			ctrl.PrintfLine("227 Entering Passive Mode (10,255,255,1,%d,%d).", port>>8, port&0xff)
+		case "STOR", "RETR":
+			dc, err := data.Accept()
+			data.Close()
+			if err != nil {
+				ctrl.PrintfLine("425 no data connection")
+				continue
+			}
+			s.mu.Lock()
+			content, ok := s.files[arg]
+			s.mu.Unlock()
+			if cmd == "RETR" && !ok {
+				dc.Close()
+				ctrl.PrintfLine("550 no such file")
+				continue
+			}
+			ctrl.PrintfLine("150 opening data connection")
+			if cmd == "RETR" {
+				io.WriteString(dc, content)
+				dc.Close()
+			} else {
+				b, _ := io.ReadAll(dc)
+				dc.Close()
+				s.mu.Lock()
+				s.files[arg] = string(b)
+				s.mu.Unlock()
+			}
+			ctrl.PrintfLine("226 transfer complete")
+		case "RNFR":
+			from = arg
+			ctrl.PrintfLine("350 ready for RNTO")
+		case "RNTO":
+			s.mu.Lock()
+			s.files[arg] = s.files[from]
+			delete(s.files, from)
+			s.mu.Unlock()
+			ctrl.PrintfLine("250 renamed")
+		case "QUIT":
+			ctrl.PrintfLine("221 bye")
+			return
+		default:
+			ctrl.PrintfLine("502 %s not implemented", cmd)
+		}
+	}
+}
+
+func TestFTPFile(t *testing.T) {
+	addr, srv := startFTP(t)
+	ctx := context.Background()
+	uri := "ftp://etl:secret@" + addr + "/out/orders.csv"
+
+	w, err := createFile(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, "id\n1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.mu.Lock()
+	files := srv.files
+	srv.mu.Unlock()
+	if len(files) != 1 || files["out/orders.csv"] != "id\n1\n" {
+		t.Errorf("files = %q", files)
+	}
+
+	r, err := openFile(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "id\n1\n" {
+		t.Errorf("read %q, %v", b, err)
+	}
+
+	// The data connections were made to the control connection's host
+	// rather than PASV's address, after EPSV was refused
+	srv.mu.Lock()
+	cmds := strings.Join(srv.cmds, " ")
+	srv.mu.Unlock()
+	if !strings.Contains(cmds, "EPSV PASV STOR") || !strings.Contains(cmds, "RNFR RNTO") {
+		t.Errorf("commands = %s", cmds)
+	}
+
+	if _, err = openFile(ctx, "ftp://etl:secret@"+addr+"/missing.csv"); err == nil {
+		t.Error("reading a missing file didn't fail")
+	}
+	if _, err = openFile(ctx, "ftp://etl:wrong@"+addr+"/out/orders.csv"); err == nil || !strings.Contains(err.Error(), "logging in") {
+		t.Errorf("wrong password error = %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package godatapipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ReportFormat is the format a Report is written in.
+type ReportFormat int
+
+const (
+	ReportJSON     ReportFormat = iota //Machine readable JSON
+	ReportMarkdown                     //A markdown table for tickets
+	ReportHTML                         //A standalone HTML page
+)
+
+// Parses a ReportFormat name: json, markdown or html. An empty name
+// gives the format of the path's extension, JSON if it has none.
+func ParseReportFormat(s string, path string) (f ReportFormat, err error) {
+	if s == "" {
+		s = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+
+	switch strings.ToLower(s) {
+	case "", "json":
+		return ReportJSON, nil
+	case "md", "markdown":
+		return ReportMarkdown, nil
+	case "html", "htm":
+		return ReportHTML, nil
+	}
+
+	return ReportJSON, errors.NotValidf("report format %q", s)
+}
+
+// Report summarises the runs of one or more tables, for attaching to job
+// logs and tickets.
+type Report struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	Tables      []TableReport `json:"tables"`
+	RowCount    int           `json:"row_count"` //Rows committed over all tables
+	Failed      int           `json:"failed"`    //Tables whose run failed
+}
+
+// TableReport is the outcome of one table's run.
+type TableReport struct {
+	Name      string    `json:"name"`
+	RunID     string    `json:"run_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	File      string    `json:"file,omitempty"` //Local DstFile the rows were exported to
+
+	RowCount      int `json:"row_count"`
+	FilteredRows  int `json:"filtered_rows"`
+	DuplicateRows int `json:"duplicate_rows"`
+	DeletedRows   int `json:"deleted_rows"`
+	SkippedRows   int `json:"skipped_rows"`
+	UnchangedRows int `json:"unchanged_rows"`
+	ExpiredRows   int `json:"expired_rows,omitempty"`
+
+	AssertionFailures map[string]int `json:"assertion_failures,omitempty"` //Rows failing each assertion
+
+	ReadSeconds   float64 `json:"read_seconds"`
+	WriteSeconds  float64 `json:"write_seconds"`
+	RowsPerSecond float64 `json:"rows_per_second"` //Rows committed per second of writing
+
+	Interrupted bool          `json:"interrupted"`
+	SchemaDiff  string        `json:"schema_diff,omitempty"` //Differences found by the schema drift check
+	ColumnStats []ColumnStats `json:"column_stats,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// Status returns a one word summary of the run.
+func (t *TableReport) Status() string {
+	switch {
+	case t.Error != "":
+		return "failed"
+	case t.Interrupted:
+		return "interrupted"
+	}
+
+	return "ok"
+}
+
+// Returns a report of the job results, a failed job's Result may be nil.
+func NewReport(results []JobResult) *Report {
+	r := &Report{GeneratedAt: time.Now().UTC()}
+
+	for _, jr := range results {
+		t := TableReport{}
+		if jr.Job != nil {
+			t.Name = jr.Job.Name
+		}
+		if jr.Job != nil && jr.Job.Config != nil && jr.Job.Config.DstFile != "-" && !isRemotePath(jr.Job.Config.DstFile) {
+			t.File = jr.Job.Config.DstFile
+		}
+		if jr.Err != nil {
+			t.Error = jr.Err.Error()
+			r.Failed++
+		}
+
+		if res := jr.Result; res != nil {
+			t.RunID, t.StartedAt = res.RunID, res.StartedAt
+			t.RowCount, t.FilteredRows, t.DuplicateRows = res.RowCount, res.FilteredRows, res.DuplicateRows
+			t.DeletedRows, t.SkippedRows, t.UnchangedRows = res.DeletedRows, res.SkippedRows, res.UnchangedRows
+			t.ExpiredRows = res.ExpiredRows
+			t.ReadSeconds, t.WriteSeconds = res.ReadTime.Seconds(), res.WriteTime.Seconds()
+			if t.WriteSeconds > 0 {
+				t.RowsPerSecond = float64(res.RowCount) / t.WriteSeconds
+			}
+			t.Interrupted = res.Interrupted
+			if res.SchemaDiff != nil && !res.SchemaDiff.Empty() {
+				t.SchemaDiff = res.SchemaDiff.String()
+			}
+			t.ColumnStats, t.AssertionFailures = res.ColumnStats, res.AssertionFailures
+			r.RowCount += res.RowCount
+		}
+
+		r.Tables = append(r.Tables, t)
+	}
+
+	return r
+}
+
+// Writes the report in the format.
+func (r *Report) Write(w io.Writer, f ReportFormat) (err error) {
+	switch f {
+	case ReportMarkdown:
+		return errors.Trace(r.writeMarkdown(w))
+	case ReportHTML:
+		return errors.Trace(reportHTML.Execute(w, r))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Trace(enc.Encode(r))
+}
+
+// Writes the report in the format to a file, replacing it.
+func (r *Report) WriteFile(path string, f ReportFormat) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err = r.Write(file, f); err != nil {
+		file.Close()
+		return errors.Annotatef(err, "writing report %s", path)
+	}
+
+	return errors.Trace(file.Close())
+}
+
+func (r *Report) writeMarkdown(w io.Writer) (err error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "## Copy report %s\n\n", r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "%d rows copied, %d of %d tables failed\n\n", r.RowCount, r.Failed, len(r.Tables))
+	b.WriteString("| Table | Status | Rows | Filtered | Duplicates | Deleted | Skipped | Read s | Write s | Rows/s | Notes |\n")
+	b.WriteString("|---|---|---:|---:|---:|---:|---:|---:|---:|---:|---|\n")
+
+	for _, t := range r.Tables {
+		notes := strings.TrimSpace(t.Error + " " + t.SchemaDiff)
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %d | %d | %d | %.2f | %.2f | %.0f | %s |\n",
+			markdownCell(t.Name), t.Status(), t.RowCount, t.FilteredRows, t.DuplicateRows, t.DeletedRows, t.SkippedRows,
+			t.ReadSeconds, t.WriteSeconds, t.RowsPerSecond, markdownCell(notes))
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return errors.Trace(err)
+}
+
+// markdownCell escapes text for a markdown table cell.
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Copy report {{.GeneratedAt.Format "2006-01-02 15:04:05"}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td.n { text-align: right; }
+tr.failed { background: #fdd; }
+tr.interrupted { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>Copy report {{.GeneratedAt.Format "2006-01-02 15:04:05"}}</h1>
+<p>{{.RowCount}} rows copied, {{.Failed}} of {{len .Tables}} tables failed</p>
+<table>
+<tr><th>Table</th><th>Status</th><th>Rows</th><th>Filtered</th><th>Duplicates</th><th>Deleted</th><th>Skipped</th><th>Read s</th><th>Write s</th><th>Rows/s</th><th>Notes</th></tr>
+{{range .Tables}}<tr class="{{.Status}}"><td>{{.Name}}</td><td>{{.Status}}</td><td class="n">{{.RowCount}}</td><td class="n">{{.FilteredRows}}</td><td class="n">{{.DuplicateRows}}</td><td class="n">{{.DeletedRows}}</td><td class="n">{{.SkippedRows}}</td><td class="n">{{printf "%.2f" .ReadSeconds}}</td><td class="n">{{printf "%.2f" .WriteSeconds}}</td><td class="n">{{printf "%.0f" .RowsPerSecond}}</td><td>{{.Error}} {{.SchemaDiff}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,186 @@
+package godatapipe
+
+import (
+	"github.com/juju/errors"
+)
+
+// Default columns unpivoted rows hold each column's name and value in.
+const (
+	unpivotNameColumn  = "name"
+	unpivotValueColumn = "value"
+)
+
+// Pivot turns rows into columns: the rows with the same key values are
+// written as one row, with a column for each of Names holding the value
+// of the row whose NameColumn matched it.
+type Pivot struct {
+	NameColumn  string   //Column whose values name the pivoted columns
+	ValueColumn string   //Column whose values fill the pivoted columns
+	Names       []string //Values of NameColumn written as columns of the same name, rows with others are dropped
+	Keys        []string //Columns rows are grouped on, defaults to all but NameColumn and ValueColumn
+}
+
+// Unpivot turns columns into rows: each row is written once for each of
+// Columns, with the other columns, the column's name and its value.
+type Unpivot struct {
+	Columns     []string //Columns turned into rows
+	NameColumn  string   //Destination column of each row's column name, defaults to name
+	ValueColumn string   //Destination column of each row's value, defaults to value
+	KeepNulls   bool     //Also write rows for NULL values
+}
+
+// rollup combines rows into rows written once the copy is done.
+type rollup interface {
+	add(values []interface{}) (err error)
+	rows() (rows [][]interface{})
+}
+
+// unpivoter turns the columns of each row into rows.
+type unpivoter struct {
+	keepPos   []int //Positions of the columns kept in each row
+	pivotPos  []int //Positions of the columns turned into rows
+	names     []string
+	keepNulls bool
+}
+
+// newUnpivoter returns an unpivoter of rows with the columns, and the
+// columns of the rows it returns, the kept columns then the name and
+// value columns.
+func newUnpivoter(u *Unpivot, columns []string) (up *unpivoter, outColumns []string, err error) {
+	if len(u.Columns) == 0 {
+		return nil, nil, errors.NotValidf("unpivot without columns")
+	}
+
+	up = &unpivoter{names: u.Columns, keepNulls: u.KeepNulls}
+	for _, name := range u.Columns {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, nil, errors.Trace(sourceColumnError(name, "unpivot"))
+		}
+		up.pivotPos = append(up.pivotPos, pos)
+	}
+	for pos, name := range columns {
+		if indexOf(u.Columns, name) < 0 {
+			up.keepPos = append(up.keepPos, pos)
+			outColumns = append(outColumns, name)
+		}
+	}
+
+	nameColumn, valueColumn := u.NameColumn, u.ValueColumn
+	if nameColumn == "" {
+		nameColumn = unpivotNameColumn
+	}
+	if valueColumn == "" {
+		valueColumn = unpivotValueColumn
+	}
+	for _, name := range []string{nameColumn, valueColumn} {
+		if indexOf(outColumns, name) >= 0 {
+			return nil, nil, errors.Errorf("unpivot column %s is already a column", name)
+		}
+		outColumns = append(outColumns, name)
+	}
+
+	return up, outColumns, nil
+}
+
+// apply returns a row for each unpivoted column of each row.
+func (up *unpivoter) apply(rows [][]interface{}) (out [][]interface{}) {
+	for _, values := range rows {
+		for i, pos := range up.pivotPos {
+			if values[pos] == nil && !up.keepNulls {
+				continue
+			}
+			row := make([]interface{}, 0, len(up.keepPos)+2)
+			for _, keep := range up.keepPos {
+				row = append(row, values[keep])
+			}
+			out = append(out, append(row, up.names[i], values[pos]))
+		}
+	}
+
+	return out
+}
+
+// pivoter turns rows into columns, holding a row for each group of key
+// values, in the order the groups are first seen.
+type pivoter struct {
+	keyPos   []int
+	namePos  int
+	valuePos int
+	names    map[string]int //Position of each pivoted column after the keys
+
+	groups map[rowKey][]interface{}
+	order  [][]interface{}
+}
+
+// newPivoter returns a pivoter of rows with the columns, and the columns
+// of the rows it returns, the keys then the pivoted columns.
+func newPivoter(p *Pivot, columns []string) (pv *pivoter, outColumns []string, err error) {
+	if len(p.Names) == 0 {
+		return nil, nil, errors.NotValidf("pivot without names")
+	}
+
+	pv = &pivoter{names: map[string]int{}, groups: map[rowKey][]interface{}{}}
+	if pv.namePos = indexOf(columns, p.NameColumn); pv.namePos < 0 {
+		return nil, nil, errors.Trace(sourceColumnError(p.NameColumn, "pivot name"))
+	}
+	if pv.valuePos = indexOf(columns, p.ValueColumn); pv.valuePos < 0 {
+		return nil, nil, errors.Trace(sourceColumnError(p.ValueColumn, "pivot value"))
+	}
+
+	keys := p.Keys
+	if len(keys) == 0 {
+		for _, name := range columns {
+			if name != p.NameColumn && name != p.ValueColumn {
+				keys = append(keys, name)
+			}
+		}
+	}
+	for _, name := range keys {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, nil, errors.Trace(sourceColumnError(name, "pivot key"))
+		}
+		pv.keyPos = append(pv.keyPos, pos)
+		outColumns = append(outColumns, name)
+	}
+	for i, name := range p.Names {
+		if indexOf(outColumns, name) >= 0 {
+			return nil, nil, errors.Errorf("pivot column %s is already a column", name)
+		}
+		pv.names[name] = len(keys) + i
+		outColumns = append(outColumns, name)
+	}
+
+	return pv, outColumns, nil
+}
+
+// add sets the pivoted column named by the row in its group's row. A
+// later row with the same name replaces the value.
+func (pv *pivoter) add(values []interface{}) (err error) {
+	if values[pv.namePos] == nil {
+		return nil
+	}
+	pos, ok := pv.names[valueText(values[pv.namePos])]
+	if !ok {
+		return nil
+	}
+
+	k := hashKey(values, pv.keyPos)
+	row, ok := pv.groups[k]
+	if !ok {
+		row = make([]interface{}, len(pv.keyPos)+len(pv.names))
+		for i, kp := range pv.keyPos {
+			row[i] = values[kp]
+		}
+		pv.groups[k] = row
+		pv.order = append(pv.order, row)
+	}
+	row[pos] = values[pv.valuePos]
+
+	return nil
+}
+
+func (pv *pivoter) rows() (rows [][]interface{}) {
+	return pv.order
+}
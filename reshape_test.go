@@ -0,0 +1,74 @@
+package godatapipe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnpivot(t *testing.T) {
+	columns := []string{"id", "q1", "q2"}
+	rows := [][]interface{}{{int64(1), int64(10), nil}, {int64(2), int64(20), int64(21)}}
+
+	tests := []struct {
+		unpivot Unpivot
+		columns []string
+		rows    [][]interface{}
+	}{
+		{Unpivot{Columns: []string{"q1", "q2"}}, []string{"id", "name", "value"}, [][]interface{}{
+			{int64(1), "q1", int64(10)},
+			{int64(2), "q1", int64(20)},
+			{int64(2), "q2", int64(21)}}},
+		{Unpivot{Columns: []string{"q2", "q1"}, NameColumn: "quarter", ValueColumn: "sales", KeepNulls: true}, []string{"id", "quarter", "sales"}, [][]interface{}{
+			{int64(1), "q2", nil},
+			{int64(1), "q1", int64(10)},
+			{int64(2), "q2", int64(21)},
+			{int64(2), "q1", int64(20)}}},
+	}
+
+	for _, tt := range tests {
+		u := tt.unpivot
+		got, written, err := copyColumns(t, &Config{MaxRowBufSz: 10, Unpivot: &u}, columns, rows)
+		if err != nil || !reflect.DeepEqual(got, tt.columns) || !reflect.DeepEqual(written, tt.rows) {
+			t.Errorf("unpivot %+v = %v %v, %v, want %v %v", tt.unpivot, got, written, err, tt.columns, tt.rows)
+		}
+	}
+
+	for _, u := range []Unpivot{{}, {Columns: []string{"missing"}}, {Columns: []string{"q1"}, NameColumn: "id"}} {
+		if _, _, err := copyColumns(t, &Config{MaxRowBufSz: 10, Unpivot: &u}, columns, rows); err == nil {
+			t.Errorf("unpivot %+v didn't fail", u)
+		}
+	}
+}
+
+func TestPivot(t *testing.T) {
+	columns := []string{"id", "attr", "val"}
+	rows := [][]interface{}{
+		{int64(1), "color", "red"},
+		{int64(2), "size", "L"},
+		{int64(1), "size", "M"},
+		{int64(1), "weight", "9"},
+		{int64(3), nil, "x"},
+		{int64(1), "color", "blue"}}
+
+	p := &Pivot{NameColumn: "attr", ValueColumn: "val", Names: []string{"color", "size"}}
+	got, written, err := copyColumns(t, &Config{MaxRowBufSz: 2, Pivot: p}, columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unnamed and NULL names are dropped and later values replace earlier
+	// ones, across batches
+	want := [][]interface{}{{int64(1), "blue", "M"}, {int64(2), nil, "L"}}
+	if !reflect.DeepEqual(got, []string{"id", "color", "size"}) || !reflect.DeepEqual(written, want) {
+		t.Errorf("pivot = %v %v, want %v", got, written, want)
+	}
+
+	for _, p := range []Pivot{
+		{NameColumn: "attr", ValueColumn: "val"},
+		{NameColumn: "missing", ValueColumn: "val", Names: []string{"a"}},
+		{NameColumn: "attr", ValueColumn: "val", Names: []string{"id"}}} {
+		if _, _, err = copyColumns(t, &Config{MaxRowBufSz: 2, Pivot: &p}, columns, rows); err == nil {
+			t.Errorf("pivot %+v didn't fail", p)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Times a page request which was rate limited or failed on the server is
+// retried.
+const restRetries = 5
+
+// Pagination is how a REST API's next page is requested.
+type Pagination int
+
+const (
+	PageNone   Pagination = iota //The API returns a single page
+	PageNumber                   //A page number query parameter, counting up until a page is empty
+	PageOffset                   //An offset query parameter, advanced by each page's records until one is empty
+	PageCursor                   //A cursor query parameter, taken from each response until it has none
+	PageLink                     //The Link header's rel="next" URL, until there's none
+)
+
+// Parses a Pagination name: none, page, offset, cursor or link.
+func ParsePagination(s string) (p Pagination, err error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return PageNone, nil
+	case "page":
+		return PageNumber, nil
+	case "offset":
+		return PageOffset, nil
+	case "cursor":
+		return PageCursor, nil
+	case "link":
+		return PageLink, nil
+	}
+
+	return PageNone, errors.NotValidf("pagination %q", s)
+}
+
+// RESTColumn is a column taken from a path in each JSON record.
+type RESTColumn struct {
+	Name string
+	Path string //Dot separated object keys and array indexes, e.g. address.lines.0
+}
+
+// Parses a comma separated list of columns, each a path or name=path. A
+// column named by its path has the dots replaced with underscores.
+func ParseRESTColumns(s string) (columns []RESTColumn, err error) {
+	for _, item := range splitList(s) {
+		name, path, ok := strings.Cut(item, "=")
+		if !ok {
+			name, path = strings.ReplaceAll(item, ".", "_"), item
+		}
+		if name = strings.TrimSpace(name); name == "" || strings.TrimSpace(path) == "" {
+			return nil, errors.NotValidf("REST column %q", item)
+		}
+		columns = append(columns, RESTColumn{Name: name, Path: strings.TrimSpace(path)})
+	}
+
+	return columns, nil
+}
+
+// RESTOptions are where and how a RESTSource pulls records.
+type RESTOptions struct {
+	URL         string       //First page's URL
+	Pagination  Pagination   //How the following pages are requested
+	PageParam   string       //Query parameter of page, offset or cursor pagination, defaults to page, offset or cursor
+	CursorPath  string       //Path of the next page's cursor in a response, defaults to next_cursor
+	RecordsPath string       //Path of the array of records in a response, empty if it's the whole response
+	Columns     []RESTColumn //Columns taken from each record, by default the first record's keys
+	Auth        string       //Secret reference to the Authorization header's value, e.g. Bearer followed by a token
+}
+
+// RESTSource reads JSON records from a paginated HTTP API, a page at a
+// time. Values are JSON's types, with objects and arrays kept as JSON
+// text.
+type RESTSource struct {
+	opts    RESTOptions
+	auth    string
+	columns []string
+	values  []interface{}
+
+	next    *url.URL //Next page's URL, nil after the last page
+	page    int      //Page number or offset of the next page
+	records []json.RawMessage
+	pos     int
+	pages   int
+}
+
+// Creates a REST source, reading the first page for the columns if they
+// aren't given.
+func NewRESTSource(ctx context.Context, opts RESTOptions) (s *RESTSource, err error) {
+	s = &RESTSource{opts: opts}
+	if s.next, err = url.Parse(opts.URL); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.next.Scheme != "http" && s.next.Scheme != "https" {
+		return nil, errors.NotValidf("REST URL %q", opts.URL)
+	}
+
+	if s.opts.PageParam == "" {
+		switch opts.Pagination {
+		case PageNumber:
+			s.opts.PageParam = "page"
+		case PageOffset:
+			s.opts.PageParam = "offset"
+		case PageCursor:
+			s.opts.PageParam = "cursor"
+		}
+	}
+	if s.opts.CursorPath == "" {
+		s.opts.CursorPath = "next_cursor"
+	}
+	// Page numbers start at 1 unless the URL starts further on
+	if opts.Pagination == PageNumber || opts.Pagination == PageOffset {
+		var perr error
+		if s.page, perr = strconv.Atoi(s.next.Query().Get(s.opts.PageParam)); perr != nil && opts.Pagination == PageNumber {
+			s.page = 1
+		}
+	}
+	if opts.Auth != "" {
+		if s.auth, err = ResolveSecret(ctx, opts.Auth); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	for _, c := range opts.Columns {
+		s.columns = append(s.columns, c.Name)
+	}
+	if len(s.columns) == 0 {
+		if err = s.fetch(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(s.records) > 0 {
+			if s.columns, err = jsonKeys(s.records[0]); err != nil {
+				return nil, errors.Annotatef(err, "reading %s's first record", opts.URL)
+			}
+		}
+		for _, c := range s.columns {
+			s.opts.Columns = append(s.opts.Columns, RESTColumn{Name: c, Path: c})
+		}
+	}
+
+	return s, nil
+}
+
+func (s *RESTSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *RESTSource) Next(ctx context.Context) (values []interface{}, err error) {
+	for s.pos >= len(s.records) {
+		if s.next == nil {
+			return nil, io.EOF
+		}
+		if err = s.fetch(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if s.values == nil {
+		s.values = make([]interface{}, len(s.columns))
+	}
+	for i, c := range s.opts.Columns {
+		if s.values[i], err = decodeJSONValue(jsonPath(s.records[s.pos], c.Path)); err != nil {
+			return nil, errors.Annotatef(err, "column %s", c.Name)
+		}
+	}
+	s.pos++
+
+	return s.values, nil
+}
+
+func (s *RESTSource) Close() (err error) {
+	return nil
+}
+
+// fetch gets the next page's records and works out the URL of the page
+// after it.
+func (s *RESTSource) fetch(ctx context.Context) (err error) {
+	var resp *http.Response
+	var body []byte
+
+	page := s.next
+	if resp, body, err = s.get(ctx, page); err != nil {
+		return errors.Annotatef(err, "getting page %d of %s", s.pages+1, s.opts.URL)
+	}
+	s.pages++
+
+	records := jsonPath(body, s.opts.RecordsPath)
+	s.records, s.pos = nil, 0
+	if len(records) > 0 && string(records) != "null" {
+		if err = json.Unmarshal(records, &s.records); err != nil {
+			return errors.Annotatef(err, "reading page %d of %s's records", s.pages, s.opts.URL)
+		}
+	}
+
+	s.next = nil
+	switch s.opts.Pagination {
+	case PageNumber, PageOffset:
+		if len(s.records) > 0 {
+			if s.opts.Pagination == PageNumber {
+				s.page++
+			} else {
+				s.page += len(s.records)
+			}
+			s.next = withParam(page, s.opts.PageParam, strconv.Itoa(s.page))
+		}
+	case PageCursor:
+		var cursor interface{}
+		if cursor, err = decodeJSONValue(jsonPath(body, s.opts.CursorPath)); err != nil {
+			return errors.Annotatef(err, "reading page %d of %s's cursor", s.pages, s.opts.URL)
+		}
+		if c := fileText(cursor); c != "" {
+			s.next = withParam(page, s.opts.PageParam, c)
+		}
+	case PageLink:
+		if link := nextLink(resp.Header.Values("Link")); link != "" {
+			if s.next, err = page.Parse(link); err != nil {
+				return errors.Annotatef(err, "following page %d of %s's next link", s.pages, s.opts.URL)
+			}
+		}
+	}
+
+	return nil
+}
+
+// get requests the URL, retrying requests which were rate limited or
+// failed on the server after their Retry-After or with backoff.
+func (s *RESTSource) get(ctx context.Context, u *url.URL) (resp *http.Response, body []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if s.auth != "" {
+			req.Header.Set("Authorization", s.auth)
+		}
+
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if resp.StatusCode/100 == 2 {
+			return resp, body, nil
+		} else if !retry || attempt >= restRetries {
+			return nil, nil, errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body[:min(len(body), 200)]))
+		}
+
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, errors.Trace(ctx.Err())
+			case <-time.After(time.Duration(secs) * time.Second):
+			}
+		} else if err = sleepBackoff(ctx, attempt); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+}
+
+// withParam returns a copy of the URL with the query parameter set.
+func withParam(u *url.URL, name string, value string) *url.URL {
+	next := *u
+	q := next.Query()
+	q.Set(name, value)
+	next.RawQuery = q.Encode()
+
+	return &next
+}
+
+// nextLink returns the rel="next" URL in Link headers, or empty if there
+// isn't one.
+func nextLink(headers []string) string {
+	for _, h := range headers {
+		for _, link := range strings.Split(h, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if strings.EqualFold(name, "rel") && strings.Contains(" "+strings.Trim(value, `"`)+" ", " next ") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// jsonPath returns the value at the dot separated path of object keys and
+// array indexes in the JSON, or nil if there's none. An empty path is the
+// whole value.
+func jsonPath(raw json.RawMessage, path string) json.RawMessage {
+	if path == "" {
+		return raw
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		var obj map[string]json.RawMessage
+		var arr []json.RawMessage
+
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case len(raw) > 0 && raw[0] == '{' && json.Unmarshal(raw, &obj) == nil:
+			raw = obj[key]
+		case len(raw) > 0 && raw[0] == '[' && json.Unmarshal(raw, &arr) == nil:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(arr) {
+				return nil
+			}
+			raw = arr[i]
+		default:
+			return nil
+		}
+	}
+
+	return raw
+}
+
+// jsonKeys returns a JSON object's keys, in order.
+func jsonKeys(raw json.RawMessage) (keys []string, err error) {
+	var t json.Token
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err = dec.Token(); err != nil {
+		return nil, errors.Trace(err)
+	} else if t != json.Delim('{') {
+		return nil, errors.NotValidf("record which isn't an object")
+	}
+
+	for dec.More() {
+		var skip json.RawMessage
+		if t, err = dec.Token(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = dec.Decode(&skip); err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys = append(keys, t.(string))
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,44 @@
+package godatapipe
+
+import (
+	"fmt"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// sampleConfig returns a copy of the config with the source selects
+// rewritten to read a sample of their rows, or cfg if it doesn't sample.
+func sampleConfig(cfg *Config) (sampled *Config, err error) {
+	if cfg.SampleRows <= 0 && cfg.SamplePercent <= 0 {
+		return cfg, nil
+	}
+
+	if cfg.SamplePercent > 100 {
+		return nil, errors.Trace(&ConfigError{Setting: "SAMPLE_PERCENT", Value: fmt.Sprint(cfg.SamplePercent), Err: errors.NotValidf("percentage over 100")})
+	}
+
+	d := bulk.DialectFor(cfg.SrcDbDriver)
+	sample := func(query string) string {
+		if cfg.SamplePercent > 0 {
+			query = d.SampleQuery(query, cfg.SamplePercent)
+		}
+		if cfg.SampleRows > 0 {
+			query = d.LimitQuery(fmt.Sprintf("SELECT * FROM (%s) datapipe_limit", query), cfg.SampleRows)
+		}
+		return query
+	}
+
+	c := *cfg
+	c.SrcSelectSql = sample(cfg.SrcSelectSql)
+
+	c.SrcShards = make([]Shard, len(cfg.SrcShards))
+	for i, sh := range cfg.SrcShards {
+		if sh.SelectSql != "" {
+			sh.SelectSql = sample(sh.SelectSql)
+		}
+		c.SrcShards[i] = sh
+	}
+
+	return &c, nil
+}
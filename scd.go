@@ -0,0 +1,141 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Default columns recording the lifetime of LoadSCD2 versions.
+const (
+	scdFromColumn    = "effective_from"
+	scdToColumn      = "effective_to"
+	scdCurrentColumn = "is_current"
+)
+
+// scd2Columns returns the configured version lifetime columns, or their
+// defaults.
+func (c *Config) scd2Columns() (scd bulk.SCD2Columns) {
+	scd = bulk.SCD2Columns{From: c.EffectiveFromColumn, To: c.EffectiveToColumn, Current: c.CurrentColumn}
+	if scd.From == "" {
+		scd.From = scdFromColumn
+	}
+	if scd.To == "" {
+		scd.To = scdToColumn
+	}
+	if scd.Current == "" {
+		scd.Current = scdCurrentColumn
+	}
+
+	return scd
+}
+
+// runSCD2 copies the source rows into a temporary staging table, then in
+// one transaction end-dates the current versions of the rows which
+// changed and inserts new current versions of the new and changed rows,
+// keeping the destination table's history as a type 2 slowly changing
+// dimension. Rows are matched on Config.KeyColumns, the business keys, and
+// compared on Config.DiffColumns, or all the copied columns other than
+// the keys and those added by ExtraColumns and SurrogateKeys. Versions of
+// rows missing from the source stay current.
+func runSCD2(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config, res *Result, stop <-chan struct{}) (err error) {
+	var keys, columns, compare []string
+	var qs []string
+	var end, insert string
+	var tx *sql.Tx
+	var r sql.Result
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	scd := cfg.scd2Columns()
+
+	if len(cfg.KeyColumns) == 0 {
+		return errors.NotValidf("LoadSCD2 without KeyColumns")
+	}
+
+	stage := "datapipe_stage"
+	if d == bulk.SQLServer {
+		stage = "#" + stage
+	}
+
+	if qs, err = d.CreateStageSQL(cfg.DstSchema, cfg.DstTable, stage); err != nil {
+		return errors.Trace(err)
+	}
+	for _, q := range qs {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotate(err, "creating staging table")
+		}
+	}
+	defer dstConn.ExecContext(context.WithoutCancel(ctx), qs[0])
+
+	if columns, err = copyTable(ctx, srcConn, nil, dstConn, cfg, d.StageSchema(), stage, res, stop); err != nil {
+		return errors.Trace(err)
+	}
+
+	if res.Interrupted && cfg.StopPolicy == StopRollback {
+		return nil
+	}
+
+	compare = cfg.DiffColumns
+	if len(compare) == 0 {
+		generated := map[string]bool{}
+		for _, k := range cfg.KeyColumns {
+			generated[k] = true
+		}
+		for _, e := range cfg.ExtraColumns {
+			generated[e.Name] = true
+		}
+		for _, k := range cfg.SurrogateKeys {
+			generated[k.Column] = true
+		}
+		for _, c := range columns {
+			if !generated[c] {
+				compare = append(compare, c)
+			}
+		}
+	}
+
+	// The staging table was copied from the destination so it has the
+	// destination's spelling of the column names.
+	if columns, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, columns); err != nil {
+		return errors.Trace(err)
+	}
+	if keys, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, cfg.KeyColumns); err != nil {
+		return errors.Trace(err)
+	}
+	if compare, err = bulk.ResolveColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable, compare); err != nil {
+		return errors.Trace(err)
+	}
+	for _, c := range []string{scd.From, scd.To, scd.Current} {
+		if indexOf(columns, c) >= 0 {
+			return errors.Trace(&SchemaError{Table: cfg.DstTable, Column: c, Err: errors.NotValidf("copying a column LoadSCD2 manages")})
+		}
+	}
+
+	if end, insert, err = d.SCD2SQL(cfg.DstSchema, cfg.DstTable, stage, columns, keys, compare, scd); err != nil {
+		return errors.Trace(err)
+	}
+
+	if tx, err = dstConn.BeginTx(ctx, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Both statements use the run's start time, so an end-dated
+	// version's end is its successor's start
+	if r, err = tx.ExecContext(ctx, end, res.StartedAt); err != nil {
+		tx.Rollback()
+		return errors.Annotate(err, "end-dating changed versions")
+	}
+	n, _ := r.RowsAffected()
+	res.ExpiredRows += int(n)
+
+	if r, err = tx.ExecContext(ctx, insert, res.StartedAt); err != nil {
+		tx.Rollback()
+		return errors.Annotate(err, "inserting new versions")
+	}
+	n, _ = r.RowsAffected()
+	res.UnchangedRows += res.RowCount - int(n)
+
+	return errors.Trace(tx.Commit())
+}
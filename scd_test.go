@@ -0,0 +1,54 @@
+package godatapipe
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSCD2(t *testing.T) {
+	conn := openSQLite(t, `CREATE TABLE dim (dim_key INTEGER PRIMARY KEY, code TEXT, name TEXT,
+		effective_from TIMESTAMP, effective_to TIMESTAMP, is_current BOOLEAN)`)
+	cfg := &Config{DstTable: "dim", LoadMode: LoadSCD2, KeyColumns: []string{"code"}, MaxRowBufSz: 2}
+	columns := []string{"code", "name"}
+
+	res := copyToSQLite(t, cfg, conn, columns, [][]interface{}{{"a", "alpha"}, {"b", "beta"}, {"c", "gamma"}})
+	if res.RowCount != 3 || res.ExpiredRows != 0 || res.UnchangedRows != 0 {
+		t.Errorf("first run copied %d rows, %d expired, %d unchanged", res.RowCount, res.ExpiredRows, res.UnchangedRows)
+	}
+
+	// b changes, c is missing and d is new
+	res = copyToSQLite(t, cfg, conn, columns, [][]interface{}{{"a", "alpha"}, {"b", "bravo"}, {"d", "delta"}})
+	if res.RowCount != 3 || res.ExpiredRows != 1 || res.UnchangedRows != 1 {
+		t.Errorf("second run copied %d rows, %d expired, %d unchanged", res.RowCount, res.ExpiredRows, res.UnchangedRows)
+	}
+
+	want := [][]interface{}{
+		{"a", "alpha", int64(1), int64(1)},
+		{"b", "beta", int64(0), int64(0)},
+		{"b", "bravo", int64(1), int64(1)},
+		{"c", "gamma", int64(1), int64(1)},
+		{"d", "delta", int64(1), int64(1)}}
+	got := queryRows(t, conn, `SELECT code, name, effective_to IS NULL, is_current FROM dim ORDER BY code, dim_key`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dim = %v, want %v", got, want)
+	}
+
+	// An end-dated version ends when its successor starts
+	got = queryRows(t, conn, `SELECT COUNT(*) FROM dim o JOIN dim n ON n.code = o.code AND n.effective_from = o.effective_to`)
+	if got[0][0] != int64(1) {
+		t.Errorf("%v versions follow on from their predecessor", got[0][0])
+	}
+}
+
+func TestLoadSCD2ManagedColumn(t *testing.T) {
+	conn := openSQLite(t, `CREATE TABLE dim (code TEXT, name TEXT, effective_from TIMESTAMP, effective_to TIMESTAMP, is_current BOOLEAN)`)
+	cfg := &Config{Source: &sliceSource{columns: []string{"code", "is_current"}, rows: [][]interface{}{{"a", true}}},
+		DstConn: conn, DstDbDriver: "sqlite", DstTable: "dim", LoadMode: LoadSCD2, KeyColumns: []string{"code"}, MaxRowBufSz: 2}
+
+	var se *SchemaError
+	if _, err := NewPipeline(cfg).Run(context.Background()); !errors.As(err, &se) || se.Column != "is_current" {
+		t.Errorf("copying is_current: %v", err)
+	}
+}
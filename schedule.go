@@ -0,0 +1,202 @@
+package godatapipe
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Schedule returns when a pipeline next runs after a given time.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// Every runs a pipeline at a fixed interval.
+type Every time.Duration
+
+func (e Every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cronSchedule is a standard five field cron expression. Each field is a
+// bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	domStar, dowStar bool //Day of month or week is *, see Next
+	loc              *time.Location
+}
+
+var cronFields = []struct {
+	min, max int
+	names    []string
+}{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 6, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parses a schedule, either "@every <duration>", a macro such as @daily
+// or a five field cron expression "minute hour day-of-month month
+// day-of-week" in local time. Fields accept *, lists, ranges and /steps.
+func ParseSchedule(spec string) (s Schedule, err error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		var d time.Duration
+		if d, err = time.ParseDuration(strings.TrimSpace(spec[len("@every "):])); err != nil {
+			return nil, errors.Annotatef(err, "schedule %q", spec)
+		} else if d <= 0 {
+			return nil, errors.NotValidf("schedule %q", spec)
+		}
+		return Every(d), nil
+	}
+
+	if m, ok := cronMacros[spec]; ok {
+		spec = m
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.NotValidf("cron expression %q", spec)
+	}
+
+	c := &cronSchedule{loc: time.Local}
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		if *sets[i], err = parseCronField(f, i); err != nil {
+			return nil, errors.Annotatef(err, "cron expression %q", spec)
+		}
+	}
+	// Sunday can be written as 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+
+	return c, nil
+}
+
+func parseCronField(field string, pos int) (set uint64, err error) {
+	f := cronFields[pos]
+	max := f.max
+	if pos == 4 {
+		max = 7
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		lo, hi, step := f.min, f.max, 1
+
+		rng := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, errors.NotValidf("step in %q", part)
+			}
+		}
+
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = cronValue(bounds[0], f.names); err != nil {
+				return 0, errors.Trace(err)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = cronValue(bounds[1], f.names); err != nil {
+					return 0, errors.Trace(err)
+				}
+			} else if step > 1 {
+				hi = f.max
+			}
+		}
+
+		if lo < f.min || hi > max || lo > hi {
+			return 0, errors.NotValidf("range %q", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+func cronValue(s string, names []string) (v int, err error) {
+	for i, n := range names {
+		if strings.EqualFold(s, n) {
+			// Month names start at 1, day names at 0
+			if len(names) == 12 {
+				return i + 1, nil
+			}
+			return i, nil
+		}
+	}
+
+	if v, err = strconv.Atoi(s); err != nil {
+		return 0, errors.NotValidf("cron value %q", s)
+	}
+
+	return v, nil
+}
+
+// Returns the first matching minute after the given time. As with cron,
+// when both day fields are restricted a day matching either runs.
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+
+	// Every valid expression matches within a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+
+	return dom || dow
+}
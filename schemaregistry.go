@@ -0,0 +1,283 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// Content type of Confluent Schema Registry requests and responses.
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// Confluent's wire format frames each Avro record with a zero magic byte
+// and its schema's 4 byte big endian ID.
+const (
+	schemaRegistryMagic  = 0
+	schemaRegistryHeader = 5
+)
+
+// SchemaRegistry registers and looks up Avro schemas in a Confluent Schema
+// Registry, and frames records with their schema's ID as Kafka producers
+// and consumers using it expect.
+type SchemaRegistry struct {
+	URL        string //Base URL, e.g. http://registry:8081
+	Username   string //Basic auth user, none if empty
+	Password   string //Secret reference to the basic auth password
+	LookupOnly bool   //Only look up schemas, failing if they aren't registered, rather than registering them
+
+	mu      sync.Mutex
+	schemas map[int]*avroType //Parsed schemas by ID
+}
+
+// Creates a schema registry client. The URL's user info, if any, is the
+// basic auth user and password.
+func NewSchemaRegistry(uri string) (r *SchemaRegistry, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.NotValidf("schema registry URL %q", uri)
+	}
+
+	r = &SchemaRegistry{schemas: map[int]*avroType{}}
+	if u.User != nil {
+		r.Username = u.User.Username()
+		r.Password, _ = u.User.Password()
+		u.User = nil
+	}
+	r.URL = strings.TrimSuffix(u.String(), "/")
+
+	return r, nil
+}
+
+// Returns the subject of a topic's key or value schemas under the
+// registry's default TopicNameStrategy.
+func SubjectName(topic string, key bool) string {
+	if key {
+		return topic + "-key"
+	}
+
+	return topic + "-value"
+}
+
+// schemaRegistryError is an error the registry replied with.
+type schemaRegistryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func (e *schemaRegistryError) Error() string {
+	return fmt.Sprintf("schema registry error %d: %s", e.ErrorCode, e.Message)
+}
+
+// do sends a request with the body as JSON, decoding the reply into res.
+// Subjects and schemas which aren't found are NotFound errors.
+func (r *SchemaRegistry) do(ctx context.Context, method string, path string, body interface{}, res interface{}) (err error) {
+	var b []byte
+
+	if body != nil {
+		if b, err = json.Marshal(body); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	req.Header.Set("Accept", schemaRegistryContentType)
+	if r.Username != "" {
+		var password string
+		if password, err = ResolveSecret(ctx, r.Password); err != nil {
+			return errors.Trace(err)
+		}
+		req.SetBasicAuth(r.Username, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		e := &schemaRegistryError{}
+		if json.NewDecoder(resp.Body).Decode(e) != nil || e.ErrorCode == 0 {
+			return errors.Errorf("schema registry returned %s", resp.Status)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return errors.NewNotFound(e, "")
+		}
+		return errors.Trace(e)
+	}
+
+	return errors.Annotate(json.NewDecoder(resp.Body).Decode(res), "decoding schema registry reply")
+}
+
+// Registers the schema under the subject, returning its ID. Registering a
+// schema the subject already has returns its existing ID, while one the
+// subject's compatibility setting rejects is an error.
+func (r *SchemaRegistry) Register(ctx context.Context, subject string, schema []byte) (id int, err error) {
+	var res struct {
+		ID int `json:"id"`
+	}
+
+	if err = r.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", map[string]string{"schema": string(schema)}, &res); err != nil {
+		return 0, errors.Annotatef(err, "registering %s schema", subject)
+	}
+
+	return res.ID, nil
+}
+
+// Returns the ID of the schema under the subject, or a NotFound error if the
+// subject doesn't have it.
+func (r *SchemaRegistry) Lookup(ctx context.Context, subject string, schema []byte) (id int, err error) {
+	var res struct {
+		ID int `json:"id"`
+	}
+
+	if err = r.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject), map[string]string{"schema": string(schema)}, &res); err != nil {
+		return 0, errors.Annotatef(err, "looking up %s schema", subject)
+	}
+
+	return res.ID, nil
+}
+
+// schemaID registers the schema under the subject, or only looks it up if
+// the registry is LookupOnly.
+func (r *SchemaRegistry) schemaID(ctx context.Context, subject string, schema []byte) (id int, err error) {
+	if r.LookupOnly {
+		id, err = r.Lookup(ctx, subject, schema)
+	} else {
+		id, err = r.Register(ctx, subject, schema)
+	}
+
+	return id, errors.Trace(err)
+}
+
+// schema returns the parsed record schema with the ID, fetching it once.
+func (r *SchemaRegistry) schema(ctx context.Context, id int) (t *avroType, err error) {
+	var res struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+
+	r.mu.Lock()
+	t = r.schemas[id]
+	r.mu.Unlock()
+	if t != nil {
+		return t, nil
+	}
+
+	if err = r.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &res); err != nil {
+		return nil, errors.Annotatef(err, "fetching schema %d", id)
+	}
+	if res.SchemaType != "" && res.SchemaType != "AVRO" {
+		return nil, errors.NotSupportedf("%s schema %d", res.SchemaType, id)
+	}
+
+	var v interface{}
+	if err = json.Unmarshal([]byte(res.Schema), &v); err != nil {
+		return nil, errors.Annotatef(err, "reading schema %d", id)
+	}
+	if t, err = parseAvroSchema(v, map[string]*avroType{}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if t.Type != "record" {
+		return nil, errors.NotSupportedf("schema %d of %s", id, t.Type)
+	}
+
+	r.mu.Lock()
+	if r.schemas == nil {
+		r.schemas = map[int]*avroType{}
+	}
+	r.schemas[id] = t
+	r.mu.Unlock()
+
+	return t, nil
+}
+
+// AvroSerializer encodes rows as Avro records framed with their schema's
+// registry ID.
+type AvroSerializer struct {
+	id     int
+	schema *avroType
+}
+
+// Returns a serializer for records named name whose schema is derived from
+// the column types, registering the schema under the subject, or looking
+// it up if the registry is LookupOnly.
+func (r *SchemaRegistry) Serializer(ctx context.Context, subject string, name string, types []ColumnType, m AvroTypes) (s *AvroSerializer, err error) {
+	var schema []byte
+
+	s = &AvroSerializer{}
+	if schema, s.schema, err = avroSchemaFor(name, types, m); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.id, err = r.schemaID(ctx, subject, schema); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+// Returns the registry ID of the serializer's schema.
+func (s *AvroSerializer) SchemaID() int {
+	return s.id
+}
+
+// Appends the row's framed record to buf.
+func (s *AvroSerializer) Serialize(buf []byte, values []interface{}) (out []byte, err error) {
+	if len(values) != len(s.schema.Fields) {
+		return nil, errors.Errorf("row has %d values for %d fields", len(values), len(s.schema.Fields))
+	}
+
+	buf = append(buf, schemaRegistryMagic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(s.id))
+	for i, f := range s.schema.Fields {
+		if buf, err = appendAvro(buf, f.Type, values[i]); err != nil {
+			return nil, errors.Annotatef(err, "column %s", f.Name)
+		}
+	}
+
+	return buf, nil
+}
+
+// Decodes a framed record, fetching its schema by the ID it's framed with,
+// into its field names and values.
+func (r *SchemaRegistry) Deserialize(ctx context.Context, msg []byte) (columns []string, values []interface{}, err error) {
+	var t *avroType
+
+	if len(msg) < schemaRegistryHeader || msg[0] != schemaRegistryMagic {
+		return nil, nil, errors.NotValidf("record without the schema registry magic byte")
+	}
+	if t, err = r.schema(ctx, int(binary.BigEndian.Uint32(msg[1:schemaRegistryHeader]))); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	d := avroDecoder{r: bytes.NewReader(msg[schemaRegistryHeader:])}
+	for _, f := range t.Fields {
+		var v interface{}
+		if v, err = d.value(f.Type); err != nil {
+			return nil, nil, errors.Annotatef(err, "column %s", f.Name)
+		}
+		columns = append(columns, f.Name)
+		values = append(values, v)
+	}
+	if d.r.Len() > 0 {
+		return nil, nil, errors.NotValidf("record with %d bytes after its fields", d.r.Len())
+	}
+
+	return columns, values, nil
+}
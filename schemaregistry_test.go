@@ -0,0 +1,217 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// fakeRegistry is a schema registry keeping one schema per subject, which
+// rejects registering another as incompatible.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	schemas  []string       //Schemas by ID less one
+	subjects map[string]int //Schema IDs by subject
+}
+
+// startRegistry serves a fake schema registry to user etl with password
+// secret.
+func startRegistry(t *testing.T) (srv *httptest.Server, reg *fakeRegistry) {
+	t.Helper()
+
+	reg = &fakeRegistry{subjects: map[string]int{}}
+	srv = httptest.NewServer(reg)
+	t.Cleanup(srv.Close)
+
+	return srv, reg
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Schema string `json:"schema"`
+	}
+
+	reply := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", schemaRegistryContentType)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	if user, password, _ := r.BasicAuth(); user != "etl" || password != "secret" {
+		reply(http.StatusUnauthorized, map[string]interface{}{"error_code": 401, "message": "Unauthorized"})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "schemas" && path[1] == "ids":
+		id, _ := strconv.Atoi(path[2])
+		if id < 1 || id > len(f.schemas) {
+			reply(http.StatusNotFound, map[string]interface{}{"error_code": 40403, "message": "Schema not found"})
+			return
+		}
+		reply(http.StatusOK, map[string]string{"schema": f.schemas[id-1]})
+		return
+	case r.Method != http.MethodPost || path[0] != "subjects":
+		reply(http.StatusNotFound, map[string]interface{}{"error_code": 404, "message": "HTTP 404 Not Found"})
+		return
+	}
+
+	json.NewDecoder(r.Body).Decode(&req)
+	id, ok := f.subjects[path[1]]
+	if len(path) == 2 {
+		if !ok || f.schemas[id-1] != req.Schema {
+			reply(http.StatusNotFound, map[string]interface{}{"error_code": 40401, "message": "Subject '" + path[1] + "' not found."})
+			return
+		}
+	} else if !ok {
+		f.schemas = append(f.schemas, req.Schema)
+		id = len(f.schemas)
+		f.subjects[path[1]] = id
+	} else if f.schemas[id-1] != req.Schema {
+		reply(http.StatusConflict, map[string]interface{}{"error_code": 409, "message": "Schema being registered is incompatible with an earlier schema"})
+		return
+	}
+	reply(http.StatusOK, map[string]int{"id": id})
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	srv, _ := startRegistry(t)
+	ctx := context.Background()
+
+	r, err := NewSchemaRegistry(strings.Replace(srv.URL, "://", "://etl:secret@", 1) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.URL != srv.URL || r.Username != "etl" || r.Password != "secret" {
+		t.Errorf("registry %s as %s:%s", r.URL, r.Username, r.Password)
+	}
+
+	schema := []byte(`{"type":"record","name":"orders","fields":[{"name":"id","type":"long"}]}`)
+	if _, err = r.Lookup(ctx, "orders-value", schema); !errors.IsNotFound(err) {
+		t.Errorf("looking up an unregistered schema = %v", err)
+	}
+	id, err := r.Register(ctx, "orders-value", schema)
+	if err != nil || id != 1 {
+		t.Fatalf("registered schema %d, %v", id, err)
+	}
+	if id, err = r.Register(ctx, "orders-value", schema); err != nil || id != 1 {
+		t.Errorf("registered the schema again as %d, %v", id, err)
+	}
+	if id, err = r.Lookup(ctx, "orders-value", schema); err != nil || id != 1 {
+		t.Errorf("looked up schema %d, %v", id, err)
+	}
+
+	other := []byte(`{"type":"record","name":"orders","fields":[{"name":"id","type":"string"}]}`)
+	if _, err = r.Register(ctx, "orders-value", other); err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Errorf("registering an incompatible schema = %v", err)
+	}
+
+	r.Password = "wrong"
+	if _, err = r.Register(ctx, "orders-value", schema); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong password error = %v", err)
+	}
+
+	if _, err = NewSchemaRegistry("registry:8081"); err == nil {
+		t.Error("a registry URL without a scheme was accepted")
+	}
+	if s := SubjectName("orders", true); s != "orders-key" {
+		t.Errorf("key subject = %s", s)
+	}
+}
+
+func TestAvroSerializer(t *testing.T) {
+	srv, reg := startRegistry(t)
+	ctx := context.Background()
+
+	r, _ := NewSchemaRegistry(strings.Replace(srv.URL, "://", "://etl:secret@", 1))
+	types := []ColumnType{{Name: "id", DatabaseType: "BIGINT"}, {Name: "name", DatabaseType: "VARCHAR"}, {Name: "created", DatabaseType: "TIMESTAMP"}}
+
+	r.LookupOnly = true
+	if _, err := r.Serializer(ctx, "orders-value", "orders", types, AvroTypes{}); !errors.IsNotFound(err) {
+		t.Errorf("looking up an unregistered schema = %v", err)
+	}
+	r.LookupOnly = false
+
+	s, err := r.Serializer(ctx, "orders-value", "orders", types, AvroTypes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.SchemaID() != 1 || len(reg.schemas) != 1 {
+		t.Fatalf("schema %d of %d registered", s.SchemaID(), len(reg.schemas))
+	}
+
+	created := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	msg, err := s.Serialize(nil, []interface{}{int64(7), nil, created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(msg, []byte{0, 0, 0, 0, 1}) {
+		t.Errorf("record framed with % x", msg[:5])
+	}
+
+	// A new client fetches the schema by the ID the record's framed with
+	d, _ := NewSchemaRegistry(strings.Replace(srv.URL, "://", "://etl:secret@", 1))
+	columns, values, err := d.Deserialize(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columns, []string{"id", "name", "created"}) || !reflect.DeepEqual(values, []interface{}{int64(7), nil, created}) {
+		t.Errorf("decoded %v %v", columns, values)
+	}
+
+	if _, err = s.Serialize(nil, []interface{}{int64(7)}); err == nil {
+		t.Error("serializing a short row didn't fail")
+	}
+	if _, _, err = d.Deserialize(ctx, append([]byte{1}, msg[1:]...)); err == nil || !strings.Contains(err.Error(), "magic") {
+		t.Errorf("wrong magic byte error = %v", err)
+	}
+	if _, _, err = d.Deserialize(ctx, []byte{0, 0, 0, 0, 9, 0}); !errors.IsNotFound(err) {
+		t.Errorf("unknown schema ID error = %v", err)
+	}
+}
+
+func TestFileWriterSchemaRegistry(t *testing.T) {
+	srv, reg := startRegistry(t)
+	dir := t.TempDir()
+
+	write := func(name string, columns []string) (w *FileWriter, err error) {
+		if w, err = CreateFileWriter(filepath.Join(dir, name), "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		w.Registry, _ = NewSchemaRegistry(strings.Replace(srv.URL, "://", "://etl:secret@", 1))
+		w.SetColumns(columns)
+		if err = w.AppendValues(context.Background(), []interface{}{int64(1)}); err != nil {
+			abortWriter(w)
+			return w, err
+		}
+		return w, w.Close()
+	}
+
+	w, err := write("orders.avro", []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SchemaID() != 1 || reg.subjects["orders-value"] != 1 {
+		t.Errorf("schema %d registered under %v", w.SchemaID(), reg.subjects)
+	}
+
+	// The subject already has a schema with another column
+	if _, err = write("orders.avro", []string{"order_id"}); err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Errorf("writing with an incompatible schema = %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package godatapipe
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/xo/dburl"
+)
+
+// SecretProvider resolves secret references such as
+// vault://secret/data/db#password to their values.
+type SecretProvider interface {
+	Secret(ctx context.Context, ref string) (value string, err error)
+}
+
+// SecretProviderFunc adapts a function to a SecretProvider.
+type SecretProviderFunc func(ctx context.Context, ref string) (value string, err error)
+
+func (f SecretProviderFunc) Secret(ctx context.Context, ref string) (value string, err error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"file":  SecretProviderFunc(fileSecret),
+		"env":   SecretProviderFunc(envSecret),
+		"vault": SecretProviderFunc(vaultSecret)}
+)
+
+// Registers a secret provider for references starting with scheme://,
+// e.g. aws-sm or gcp-sm backed by the cloud provider's SDK, replacing any
+// provider previously registered for that scheme.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	if p == nil {
+		delete(secretProviders, scheme)
+		return
+	}
+
+	secretProviders[scheme] = p
+}
+
+// Returns the value of a secret reference. Values which don't start with
+// a registered scheme:// are returned as they are.
+func ResolveSecret(ctx context.Context, value string) (secret string, err error) {
+	i := strings.Index(value, "://")
+	if i <= 0 {
+		return value, nil
+	}
+
+	secretProvidersMu.RLock()
+	p := secretProviders[value[:i]]
+	secretProvidersMu.RUnlock()
+
+	if p == nil {
+		return value, nil
+	}
+
+	if secret, err = p.Secret(ctx, value); err != nil {
+		return "", errors.Annotatef(err, "resolving %s secret", value[:i])
+	}
+
+	return secret, nil
+}
+
+// Returns the database URL with its password resolved. A non-empty
+// password replaces the URL's own one, and either can be a secret
+// reference.
+func ResolveURI(ctx context.Context, uri string, password string) (resolved string, err error) {
+	var u *dburl.URL
+
+	if u, err = dburl.Parse(uri); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if password == "" && u.URL.User != nil {
+		password, _ = u.URL.User.Password()
+	}
+	if password == "" {
+		return uri, nil
+	}
+
+	if password, err = ResolveSecret(ctx, password); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	user := ""
+	if u.URL.User != nil {
+		user = u.URL.User.Username()
+	}
+	u.URL.User = url.UserPassword(user, password)
+
+	return u.URL.String(), nil
+}
+
+// fileSecret reads a file:///path reference, trimming the trailing
+// newline secret files are usually written with.
+func fileSecret(ctx context.Context, ref string) (value string, err error) {
+	b, err := os.ReadFile(strings.TrimPrefix(ref, "file://"))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// envSecret reads an env://NAME reference from the environment.
+func envSecret(ctx context.Context, ref string) (value string, err error) {
+	name := strings.TrimPrefix(ref, "env://")
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.NotFoundf("env variable %s", name)
+	}
+
+	return value, nil
+}
+
+// vaultSecret reads a vault://path#key reference from the HashiCorp Vault
+// server at VAULT_ADDR using VAULT_TOKEN. Both KV version 1 and version 2
+// paths (secret/data/...) are read.
+func vaultSecret(ctx context.Context, ref string) (value string, err error) {
+	path, key, _ := strings.Cut(strings.TrimPrefix(ref, "vault://"), "#")
+	if key == "" {
+		return "", errors.NotValidf("vault reference %q without a #key", ref)
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.NotFoundf("VAULT_ADDR")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+
+	s, ok := data[key].(string)
+	if !ok {
+		return "", errors.NotFoundf("key %s in vault secret %s", key, path)
+	}
+
+	return s, nil
+}
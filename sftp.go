@@ -0,0 +1,228 @@
+package godatapipe
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpClient is an SFTP client and the SSH connection it runs over.
+type sftpClient struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+// Closes the client and its connection.
+func (c *sftpClient) Close() (err error) {
+	c.Client.Close()
+
+	return errors.Trace(c.conn.Close())
+}
+
+// dialSFTP connects and logs in to the server in an sftp:// URL, whose
+// host key must be in the known_hosts file, ~/.ssh/known_hosts by default,
+// or match the host_key SHA256 fingerprint. Logins use the password, in
+// the URL or a password query parameter, the private key in a key query
+// parameter with its passphrase, or else an SSH agent's keys.
+func dialSFTP(ctx context.Context, u *url.URL) (c *sftpClient, err error) {
+	var auth []ssh.AuthMethod
+	var hostKey ssh.HostKeyCallback
+
+	q := u.Query()
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.NotValidf("SFTP URL without a user")
+	}
+
+	password, ok := u.User.Password()
+	if !ok {
+		password = q.Get("password")
+	}
+	if password != "" {
+		if password, err = ResolveSecret(ctx, password); err != nil {
+			return nil, errors.Trace(err)
+		}
+		auth = append(auth, ssh.Password(password))
+	}
+	if ref := q.Get("key"); ref != "" {
+		var signer ssh.Signer
+		if signer, err = sftpSigner(ctx, ref, q.Get("passphrase")); err != nil {
+			return nil, errors.Annotate(err, "reading SFTP private key")
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); len(auth) == 0 && sock != "" {
+		var ac net.Conn
+		if ac, err = net.Dial("unix", sock); err != nil {
+			return nil, errors.Annotate(err, "connecting to the SSH agent")
+		}
+		defer ac.Close()
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(ac).Signers))
+	}
+
+	if fingerprint := q.Get("host_key"); fingerprint != "" {
+		// Unescaped base64 pluses are decoded as spaces
+		fingerprint = strings.ReplaceAll(fingerprint, " ", "+")
+		hostKey = func(host string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != fingerprint {
+				return errors.Errorf("host key %s of %s isn't %s", ssh.FingerprintSHA256(key), host, fingerprint)
+			}
+			return nil
+		}
+	} else {
+		file := q.Get("known_hosts")
+		if file == "" {
+			var home string
+			if home, err = os.UserHomeDir(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		if hostKey, err = knownhosts.New(file); err != nil {
+			return nil, errors.Annotate(err, "reading SFTP known hosts")
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(nc, addr, &ssh.ClientConfig{User: u.User.Username(), Auth: auth, HostKeyCallback: hostKey})
+	if err != nil {
+		nc.Close()
+		return nil, errors.Annotatef(err, "connecting to %s", addr)
+	}
+
+	c = &sftpClient{conn: ssh.NewClient(sc, chans, reqs)}
+	if c.Client, err = sftp.NewClient(c.conn, sftp.UseConcurrentWrites(true)); err != nil {
+		c.conn.Close()
+		return nil, errors.Annotatef(err, "starting SFTP on %s", addr)
+	}
+
+	return c, nil
+}
+
+// sftpSigner returns the private key a secret reference, or path, holds.
+func sftpSigner(ctx context.Context, ref string, passphrase string) (signer ssh.Signer, err error) {
+	var pem string
+
+	if pem, err = ResolveSecret(ctx, ref); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !strings.Contains(pem, "PRIVATE KEY") {
+		var b []byte
+		if b, err = os.ReadFile(pem); err != nil {
+			return nil, errors.Trace(err)
+		}
+		pem = string(b)
+	}
+	if passphrase == "" {
+		signer, err = ssh.ParsePrivateKey([]byte(pem))
+		return signer, errors.Trace(err)
+	}
+
+	if passphrase, err = ResolveSecret(ctx, passphrase); err != nil {
+		return nil, errors.Trace(err)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(pem), []byte(passphrase))
+
+	return signer, errors.Trace(err)
+}
+
+// sftpFile reads or writes a file through an SFTP client of its own.
+type sftpFile struct {
+	*sftp.File
+	c    *sftpClient
+	path string //File renamed to on closing, empty for reading
+	part string //File written to until it's closed
+}
+
+// openSFTPFile opens the file in an sftp:// URL for reading.
+func openSFTPFile(ctx context.Context, u *url.URL) (f *sftpFile, err error) {
+	f = &sftpFile{}
+	if f.c, err = dialSFTP(ctx, u); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.File, err = f.c.Open(sftpPath(u)); err != nil {
+		f.c.Close()
+		return nil, errors.Annotatef(err, "opening %s", sftpPath(u))
+	}
+
+	return f, nil
+}
+
+// createSFTPFile creates the file in an sftp:// URL, which is written as
+// a .part file renamed to it once it's closed, so it isn't picked up half
+// written.
+func createSFTPFile(ctx context.Context, u *url.URL) (f *sftpFile, err error) {
+	f = &sftpFile{path: sftpPath(u)}
+	f.part = f.path + ".part"
+	if f.c, err = dialSFTP(ctx, u); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if f.File, err = f.c.OpenFile(f.part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		f.c.Close()
+		return nil, errors.Annotatef(err, "creating %s", f.part)
+	}
+
+	return f, nil
+}
+
+// sftpPath returns a URL's path, relative to the home directory if it
+// starts with /~/.
+func sftpPath(u *url.URL) string {
+	if strings.HasPrefix(u.Path, "/~/") {
+		return u.Path[3:]
+	}
+
+	return u.Path
+}
+
+// Closes the file, renaming a file written to its name, replacing any
+// file already there.
+func (f *sftpFile) Close() (err error) {
+	defer f.c.Close()
+
+	if err = f.File.Close(); err != nil {
+		return errors.Annotatef(err, "closing %s", f.File.Name())
+	}
+	if f.path == "" {
+		return nil
+	}
+
+	// Version 3 renames fail if the file exists, so without OpenSSH's
+	// atomic rename the file is removed first
+	if err = f.c.PosixRename(f.part, f.path); err == nil {
+		return nil
+	}
+	if err = f.c.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Annotatef(err, "replacing %s", f.path)
+	}
+	if err = f.c.Rename(f.part, f.path); err != nil {
+		return errors.Annotatef(err, "renaming %s", f.part)
+	}
+
+	return nil
+}
+
+// abort closes a file being written without renaming it, leaving the
+// .part file.
+func (f *sftpFile) abort() (err error) {
+	f.File.Close()
+
+	return errors.Trace(f.c.Close())
+}
@@ -0,0 +1,163 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// sheetsDriver writes to a Google Sheets spreadsheet through the Sheets
+// API. URIs are sheets://SPREADSHEET_ID with an optional query parameter:
+// token, a secret reference to an OAuth access token, by default the
+// instance metadata server's. The table is the name of the sheet, which
+// is cleared and written with a header row.
+type sheetsDriver struct{}
+
+func (sheetsDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from Google Sheets")
+}
+
+func (sheetsDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if u.Host == "" {
+		return nil, errors.NotValidf("Sheets URI %q without a spreadsheet ID", uri)
+	}
+	s := &sheetsWriter{
+		endpoint: "https://sheets.googleapis.com/v4/spreadsheets/" + url.PathEscape(u.Host),
+		sheet:    "'" + strings.ReplaceAll(table, "'", "''") + "'"}
+
+	if ref := u.Query().Get("token"); ref != "" {
+		if s.token, err = ResolveSecret(ctx, ref); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if s.token, err = metadataToken(ctx); err != nil {
+		return nil, errors.Annotate(err, "getting a Google Sheets access token")
+	}
+
+	if err = s.call(ctx, ":clear", nil); err != nil {
+		return nil, errors.Annotatef(err, "clearing sheet %s", table)
+	}
+
+	return s, nil
+}
+
+// sheetsWriter appends record batches' rows to a sheet, after a header row
+// of the first batch's fields.
+type sheetsWriter struct {
+	endpoint string
+	sheet    string //Quoted sheet name, as ranges name it
+	token    string
+	header   bool
+}
+
+func (s *sheetsWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	var rows [][]interface{}
+
+	if !s.header {
+		h := make([]interface{}, len(b.Fields))
+		for i, f := range b.Fields {
+			h[i] = sheetsValue(f.Name)
+		}
+		rows = append(rows, h)
+	}
+
+	row := make([]interface{}, len(b.Fields))
+	for i := 0; i < b.NumRows; i++ {
+		row = b.Row(i, row)
+		r := make([]interface{}, len(row))
+		for c, v := range row {
+			r[c] = sheetsValue(v)
+		}
+		rows = append(rows, r)
+	}
+
+	if err = s.call(ctx, ":append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS", rows); err != nil {
+		return errors.Annotate(err, "appending to Google Sheet")
+	}
+	s.header = true
+
+	return nil
+}
+
+// call posts the rows, if any, to the method on the sheet's range.
+func (s *sheetsWriter) call(ctx context.Context, method string, rows [][]interface{}) (err error) {
+	in := map[string]interface{}{}
+	if rows != nil {
+		in["values"] = rows
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/values/"+url.PathEscape(s.sheet)+method, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error struct {
+				Status  string
+				Message string
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error.Status == "" {
+			e.Error.Status = resp.Status
+		}
+		return errors.Errorf("sheets: %s: %s", e.Error.Status, e.Error.Message)
+	}
+
+	return nil
+}
+
+func (s *sheetsWriter) Close() (err error) {
+	return nil
+}
+
+// sheetsValue returns a value as it's entered into a cell, so numbers,
+// booleans and times are typed the way Sheets would type them if they
+// were typed in. Text is prefixed with ' so it's kept as it is, rather
+// than parsed as a number or run as a formula.
+func sheetsValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		return t
+	case int64, int32, int16, int8, int, uint64, uint32, uint16, uint8:
+		return t
+	case float64, float32:
+		if f, _ := recordFloat(t); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			return t.Format(time.DateOnly)
+		}
+		return t.Format(time.DateTime)
+	}
+
+	return "'" + fileText(v)
+}
@@ -0,0 +1,542 @@
+package godatapipe
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// A snapshot is a directory holding a table's rows in JSON lines chunks,
+// gzipped by default, each row an array of values, and snapshot.json describing the
+// columns and listing the chunks. It's written last, so a snapshot without
+// it is incomplete.
+const snapshotManifest = "snapshot.json"
+
+// SnapshotColumn describes a snapshot column. Kind is how its values are
+// encoded: int, float, bool, string, bytes as base64, or time as RFC 3339.
+type SnapshotColumn struct {
+	ColumnType
+	Kind string
+}
+
+// SnapshotManifest describes a snapshot.
+type SnapshotManifest struct {
+	Version     int
+	Table       string
+	CreatedAt   time.Time
+	RowCount    int
+	Columns     []SnapshotColumn
+	Compression string   //Codec the chunks are compressed with, or none
+	Encrypted   bool     //Whether the chunks are encrypted
+	Chunks      []string //Chunk file names in row order
+}
+
+// SnapshotWriter writes rows to a snapshot directory. Set it as
+// Config.DstWriter to export a table without a destination database.
+type SnapshotWriter struct {
+	ChunkRows int    //Rows per chunk file, defaults to 100000
+	Codec     Codec  //Chunk compression, gzip by NewSnapshotWriter, none if nil
+	Key       []byte //AES key encrypting the chunks, if any
+
+	dir      string
+	manifest SnapshotManifest
+
+	file *os.File
+	enc  io.WriteCloser
+	w    io.WriteCloser
+	buf  *bufio.Writer
+	rows int //Rows in the current chunk
+	cell []interface{}
+
+	rolledBack bool
+}
+
+// Returns a writer creating the snapshot directory if need be. The column
+// types, if known, are kept in the manifest so the table can be created
+// on import; otherwise they're guessed from the values.
+func NewSnapshotWriter(dir string, table string, types []ColumnType) (w *SnapshotWriter, err error) {
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Any old manifest would describe the wrong chunks
+	if err = os.Remove(filepath.Join(dir, snapshotManifest)); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+
+	w = &SnapshotWriter{
+		ChunkRows: 100000,
+		Codec:     gzipCodec{},
+		dir:       dir,
+		manifest:  SnapshotManifest{Version: 1, Table: table, CreatedAt: time.Now().UTC()}}
+	for _, ct := range types {
+		w.manifest.Columns = append(w.manifest.Columns, SnapshotColumn{ColumnType: ct})
+	}
+
+	return w, nil
+}
+
+// Sets the column names, called by the pipeline before the first row.
+func (w *SnapshotWriter) SetColumns(columns []string) {
+	cols := make([]SnapshotColumn, len(columns))
+	for i, name := range columns {
+		for _, c := range w.manifest.Columns {
+			if c.Name == name {
+				cols[i] = c
+			}
+		}
+		cols[i].Name = name
+	}
+	w.manifest.Columns = cols
+}
+
+func (w *SnapshotWriter) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	if w.w == nil {
+		if err = w.openChunk(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(w.cell) != len(values) {
+		w.cell = make([]interface{}, len(values))
+	}
+	for i, v := range values {
+		if i >= len(w.manifest.Columns) {
+			return errors.Errorf("row has %d values for %d columns", len(values), len(w.manifest.Columns))
+		}
+		w.cell[i] = encodeSnapshotValue(&w.manifest.Columns[i], v)
+	}
+
+	b, err := json.Marshal(w.cell)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = w.buf.Write(append(b, '\n')); err != nil {
+		return errors.Trace(err)
+	}
+
+	w.rows++
+	w.manifest.RowCount++
+	if w.rows >= w.ChunkRows {
+		return errors.Trace(w.closeChunk())
+	}
+
+	return nil
+}
+
+// Rows are written as they're appended, so flushing only finishes the
+// current chunk.
+func (w *SnapshotWriter) Flush(ctx context.Context) (totalRowCount int, err error) {
+	if err = w.closeChunk(); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return w.manifest.RowCount, nil
+}
+
+// Rows can't be taken back out of the chunks, the snapshot just isn't
+// finished by Close.
+func (w *SnapshotWriter) Rollback() (committedRowCount int, err error) {
+	w.closeChunk()
+	w.rolledBack = true
+
+	return 0, nil
+}
+
+// Writes the manifest, finishing the snapshot, unless it was rolled back.
+func (w *SnapshotWriter) Close() (err error) {
+	if err = w.closeChunk(); err != nil {
+		return errors.Trace(err)
+	}
+	if w.rolledBack {
+		return nil
+	}
+
+	w.manifest.Compression = "none"
+	w.manifest.Encrypted = w.Key != nil
+	if w.Codec != nil {
+		w.manifest.Compression = w.Codec.Name()
+	}
+
+	for i := range w.manifest.Columns {
+		c := &w.manifest.Columns[i]
+		if c.DatabaseType == "" {
+			c.DatabaseType, c.Nullable = snapshotKindType[c.Kind], true
+		}
+	}
+
+	b, err := json.MarshalIndent(&w.manifest, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.WriteFile(filepath.Join(w.dir, snapshotManifest), append(b, '\n'), 0o644))
+}
+
+func (w *SnapshotWriter) openChunk() (err error) {
+	name := fmt.Sprintf("data-%05d.jsonl", len(w.manifest.Chunks))
+	if w.Codec != nil {
+		name += w.Codec.Extension()
+	}
+	if w.Key != nil {
+		name += encryptExt
+	}
+	if w.file, err = os.Create(filepath.Join(w.dir, name)); err != nil {
+		return errors.Trace(err)
+	}
+
+	var out io.Writer = w.file
+	if w.Key != nil {
+		if w.enc, err = encryptTo(w.file, w.Key); err != nil {
+			w.file.Close()
+			return errors.Trace(err)
+		}
+		out = w.enc
+	}
+	if w.w, err = compressWriter(w.Codec, out); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	w.buf = bufio.NewWriter(w.w)
+	w.rows = 0
+	w.manifest.Chunks = append(w.manifest.Chunks, name)
+
+	return nil
+}
+
+func (w *SnapshotWriter) closeChunk() (err error) {
+	if w.w == nil {
+		return nil
+	}
+
+	defer func() {
+		w.file, w.enc, w.w, w.buf = nil, nil, nil, nil
+	}()
+
+	if err = w.buf.Flush(); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if err = w.w.Close(); err != nil {
+		w.file.Close()
+		return errors.Trace(err)
+	}
+	if w.enc != nil {
+		if err = w.enc.Close(); err != nil {
+			w.file.Close()
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(w.file.Close())
+}
+
+// Database types of the columns whose types weren't given, by kind.
+var snapshotKindType = map[string]string{
+	"int": "bigint", "float": "double precision", "bool": "boolean",
+	"string": "text", "bytes": "bytea", "time": "timestamp", "": "text"}
+
+// encodeSnapshotValue returns the JSON value for v, setting the column's
+// kind from the first value which isn't NULL.
+func encodeSnapshotValue(c *SnapshotColumn, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	kind := "string"
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		kind = "int"
+	case float32, float64:
+		kind = "float"
+	case bool:
+		kind = "bool"
+	case []byte:
+		kind = "bytes"
+	case time.Time:
+		kind = "time"
+	}
+	if c.Kind == "" {
+		c.Kind = kind
+	}
+
+	switch t := v.(type) {
+	case []byte:
+		if c.Kind == "bytes" {
+			return base64.StdEncoding.EncodeToString(t)
+		}
+		return string(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	case string:
+		return t
+	}
+	if kind != c.Kind {
+		return valueText(v)
+	}
+
+	return v
+}
+
+// SnapshotSource reads the rows of a snapshot. Set it as Config.Source to
+// import a snapshot into the destination.
+type SnapshotSource struct {
+	Key []byte //AES key decrypting the chunks of an encrypted snapshot
+
+	dir      string
+	manifest SnapshotManifest
+
+	codec  Codec
+	chunk  int
+	file   *os.File
+	r      io.ReadCloser
+	dec    *json.Decoder
+	values []interface{}
+}
+
+// Opens a snapshot, which fails if it's incomplete.
+func OpenSnapshot(dir string) (s *SnapshotSource, err error) {
+	b, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("snapshot manifest in %s", dir)
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s = &SnapshotSource{dir: dir}
+	if err = json.Unmarshal(b, &s.manifest); err != nil {
+		return nil, errors.Annotatef(err, "reading %s", filepath.Join(dir, snapshotManifest))
+	}
+	if s.manifest.Version != 1 {
+		return nil, errors.NotSupportedf("snapshot version %d", s.manifest.Version)
+	}
+	if s.codec, err = CodecFor(s.manifest.Compression); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+// Returns the snapshot's description.
+func (s *SnapshotSource) Manifest() SnapshotManifest {
+	return s.manifest
+}
+
+func (s *SnapshotSource) Columns() (columns []string, err error) {
+	for _, c := range s.manifest.Columns {
+		columns = append(columns, c.Name)
+	}
+
+	return columns, nil
+}
+
+func (s *SnapshotSource) ColumnTypes() (types []ColumnType, err error) {
+	for _, c := range s.manifest.Columns {
+		types = append(types, c.ColumnType)
+	}
+
+	return types, nil
+}
+
+func (s *SnapshotSource) Next(ctx context.Context) (values []interface{}, err error) {
+	var cells []json.RawMessage
+
+	for {
+		if s.dec == nil {
+			if s.chunk >= len(s.manifest.Chunks) {
+				return nil, io.EOF
+			}
+			if err = s.openChunk(s.manifest.Chunks[s.chunk]); err != nil {
+				return nil, errors.Trace(err)
+			}
+			s.chunk++
+		}
+
+		if err = s.dec.Decode(&cells); err == io.EOF {
+			if err = s.closeChunk(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading %s", s.manifest.Chunks[s.chunk-1])
+		}
+		break
+	}
+
+	if len(cells) != len(s.manifest.Columns) {
+		return nil, errors.Errorf("%s: row has %d values for %d columns", s.manifest.Chunks[s.chunk-1], len(cells), len(s.manifest.Columns))
+	}
+
+	if s.values == nil {
+		s.values = make([]interface{}, len(cells))
+	}
+	for i, cell := range cells {
+		if s.values[i], err = decodeSnapshotValue(&s.manifest.Columns[i], cell); err != nil {
+			return nil, errors.Annotatef(err, "column %s", s.manifest.Columns[i].Name)
+		}
+	}
+
+	return s.values, nil
+}
+
+func (s *SnapshotSource) Close() (err error) {
+	return errors.Trace(s.closeChunk())
+}
+
+func (s *SnapshotSource) openChunk(name string) (err error) {
+	var f *os.File
+	var r io.Reader
+
+	if f, err = os.Open(filepath.Join(s.dir, name)); err != nil {
+		return errors.Trace(err)
+	}
+	if r, err = decryptReaderFor(f, s.Key); err != nil {
+		f.Close()
+		return errors.Annotatef(err, "reading %s", name)
+	}
+	if s.r, err = compressReader(s.codec, r); err != nil {
+		f.Close()
+		return errors.Annotatef(err, "reading %s", name)
+	}
+
+	s.file = f
+	s.dec = json.NewDecoder(s.r)
+	s.dec.UseNumber()
+
+	return nil
+}
+
+func (s *SnapshotSource) closeChunk() (err error) {
+	if s.file == nil {
+		return nil
+	}
+
+	s.r.Close()
+	err = s.file.Close()
+	s.file, s.r, s.dec = nil, nil, nil
+
+	return errors.Trace(err)
+}
+
+// decodeSnapshotValue returns the value of a cell of the column.
+func decodeSnapshotValue(c *SnapshotColumn, cell json.RawMessage) (v interface{}, err error) {
+	var s string
+
+	if string(cell) == "null" {
+		return nil, nil
+	}
+
+	if cell[0] != '"' {
+		var n json.Number
+		var b bool
+
+		if err = json.Unmarshal(cell, &b); err == nil {
+			return b, nil
+		}
+		if err = json.Unmarshal(cell, &n); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if c.Kind == "int" {
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+			if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+				return u, nil
+			}
+		}
+		return n.Float64()
+	}
+
+	if err = json.Unmarshal(cell, &s); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch c.Kind {
+	case "bytes":
+		return base64.StdEncoding.DecodeString(s)
+	case "time":
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return s, nil
+}
+
+// Copies the source rows into a snapshot in the directory instead of the
+// destination database. The source's column types are kept so the table
+// can be created on import.
+func ExportSnapshot(ctx context.Context, cfg *Config, dir string) (res *Result, err error) {
+	var types []ColumnType
+	var w *SnapshotWriter
+
+	if ct, ok := cfg.Source.(ColumnTyper); ok {
+		if types, err = ct.ColumnTypes(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if cfg.Source == nil && !hasTemplate(cfg.SrcSelectSql) {
+		var conn *sql.Conn
+		var release func()
+
+		if _, conn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+			return nil, errors.Trace(err)
+		}
+		types, err = queryColumnTypes(ctx, conn, cfg.SrcSelectSql, cfg.SelectArgs()...)
+		release()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if w, err = NewSnapshotWriter(dir, cfg.DstTable, types); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if w.Key, err = cfg.encryptionKey(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cfg.DstCompression != "" {
+		if w.Codec, err = CodecFor(cfg.DstCompression); err != nil {
+			return nil, errors.Trace(newConfigError("DST_COMPRESSION", err))
+		}
+	}
+
+	c := *cfg
+	c.DstWriter = w
+	if res, err = NewPipeline(&c).Run(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res, nil
+}
+
+// Copies the rows of the snapshot in the directory into the destination
+// table, which is created from the snapshot's column types if it's
+// missing and Config.MissingTable is MissingTableCreate.
+func ImportSnapshot(ctx context.Context, cfg *Config, dir string) (res *Result, err error) {
+	var src *SnapshotSource
+
+	if src, err = OpenSnapshot(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer src.Close()
+	if src.Key, err = cfg.encryptionKey(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c := *cfg
+	c.Source = src
+	if res, err = NewPipeline(&c).Run(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,139 @@
+package godatapipe
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// SoftDeleteAction determines what happens to source rows marked as
+// deleted by Config.SoftDeleteColumn.
+type SoftDeleteAction int
+
+const (
+	SoftDeleteRemove SoftDeleteAction = iota //Don't copy the row, so it's deleted when mirroring
+	SoftDeleteFlag                           //Copy the row with SoftDeleteFlagColumn set to true
+)
+
+// Parses a SoftDeleteAction name: delete or flag.
+func ParseSoftDeleteAction(s string) (a SoftDeleteAction, err error) {
+	switch s {
+	case "", "delete":
+		return SoftDeleteRemove, nil
+	case "flag":
+		return SoftDeleteFlag, nil
+	}
+
+	return SoftDeleteRemove, errors.NotValidf("soft delete action %q", s)
+}
+
+// softDelete tracks whether the row going through the stages is marked
+// as deleted, between the stage reading the marker, which sees every
+// source column, and the stage writing the flag column.
+type softDelete struct {
+	cfg     *Config
+	pos     int //Position of the marker column in the source row
+	deleted bool
+}
+
+// newSoftDelete returns nil if soft deletes aren't configured.
+func newSoftDelete(cfg *Config, columns []string) (sd *softDelete, err error) {
+	if cfg.SoftDeleteColumn == "" {
+		return nil, nil
+	}
+
+	sd = &softDelete{cfg: cfg, pos: indexOf(columns, cfg.SoftDeleteColumn)}
+	if sd.pos < 0 {
+		return nil, errors.Trace(sourceColumnError(cfg.SoftDeleteColumn, "soft delete"))
+	}
+
+	return sd, nil
+}
+
+// markStage returns a stage noting whether each row is deleted, dropping
+// it unless deleted rows are flagged.
+func (sd *softDelete) markStage(res *Result) stage {
+	if sd == nil {
+		return nil
+	}
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		if sd.deleted = softDeleted(values[sd.pos]); !sd.deleted {
+			return values, nil
+		}
+
+		res.SoftDeletedRows++
+		if sd.cfg.SoftDeleteAction == SoftDeleteRemove {
+			return nil, nil
+		}
+
+		return values, nil
+	}
+}
+
+// flagStage returns a stage writing the flag column, appending it if it
+// isn't already a column, and the resulting columns.
+func (sd *softDelete) flagStage(columns []string) (s stage, outColumns []string) {
+	if sd == nil || sd.cfg.SoftDeleteAction != SoftDeleteFlag {
+		return nil, columns
+	}
+
+	flag := sd.cfg.SoftDeleteFlagColumn
+	if flag == "" {
+		flag = "is_deleted"
+	}
+
+	outColumns = columns
+	pos := indexOf(columns, flag)
+	if pos < 0 {
+		outColumns = append(append([]string{}, columns...), flag)
+	}
+
+	var row []interface{}
+
+	return func(rowNum int, values []interface{}) ([]interface{}, error) {
+		if pos >= 0 {
+			values[pos] = sd.deleted
+			return values, nil
+		}
+
+		row = append(append(row[:0], values...), sd.deleted)
+		return row, nil
+	}, outColumns
+}
+
+// softDeleted reports whether a marker value means the row is deleted: any
+// value other than NULL, false, zero, a zero time or an empty string.
+func softDeleted(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case time.Time:
+		return !t.IsZero()
+	case []byte:
+		return softDeletedText(string(t))
+	case string:
+		return softDeletedText(t)
+	}
+
+	if f, ok := numericValue(v); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+func softDeletedText(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+
+	return true
+}
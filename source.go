@@ -0,0 +1,135 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// Source produces the rows to copy.
+type Source interface {
+	// Returns the names of the columns produced by Next.
+	Columns() (columns []string, err error)
+
+	// Returns the next row, or io.EOF once the source is exhausted. The
+	// returned slice is only valid until the next call to Next.
+	Next(ctx context.Context) (values []interface{}, err error)
+
+	Close() (err error)
+}
+
+// sqlSource reads rows from a source database query.
+type sqlSource struct {
+	rows *sql.Rows
+
+	columns   []string
+	valuePtrs []interface{} //Pointer to current row buffer
+	values    []interface{} //Buffer for the current row
+}
+
+func newSQLSource(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) (s *sqlSource, err error) {
+	var rows *sql.Rows
+
+	if rows, err = conn.QueryContext(ctx, query, args...); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newRowsSource(rows)
+}
+
+// newRowsSource reads rows from an open result set, closing it on error.
+func newRowsSource(rows *sql.Rows) (s *sqlSource, err error) {
+	s = &sqlSource{rows: rows}
+
+	if s.columns, err = s.rows.Columns(); err != nil {
+		s.rows.Close()
+		return nil, errors.Trace(err)
+	}
+
+	s.values = make([]interface{}, len(s.columns))
+	s.valuePtrs = make([]interface{}, len(s.columns))
+
+	for i := range s.values {
+		s.valuePtrs[i] = &s.values[i]
+	}
+
+	return s, nil
+}
+
+// newSource returns the source configured for the copy.
+func newSource(ctx context.Context, conn *sql.Conn, cfg *Config) (src Source, err error) {
+	switch {
+	case cfg.Source != nil:
+		return cfg.Source, nil
+	case cfg.SrcFile != "":
+		var key []byte
+		if key, err = cfg.encryptionKey(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		src, err = OpenFileSource(cfg.SrcFile, cfg.SrcFileFormat, cfg.SrcCompression, key)
+	case cfg.SrcRecordURI != "":
+		src, err = newRecordURISource(ctx, cfg)
+	case cfg.SrcAPI.URL != "":
+		src, err = NewRESTSource(ctx, cfg.SrcAPI)
+	case len(cfg.SrcShards) > 0:
+		src, err = newFanInSource(ctx, cfg)
+	case cfg.SrcKeyColumn != "" && cfg.SrcChunkSize > 0:
+		src, err = newChunkedSource(ctx, conn, cfg)
+	case cfg.SrcCursor && bulk.DialectFor(cfg.SrcDbDriver) == bulk.Postgres:
+		src, err = newCursorSource(ctx, conn, cfg)
+	case cfg.SrcCursor && bulk.DialectFor(cfg.SrcDbDriver) != bulk.MySQL:
+		return nil, errors.NotSupportedf("server-side cursors for %s sources", cfg.SrcDbDriver)
+	default:
+		src, err = newSQLSource(ctx, conn, cfg.SrcSelectSql, cfg.SelectArgs()...)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return src, nil
+}
+
+func (s *sqlSource) Columns() (columns []string, err error) {
+	return s.columns, nil
+}
+
+func (s *sqlSource) ColumnTypes() (types []ColumnType, err error) {
+	var cts []*sql.ColumnType
+
+	if cts, err = s.rows.ColumnTypes(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	types = make([]ColumnType, len(cts))
+	for i, ct := range cts {
+		types[i].Name = ct.Name()
+		types[i].DatabaseType = ct.DatabaseTypeName()
+		types[i].Length, _ = ct.Length()
+		types[i].Precision, types[i].Scale, _ = ct.DecimalSize()
+		types[i].Nullable, _ = ct.Nullable()
+	}
+
+	return types, nil
+}
+
+func (s *sqlSource) Next(ctx context.Context) (values []interface{}, err error) {
+	if !s.rows.Next() {
+		if err = s.rows.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return nil, io.EOF
+	}
+
+	if err = s.rows.Scan(s.valuePtrs...); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.values, nil
+}
+
+func (s *sqlSource) Close() (err error) {
+	return errors.Trace(s.rows.Close())
+}
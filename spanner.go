@@ -0,0 +1,344 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Spanner limits a commit to 80000 mutations, each column of each row
+// written counting as one.
+const spannerMaxMutations = 80000
+
+// Times a commit Spanner aborts is retried.
+const spannerRetries = 5
+
+// spannerDriver writes to Google Cloud Spanner through its REST API.
+// URIs are spanner://projects/P/instances/I/databases/D, with optional
+// query parameters: token, a secret reference to an OAuth access token,
+// by default the instance metadata server's, and max_mutations, the
+// mutations per commit. SPANNER_EMULATOR_HOST points it at the emulator.
+type spannerDriver struct{}
+
+func (spannerDriver) OpenReader(ctx context.Context, uri string, query string) (r RecordReader, err error) {
+	return nil, errors.NotSupportedf("reading from Spanner")
+}
+
+func (spannerDriver) OpenWriter(ctx context.Context, uri string, table string) (w RecordWriter, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(uri); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &spannerWriter{
+		database:     strings.Trim(u.Host+u.Path, "/"),
+		table:        table,
+		endpoint:     "https://spanner.googleapis.com",
+		maxMutations: spannerMaxMutations}
+	if !strings.HasPrefix(s.database, "projects/") || strings.Count(s.database, "/") != 5 {
+		return nil, errors.NotValidf("Spanner URI %q, expected spanner://projects/P/instances/I/databases/D", uri)
+	}
+
+	q := u.Query()
+	if n := q.Get("max_mutations"); n != "" {
+		if s.maxMutations, err = strconv.Atoi(n); err != nil || s.maxMutations <= 0 {
+			return nil, errors.NotValidf("Spanner max_mutations %q", n)
+		}
+	}
+
+	if host := os.Getenv("SPANNER_EMULATOR_HOST"); host != "" {
+		s.endpoint = "http://" + host
+	} else if ref := q.Get("token"); ref != "" {
+		if s.token, err = ResolveSecret(ctx, ref); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if s.token, err = metadataToken(ctx); err != nil {
+		return nil, errors.Annotate(err, "getting a Spanner access token")
+	}
+
+	if err = s.newSession(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.types, err = s.columnTypes(ctx); err != nil {
+		s.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+// metadataToken returns the access token of the instance's default
+// service account from the Google Cloud metadata server.
+func metadataToken(ctx context.Context) (token string, err error) {
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("metadata server returned %s", resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return body.AccessToken, nil
+}
+
+// spannerWriter upserts record batches into a Spanner table, committing
+// each batch in as few transactions as the mutation limit allows.
+type spannerWriter struct {
+	database     string
+	table        string
+	endpoint     string
+	token        string
+	maxMutations int
+
+	session string
+	types   map[string]string //Spanner types of the table's columns, by lower case name
+}
+
+// spannerError is an error response from the Spanner API.
+type spannerError struct {
+	Status  string //gRPC status, e.g. ABORTED
+	Message string
+	Code    int //HTTP status code
+}
+
+func (e *spannerError) Error() string {
+	return fmt.Sprintf("spanner: %s: %s", e.Status, e.Message)
+}
+
+// call sends a request to the Spanner API, decoding the response into out
+// if it isn't nil.
+func (s *spannerWriter) call(ctx context.Context, method string, path string, in interface{}, out interface{}) (err error) {
+	var body io.Reader
+
+	if in != nil {
+		var b []byte
+		if b, err = json.Marshal(in); err != nil {
+			return errors.Trace(err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/v1/"+path, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error spannerError `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		e.Error.Code = resp.StatusCode
+		if e.Error.Status == "" {
+			e.Error.Status = resp.Status
+		}
+		return errors.Trace(&e.Error)
+	}
+	if out != nil {
+		return errors.Trace(json.NewDecoder(resp.Body).Decode(out))
+	}
+
+	return nil
+}
+
+func (s *spannerWriter) newSession(ctx context.Context) (err error) {
+	var session struct {
+		Name string `json:"name"`
+	}
+
+	if err = s.call(ctx, http.MethodPost, s.database+"/sessions", map[string]interface{}{}, &session); err != nil {
+		return errors.Annotate(err, "creating Spanner session")
+	}
+	s.session = session.Name
+
+	return nil
+}
+
+// columnTypes reads the types of the table's columns, so values are
+// encoded the way Spanner expects them.
+func (s *spannerWriter) columnTypes(ctx context.Context) (types map[string]string, err error) {
+	var res struct {
+		Rows [][]string `json:"rows"`
+	}
+
+	q := map[string]interface{}{
+		"sql":        "SELECT COLUMN_NAME, SPANNER_TYPE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = '' AND TABLE_NAME = @table",
+		"params":     map[string]string{"table": s.table},
+		"paramTypes": map[string]interface{}{"table": map[string]string{"code": "STRING"}}}
+	if err = s.call(ctx, http.MethodPost, s.session+":executeSql", q, &res); err != nil {
+		return nil, errors.Annotatef(err, "reading Spanner table %s's columns", s.table)
+	}
+	if len(res.Rows) == 0 {
+		return nil, errors.Trace(&TableNotFoundError{Table: s.table})
+	}
+
+	types = map[string]string{}
+	for _, r := range res.Rows {
+		types[strings.ToLower(r[0])] = r[1]
+	}
+
+	return types, nil
+}
+
+func (s *spannerWriter) WriteRecord(ctx context.Context, b *RecordBatch) (err error) {
+	columns := make([]string, len(b.Fields))
+	for i, f := range b.Fields {
+		columns[i] = f.Name
+		if _, ok := s.types[strings.ToLower(f.Name)]; !ok {
+			return errors.Trace(&SchemaError{Table: s.table, Column: f.Name, Err: errors.NotFoundf("Spanner column")})
+		}
+	}
+
+	perCommit := max(s.maxMutations/max(len(columns), 1), 1)
+	row := make([]interface{}, len(columns))
+
+	for start := 0; start < b.NumRows; start += perCommit {
+		var values [][]interface{}
+
+		for i := start; i < min(start+perCommit, b.NumRows); i++ {
+			row = b.Row(i, row)
+			v := make([]interface{}, len(row))
+			for c := range row {
+				v[c] = spannerValue(s.types[strings.ToLower(columns[c])], row[c])
+			}
+			values = append(values, v)
+		}
+
+		mutation := map[string]interface{}{"insertOrUpdate": map[string]interface{}{
+			"table": s.table, "columns": columns, "values": values}}
+		if err = s.commit(ctx, mutation); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// commit applies the mutation in a transaction of its own, retrying it if
+// Spanner aborts it or the session expired.
+func (s *spannerWriter) commit(ctx context.Context, mutation interface{}) (err error) {
+	req := map[string]interface{}{
+		"singleUseTransaction": map[string]interface{}{"readWrite": map[string]interface{}{}},
+		"mutations":            []interface{}{mutation}}
+
+	for attempt := 0; ; attempt++ {
+		if err = s.call(ctx, http.MethodPost, s.session+":commit", req, nil); err == nil {
+			return nil
+		}
+
+		var se *spannerError
+		if !errors.As(err, &se) || attempt >= spannerRetries {
+			return errors.Annotate(err, "committing Spanner mutations")
+		}
+		switch se.Status {
+		case "ABORTED", "UNAVAILABLE":
+		case "NOT_FOUND":
+			if err = s.newSession(ctx); err != nil {
+				return errors.Trace(err)
+			}
+		default:
+			return errors.Annotate(err, "committing Spanner mutations")
+		}
+
+		if err = sleepBackoff(ctx, attempt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+func (s *spannerWriter) Close() (err error) {
+	if s.session == "" {
+		return nil
+	}
+
+	err = s.call(context.Background(), http.MethodDelete, s.session, nil, nil)
+	s.session = ""
+
+	return errors.Trace(err)
+}
+
+// spannerValue returns a value as Spanner's REST API encodes values of
+// the type: 64 bit integers, numerics and times as strings and bytes as
+// base64.
+func spannerValue(typ string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch {
+	case typ == "DATE":
+		if t, ok := v.(time.Time); ok {
+			return t.Format(time.DateOnly)
+		}
+	case typ == "TIMESTAMP":
+		if t, ok := v.(time.Time); ok {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	case typ == "BOOL":
+		if b, err := recordBool(v); err == nil {
+			return b
+		}
+	case typ == "FLOAT64" || typ == "FLOAT32":
+		if f, err := recordFloat(v); err == nil {
+			return f
+		}
+	case strings.HasPrefix(typ, "BYTES"):
+		if b, ok := v.([]byte); ok {
+			return base64.StdEncoding.EncodeToString(b)
+		}
+		return base64.StdEncoding.EncodeToString([]byte(valueText(v)))
+	}
+
+	return fileText(v)
+}
+
+// sleepBackoff waits before retry attempt+1, doubling from 100ms up to 5s
+// with up to half again as jitter.
+func sleepBackoff(ctx context.Context, attempt int) (err error) {
+	d := min(100*time.Millisecond<<min(attempt, 6), 5*time.Second)
+	d += time.Duration(time.Now().UnixNano() % int64(d/2+1))
+
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,174 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/juju/errors"
+)
+
+// stage processes a row between the source and the writer. rowNum is
+// the 1-based position of the row in the source. Returning a nil row
+// drops it from the copy.
+type stage func(rowNum int, values []interface{}) (row []interface{}, err error)
+
+// buildStages returns the stages configured for the source columns in
+// the order they're applied, and the destination columns they produce.
+// With lookups, a TransformBatch, an aggregation or a pivot or unpivot,
+// the stages after them are run by the returned batchTransformer instead,
+// which has to be released.
+func buildStages(ctx context.Context, cfg *Config, src Source, dstDb *sql.DB, dstConn *sql.Conn, columns []string, res *Result) (stages []stage, batch *batchTransformer, dstColumns []string, err error) {
+	var s stage
+	var srcTypes, dstTypes []ColumnType
+
+	if ct, ok := src.(ColumnTyper); ok {
+		if srcTypes, err = ct.ColumnTypes(); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+	}
+
+	stages = appendStage(stages, newConverterStage(columns, srcTypes, true))
+	stages = appendStage(stages, newEncodingStage(cfg, columns, srcTypes))
+	stages = appendStage(stages, newGeoStage(cfg, columns, srcTypes))
+
+	// Filters see every source column, even those which aren't copied
+	if s, err = newFilterStage(cfg, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	var sd *softDelete
+	if sd, err = newSoftDelete(cfg, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, sd.markStage(res))
+
+	if s, err = newWatermarkStage(cfg, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if s, err = newDedupeStage(cfg, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	// JSON paths are projected first so the copied columns can name them
+	if s, columns, srcTypes, err = newJSONStage(cfg.JSONPaths, columns, srcTypes); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if s, columns, srcTypes, err = newProjectStage(cfg.Columns, cfg.ExcludeColumns, columns, srcTypes); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if cfg.SkipIdentityColumns && dstConn != nil {
+		var exclude []string
+		if exclude, err = identityExclusions(ctx, dstConn, cfg, columns); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		if s, columns, srcTypes, err = newProjectStage(nil, exclude, columns, srcTypes); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		stages = appendStage(stages, s)
+	}
+
+	if s, columns, err = newExtraStage(cfg.ExtraColumns, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if s, columns, err = newSurrogateKeyStage(ctx, cfg, dstDb, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	s, columns = sd.flagStage(columns)
+	stages = appendStage(stages, s)
+
+	if s, err = newNullStage(cfg.NullPolicies, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if s, err = newColumnTransformStage(cfg.ColumnTransforms, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if s, err = newAssertStage(cfg.Assertions, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	if dstTypes, err = destColumnTypes(ctx, cfg, dstConn, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, newCoerceStage(cfg.CoerceRules, columns, srcTypes, dstTypes))
+	stages = appendStage(stages, newConverterStage(columns, srcTypes, false))
+
+	if s, err = newTimeStage(cfg); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	stages = appendStage(stages, newRowTransformStage(cfg.Transform, columns))
+
+	// Stages after the batch transforms run on the rows they return, or
+	// the rolled up rows
+	if batch, columns, err = newBatchTransformer(ctx, cfg, columns); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	defer func() {
+		if err != nil && batch != nil {
+			batch.release()
+		}
+	}()
+	split := len(stages)
+
+	// The rows the batch transforms return, and rolled up rows, are
+	// coerced to the destination types again
+	if batch != nil {
+		if dstTypes, err = destColumnTypes(ctx, cfg, dstConn, columns); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		stages = appendStage(stages, newCoerceStage(cfg.CoerceRules, columns, nil, dstTypes))
+	}
+
+	if s, columns, err = newDiffStage(cfg, columns, res); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	stages = appendStage(stages, s)
+
+	stages = appendStage(stages, newStatsStage(cfg, columns, res))
+
+	if batch != nil {
+		stages, batch.after = stages[:split], stages[split:]
+	}
+
+	return stages, batch, columns, nil
+}
+
+// appendStage appends s if it isn't nil.
+func appendStage(stages []stage, s stage) []stage {
+	if s == nil {
+		return stages
+	}
+
+	return append(stages, s)
+}
+
+// applyStages runs the row through each stage, stopping early if a
+// stage drops it.
+func applyStages(stages []stage, rowNum int, values []interface{}) (row []interface{}, err error) {
+	row = values
+	for _, s := range stages {
+		if row, err = s(rowNum, row); err != nil || row == nil {
+			return nil, err
+		}
+	}
+
+	return row, nil
+}
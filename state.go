@@ -0,0 +1,294 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// State holds the values a pipeline keeps between runs, such as
+// watermarks and checkpoints.
+type State map[string]string
+
+// StateStore saves pipeline state between runs, keyed by pipeline name.
+type StateStore interface {
+	// Returns the saved state, or nil if the pipeline has none.
+	Get(ctx context.Context, pipeline string) (state State, err error)
+
+	// Replaces the saved state.
+	Set(ctx context.Context, pipeline string, state State) (err error)
+}
+
+// TableStateStore keeps pipeline state as JSON in a database table,
+// usually on the destination so the state commits alongside the data.
+type TableStateStore struct {
+	conn  *sql.Conn
+	d     *bulk.Dialect
+	table string //Quoted table name
+}
+
+// NewTableStateStore returns a state store using the table, creating it if
+// it doesn't exist.
+func NewTableStateStore(ctx context.Context, conn *sql.Conn, driver string, schema string, table string) (s *TableStateStore, err error) {
+	d := bulk.DialectFor(driver)
+	s = &TableStateStore{conn: conn, d: d, table: d.QualifiedName(schema, table)}
+
+	columns := "pipeline VARCHAR(255) NOT NULL PRIMARY KEY, state TEXT NOT NULL, updated_at TIMESTAMP NOT NULL"
+
+	var q string
+	switch d {
+	case bulk.SQLServer:
+		columns = "pipeline NVARCHAR(255) NOT NULL PRIMARY KEY, state NVARCHAR(MAX) NOT NULL, updated_at DATETIME2 NOT NULL"
+		q = fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)",
+			strings.Replace(s.table, "'", "''", -1), s.table, columns)
+	case bulk.MySQL:
+		columns = "pipeline VARCHAR(255) NOT NULL PRIMARY KEY, state LONGTEXT NOT NULL, updated_at DATETIME(6) NOT NULL"
+		fallthrough
+	default:
+		q = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", s.table, columns)
+	}
+
+	if _, err = conn.ExecContext(ctx, q); err != nil {
+		return nil, errors.Annotatef(err, "creating state table %s", s.table)
+	}
+
+	return s, nil
+}
+
+func (s *TableStateStore) Get(ctx context.Context, pipeline string) (state State, err error) {
+	var data string
+
+	q := fmt.Sprintf("SELECT state FROM %s WHERE pipeline = %s", s.table, s.d.Placeholder(1))
+	if err = s.conn.QueryRowContext(ctx, q, pipeline).Scan(&data); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, errors.Annotatef(err, "reading state for %s", pipeline)
+	}
+
+	return state, nil
+}
+
+func (s *TableStateStore) Set(ctx context.Context, pipeline string, state State) (err error) {
+	var data []byte
+	var res sql.Result
+	var n int64
+
+	if data, err = json.Marshal(state); err != nil {
+		return errors.Trace(err)
+	}
+	now := time.Now().UTC()
+
+	q := fmt.Sprintf("UPDATE %s SET state = %s, updated_at = %s WHERE pipeline = %s",
+		s.table, s.d.Placeholder(1), s.d.Placeholder(2), s.d.Placeholder(3))
+	if res, err = s.conn.ExecContext(ctx, q, string(data), now, pipeline); err != nil {
+		return errors.Trace(err)
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return errors.Trace(err)
+	} else if n > 0 {
+		return nil
+	}
+
+	q = fmt.Sprintf("INSERT INTO %s (pipeline, state, updated_at) VALUES (%s, %s, %s)",
+		s.table, s.d.Placeholder(1), s.d.Placeholder(2), s.d.Placeholder(3))
+	if _, err = s.conn.ExecContext(ctx, q, pipeline, string(data), now); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// FileStateStore keeps the state of every pipeline in a local JSON file.
+type FileStateStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{Path: path}
+}
+
+func (s *FileStateStore) load() (states map[string]State, err error) {
+	var data []byte
+
+	states = map[string]State{}
+	if data, err = os.ReadFile(s.Path); os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = json.Unmarshal(data, &states); err != nil {
+		return nil, errors.Annotatef(err, "reading state file %s", s.Path)
+	}
+
+	return states, nil
+}
+
+func (s *FileStateStore) Get(ctx context.Context, pipeline string) (state State, err error) {
+	var states map[string]State
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if states, err = s.load(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return states[pipeline], nil
+}
+
+// Set rewrites the file through a temporary file so a crash never leaves
+// it half written.
+func (s *FileStateStore) Set(ctx context.Context, pipeline string, state State) (err error) {
+	var states map[string]State
+	var data []byte
+	var f *os.File
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if states, err = s.load(); err != nil {
+		return errors.Trace(err)
+	}
+	states[pipeline] = state
+
+	if data, err = json.MarshalIndent(states, "", "  "); err != nil {
+		return errors.Trace(err)
+	}
+
+	if f, err = os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*"); err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.Rename(f.Name(), s.Path))
+}
+
+// RedisStateStore keeps pipeline state as JSON strings in Redis.
+type RedisStateStore struct {
+	URI    string //redis://[user:password@]host[:port][/db]
+	Prefix string //Key prefix, the pipeline name is appended to it
+
+	mu sync.Mutex
+}
+
+func NewRedisStateStore(uri string) *RedisStateStore {
+	return &RedisStateStore{URI: uri, Prefix: "datapipe:state:"}
+}
+
+func (s *RedisStateStore) Get(ctx context.Context, pipeline string) (state State, err error) {
+	var c *redisConn
+	var reply interface{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, err = dialRedis(ctx, s.URI); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer c.Close()
+
+	if reply, err = c.do("GET", s.Prefix+pipeline); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	if err = json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, errors.Annotatef(err, "reading state for %s", pipeline)
+	}
+
+	return state, nil
+}
+
+func (s *RedisStateStore) Set(ctx context.Context, pipeline string, state State) (err error) {
+	var c *redisConn
+	var data []byte
+
+	if data, err = json.Marshal(state); err != nil {
+		return errors.Trace(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, err = dialRedis(ctx, s.URI); err != nil {
+		return errors.Trace(err)
+	}
+	defer c.Close()
+
+	if _, err = c.do("SET", s.Prefix+pipeline, string(data)); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// openStateStore returns the configured state store, creating the table
+// store on the destination connection if one was asked for.
+func openStateStore(ctx context.Context, cfg *Config, dstConn *sql.Conn) (s StateStore, err error) {
+	if cfg.StateStore != nil || cfg.StateTable == "" || dstConn == nil {
+		return cfg.StateStore, nil
+	}
+
+	if s, err = NewTableStateStore(ctx, dstConn, cfg.DstDbDriver, cfg.DstSchema, cfg.StateTable); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s, nil
+}
+
+// Returns the name the pipeline's state is saved under.
+func (c *Config) pipelineName() string {
+	if c.PipelineName != "" {
+		return c.PipelineName
+	}
+
+	return c.DstTable
+}
+
+// parseStateStore sets up the state store from a STATE_STORE value: table,
+// table:<name>, file:<path> or a redis:// URL.
+func (c *Config) parseStateStore(spec string) (err error) {
+	switch {
+	case spec == "":
+	case spec == "table":
+		c.StateTable = "datapipe_state"
+	case strings.HasPrefix(spec, "table:"):
+		c.StateTable = strings.TrimPrefix(spec, "table:")
+	case strings.HasPrefix(spec, "file:"):
+		c.StateStore = NewFileStateStore(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "redis://"):
+		c.StateStore = NewRedisStateStore(spec)
+	default:
+		return errors.NotValidf("state store %q", spec)
+	}
+
+	return nil
+}
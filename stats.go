@@ -0,0 +1,134 @@
+package godatapipe
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"unicode/utf8"
+)
+
+// ColumnStats describes the values written to a destination column, for
+// checking the data and sizing the destination's columns.
+type ColumnStats struct {
+	Name             string      `json:"name"`
+	Count            int64       `json:"count"`      //Values which aren't null
+	NullCount        int64       `json:"null_count"` //Null values
+	Min              interface{} `json:"min"`        //Smallest value, nil if they're all null
+	Max              interface{} `json:"max"`        //Largest value, nil if they're all null
+	DistinctEstimate int64       `json:"distinct_estimate"`
+	MaxLength        int         `json:"max_length"` //Characters in the longest text value, or bytes in the longest binary value
+
+	hll *hyperLogLog
+}
+
+// observe adds a value to the stats.
+func (s *ColumnStats) observe(v interface{}) {
+	if v == nil {
+		s.NullCount++
+		return
+	}
+
+	s.Count++
+
+	switch t := v.(type) {
+	case string:
+		s.MaxLength = max(s.MaxLength, utf8.RuneCountInString(t))
+	case []byte:
+		s.MaxLength = max(s.MaxLength, len(t))
+		// The driver may reuse the buffer
+		v = string(t)
+	}
+
+	if cmp, ok := compareValues(v, s.Min); s.Min == nil || ok && cmp < 0 {
+		s.Min = v
+	}
+	if cmp, ok := compareValues(v, s.Max); s.Max == nil || ok && cmp > 0 {
+		s.Max = v
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:", v)
+	h.Write([]byte(valueText(v)))
+	s.hll.add(h.Sum64())
+}
+
+// newStatsStage returns a stage collecting stats of the columns into the
+// result, or nil if it's off. The stats are of the rows sent to the
+// destination, including any in batches later skipped or rolled back.
+func newStatsStage(cfg *Config, columns []string, res *Result) stage {
+	if !cfg.ColumnStats {
+		return nil
+	}
+
+	res.ColumnStats = make([]ColumnStats, len(columns))
+	for i, name := range columns {
+		res.ColumnStats[i] = ColumnStats{Name: name, hll: newHyperLogLog()}
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i := range res.ColumnStats {
+			res.ColumnStats[i].observe(values[i])
+		}
+		return values, nil
+	}
+}
+
+// finishStats sets the distinct estimates from the sketches.
+func finishStats(res *Result) {
+	for i := range res.ColumnStats {
+		s := &res.ColumnStats[i]
+		if s.hll != nil {
+			s.DistinctEstimate = s.hll.estimate()
+		}
+	}
+}
+
+// hllPrecision is the number of hash bits picking a register, giving 2^14
+// registers and an error of about 0.8%.
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct hashes added to it.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// add adds a hash, mixed first as FNV's high bits are poorly distributed.
+func (h *hyperLogLog) add(x uint64) {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct hashes added, counting
+// the empty registers when there are few.
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(e + 0.5)
+}
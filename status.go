@@ -0,0 +1,149 @@
+package godatapipe
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// RunStatus is the live state of a pipeline's current or last run.
+type RunStatus struct {
+	Pipeline  string    `json:"pipeline"`
+	RunID     string    `json:"run_id"`
+	State     string    `json:"state"` //running, finished or failed
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"` //Time of the last event
+
+	RowsRead      int     `json:"rows_read"`    //Source rows read, from progress events
+	RowsWritten   int     `json:"rows_written"` //Rows written in destination batches
+	EstimatedRows int64   `json:"estimated_rows,omitempty"`
+	Percent       float64 `json:"percent,omitempty"`
+	RowsPerSecond float64 `json:"rows_per_second"` //Rows written per second since the run started
+	ETASeconds    float64 `json:"eta_seconds,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Status tracks the runs of pipelines for the status endpoint. Its Handle
+// method can be used as Config.OnEvent, progress needing a
+// ProgressInterval.
+type Status struct {
+	mu      sync.Mutex
+	started time.Time
+	runs    map[string]*RunStatus
+}
+
+func NewStatus() *Status {
+	return &Status{started: time.Now(), runs: map[string]*RunStatus{}}
+}
+
+func (s *Status) Handle(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.runs[e.Pipeline]
+	if e.Type == EventRunStarted || r == nil {
+		r = &RunStatus{Pipeline: e.Pipeline, RunID: e.RunID, State: "running", StartedAt: e.Time}
+		s.runs[e.Pipeline] = r
+	}
+	r.UpdatedAt = e.Time
+
+	switch e.Type {
+	case EventRunFinished:
+		r.State = "finished"
+		r.RowsWritten = e.Result.RowCount
+		r.ETASeconds = 0
+	case EventRunFailed:
+		r.State = "failed"
+		r.Error = e.Err.Error()
+	case EventProgress:
+		r.RowsRead, r.EstimatedRows = e.Progress.RowsRead, e.Progress.EstimatedRows
+		r.Percent = max(0, e.Progress.Percent())
+		r.ETASeconds = max(0, e.Progress.ETA().Seconds())
+	case EventBatchWritten:
+		if !e.Batch.Commit {
+			r.RowsWritten += e.Batch.Rows
+		}
+	}
+
+	if elapsed := r.UpdatedAt.Sub(r.StartedAt).Seconds(); elapsed > 0 {
+		r.RowsPerSecond = float64(r.RowsWritten) / elapsed
+	}
+}
+
+// Returns a copy of the runs, ordered by pipeline name.
+func (s *Status) Snapshot() (runs []RunStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.runs {
+		runs = append(runs, *r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Pipeline < runs[j].Pipeline })
+
+	return runs
+}
+
+// Returns a handler serving /healthz, which answers ok while the process
+// is up, and /status, the runs as JSON with the names of those running.
+func (s *Status) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		runs := s.Snapshot()
+
+		running := []string{}
+		for _, r := range runs {
+			if r.State == "running" {
+				running = append(running, r.Pipeline)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			StartedAt     time.Time   `json:"started_at"`
+			UptimeSeconds float64     `json:"uptime_seconds"`
+			Running       []string    `json:"running"`
+			Runs          []RunStatus `json:"runs"`
+		}{s.started, time.Since(s.started).Seconds(), running, runs})
+	})
+
+	return mux
+}
+
+// Serves the status handler on addr until the context is cancelled, see
+// ListenAndServe.
+func (s *Status) ListenAndServe(ctx context.Context, addr string) (err error) {
+	return errors.Trace(ListenAndServe(ctx, addr, s.Handler()))
+}
+
+// Serves a handler on addr, such as :8080, until the context is
+// cancelled. The listener is opened before returning so an address in use
+// is reported straight away.
+func ListenAndServe(ctx context.Context, addr string, h http.Handler) (err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Annotatef(err, "listening on %s", addr)
+	}
+
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go srv.Serve(ln)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package godatapipe
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+)
+
+func TestStatusHandle(t *testing.T) {
+	s := NewStatus()
+	start := time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC)
+
+	s.Handle(Event{Type: EventRunStarted, Time: start, Pipeline: "orders", RunID: "r1"})
+	s.Handle(Event{Type: EventBatchWritten, Time: start.Add(time.Second), Pipeline: "orders", Batch: &bulk.BatchTiming{Rows: 100}})
+	s.Handle(Event{Type: EventBatchWritten, Time: start.Add(time.Second), Pipeline: "orders", Batch: &bulk.BatchTiming{Rows: 100, Commit: true}})
+	s.Handle(Event{Type: EventBatchWritten, Time: start.Add(2 * time.Second), Pipeline: "orders", Batch: &bulk.BatchTiming{Rows: 100}})
+	s.Handle(Event{Type: EventProgress, Time: start.Add(2 * time.Second), Pipeline: "orders",
+		Progress: &Progress{RowsRead: 250, EstimatedRows: 1000, Elapsed: 2 * time.Second}})
+	s.Handle(Event{Type: EventRunStarted, Time: start, Pipeline: "items", RunID: "r2"})
+	s.Handle(Event{Type: EventRunFailed, Time: start.Add(time.Second), Pipeline: "items", Err: errors.New("boom")})
+
+	runs := s.Snapshot()
+	if len(runs) != 2 || runs[0].Pipeline != "items" || runs[1].Pipeline != "orders" {
+		t.Fatalf("runs = %+v", runs)
+	}
+
+	items, orders := runs[0], runs[1]
+	if items.State != "failed" || items.Error != "boom" {
+		t.Errorf("failed run = %+v", items)
+	}
+	if orders.State != "running" || orders.RunID != "r1" || orders.RowsRead != 250 || orders.RowsWritten != 200 ||
+		orders.Percent != 25 || orders.ETASeconds != 6 || orders.RowsPerSecond != 100 {
+		t.Errorf("running run = %+v", orders)
+	}
+
+	s.Handle(Event{Type: EventRunFinished, Time: start.Add(4 * time.Second), Pipeline: "orders", Result: &Result{RowCount: 1000}})
+	if orders = s.Snapshot()[1]; orders.State != "finished" || orders.RowsWritten != 1000 || orders.ETASeconds != 0 || orders.RowsPerSecond != 250 {
+		t.Errorf("finished run = %+v", orders)
+	}
+
+	// A new run starts afresh
+	s.Handle(Event{Type: EventRunStarted, Time: start.Add(time.Hour), Pipeline: "orders", RunID: "r3"})
+	if orders = s.Snapshot()[1]; orders.State != "running" || orders.RunID != "r3" || orders.RowsWritten != 0 {
+		t.Errorf("restarted run = %+v", orders)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	s := NewStatus()
+	h := s.Handler()
+
+	_, _, err := copyRows(t, &Config{DstTable: "orders", OnEvent: s.Handle}, []string{"id"}, intRows(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle(Event{Type: EventRunStarted, Time: time.Now(), Pipeline: "items"})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("/healthz = %d %q", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var status struct {
+		Running []string    `json:"running"`
+		Runs    []RunStatus `json:"runs"`
+	}
+	if err = json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || len(status.Running) != 1 || status.Running[0] != "items" {
+		t.Errorf("/status running = %v", status.Running)
+	}
+	if len(status.Runs) != 2 || status.Runs[1].Pipeline != "orders" || status.Runs[1].State != "finished" || status.Runs[1].RowsWritten != 3 {
+		t.Errorf("/status runs = %+v", status.Runs)
+	}
+}
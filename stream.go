@@ -0,0 +1,87 @@
+package godatapipe
+
+import (
+	"context"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// MessageStream is the sending side of a client stream, such as a gRPC
+// client stream, whose generated types all have SendMsg.
+type MessageStream interface {
+	SendMsg(m interface{}) error
+}
+
+// StreamEncoder returns the message sent for a row. values is reused for
+// the next row, so the message mustn't keep it.
+type StreamEncoder func(columns []string, values []interface{}) (msg interface{}, err error)
+
+// StreamWriter sends each row over a stream as the message its encoder
+// returns, so bespoke ingestion services can be written to without an
+// Insert of their own. Rows which were sent can't be rolled back.
+type StreamWriter struct {
+	stream  MessageStream
+	encode  StreamEncoder
+	finish  func() error
+	columns []string
+	sent    int
+}
+
+// Creates a stream writer. finish, if not nil, is called by Close to end
+// the stream and returns the server's error, if any, e.g. for a gRPC
+// client stream
+//
+//	func() error { _, err := stream.CloseAndRecv(); return err }
+func NewStreamWriter(stream MessageStream, encode StreamEncoder, finish func() error) *StreamWriter {
+	return &StreamWriter{stream: stream, encode: encode, finish: finish}
+}
+
+// Sets the column names, called by the pipeline before the first row.
+func (w *StreamWriter) SetColumns(columns []string) {
+	w.columns = columns
+}
+
+func (w *StreamWriter) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	var msg interface{}
+
+	if err = ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if msg, err = w.encode(w.columns, values); err != nil {
+		return errors.Annotatef(err, "encoding row %d", w.sent+1)
+	}
+
+	// A stream the server ended returns io.EOF, the reason comes from
+	// finishing it
+	if err = w.stream.SendMsg(msg); err == io.EOF && w.finish != nil {
+		if err = w.finish(); err == nil {
+			err = errors.New("stream ended by the server")
+		}
+		w.finish = nil
+	}
+	if err != nil {
+		return errors.Annotatef(err, "sending row %d", w.sent+1)
+	}
+	w.sent++
+
+	return nil
+}
+
+func (w *StreamWriter) Flush(ctx context.Context) (totalRowCount int, err error) {
+	return w.sent, nil
+}
+
+func (w *StreamWriter) Rollback() (committedRowCount int, err error) {
+	return w.sent, nil
+}
+
+func (w *StreamWriter) Close() (err error) {
+	if w.finish == nil {
+		return nil
+	}
+
+	err, w.finish = w.finish(), nil
+
+	return errors.Annotate(err, "ending stream")
+}
@@ -0,0 +1,295 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// ConflictPolicy determines which row a two-way sync keeps when a row
+// changed on both sides since the last sync.
+type ConflictPolicy int
+
+const (
+	ConflictLatestWins ConflictPolicy = iota //Keep the row with the later Config.SyncColumn, the source's if they're equal
+	ConflictSourceWins                       //Keep the source's row
+	ConflictCustom                           //Keep the row Config.ResolveConflict returns
+)
+
+// Parses a ConflictPolicy name: latest or source. Custom resolution can
+// only be set from code.
+func ParseConflictPolicy(s string) (p ConflictPolicy, err error) {
+	switch s {
+	case "", "latest":
+		return ConflictLatestWins, nil
+	case "source":
+		return ConflictSourceWins, nil
+	}
+
+	return ConflictLatestWins, errors.NotValidf("conflict policy %q", s)
+}
+
+// Conflict is a row changed on both sides of a two-way sync.
+type Conflict struct {
+	Columns []string
+	Src     []interface{} //Source row
+	Dst     []interface{} //Destination row
+}
+
+// ConflictResolver returns the row both sides of a conflict are given,
+// which may be either side's or a merge of the two.
+type ConflictResolver func(ctx context.Context, c *Conflict) (row []interface{}, err error)
+
+// SyncResult describes the outcome of a two-way sync.
+type SyncResult struct {
+	RunID     string
+	StartedAt time.Time
+
+	SrcRows   int //Rows written to the source
+	DstRows   int //Rows written to the destination
+	Conflicts int //Rows changed on both sides
+}
+
+// syncState is the pipeline state holding the time of the last sync.
+const syncState = "last_sync"
+
+// Sync keeps SrcTable and the destination table aligned both ways. Rows
+// changed on one side since the last sync, found by their
+// Config.SyncColumn, are upserted into the other on the key columns, and
+// rows changed on both are resolved by Config.ConflictPolicy. The first
+// sync compares every row. Deletes aren't synced. The time of the sync is
+// saved in the pipeline's state, so the sides' clocks should agree with
+// this one's.
+func Sync(ctx context.Context, cfg *Config) (res *SyncResult, err error) {
+	var srcConn, dstConn *sql.Conn
+	var release func()
+	var keys, columns []string
+	var state State
+	var store StateStore
+
+	switch {
+	case cfg.SrcTable == "":
+		return nil, errors.NotValidf("Sync without SrcTable")
+	case cfg.SyncColumn == "":
+		return nil, errors.NotValidf("Sync without SyncColumn")
+	case cfg.ConflictPolicy == ConflictCustom && cfg.ResolveConflict == nil:
+		return nil, errors.NotValidf("ConflictCustom without ResolveConflict")
+	}
+
+	res = &SyncResult{StartedAt: time.Now()}
+	if res.RunID, err = newUUID(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if _, srcConn, release, err = connect(ctx, cfg.SrcConn, cfg.SrcDB, cfg.SrcDbUri, cfg.SrcDbPassword, cfg.SrcConnOptions); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer release()
+
+	if _, dstConn, release, err = connect(ctx, cfg.DstConn, cfg.DstDB, cfg.DstDbUri, cfg.DstDbPassword, cfg.DstConnOptions); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer release()
+
+	if store, err = openStateStore(ctx, cfg, dstConn); err != nil {
+		return nil, errors.Trace(err)
+	} else if store == nil {
+		return nil, errors.NotValidf("Sync without a StateStore or StateTable")
+	}
+	if state, err = store.Get(ctx, cfg.pipelineName()); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var since time.Time
+	if s := state[syncState]; s != "" {
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, errors.Annotatef(err, "last sync time %q", s)
+		}
+	}
+
+	if keys, err = mirrorKeys(ctx, dstConn, cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	src := &syncSide{conn: srcConn, d: bulk.DialectFor(cfg.SrcDbDriver)}
+	src.schema, src.table = splitTableName(cfg.SrcTable)
+	dst := &syncSide{conn: dstConn, d: bulk.DialectFor(cfg.DstDbDriver), schema: cfg.DstSchema, table: cfg.DstTable}
+
+	var types []ColumnType
+	if types, err = bulk.TableColumns(ctx, dstConn, dst.d, dst.schema, dst.table); err != nil {
+		return nil, errors.Trace(err)
+	} else if len(types) == 0 {
+		return nil, errors.Trace(&TableNotFoundError{Table: dst.d.QualifiedName(dst.schema, dst.table)})
+	}
+	for _, ct := range types {
+		columns = append(columns, ct.Name)
+	}
+
+	at := indexOfFold(columns, cfg.SyncColumn)
+	if at < 0 {
+		return nil, errors.Trace(&SchemaError{Table: dst.d.QualifiedName(dst.schema, dst.table), Column: cfg.SyncColumn, Err: errors.NotFoundf("sync column")})
+	}
+
+	// Both sides' columns in the destination's order, spelt their way
+	for _, side := range []*syncSide{src, dst} {
+		if side.columns, err = bulk.ResolveColumns(ctx, side.conn, side.d, side.schema, side.table, columns); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if side.keys, err = bulk.ResolveColumns(ctx, side.conn, side.d, side.schema, side.table, keys); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = side.changed(ctx, side.columns[at], since); err != nil {
+			return nil, errors.Annotatef(err, "reading changes from %s", side.d.QualifiedName(side.schema, side.table))
+		}
+	}
+
+	toSrc, toDst := map[string][]interface{}{}, map[string][]interface{}{}
+
+	for k, s := range src.rows {
+		d, ok := dst.rows[k]
+		if !ok {
+			toDst[k] = s
+			continue
+		}
+
+		res.Conflicts++
+		row := s
+		switch cfg.ConflictPolicy {
+		case ConflictLatestWins:
+			if cmp, ok := compareValues(d[at], s[at]); ok && cmp > 0 {
+				row = d
+			}
+		case ConflictCustom:
+			if row, err = cfg.ResolveConflict(ctx, &Conflict{Columns: columns, Src: s, Dst: d}); err != nil {
+				return nil, errors.Annotatef(err, "resolving the conflict on key %s", k)
+			}
+		}
+
+		// Only write the side whose row lost
+		if keyText(row, nil) != keyText(s, nil) {
+			toSrc[k] = row
+		}
+		if keyText(row, nil) != keyText(d, nil) {
+			toDst[k] = row
+		}
+	}
+	for k, d := range dst.rows {
+		if _, ok := src.rows[k]; !ok {
+			toSrc[k] = d
+		}
+	}
+
+	if res.SrcRows, err = src.upsert(ctx, toSrc); err != nil {
+		return nil, errors.Annotatef(err, "writing to %s", cfg.SrcTable)
+	}
+	if res.DstRows, err = dst.upsert(ctx, toDst); err != nil {
+		return nil, errors.Annotatef(err, "writing to %s", dst.d.QualifiedName(dst.schema, dst.table))
+	}
+
+	// Changes made while reading are picked up by the next sync
+	if state == nil {
+		state = State{}
+	}
+	state[syncState] = res.StartedAt.UTC().Format(time.RFC3339Nano)
+	if err = store.Set(ctx, cfg.pipelineName(), state); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return res, nil
+}
+
+// syncSide is one of the tables of a two-way sync.
+type syncSide struct {
+	conn   *sql.Conn
+	d      *bulk.Dialect
+	schema string
+	table  string
+
+	columns []string
+	keys    []string
+
+	rows map[string][]interface{} //Rows changed since the last sync, by key text
+}
+
+// changed reads the rows changed since the time, or all of them if it's
+// zero.
+func (s *syncSide) changed(ctx context.Context, syncColumn string, since time.Time) (err error) {
+	var rows *sql.Rows
+	var args []interface{}
+
+	cols := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		cols[i] = s.d.QuoteIdent(c)
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), s.d.QualifiedName(s.schema, s.table))
+	if !since.IsZero() {
+		q += fmt.Sprintf(" WHERE %s > %s", s.d.QuoteIdent(syncColumn), s.d.Placeholder(1))
+		args = append(args, since)
+	}
+
+	positions := make([]int, len(s.keys))
+	for i, k := range s.keys {
+		if positions[i] = indexOfFold(s.columns, k); positions[i] < 0 {
+			return errors.Trace(&SchemaError{Table: s.table, Column: k, Err: errors.NotFoundf("key column")})
+		}
+	}
+
+	if rows, err = s.conn.QueryContext(ctx, q, args...); err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	s.rows = map[string][]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(s.columns))
+		ptrs := make([]interface{}, len(s.columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return errors.Trace(err)
+		}
+		s.rows[keyText(values, positions)] = values
+	}
+
+	return errors.Trace(rows.Err())
+}
+
+// upsert writes the rows in one transaction, returning how many there were.
+func (s *syncSide) upsert(ctx context.Context, rows map[string][]interface{}) (n int, err error) {
+	var tx *sql.Tx
+	var stmt *sql.Stmt
+	var q string
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	if q, err = s.d.UpsertSQL(s.schema, s.table, s.columns, s.keys); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if tx, err = s.conn.BeginTx(ctx, nil); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if stmt, err = tx.PrepareContext(ctx, q); err != nil {
+		tx.Rollback()
+		return 0, errors.Trace(err)
+	}
+	defer stmt.Close()
+
+	for k, row := range rows {
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			tx.Rollback()
+			return 0, errors.Annotatef(err, "upserting key %s", k)
+		}
+	}
+
+	return len(rows), errors.Trace(tx.Commit())
+}
@@ -0,0 +1,135 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// MissingTable determines what happens when the destination table doesn't
+// exist.
+type MissingTable int
+
+const (
+	MissingTableError  MissingTable = iota //Fail with a TableNotFoundError
+	MissingTableCreate                     //Create the table from the source select's column types
+	MissingTableSkip                       //Carry on without clearing the table
+)
+
+// Parses a MissingTable name: error, create or skip.
+func ParseMissingTable(s string) (m MissingTable, err error) {
+	switch s {
+	case "", "error":
+		return MissingTableError, nil
+	case "create":
+		return MissingTableCreate, nil
+	case "skip":
+		return MissingTableSkip, nil
+	}
+
+	return MissingTableError, errors.NotValidf("missing table action %q", s)
+}
+
+// prepareTable checks the destination table exists before the copy,
+// creating it if it's missing and MissingTableCreate is set, and clears it
+// when replacing its rows.
+func prepareTable(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config) (err error) {
+	var types []bulk.ColumnType
+	var q string
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	if types, err = bulk.TableColumns(ctx, dstConn, d, cfg.DstSchema, cfg.DstTable); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(types) > 0 {
+		if cfg.LoadMode == LoadReplace {
+			return errors.Trace(clearTable(ctx, dstConn, cfg))
+		}
+		return nil
+	}
+
+	switch cfg.MissingTable {
+	case MissingTableSkip:
+		return nil
+	case MissingTableCreate:
+		// The new table is empty so there's nothing to clear
+		ct, typed := cfg.Source.(ColumnTyper)
+		switch {
+		case srcConn != nil:
+			types, err = queryColumnTypes(ctx, srcConn, cfg.SrcSelectSql, cfg.SelectArgs()...)
+		case typed:
+			types, err = ct.ColumnTypes()
+		default:
+			return errors.NotSupportedf("creating %s without a source connection", d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		q = d.CreateTableSQL(cfg.DstSchema, cfg.DstTable, types)
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "creating %s", d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+		if cfg.CopyComments {
+			return errors.Trace(copyComments(ctx, srcConn, dstConn, cfg, types))
+		}
+		return nil
+	}
+
+	return errors.Trace(&TableNotFoundError{Table: d.QualifiedName(cfg.DstSchema, cfg.DstTable)})
+}
+
+// copyComments sets the comments on SrcTable and its columns on the
+// destination table and its columns of the same names.
+func copyComments(ctx context.Context, srcConn *sql.Conn, dstConn *sql.Conn, cfg *Config, types []bulk.ColumnType) (err error) {
+	var comments map[string]string
+
+	if cfg.SrcTable == "" {
+		return errors.NotValidf("CopyComments without SrcTable")
+	}
+
+	schema, table := splitTableName(cfg.SrcTable)
+	if comments, err = bulk.Comments(ctx, srcConn, bulk.DialectFor(cfg.SrcDbDriver), schema, table); err != nil {
+		return errors.Annotatef(err, "reading the comments of %s", cfg.SrcTable)
+	}
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+
+	var qs []string
+	if c, ok := comments[""]; ok {
+		qs = append(qs, d.CommentSQL(cfg.DstSchema, cfg.DstTable, nil, c))
+	}
+	for i := range types {
+		if c, ok := comments[types[i].Name]; ok {
+			qs = append(qs, d.CommentSQL(cfg.DstSchema, cfg.DstTable, &types[i], c))
+		}
+	}
+
+	for _, q := range qs {
+		if q == "" {
+			continue
+		}
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "commenting %s", d.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+	}
+
+	return nil
+}
+
+// unquoteConfig returns a copy of the config with any quotes around the
+// destination schema and table removed, so they can be looked up in the
+// catalog and quoted for the destination dialect.
+func unquoteConfig(cfg *Config) *Config {
+	schema, table := bulk.UnquoteIdent(cfg.DstSchema), bulk.UnquoteIdent(cfg.DstTable)
+	if schema == cfg.DstSchema && table == cfg.DstTable {
+		return cfg
+	}
+
+	c := *cfg
+	c.DstSchema, c.DstTable = schema, table
+	return &c
+}
@@ -0,0 +1,43 @@
+package godatapipe
+
+import (
+	"testing"
+
+	"github.com/joescharf/go-datapipe/bulk"
+)
+
+func TestUnquoteConfig(t *testing.T) {
+	tests := []struct {
+		schema    string
+		table     string
+		postgres  string
+		mysql     string
+		sqlserver string
+	}{
+		{`"s"`, `"t"`, `"s"."t"`, "`s`.`t`", "[s].[t]"},
+		{"[dbo]", "[Orders]", `"dbo"."Orders"`, "`dbo`.`Orders`", "[dbo].[Orders]"},
+		{"`db`", "`t`", `"db"."t"`, "`db`.`t`", "[db].[t]"},
+		{`"a""b"`, "[a]]b]", `"a""b"."a]b"`, "`a\"b`.`a]b`", `[a"b].[a]]b]`},
+		{"", "Orders", `"Orders"`, "`Orders`", "[Orders]"},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{DstSchema: tt.schema, DstTable: tt.table}
+		c := unquoteConfig(cfg)
+		if tt.schema == bulk.UnquoteIdent(tt.schema) && tt.table == bulk.UnquoteIdent(tt.table) && c != cfg {
+			t.Errorf("unquoteConfig(%q, %q) copied a config without quotes", tt.schema, tt.table)
+		}
+		if cfg.DstSchema != tt.schema || cfg.DstTable != tt.table {
+			t.Errorf("unquoteConfig(%q, %q) changed the original config", tt.schema, tt.table)
+		}
+
+		for _, d := range []struct {
+			d    *bulk.Dialect
+			want string
+		}{{bulk.Postgres, tt.postgres}, {bulk.MySQL, tt.mysql}, {bulk.SQLServer, tt.sqlserver}} {
+			if got := d.d.QualifiedName(c.DstSchema, c.DstTable); got != d.want {
+				t.Errorf("%s name of unquoted (%q, %q) = %s, want %s", d.d.Name, tt.schema, tt.table, got, d.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// TemplateData is available to templates in SrcSelectSql and DstTable,
+// e.g. SELECT * FROM events WHERE updated_at > '{{ .LastWatermark }}'
+// into events_{{ .RunDate }}.
+type TemplateData struct {
+	RunID         string
+	RunTime       time.Time         //Time the run started
+	RunDate       string            //Date the run started as 2006-01-02
+	Pipeline      string            //Name the pipeline's state is saved under
+	LastWatermark string            //Watermark saved by the last successful run, empty on the first
+	State         State             //State saved by the last successful run
+	Env           map[string]string //Environment variables
+}
+
+// hasTemplate reports whether s holds template actions.
+func hasTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// renderTemplate executes a template string with the data.
+func renderTemplate(name string, text string, data *TemplateData) (s string, err error) {
+	var t *template.Template
+	var buf bytes.Buffer
+
+	if !hasTemplate(text) {
+		return text, nil
+	}
+
+	if t, err = template.New(name).Option("missingkey=error").Parse(text); err != nil {
+		return "", errors.Annotatef(err, "parsing %s template", name)
+	}
+
+	if err = t.Execute(&buf, data); err != nil {
+		return "", errors.Annotatef(err, "executing %s template", name)
+	}
+
+	return buf.String(), nil
+}
+
+// newTemplateData returns the template data for the run.
+func newTemplateData(cfg *Config, res *Result, state State) (data *TemplateData) {
+	data = &TemplateData{
+		RunID:         res.RunID,
+		RunTime:       res.StartedAt,
+		RunDate:       res.StartedAt.Format("2006-01-02"),
+		Pipeline:      cfg.pipelineName(),
+		LastWatermark: state[watermarkKey],
+		State:         state,
+		Env:           map[string]string{}}
+
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			data.Env[k] = v
+		}
+	}
+
+	return data
+}
+
+// renderConfig returns a copy of the config with the templates in
+// SrcSelectSql, the shards' selects and DstTable executed, leaving cfg
+// as it is for the next run. The pipeline's state is read from the state
+// store if a template or the watermark needs it.
+func renderConfig(ctx context.Context, cfg *Config, store StateStore, res *Result) (rendered *Config, err error) {
+	var state State
+
+	shards := false
+	for _, sh := range cfg.SrcShards {
+		shards = shards || hasTemplate(sh.SelectSql)
+	}
+
+	if !hasTemplate(cfg.SrcSelectSql) && !hasTemplate(cfg.DstTable) && !shards {
+		return cfg, nil
+	}
+
+	if store != nil {
+		if state, err = store.Get(ctx, cfg.pipelineName()); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	data := newTemplateData(cfg, res, state)
+	c := *cfg
+
+	if c.SrcSelectSql, err = renderTemplate("SrcSelectSql", cfg.SrcSelectSql, data); err != nil {
+		return nil, errors.Trace(&ConfigError{Setting: "SRC_DB_SELECT_SQL", Value: cfg.SrcSelectSql, Err: err})
+	}
+	if c.DstTable, err = renderTemplate("DstTable", cfg.DstTable, data); err != nil {
+		return nil, errors.Trace(&ConfigError{Setting: "DST_DB_TABLE", Value: cfg.DstTable, Err: err})
+	}
+
+	if shards {
+		c.SrcShards = make([]Shard, len(cfg.SrcShards))
+		for i, sh := range cfg.SrcShards {
+			if sh.SelectSql, err = renderTemplate("SelectSql", sh.SelectSql, data); err != nil {
+				return nil, errors.Annotatef(err, "shard %s", sh.Name)
+			}
+			c.SrcShards[i] = sh
+		}
+	}
+
+	// Keep state under the unrendered table name so it's found next run
+	if c.PipelineName == "" {
+		c.PipelineName = cfg.pipelineName()
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,67 @@
+package godatapipe
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderConfig(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err := store.Set(ctx, "events_{{ .RunDate }}", State{watermarkKey: "2024-05-01", "batch": "7"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DATAPIPE_TEST_REGION", "eu")
+
+	cfg := &Config{
+		SrcSelectSql: "SELECT * FROM events WHERE updated_at > '{{ .LastWatermark }}' AND batch > {{ index .State \"batch\" }} AND region = '{{ .Env.DATAPIPE_TEST_REGION }}'",
+		DstTable:     "events_{{ .RunDate }}",
+		SrcShards:    []Shard{{Name: "a", SelectSql: "SELECT '{{ .RunID }}'"}, {Name: "b", SelectSql: "SELECT 1"}}}
+	res := &Result{RunID: "r1", StartedAt: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)}
+
+	c, err := renderConfig(ctx, cfg, store, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "SELECT * FROM events WHERE updated_at > '2024-05-01' AND batch > 7 AND region = 'eu'"; c.SrcSelectSql != want {
+		t.Errorf("SrcSelectSql = %s, want %s", c.SrcSelectSql, want)
+	}
+	if c.DstTable != "events_2024-05-06" || c.PipelineName != "events_{{ .RunDate }}" {
+		t.Errorf("DstTable = %s under pipeline %s", c.DstTable, c.PipelineName)
+	}
+	if c.SrcShards[0].SelectSql != "SELECT 'r1'" || c.SrcShards[1].SelectSql != "SELECT 1" {
+		t.Errorf("shards = %+v", c.SrcShards)
+	}
+	if cfg.DstTable != "events_{{ .RunDate }}" || cfg.SrcShards[0].SelectSql != "SELECT '{{ .RunID }}'" || cfg.PipelineName != "" {
+		t.Errorf("rendering changed the config: %+v", cfg)
+	}
+
+	plain := &Config{SrcSelectSql: "SELECT 1", DstTable: "t"}
+	if c, err = renderConfig(ctx, plain, nil, res); err != nil || c != plain {
+		t.Errorf("config without templates was copied: %v", err)
+	}
+}
+
+func TestRenderConfigErrors(t *testing.T) {
+	res := &Result{StartedAt: time.Now()}
+
+	tests := []struct {
+		cfg     *Config
+		setting string
+	}{
+		{&Config{SrcSelectSql: "SELECT {{ .Missing }}"}, "SRC_DB_SELECT_SQL"},
+		{&Config{SrcSelectSql: "SELECT {{ .RunID"}, "SRC_DB_SELECT_SQL"},
+		{&Config{DstTable: "t_{{ .Env.NO_SUCH_VARIABLE_SET }}"}, "DST_DB_TABLE"},
+	}
+
+	for _, tt := range tests {
+		var ce *ConfigError
+		if _, err := renderConfig(context.Background(), tt.cfg, nil, res); !errors.As(err, &ce) || ce.Setting != tt.setting {
+			t.Errorf("rendering %+v error = %v, want a %s error", tt.cfg, err, tt.setting)
+		}
+	}
+}
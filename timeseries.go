@@ -0,0 +1,65 @@
+package godatapipe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/joescharf/go-datapipe/bulk"
+	"github.com/juju/errors"
+)
+
+// hypertableSQL returns the statements making the destination table a
+// TimescaleDB hypertable partitioned on Config.TimeColumn, and indexing
+// Config.TagColumns with it, or none without a TimeColumn.
+func hypertableSQL(cfg *Config) (stmts []string, err error) {
+	if cfg.TimeColumn == "" {
+		return nil, nil
+	}
+
+	d := bulk.DialectFor(cfg.DstDbDriver)
+	if d != bulk.Postgres {
+		return nil, errors.NotSupportedf("TimeColumn on %s, hypertables need TimescaleDB", cfg.DstDbDriver)
+	}
+
+	name := d.QualifiedName(cfg.DstSchema, cfg.DstTable)
+	literal := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+
+	q := "SELECT create_hypertable(" + literal(name) + "::regclass, " + literal(cfg.TimeColumn)
+	if cfg.ChunkInterval > 0 {
+		q += fmt.Sprintf(", chunk_time_interval => INTERVAL '%d microseconds'", cfg.ChunkInterval.Microseconds())
+	}
+	stmts = append(stmts, q+", if_not_exists => TRUE, migrate_data => TRUE)")
+
+	// Queries filter on tags over a time range
+	if len(cfg.TagColumns) > 0 {
+		var columns []string
+		for _, c := range cfg.TagColumns {
+			columns = append(columns, d.QuoteIdent(c))
+		}
+		stmts = append(stmts, "CREATE INDEX IF NOT EXISTS "+d.QuoteIdent(cfg.DstTable+"_tags_time_idx")+
+			" ON "+name+" ("+strings.Join(columns, ", ")+", "+d.QuoteIdent(cfg.TimeColumn)+" DESC)")
+	}
+
+	return stmts, nil
+}
+
+// createHypertable makes the destination table a hypertable if it isn't
+// one already, moving any rows it has into chunks.
+func createHypertable(ctx context.Context, dstConn *sql.Conn, cfg *Config) (err error) {
+	var stmts []string
+
+	if stmts, err = hypertableSQL(cfg); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, q := range stmts {
+		if _, err = dstConn.ExecContext(ctx, q); err != nil {
+			return errors.Annotatef(err, "making %s a hypertable, is the timescaledb extension installed?",
+				bulk.Postgres.QualifiedName(cfg.DstSchema, cfg.DstTable))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package godatapipe
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// TimeMode determines how temporal values are transferred.
+type TimeMode int
+
+const (
+	TimeDriverDefault TimeMode = iota //Pass times through as returned by the source driver
+	TimeUTC                           //Convert times to UTC
+	TimeConvert                       //Read times in SrcTimeZone and convert them to DstTimeZone
+	TimeWallClock                     //Keep the wall clock reading literally, in DstTimeZone or UTC
+)
+
+// Parses a TIME_MODE value.
+func ParseTimeMode(s string) (m TimeMode, err error) {
+	switch s {
+	case "", "driver":
+		return TimeDriverDefault, nil
+	case "utc":
+		return TimeUTC, nil
+	case "convert":
+		return TimeConvert, nil
+	case "wallclock":
+		return TimeWallClock, nil
+	}
+
+	return 0, errors.Errorf("invalid time mode %q", s)
+}
+
+// newTimeStage returns a stage normalizing time.Time values, or nil if
+// times are passed through as is.
+func newTimeStage(cfg *Config) (s stage, err error) {
+	var srcLoc, dstLoc *time.Location
+
+	if cfg.TimeMode == TimeDriverDefault && cfg.TimeFormat == "" {
+		return nil, nil
+	}
+
+	if cfg.SrcTimeZone != "" {
+		if srcLoc, err = time.LoadLocation(cfg.SrcTimeZone); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if cfg.DstTimeZone != "" {
+		if dstLoc, err = time.LoadLocation(cfg.DstTimeZone); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	convert := func(t time.Time) time.Time {
+		switch cfg.TimeMode {
+		case TimeUTC:
+			return t.UTC()
+		case TimeConvert:
+			if srcLoc != nil {
+				t = inLocation(t, srcLoc)
+			}
+			if dstLoc != nil {
+				t = t.In(dstLoc)
+			}
+		case TimeWallClock:
+			if dstLoc == nil {
+				return inLocation(t, time.UTC)
+			}
+			return inLocation(t, dstLoc)
+		}
+		return t
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, v := range values {
+			t, ok := v.(time.Time)
+			if !ok {
+				continue
+			}
+
+			t = convert(t)
+			if cfg.TimeFormat != "" {
+				values[i] = t.Format(cfg.TimeFormat)
+			} else {
+				values[i] = t
+			}
+		}
+
+		return values, nil
+	}, nil
+}
+
+// inLocation returns the same wall clock reading in another location.
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
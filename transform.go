@@ -0,0 +1,439 @@
+package godatapipe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// ValueTransform rewrites a single column value in flight.
+type ValueTransform func(v interface{}) (interface{}, error)
+
+// RowTransform rewrites a row in flight. The values are in destination
+// column order and may be modified in place. Returning a nil row drops
+// it from the copy.
+type RowTransform func(columns []string, values []interface{}) (row []interface{}, err error)
+
+// BatchTransform rewrites a batch of rows in flight, so expensive work such
+// as regexes, hashing or lookups can be amortized or parallelized across
+// rows. The rows are in destination column order and may be modified in
+// place; the returned rows, which may drop or add rows, are written.
+type BatchTransform func(columns []string, batch [][]interface{}) (rows [][]interface{}, err error)
+
+var (
+	fakeFirstNames = []string{"Alex", "Sam", "Jordan", "Taylor", "Morgan", "Casey", "Riley", "Jamie", "Avery", "Quinn", "Robin", "Drew"}
+	fakeLastNames  = []string{"Smith", "Jones", "Taylor", "Brown", "Williams", "Wilson", "Johnson", "Davies", "Patel", "Wright", "Walker", "Young"}
+)
+
+// Replaces values with the hex SHA-256 hash of the salt and the value.
+// Equal values hash the same so joins on the column still work.
+func Hash(salt string) ValueTransform {
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+
+		sum := sha256.Sum256([]byte(salt + valueText(v)))
+		return hex.EncodeToString(sum[:]), nil
+	}
+}
+
+// Replaces values with a fixed string.
+func Redact(replacement string) ValueTransform {
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+
+		return replacement, nil
+	}
+}
+
+// Replaces every value with NULL.
+func Nullify() ValueTransform {
+	return func(v interface{}) (interface{}, error) {
+		return nil, nil
+	}
+}
+
+// Masks all but the first keepStart and last keepEnd characters of the
+// value with the mask character. Neither count can be negative.
+func PartialMask(keepStart int, keepEnd int, mask rune) (t ValueTransform, err error) {
+	if keepStart < 0 || keepEnd < 0 {
+		return nil, errors.NotValidf("mask keeping %d and %d characters", keepStart, keepEnd)
+	}
+
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+
+		runes := []rune(valueText(v))
+		for i := keepStart; i < len(runes)-keepEnd; i++ {
+			runes[i] = mask
+		}
+
+		return string(runes), nil
+	}, nil
+}
+
+// Replaces values with realistic looking fake ones of a kind: "email",
+// "name", "first_name", "last_name", "phone" or "token". The same input
+// always produces the same fake value.
+func Fake(kind string) (t ValueTransform, err error) {
+	var gen func(seed uint64) string
+
+	switch kind {
+	case "email":
+		gen = func(seed uint64) string {
+			return fmt.Sprintf("%s.%s%d@example.com",
+				strings.ToLower(pick(fakeFirstNames, seed)), strings.ToLower(pick(fakeLastNames, seed>>8)), seed%1000)
+		}
+	case "name":
+		gen = func(seed uint64) string {
+			return pick(fakeFirstNames, seed) + " " + pick(fakeLastNames, seed>>8)
+		}
+	case "first_name":
+		gen = func(seed uint64) string { return pick(fakeFirstNames, seed) }
+	case "last_name":
+		gen = func(seed uint64) string { return pick(fakeLastNames, seed) }
+	case "phone":
+		gen = func(seed uint64) string {
+			return fmt.Sprintf("555-%03d-%04d", seed%1000, (seed>>10)%10000)
+		}
+	case "token":
+		gen = func(seed uint64) string { return fmt.Sprintf("%016x", seed) }
+	default:
+		return nil, errors.Errorf("unknown fake value kind %q", kind)
+	}
+
+	return func(v interface{}) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+
+		sum := sha256.Sum256([]byte(valueText(v)))
+		return gen(binary.BigEndian.Uint64(sum[:8])), nil
+	}, nil
+}
+
+// Parses a value transform spec: "hash[:salt]", "redact[:replacement]",
+// "nullify", "mask:keepStart:keepEnd" or "fake:kind".
+func ParseValueTransform(spec string) (t ValueTransform, err error) {
+	parts := strings.Split(spec, ":")
+
+	switch parts[0] {
+	case "hash":
+		return Hash(strings.Join(parts[1:], ":")), nil
+	case "redact":
+		if len(parts) == 1 {
+			return Redact("REDACTED"), nil
+		}
+		return Redact(strings.Join(parts[1:], ":")), nil
+	case "nullify":
+		return Nullify(), nil
+	case "mask":
+		var keepStart, keepEnd int
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid mask transform %q, expected mask:keepStart:keepEnd", spec)
+		}
+		if keepStart, err = strconv.Atoi(parts[1]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if keepEnd, err = strconv.Atoi(parts[2]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return PartialMask(keepStart, keepEnd, '*')
+	case "fake":
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid fake transform %q, expected fake:kind", spec)
+		}
+		return Fake(parts[1])
+	}
+
+	return nil, errors.Errorf("unknown transform %q", spec)
+}
+
+// Parses column transforms in the form "column=spec,..." where spec is
+// accepted by ParseValueTransform.
+func ParseColumnTransforms(spec string) (transforms map[string]ValueTransform, err error) {
+	transforms = map[string]ValueTransform{}
+
+	for _, entry := range splitList(spec) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid column transform %q", entry)
+		}
+
+		if transforms[parts[0]], err = ParseValueTransform(parts[1]); err != nil {
+			return nil, errors.Annotatef(err, "column %s", parts[0])
+		}
+	}
+
+	return transforms, nil
+}
+
+// newColumnTransformStage returns a stage applying the column
+// transforms, or nil if there are none.
+func newColumnTransformStage(transforms map[string]ValueTransform, columns []string) (s stage, err error) {
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+
+	byPos := make([]ValueTransform, len(columns))
+	for name, t := range transforms {
+		pos := indexOf(columns, name)
+		if pos < 0 {
+			return nil, errors.Errorf("transform for unknown column %s", name)
+		}
+		byPos[pos] = t
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		for i, t := range byPos {
+			if t == nil {
+				continue
+			}
+
+			if values[i], err = t(values[i]); err != nil {
+				return nil, errors.Annotatef(err, "row %d: column %s", rowNum, columns[i])
+			}
+		}
+
+		return values, nil
+	}, nil
+}
+
+// newRowTransformStage adapts a RowTransform to a stage.
+func newRowTransformStage(t RowTransform, columns []string) (s stage) {
+	if t == nil {
+		return nil
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		if row, err = t(columns, values); err != nil {
+			return nil, errors.Annotatef(err, "row %d", rowNum)
+		}
+
+		return row, nil
+	}
+}
+
+// ParallelBatch returns a BatchTransform running a RowTransform over each
+// batch's rows with up to workers goroutines, keeping the rows' order.
+func ParallelBatch(t RowTransform, workers int) BatchTransform {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	return func(columns []string, batch [][]interface{}) (rows [][]interface{}, err error) {
+		var wg sync.WaitGroup
+		var once sync.Once
+
+		rows = make([][]interface{}, len(batch))
+		next := make(chan int)
+		for w := 0; w < workers && w < len(batch); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					row, rowErr := t(columns, batch[i])
+					if rowErr != nil {
+						once.Do(func() { err = errors.Annotatef(rowErr, "batch row %d", i+1) })
+					}
+					rows[i] = row
+				}
+			}()
+		}
+		for i := range batch {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+		if err != nil {
+			return nil, err
+		}
+
+		// Dropped rows are nil
+		kept := rows[:0]
+		for _, row := range rows {
+			if row != nil {
+				kept = append(kept, row)
+			}
+		}
+
+		return kept, nil
+	}
+}
+
+// batchTransformer buffers staged rows to run the batch transforms over
+// them, and any unpivot, then runs the stages which follow them and writes
+// the rows. With an aggregation or pivot the rows are rolled up instead,
+// and the rolled up rows written once the copy is done.
+type batchTransformer struct {
+	transforms []BatchTransform
+	columns    []string   //Columns of the rows the transforms are given
+	unpivot    *unpivoter //Turns the transformed rows' columns into rows, if unpivoting
+	rollup     rollup     //Rolls the transformed rows up, if aggregating or pivoting
+	after      []stage    //Stages run on the transformed or rolled up rows
+	releases   []func()   //Releases the transforms' resources
+
+	rows [][]interface{}
+	nums []int //Source row numbers of the buffered rows
+}
+
+// newBatchTransformer returns a batchTransformer running the configured
+// lookups, TransformBatch, unpivot and aggregation or pivot, or nil
+// without any, and the columns of the rows it writes.
+func newBatchTransformer(ctx context.Context, cfg *Config, columns []string) (b *batchTransformer, outColumns []string, err error) {
+	aggregate := len(cfg.GroupBy) > 0 || len(cfg.Aggregates) > 0
+	if len(cfg.Lookups) == 0 && cfg.TransformBatch == nil && cfg.Unpivot == nil && cfg.Pivot == nil && !aggregate {
+		return nil, columns, nil
+	}
+
+	b = &batchTransformer{columns: columns}
+	outColumns = columns
+	if cfg.Unpivot != nil {
+		if b.unpivot, outColumns, err = newUnpivoter(cfg.Unpivot, outColumns); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	switch {
+	case aggregate && cfg.Pivot != nil:
+		return nil, nil, errors.NotSupportedf("aggregating and pivoting")
+	case aggregate:
+		if b.rollup, outColumns, err = newAggregator(cfg.GroupBy, cfg.Aggregates, outColumns); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	case cfg.Pivot != nil:
+		if b.rollup, outColumns, err = newPivoter(cfg.Pivot, outColumns); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	for _, l := range cfg.Lookups {
+		t, release, err := newLookupTransform(ctx, l, columns)
+		if err != nil {
+			b.release()
+			return nil, nil, errors.Trace(err)
+		}
+		b.transforms = append(b.transforms, t)
+		b.releases = append(b.releases, release)
+	}
+	if cfg.TransformBatch != nil {
+		b.transforms = append(b.transforms, cfg.TransformBatch)
+	}
+
+	return b, outColumns, nil
+}
+
+// release releases the transforms' resources, such as lookups'
+// connections.
+func (b *batchTransformer) release() {
+	for _, release := range b.releases {
+		release()
+	}
+}
+
+// add buffers a copy of a row, as sources reuse their rows' slices.
+func (b *batchTransformer) add(rowNum int, values []interface{}) {
+	b.rows = append(b.rows, append([]interface{}(nil), values...))
+	b.nums = append(b.nums, rowNum)
+}
+
+// write transforms the buffered rows and appends them to the insert, or
+// adds them to the rollup.
+func (b *batchTransformer) write(ctx context.Context, ir Insert) (err error) {
+	var rows [][]interface{}
+
+	if len(b.rows) == 0 {
+		return nil
+	}
+	first, last := b.nums[0], b.nums[len(b.nums)-1]
+	rows = b.rows
+	for _, t := range b.transforms {
+		if rows, err = t(b.columns, rows); err != nil {
+			return errors.Annotatef(err, "rows %d to %d", first, last)
+		}
+	}
+
+	if b.unpivot != nil {
+		rows = b.unpivot.apply(rows)
+	}
+
+	if b.rollup != nil {
+		for _, row := range rows {
+			if err = b.rollup.add(row); err != nil {
+				return errors.Annotatef(err, "rows %d to %d", first, last)
+			}
+		}
+	} else if err = b.append(ctx, ir, rows, b.nums); err != nil {
+		return errors.Trace(err)
+	}
+	b.rows, b.nums = b.rows[:0], b.nums[:0]
+
+	return nil
+}
+
+// flush writes the buffered rows, then any rolled up rows.
+func (b *batchTransformer) flush(ctx context.Context, ir Insert) (err error) {
+	if err = b.write(ctx, ir); err != nil || b.rollup == nil {
+		return errors.Trace(err)
+	}
+
+	// Rolled up rows are numbered by group
+	rows := b.rollup.rows()
+	nums := make([]int, len(rows))
+	for i := range nums {
+		nums[i] = i + 1
+	}
+
+	return errors.Trace(b.append(ctx, ir, rows, nums))
+}
+
+// append runs the stages after the batch transforms on the rows, and
+// appends them to the insert.
+func (b *batchTransformer) append(ctx context.Context, ir Insert, rows [][]interface{}, nums []int) (err error) {
+	for i, row := range rows {
+		// Rows can only be matched to the source's while there are as
+		// many of them
+		rowNum := nums[len(nums)-1]
+		if len(rows) == len(nums) {
+			rowNum = nums[i]
+		}
+		if row, err = applyStages(b.after, rowNum, row); err != nil {
+			return errors.Trace(err)
+		} else if row == nil {
+			continue
+		}
+		if err = ir.AppendValues(ctx, row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// valueText returns the text form of a value.
+func valueText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// pick chooses an item from the list using the seed.
+func pick(list []string, seed uint64) string {
+	return list[seed%uint64(len(list))]
+}
@@ -0,0 +1,226 @@
+package godatapipe
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseValueTransform(t *testing.T) {
+	tests := []struct {
+		spec string
+		in   interface{}
+		want interface{}
+	}{
+		{"hash", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"hash:s:1", "abc", "39e6b6f8d0b462fa35c1e24930a2604cb70f282cc65171000b42b698183ace8a"},
+		{"hash", nil, nil},
+		{"redact", "abc", "REDACTED"},
+		{"redact:x:y", int64(1), "x:y"},
+		{"redact", nil, nil},
+		{"nullify", "abc", nil},
+		{"mask:2:2", "4111111111111111", "41************11"},
+		{"mask:0:4", []byte("secret1234"), "******1234"},
+		{"mask:3:3", "abcd", "abcd"},
+		{"mask:0:0", "héllo", "*****"},
+		{"mask:1:1", nil, nil},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseValueTransform(tt.spec)
+		if err != nil {
+			t.Errorf("ParseValueTransform(%q): %s", tt.spec, err)
+			continue
+		}
+		if got, err := f(tt.in); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s(%v) = %#v, %v, want %#v", tt.spec, tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "upper", "mask", "mask:1", "mask:a:1", "mask:1:-1", "mask:-1:1", "fake", "fake:ssn", "fake:email:x"} {
+		if _, err := ParseValueTransform(spec); err == nil {
+			t.Errorf("ParseValueTransform(%q) didn't fail", spec)
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	tests := []struct {
+		kind    string
+		pattern string
+	}{
+		{"email", `^[a-z]+\.[a-z]+\d{1,3}@example\.com$`},
+		{"name", `^[A-Z][a-z]+ [A-Z][a-z]+$`},
+		{"first_name", `^[A-Z][a-z]+$`},
+		{"last_name", `^[A-Z][a-z]+$`},
+		{"phone", `^555-\d{3}-\d{4}$`},
+		{"token", `^[0-9a-f]{16}$`},
+	}
+
+	for _, tt := range tests {
+		f, err := Fake(tt.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, _ := f("alice@example.org")
+		again, _ := f("alice@example.org")
+		b, _ := f("bob@example.org")
+		if !regexp.MustCompile(tt.pattern).MatchString(a.(string)) {
+			t.Errorf("fake %s = %q", tt.kind, a)
+		}
+		if a != again {
+			t.Errorf("fake %s of the same value = %q and %q", tt.kind, a, again)
+		}
+		if tt.kind != "first_name" && tt.kind != "last_name" && a == b {
+			t.Errorf("fake %s of different values = %q", tt.kind, a)
+		}
+		if v, _ := f(nil); v != nil {
+			t.Errorf("fake %s of NULL = %v", tt.kind, v)
+		}
+	}
+}
+
+func TestParseColumnTransforms(t *testing.T) {
+	transforms, err := ParseColumnTransforms("email=fake:email, card=mask:0:4,ssn=redact:x=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transforms) != 3 {
+		t.Fatalf("parsed %d transforms", len(transforms))
+	}
+	if v, _ := transforms["ssn"]("123"); v != "x=y" {
+		t.Errorf("ssn redacted to %v", v)
+	}
+
+	for _, spec := range []string{"email", "email=upper", "card=mask:4"} {
+		if _, err := ParseColumnTransforms(spec); err == nil {
+			t.Errorf("ParseColumnTransforms(%q) didn't fail", spec)
+		}
+	}
+}
+
+func TestTransformStages(t *testing.T) {
+	columns := []string{"id", "email", "card"}
+	mask, _ := PartialMask(0, 4, '#')
+	fail := errors.New("bad value")
+
+	cfg := &Config{
+		ColumnTransforms: map[string]ValueTransform{
+			"card":  mask,
+			"email": Redact("x"),
+		},
+		Transform: func(columns []string, values []interface{}) (row []interface{}, err error) {
+			switch values[0] {
+			case int64(2):
+				return nil, nil
+			case int64(4):
+				return nil, fail
+			}
+			if s, ok := values[1].(string); ok {
+				values[1] = strings.ToUpper(s)
+			}
+			return values, nil
+		}}
+	rows := [][]interface{}{
+		{int64(1), "a@b.c", "4111111111111111"},
+		{int64(2), "d@e.f", "5500000000000004"},
+		{int64(3), nil, nil},
+	}
+
+	_, written, err := copyRows(t, cfg, columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{{int64(1), "X", "############1111"}, {int64(3), nil, nil}}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written %#v, want %#v", written, want)
+	}
+
+	cfg.Source, cfg.DstWriter = nil, nil
+	_, _, err = copyRows(t, cfg, columns, append(rows, []interface{}{int64(4), "g@h.i", "1"}))
+	if !errors.Is(err, fail) || !strings.Contains(err.Error(), "row 4") {
+		t.Errorf("row transform error = %v", err)
+	}
+
+	if _, err = newColumnTransformStage(map[string]ValueTransform{"missing": Nullify()}, columns); err == nil {
+		t.Error("transform of an unknown column didn't fail")
+	}
+}
+
+func TestParallelBatch(t *testing.T) {
+	double := func(columns []string, values []interface{}) (row []interface{}, err error) {
+		n := values[0].(int64)
+		switch {
+		case n%3 == 0:
+			return nil, nil
+		case n == 50:
+			return nil, errors.New("bad row")
+		}
+		return []interface{}{n * 2}, nil
+	}
+
+	for _, workers := range []int{0, 1, 4, 100} {
+		rows, err := ParallelBatch(double, workers)([]string{"n"}, intRows(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int64
+		for _, row := range rows {
+			got = append(got, row[0].(int64))
+		}
+		want := []int64{2, 4, 8, 10, 14, 16, 20, 22, 26, 28, 32, 34, 38, 40}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers = %v, want %v", workers, got, want)
+		}
+	}
+
+	if _, err := ParallelBatch(double, 4)([]string{"n"}, intRows(60)); err == nil || !strings.Contains(err.Error(), "batch row 50") {
+		t.Errorf("failed row error = %v", err)
+	}
+	if rows, err := ParallelBatch(double, 4)([]string{"n"}, nil); err != nil || len(rows) != 0 {
+		t.Errorf("empty batch = %v, %v", rows, err)
+	}
+}
+
+func TestTransformBatch(t *testing.T) {
+	var sizes []int
+	cfg := &Config{
+		MaxRowBufSz: 4,
+		TransformBatch: func(columns []string, batch [][]interface{}) (rows [][]interface{}, err error) {
+			sizes = append(sizes, len(batch))
+			for _, row := range batch {
+				if row[0].(int64)%2 == 0 {
+					rows = append(rows, row, []interface{}{-row[0].(int64)})
+				}
+			}
+			return rows, nil
+		}}
+
+	res, written, err := copyRows(t, cfg, []string{"id"}, intRows(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int64
+	for _, row := range written {
+		got = append(got, row[0].(int64))
+	}
+	if want := []int64{2, -2, 4, -4, 6, -6, 8, -8, 10, -10}; !reflect.DeepEqual(got, want) || res.RowCount != 10 {
+		t.Errorf("written %v, %d rows, want %v", got, res.RowCount, want)
+	}
+	if want := []int{4, 4, 2}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", sizes, want)
+	}
+
+	cfg.Source, cfg.DstWriter = nil, nil
+	cfg.TransformBatch = func(columns []string, batch [][]interface{}) (rows [][]interface{}, err error) {
+		return nil, errors.New("bad batch")
+	}
+	if _, _, err = copyRows(t, cfg, []string{"id"}, intRows(6)); err == nil || !strings.Contains(err.Error(), "rows 1 to 4") {
+		t.Errorf("failed batch error = %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package godatapipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// watermarkKey is the state key the watermark is saved under.
+const watermarkKey = "watermark"
+
+// newWatermarkStage returns a stage recording the highest value of the
+// watermark column in the result.
+func newWatermarkStage(cfg *Config, columns []string, res *Result) (s stage, err error) {
+	var max interface{}
+
+	if cfg.WatermarkColumn == "" {
+		return nil, nil
+	}
+
+	pos := indexOf(columns, cfg.WatermarkColumn)
+	if pos < 0 {
+		return nil, errors.Trace(sourceColumnError(cfg.WatermarkColumn, "watermark"))
+	}
+
+	return func(rowNum int, values []interface{}) (row []interface{}, err error) {
+		if v := values[pos]; v != nil && (max == nil || valueAfter(v, max)) {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			max = v
+			res.Watermark = watermarkString(v)
+		}
+
+		return values, nil
+	}, nil
+}
+
+// watermarkString formats a watermark value for use in a query.
+func watermarkString(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// valueAfter reports whether v sorts after max.
+func valueAfter(v interface{}, max interface{}) bool {
+	cmp, _ := compareValues(v, max)
+	return cmp > 0
+}
+
+// saveWatermark saves the run's watermark in the pipeline's state, keeping
+// the rest of the state.
+func saveWatermark(ctx context.Context, cfg *Config, store StateStore, res *Result) (err error) {
+	var state State
+
+	if store == nil || res.Watermark == "" {
+		return nil
+	}
+
+	if state, err = store.Get(ctx, cfg.pipelineName()); err != nil {
+		return errors.Trace(err)
+	}
+	if state == nil {
+		state = State{}
+	}
+
+	state[watermarkKey] = res.Watermark
+
+	return errors.Trace(store.Set(ctx, cfg.pipelineName(), state))
+}
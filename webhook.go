@@ -0,0 +1,210 @@
+package godatapipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// WebhookOptions are where and how a WebhookWriter posts rows.
+type WebhookOptions struct {
+	URL     string      //URL the batches are posted to
+	Auth    string      //Secret reference to the Authorization header's value, e.g. Bearer followed by a token
+	Headers http.Header //Other headers sent, whose values can be secret references
+}
+
+// Parses a comma separated list of Name=value headers.
+func ParseWebhookHeaders(s string) (h http.Header, err error) {
+	for _, item := range splitList(s) {
+		name, value, ok := strings.Cut(item, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, errors.NotValidf("header %q, expected Name=value", item)
+		}
+		if h == nil {
+			h = http.Header{}
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+
+	return h, nil
+}
+
+// WebhookWriter posts rows in batches, each a JSON array of objects keyed
+// by column, so services without database access can be sent rows.
+// Values keep their types, with times as RFC 3339 strings and binary
+// values as text. Each post has an Idempotency-Key header, which is the
+// same when it's retried, so a service can ignore a batch it already has.
+// Rows which were posted can't be rolled back.
+type WebhookWriter struct {
+	url       string
+	header    http.Header
+	batchRows int
+	columns   [][]byte //JSON encoded column names
+	buf       bytes.Buffer
+	rows      int //Rows in buf
+	posted    int
+}
+
+// Creates a webhook writer posting batchRows rows at a time, resolving
+// the secrets in the options.
+func NewWebhookWriter(ctx context.Context, opts WebhookOptions, batchRows int) (w *WebhookWriter, err error) {
+	if !strings.HasPrefix(opts.URL, "http://") && !strings.HasPrefix(opts.URL, "https://") {
+		return nil, errors.NotValidf("webhook URL %q", opts.URL)
+	}
+	if batchRows <= 0 {
+		batchRows = 500
+	}
+
+	w = &WebhookWriter{url: opts.URL, header: http.Header{}, batchRows: batchRows}
+	for name, values := range opts.Headers {
+		for _, v := range values {
+			if v, err = ResolveSecret(ctx, v); err != nil {
+				return nil, errors.Trace(err)
+			}
+			w.header.Add(name, v)
+		}
+	}
+	if opts.Auth != "" {
+		var auth string
+		if auth, err = ResolveSecret(ctx, opts.Auth); err != nil {
+			return nil, errors.Trace(err)
+		}
+		w.header.Set("Authorization", auth)
+	}
+	w.header.Set("Content-Type", "application/json")
+
+	return w, nil
+}
+
+// Sets the column names, called by the pipeline before the first row.
+func (w *WebhookWriter) SetColumns(columns []string) {
+	w.columns = make([][]byte, len(columns))
+	for i, c := range columns {
+		w.columns[i], _ = json.Marshal(c)
+	}
+}
+
+func (w *WebhookWriter) AppendValues(ctx context.Context, values []interface{}) (err error) {
+	if w.rows == 0 {
+		w.buf.Reset()
+		w.buf.WriteByte('[')
+	} else {
+		w.buf.WriteByte(',')
+	}
+
+	w.buf.WriteByte('{')
+	for i, v := range values {
+		var b []byte
+		if b, err = json.Marshal(fileJSONValue(v)); err != nil {
+			return errors.Annotatef(err, "column %s", w.columns[i])
+		}
+		if i > 0 {
+			w.buf.WriteByte(',')
+		}
+		w.buf.Write(w.columns[i])
+		w.buf.WriteByte(':')
+		w.buf.Write(b)
+	}
+	w.buf.WriteByte('}')
+
+	if w.rows++; w.rows >= w.batchRows {
+		return errors.Trace(w.send(ctx))
+	}
+
+	return nil
+}
+
+// send posts the buffered rows.
+func (w *WebhookWriter) send(ctx context.Context) (err error) {
+	if w.rows == 0 {
+		return nil
+	}
+	w.buf.WriteByte(']')
+
+	key := make([]byte, 16)
+	if _, err = rand.Read(key); err != nil {
+		return errors.Trace(err)
+	}
+	header := w.header.Clone()
+	header.Set("Idempotency-Key", hex.EncodeToString(key))
+	if err = postRetrying(ctx, w.url, header, w.buf.Bytes()); err != nil {
+		return errors.Annotatef(err, "posting %d rows", w.rows)
+	}
+	w.posted += w.rows
+	w.rows = 0
+
+	return nil
+}
+
+func (w *WebhookWriter) Flush(ctx context.Context) (totalRowCount int, err error) {
+	if err = w.send(ctx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return w.posted, nil
+}
+
+// Discards the rows which haven't been posted yet.
+func (w *WebhookWriter) Rollback() (committedRowCount int, err error) {
+	w.rows = 0
+	return w.posted, nil
+}
+
+// postRetrying posts the body, retrying posts which failed to connect,
+// were rate limited or failed on the server, after their Retry-After or
+// with backoff.
+func postRetrying(ctx context.Context, url string, header http.Header, body []byte) (err error) {
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		var resp *http.Response
+		var retryAfter int
+
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body)); err != nil {
+			return errors.Trace(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+			resp.Body.Close()
+
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return err
+			}
+			retryAfter, _ = strconv.Atoi(resp.Header.Get("Retry-After"))
+		}
+		if attempt >= restRetries || ctx.Err() != nil {
+			return errors.Trace(err)
+		}
+
+		if retryAfter > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
+			case <-time.After(time.Duration(retryAfter) * time.Second):
+			}
+		} else if err = sleepBackoff(ctx, attempt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+func (w *WebhookWriter) Close() (err error) {
+	_, err = w.Flush(context.Background())
+	return errors.Trace(err)
+}
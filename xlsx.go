@@ -0,0 +1,218 @@
+package godatapipe
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Excel's limits on a worksheet's rows and a sheet name's length.
+const (
+	xlsxMaxRows      = 1048576
+	xlsxMaxSheetName = 31
+)
+
+// Cell styles, indexes into the cellXfs of xlsxStyles.
+const (
+	xlsxStyleDateTime = 1
+	xlsxStyleDate     = 2
+	xlsxStyleHeader   = 3
+)
+
+// Excel's day 0, as its serial dates count days from it.
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd"/></numFmts><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="4"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs></styleSheet>`
+
+// xlsxWriter streams rows into a single sheet Excel workbook. Strings are
+// written inline rather than shared, so rows aren't held in memory.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	rows  int
+	buf   []byte //A row's XML
+}
+
+// newXLSXWriter writes the workbook's parts up to the start of the sheet's
+// rows to w.
+func newXLSXWriter(w io.Writer, sheet string) (x *xlsxWriter, err error) {
+	var name strings.Builder
+
+	x = &xlsxWriter{zip: zip.NewWriter(w)}
+
+	xml.EscapeText(&name, []byte(xlsxSheetName(sheet)))
+	workbook := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="` + name.String() + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+	for _, part := range []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", workbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles}} {
+		var f io.Writer
+		if f, err = x.zip.Create(part.name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if _, err = io.WriteString(f, part.content); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if x.sheet, err = x.zip.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// The header row stays in view as the rows are scrolled
+	_, err = io.WriteString(x.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews><sheetData>`)
+
+	return x, errors.Trace(err)
+}
+
+// xlsxSheetName returns the name with the characters Excel doesn't allow
+// in sheet names replaced, cut to its maximum length.
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > xlsxMaxSheetName {
+		name = string(r[:xlsxMaxSheetName])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+
+	return name
+}
+
+// xlsxColumn returns the letters naming the column at index i, e.g. AA
+// for 26.
+func xlsxColumn(i int) string {
+	var b []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		b = append([]byte{byte('A' + (i-1)%26)}, b...)
+	}
+
+	return string(b)
+}
+
+// header writes the bold header row naming the columns.
+func (x *xlsxWriter) header(columns []string) (err error) {
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		values[i] = c
+	}
+
+	return errors.Trace(x.row(values, xlsxStyleHeader))
+}
+
+// row writes a row of values, leaving out NULLs. Numbers and booleans are
+// written as such, times as dates formatted by the style and everything
+// else as text.
+func (x *xlsxWriter) row(values []interface{}, style int) (err error) {
+	if x.rows >= xlsxMaxRows {
+		return errors.NotSupportedf("more than %d rows in an xlsx sheet", xlsxMaxRows)
+	}
+	x.rows++
+	n := strconv.Itoa(x.rows)
+
+	b := append(x.buf[:0], `<row r="`+n+`">`...)
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+
+		ref := xlsxColumn(i) + n
+		switch t := v.(type) {
+		case int64, int32, int16, int8, int, uint64, uint32, uint16, uint8:
+			b = append(b, `<c r="`+ref+`"><v>`+valueText(t)+`</v></c>`...)
+			continue
+		case float64, float32:
+			if f, _ := recordFloat(t); !math.IsNaN(f) && !math.IsInf(f, 0) {
+				b = append(b, `<c r="`+ref+`"><v>`+strconv.FormatFloat(f, 'g', -1, 64)+`</v></c>`...)
+				continue
+			}
+		case bool:
+			b = append(b, `<c r="`+ref+`" t="b"><v>`...)
+			if t {
+				b = append(b, '1')
+			} else {
+				b = append(b, '0')
+			}
+			b = append(b, `</v></c>`...)
+			continue
+		case time.Time:
+			if serial, ok := xlsxSerial(t); ok {
+				s := xlsxStyleDateTime
+				if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+					s = xlsxStyleDate
+				}
+				b = append(b, `<c r="`+ref+`" s="`+strconv.Itoa(s)+`"><v>`+strconv.FormatFloat(serial, 'f', -1, 64)+`</v></c>`...)
+				continue
+			}
+		}
+
+		var text strings.Builder
+		xml.EscapeText(&text, []byte(fileText(v)))
+		b = append(b, `<c r="`+ref+`" t="inlineStr"`...)
+		if style != 0 {
+			b = append(b, ` s="`+strconv.Itoa(style)+`"`...)
+		}
+		b = append(b, `><is><t xml:space="preserve">`+text.String()+`</t></is></c>`...)
+	}
+	b = append(b, "</row>"...)
+
+	x.buf = b
+	_, err = x.sheet.Write(b)
+
+	return errors.Trace(err)
+}
+
+// xlsxSerial returns the time's wall clock as an Excel serial date, or
+// false if it's before March 1900, where Excel's serials are off by its
+// phantom leap day, or after the years it can show.
+func xlsxSerial(t time.Time) (serial float64, ok bool) {
+	y, m, d := t.Date()
+	if y < 1900 || y == 1900 && m < time.March || y > 9999 {
+		return 0, false
+	}
+
+	days := (time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() - xlsxEpoch.Unix()) / 86400
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+
+	return float64(days) + clock.Seconds()/86400, true
+}
+
+// flush writes out what's buffered, short of finishing the workbook.
+func (x *xlsxWriter) flush() (err error) {
+	return errors.Trace(x.zip.Flush())
+}
+
+// close ends the sheet and writes the zip's directory.
+func (x *xlsxWriter) close() (err error) {
+	if _, err = io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(x.zip.Close())
+}